@@ -0,0 +1,168 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// defaultAccountInventoryRefreshInterval is the default interval between two
+	// storage account relists when no interval is configured
+	defaultAccountInventoryRefreshInterval = 5 * time.Minute
+	// accountCapacityGiB is the capacity limit of one standard storage account with
+	// large file shares enabled (100TiB)
+	// See https://docs.microsoft.com/en-us/azure/storage/files/storage-files-scale-targets
+	accountCapacityGiB = 100 * 1024
+)
+
+// accountInventory caches the per-account share usage so that GetCapacity and
+// account selection do not need to relist storage accounts on every call
+type accountInventory struct {
+	sync.RWMutex
+	// shares per account: account name -> share name -> quota in GiB
+	entries         map[string]map[string]int64
+	lastRefresh     time.Time
+	refreshInterval time.Duration
+}
+
+func newAccountInventory(refreshInterval time.Duration) *accountInventory {
+	if refreshInterval <= 0 {
+		refreshInterval = defaultAccountInventoryRefreshInterval
+	}
+	return &accountInventory{
+		entries:         make(map[string]map[string]int64),
+		refreshInterval: refreshInterval,
+	}
+}
+
+// expired returns true if the inventory was never refreshed or the last refresh
+// is older than the configured refresh interval
+func (inv *accountInventory) expired() bool {
+	inv.RLock()
+	defer inv.RUnlock()
+	return time.Since(inv.lastRefresh) > inv.refreshInterval
+}
+
+// recordShare records a newly provisioned file share in the inventory
+func (inv *accountInventory) recordShare(accountName, shareName string, sizeGiB int64) {
+	if accountName == "" || shareName == "" {
+		return
+	}
+	inv.Lock()
+	defer inv.Unlock()
+	if _, exists := inv.entries[accountName]; !exists {
+		inv.entries[accountName] = make(map[string]int64)
+	}
+	inv.entries[accountName][shareName] = sizeGiB
+}
+
+// releaseShare removes a deleted file share from the inventory
+func (inv *accountInventory) releaseShare(accountName, shareName string) {
+	inv.Lock()
+	defer inv.Unlock()
+	if shares, exists := inv.entries[accountName]; exists {
+		delete(shares, shareName)
+	}
+}
+
+// availableGiB returns the aggregated unused capacity of all accounts in the
+// inventory, assuming a new share could always be provisioned in a new account
+func (inv *accountInventory) availableGiB() int64 {
+	inv.RLock()
+	defer inv.RUnlock()
+	if len(inv.entries) == 0 {
+		// no account yet, a new account could be created on demand
+		return accountCapacityGiB
+	}
+	var available int64
+	for _, shares := range inv.entries {
+		used := int64(0)
+		for _, sizeGiB := range shares {
+			used += sizeGiB
+		}
+		if used < accountCapacityGiB {
+			available += accountCapacityGiB - used
+		}
+	}
+	return available
+}
+
+// accountShareCounts returns the number of tracked shares per account,
+// only used for debugging
+func (inv *accountInventory) accountShareCounts() map[string]int {
+	inv.RLock()
+	defer inv.RUnlock()
+	counts := make(map[string]int, len(inv.entries))
+	for account, shares := range inv.entries {
+		counts[account] = len(shares)
+	}
+	return counts
+}
+
+// listVolumeIDs returns the volume IDs of the tracked shares sorted by
+// account and share name, only shares whose name starts with prefix are
+// included when a prefix is configured
+func (inv *accountInventory) listVolumeIDs(resourceGroup, prefix string) []string {
+	inv.RLock()
+	defer inv.RUnlock()
+	ids := []string{}
+	for account, shares := range inv.entries {
+		for share := range shares {
+			if prefix != "" && !strings.HasPrefix(share, prefix) {
+				continue
+			}
+			ids = append(ids, fmt.Sprintf(volumeIDTemplate, resourceGroup, account, share, ""))
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// refreshAccountInventory relists the storage accounts under the resource group
+// and reseeds the inventory, keeping the share usage recorded since last refresh
+func (d *Driver) refreshAccountInventory(ctx context.Context, resourceGroup string) error {
+	accounts, rerr := d.cloud.StorageAccountClient.ListByResourceGroup(ctx, resourceGroup)
+	if rerr != nil {
+		return rerr.Error()
+	}
+
+	d.accountInventory.Lock()
+	defer d.accountInventory.Unlock()
+	entries := make(map[string]map[string]int64)
+	for _, account := range accounts {
+		if account.Name == nil {
+			continue
+		}
+		if shares, exists := d.accountInventory.entries[*account.Name]; exists {
+			entries[*account.Name] = shares
+		} else {
+			entries[*account.Name] = make(map[string]int64)
+		}
+	}
+	d.accountInventory.entries = entries
+	d.accountInventory.lastRefresh = time.Now()
+	klog.V(4).Infof("account inventory refreshed with %d account(s) under resource group(%s)", len(entries), resourceGroup)
+	return nil
+}
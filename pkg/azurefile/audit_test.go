@@ -0,0 +1,115 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/fileclient/mockfileclient"
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+func TestAuditLoggerRecord(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newAuditLogger(&buf)
+
+	requester := map[string]string{
+		"csi.storage.k8s.io/pvc/name":      "pvc-1",
+		"csi.storage.k8s.io/pvc/namespace": "default",
+	}
+	logger.record(auditOpCreateVolume, "", "accountname", "sharename", requester, nil)
+	logger.record(auditOpDeleteVolume, "rg#accountname#sharename", "accountname", "sharename", nil, fmt.Errorf("share is locked"))
+
+	var createRec, deleteRec auditRecord
+	decoder := json.NewDecoder(&buf)
+	assert.NoError(t, decoder.Decode(&createRec))
+	assert.NoError(t, decoder.Decode(&deleteRec))
+
+	assert.Equal(t, auditOpCreateVolume, createRec.Operation)
+	assert.Equal(t, "accountname", createRec.Account)
+	assert.Equal(t, "sharename", createRec.Share)
+	assert.Equal(t, requester, createRec.Requester)
+	assert.Equal(t, "success", createRec.Outcome)
+	assert.NotEmpty(t, createRec.Time)
+
+	assert.Equal(t, auditOpDeleteVolume, deleteRec.Operation)
+	assert.Equal(t, "rg#accountname#sharename", deleteRec.VolumeID)
+	assert.Equal(t, "failure", deleteRec.Outcome)
+	assert.Equal(t, "share is locked", deleteRec.Error)
+
+	// a nil logger is a no-op
+	var disabled *auditLogger
+	disabled.record(auditOpCreateVolume, "", "accountname", "sharename", nil, nil)
+}
+
+func TestDeleteVolumeAudit(t *testing.T) {
+	d := NewFakeDriver()
+	d.cloud = &azure.Cloud{}
+	var buf bytes.Buffer
+	d.auditLog = newAuditLogger(&buf)
+
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockFileClient := mockfileclient.NewMockInterface(ctrl)
+	d.cloud.FileClient = mockFileClient
+	mockFileClient.EXPECT().DeleteFileShare("rg", "accountname", "sharename").Return(nil).Times(1)
+
+	d.AddControllerServiceCapabilities(
+		[]csi.ControllerServiceCapability_RPC_Type{
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		})
+
+	req := &csi.DeleteVolumeRequest{VolumeId: "rg#accountname#sharename"}
+	_, err := d.DeleteVolume(context.Background(), req)
+	assert.NoError(t, err)
+
+	var rec auditRecord
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &rec))
+	assert.Equal(t, auditOpDeleteVolume, rec.Operation)
+	assert.Equal(t, "rg#accountname#sharename", rec.VolumeID)
+	assert.Equal(t, "accountname", rec.Account)
+	assert.Equal(t, "sharename", rec.Share)
+	assert.Equal(t, "success", rec.Outcome)
+}
+
+func TestRequesterMetadata(t *testing.T) {
+	parameters := map[string]string{
+		"csi.storage.k8s.io/pvc/name":      "pvc-1",
+		"csi.storage.k8s.io/pvc/namespace": "default",
+		skuNameField:                       "premium",
+		storeAccountKeyField:               storeAccountKeyFalse,
+	}
+	expected := map[string]string{
+		"csi.storage.k8s.io/pvc/name":      "pvc-1",
+		"csi.storage.k8s.io/pvc/namespace": "default",
+	}
+	result := requesterMetadata(parameters)
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("requesterMetadata result: %v, expected: %v", result, expected)
+	}
+
+	assert.Nil(t, requesterMetadata(map[string]string{skuNameField: "premium"}))
+}
@@ -24,6 +24,12 @@ import (
 	"k8s.io/utils/mount"
 )
 
+// lazyUnmount - lazy unmounting is only implemented on Linux, overridable in
+// unit tests
+var lazyUnmount = func(target string) error {
+	return nil
+}
+
 func SMBMount(m *mount.SafeFormatAndMount, source, target, fsType string, options, sensitiveMountOptions []string) error {
 	return nil
 }
@@ -44,6 +50,12 @@ func CleanupMountPoint(m *mount.SafeFormatAndMount, target string, extensiveMoun
 	return nil
 }
 
+// getDiskFormat - disk format detection is only implemented on Linux, an
+// empty format means the disk is treated as unformatted
+func getDiskFormat(m *mount.SafeFormatAndMount, disk string) (string, error) {
+	return "", nil
+}
+
 func preparePublishPath(path string, m *mount.SafeFormatAndMount) error {
 	return nil
 }
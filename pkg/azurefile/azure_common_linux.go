@@ -20,10 +20,18 @@ package azurefile
 
 import (
 	"os"
+	"syscall"
 
 	"k8s.io/utils/mount"
 )
 
+// lazyUnmount detaches the mount at target without waiting for the server,
+// the fallback when a regular unmount blocks on an unreachable server,
+// overridable in unit tests
+var lazyUnmount = func(target string) error {
+	return syscall.Unmount(target, syscall.MNT_DETACH)
+}
+
 func SMBMount(m *mount.SafeFormatAndMount, source, target, fsType string, options, sensitiveMountOptions []string) error {
 	return m.MountSensitive(source, target, fsType, options, sensitiveMountOptions)
 }
@@ -44,6 +52,10 @@ func CleanupMountPoint(m *mount.SafeFormatAndMount, target string, extensiveMoun
 	return mount.CleanupMountPoint(target, m, extensiveMountCheck)
 }
 
+func getDiskFormat(m *mount.SafeFormatAndMount, disk string) (string, error) {
+	return m.GetDiskFormat(disk)
+}
+
 func preparePublishPath(path string, m *mount.SafeFormatAndMount) error {
 	return nil
 }
@@ -26,6 +26,12 @@ import (
 	"sigs.k8s.io/azurefile-csi-driver/pkg/mounter"
 )
 
+// lazyUnmount - the CSI proxy offers no lazy unmount, the timed out unmount
+// error surfaces to the caller instead
+var lazyUnmount = func(target string) error {
+	return fmt.Errorf("lazy unmount is not supported on windows")
+}
+
 func SMBMount(m *mount.SafeFormatAndMount, source, target, fsType string, mountOptions, sensitiveMountOptions []string) error {
 	proxy, ok := m.Interface.(*mounter.CSIProxyMounter)
 	if !ok {
@@ -65,6 +71,12 @@ func CleanupMountPoint(m *mount.SafeFormatAndMount, target string, extensiveMoun
 	return proxy.Rmdir(target)
 }
 
+// getDiskFormat - disk format detection is only implemented on Linux, an
+// empty format means the disk is treated as unformatted
+func getDiskFormat(m *mount.SafeFormatAndMount, disk string) (string, error) {
+	return "", nil
+}
+
 func removeDir(path string, m *mount.SafeFormatAndMount) error {
 	proxy, ok := m.Interface.(*mounter.CSIProxyMounter)
 	if !ok {
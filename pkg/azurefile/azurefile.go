@@ -20,11 +20,16 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Azure/azure-storage-file-go/azfile"
+	"github.com/Azure/go-autorest/autorest"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/pborman/uuid"
 	"github.com/rubiojr/go-vhd/vhd"
@@ -36,9 +41,15 @@ import (
 	"k8s.io/kubernetes/pkg/volume/util"
 	"k8s.io/utils/mount"
 
+	"sigs.k8s.io/yaml"
+
 	csicommon "sigs.k8s.io/azurefile-csi-driver/pkg/csi-common"
 	"sigs.k8s.io/azurefile-csi-driver/pkg/mounter"
+	"sigs.k8s.io/cloud-provider-azure/pkg/auth"
+	azclients "sigs.k8s.io/cloud-provider-azure/pkg/azureclients"
 	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/fileclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/storageaccountclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/subnetclient"
 	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
 	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
 )
@@ -56,6 +67,7 @@ const (
 	vers               = "vers"
 	actimeo            = "actimeo"
 	mfsymlinks         = "mfsymlinks"
+	seal               = "seal"
 	defaultFileMode    = "0777"
 	defaultDirMode     = "0777"
 	defaultVers        = "3.0"
@@ -64,8 +76,20 @@ const (
 	// See https://docs.microsoft.com/en-us/rest/api/storageservices/naming-and-referencing-shares--directories--files--and-metadata#share-names
 	fileShareNameMinLength = 3
 	fileShareNameMaxLength = 63
+	// length of the hash suffix appended to truncated share names
+	shareNameHashLength = 8
+	// smallest accepted share-name-max-length, leaves room for a minimum length
+	// prefix plus the hash suffix
+	minShareNameMaxLength = fileShareNameMinLength + shareNameHashLength + 1
+
+	// largest accepted value of the quotaMarginPercent parameter
+	maxQuotaMarginPercent = 50
 
 	minimumPremiumShareSize = 100 // GB
+	// largest quota a single file share can have, 100TiB for premium shares
+	// and for standard accounts with large file shares enabled, a bigger
+	// request can never be satisfied by any account
+	maxShareSizeGiB = 102400
 	// Minimum size of Azure Premium Files is 100GiB
 	// See https://docs.microsoft.com/en-us/azure/storage/files/storage-files-planning#provisioned-shares
 	defaultAzureFileQuota = 100
@@ -73,9 +97,32 @@ const (
 	// key of snapshot name in metadata
 	snapshotNameKey = "initiator"
 
+	// set by kubelet in the volume context of CSI inline ephemeral volumes
+	ephemeralField = "csi.storage.k8s.io/ephemeral"
+
 	shareNameField           = "sharename"
+	usernameField            = "username"
+	mountProfileField        = "mountprofile"
+	mountOptionsField        = "mountoptions"
+	echoIntervalField        = "echointerval"
+	handleCacheField         = "handlecache"
+	subsIDField              = "subscriptionid"
+	encryptInTransitField    = "encryptintransit"
+	requireEncryptField      = "requireencryptintransit"
+	smbVersionField          = "smbversion"
+	fileModeField            = "filemode"
+	dirModeField             = "dirmode"
+	secNfsField              = "secnfs"
 	diskNameField            = "diskname"
+	diskModeField            = "diskmode"
+	createDiskField          = "createdisk"
+	diskMountOptionsField    = "diskmountoptions"
+	shareTierField           = "sharetier"
+	requestedSizeGiBField    = "requestedsizegib"
 	serverNameField          = "server"
+	serverAddressField       = "serveraddress"
+	endpointSuffixField      = "storageendpointsuffix"
+	portField                = "port"
 	fsTypeField              = "fstype"
 	protocolField            = "protocol"
 	tagsField                = "tags"
@@ -84,7 +131,12 @@ const (
 	skuNameField             = "skuname"
 	resourceGroupField       = "resourcegroup"
 	locationField            = "location"
+	edgeZoneField            = "edgezone"
 	secretNamespaceField     = "secretnamespace"
+	quotaMarginPercentField  = "quotamarginpercent"
+	accessPolicyPermsField   = "accesspolicypermissions"
+	accessPolicyExpiryField  = "accesspolicyexpiry"
+	accessPolicyIDField      = "accesspolicyid"
 	storeAccountKeyField     = "storeaccountkey"
 	storeAccountKeyFalse     = "false"
 	defaultSecretAccountName = "azurestorageaccountname"
@@ -102,23 +154,157 @@ const (
 	metaDataNode             = "node"
 
 	accountNotProvisioned = "StorageAccountIsNotProvisioned"
+	// Azure error codes returned when a storage account cannot accept a new file share
+	accountCapacityLimitExceed = "TotalSharesProvisionedCapacityExceedsAccountLimit"
+	shareCountLimitExceed      = "TooManyShares"
 	// this is a workaround fix for 429 throttling issue, will update cloud provider for better fix later
 	tooManyRequests   = "TooManyRequests"
 	shareNotFound     = "The specified share does not exist"
 	shareBeingDeleted = "The specified share is being deleted"
 	clientThrottled   = "client throttled"
+	resourceNotFound  = "ResourceNotFound"
+
+	// machine-readable reason codes attached to controller RPC errors as details
+	reasonQuotaExceeded   = "QUOTA_EXCEEDED"
+	reasonAccountNotFound = "ACCOUNT_NOT_FOUND"
+	reasonThrottled       = "THROTTLED"
 
 	fileShareAccountNamePrefix = "f"
+
+	// permission characters supported in a share stored access policy
+	// See https://docs.microsoft.com/en-us/rest/api/storageservices/set-share-acl
+	accessPolicyPermissionChars = "rcwdl"
+
+	// policies controlling ControllerExpandVolume when the share has snapshots
+	expandWithSnapshotsProceed = "proceed"
+	expandWithSnapshotsWarn    = "warn"
+	expandWithSnapshotsBlock   = "block"
+
+	// policies controlling DeleteVolume when the share has snapshots
+	deleteWithSnapshotsInclude = "include"
+	deleteWithSnapshotsFail    = "fail"
+	deleteWithSnapshotsRetain  = "retain"
+
+	// fsGroupPolicy values mirroring the CSIDriver fsGroupPolicy field the
+	// driver is deployed with, File keeps permission handling in the driver
+	// while None and ReadWriteOnceWithFSType leave it to kubelet
+	fsGroupPolicyNone                    = "None"
+	fsGroupPolicyFile                    = "File"
+	fsGroupPolicyReadWriteOnceWithFSType = "ReadWriteOnceWithFSType"
+
+	// supported values of the handlecache volume context field, passed through
+	// as cifs mount options controlling SMB handle caching/leases
+	handleCacheEnabled  = "handlecache"
+	handleCacheDisabled = "nohandlecache"
+
+	// account tag recording the edge zone the account is placed in
+	edgeZoneTagKey = "edgeZone"
 )
 
 var (
 	supportedFsTypeList     = []string{cifs, smb, nfs, ext4, ext3, ext2, xfs}
 	supportedProtocolList   = []string{smb, nfs}
 	supportedDiskFsTypeList = []string{ext4, ext3, ext2, xfs}
+	supportedSmbVersionList = []string{"2.0", "2.1", "3", "3.0", "3.02", "3.1.1"}
+	supportedNfsSecList     = []string{"sys", "krb5", "krb5i", "krb5p"}
 
 	retriableErrors = []string{accountNotProvisioned, tooManyRequests, shareNotFound, shareBeingDeleted, clientThrottled}
 )
 
+// DriverOptions defines driver parameters specified in driver deployment
+type DriverOptions struct {
+	NodeID string
+	// name the driver registers itself under, empty means the default name
+	DriverName string
+	// interval to refresh the cached storage account capacity inventory
+	AccountInventoryRefreshInterval time.Duration
+	// comma separated list of storage account SKUs that may be provisioned, empty means all SKUs are allowed
+	AllowedStorageAccountSKUs string
+	// comma separated list of storage account SKUs that must not be provisioned
+	DeniedStorageAccountSKUs string
+	// maximum number of concurrent mount operations on a node, 0 means no limit
+	MaxConcurrentMounts int
+	// treat missing node stage secrets as an error instead of fetching the account key via the cluster identity
+	RequireSecrets bool
+	// path to a yaml file defining named mount option profiles, e.g. `profile-name: ["nostrictsync", "actimeo=30"]`
+	MountOptionProfilesFile string
+	// address of the debug state endpoint, empty means the endpoint is disabled
+	DebugStateAddress string
+	// default resource group for SMB volumes when the volume parameters do not specify one
+	DefaultResourceGroupSMB string
+	// default resource group for NFS volumes when the volume parameters do not specify one
+	DefaultResourceGroupNFS string
+	// behavior of ControllerExpandVolume when the share has snapshots: proceed, warn or block
+	ExpandWithSnapshotsPolicy string
+	// behavior of DeleteVolume when the share has snapshots: include, fail or retain, empty means plain share deletion
+	DeleteWithSnapshotsPolicy string
+	// maximum length of created file share names, 0 means the Azure Files limit
+	ShareNameMaxLength int
+	// path of the audit log file recording provisioning operations, empty means auditing is disabled
+	AuditLogPath string
+	// fsType used for disk-mode volumes when the volume context does not set one
+	DefaultDiskFsType string
+	// maximum number of rollover account creation attempts per CreateVolume when an account is full, 0 disables rollover
+	AccountRolloverAttempts int
+	// delay between rollover account creation attempts
+	AccountRolloverDelay time.Duration
+	// maximum number of file shares packed into one automatically selected storage account, 0 disables account pooling
+	MaxSharesPerAccount int
+	// honor the requested access modes when picking provisioning defaults
+	EnableAccessModeDefaults bool
+	// default quota of single-node volumes when no capacity is requested, 0 means the standard default
+	SingleNodeDefaultQuotaGiB int
+	// refresh the credentials of already mounted SMB shares on re-stage when the account key rotated
+	EnableCredentialRefresh bool
+	// warn at mount time when the share quota no longer matches the provisioned capacity
+	EnableQuotaVerification bool
+	// number of consecutive failed health probes before NodeGetVolumeStats reports a mount as abnormal
+	StaleMountProbeThreshold int
+	// directory holding transient SMB credential files, expected to be a tmpfs, empty means the default
+	CredentialsDir string
+	// stage over an existing mount at the staging target even when it was not created by this driver
+	ForceStageOverForeignMounts bool
+	// maximum number of volumes reported to the scheduler per node, 0 means unlimited
+	MaxVolumesPerNode int
+	// operator-supplied suffix appended to the User-Agent of management API calls
+	UserAgentSuffix string
+	// maximum number of concurrent storage account creations per subscription, 0 means no limit
+	AccountCreateConcurrency int
+	// base directory of the proxy mounts of disk-mode volumes, empty means beside the staging target
+	ProxyMountBase string
+	// expose the /debug/test-mount diagnostic endpoint on the debug state address
+	EnableTestMount bool
+	// only list shares whose name starts with this prefix in ListVolumes, empty means all tracked shares
+	ListVolumesSharePrefix string
+	// number of concurrent workers of the startup mount-leak reconciler, 0 means the default
+	MountReconcileWorkers int
+	// total time budget of the startup mount-leak reconciler, 0 means the default
+	MountReconcileBudget time.Duration
+	// timeout of each CSI proxy call on Windows, 0 means the built-in default
+	CSIProxyTimeout time.Duration
+	// comma separated default mount options per protocol, empty means the built-in set
+	DefaultMountOptionsSMB string
+	DefaultMountOptionsNFS string
+	// number of NodeStageVolume mount attempts while a freshly provisioned share is not ready yet, 0 means the default
+	ShareNotReadyRetries int
+	// fall back to provisioning an SMB share when the requested NFS protocol is not available in the target region or account
+	ProtocolFallback bool
+	// octal permissions applied to created staging target directories, 0 means the directory mode is left untouched
+	MountPermissions uint64
+	// number of SMB global mapping attempts per mount on Windows, 0 means the default
+	SmbMountRetries int
+	// remount an already staged volume when the requested mount options changed
+	RemountOnOptionChange bool
+	// timeout of a NodeUnstageVolume unmount before the lazy unmount fallback, 0 means the default
+	UnmountTimeout time.Duration
+	// TTL of cached NodeGetVolumeStats results, 0 disables the cache
+	VolumeStatsCacheTTL time.Duration
+	// fsGroupPolicy the driver is deployed with, None/File/ReadWriteOnceWithFSType, empty behaves like File
+	FSGroupPolicy string
+	// maximum number of concurrent node mounts, callers over the limit block instead of being rejected, 0 means no limit
+	MaxConcurrentNodeMounts int
+}
+
 // Driver implements all interfaces of CSI drivers
 type Driver struct {
 	csicommon.CSIDriver
@@ -129,20 +315,333 @@ type Driver struct {
 	volLockMap *lockMap
 	// only for nfs feature
 	subnetLockMap *lockMap
+	// cached storage account capacity inventory used by GetCapacity and account selection
+	accountInventory *accountInventory
+	// allowed/denied storage account SKU names, empty allowedSKUs means all SKUs are allowed
+	allowedSKUs []string
+	deniedSKUs  []string
+	// bounds the number of concurrent mount operations on a node
+	mountLimiter *mountLimiter
+	// bounds the number of concurrent storage account creations per subscription
+	accountCreateLimiter *accountCreateLimiter
+	// error out instead of fetching the account key via the cluster identity when secrets are missing
+	requireSecrets bool
+	// named mount option profiles that volumes can reference via the mountProfile field
+	mountProfiles map[string][]string
+	// address of the debug state endpoint, empty means the endpoint is disabled
+	debugStateAddress string
+	// expose the /debug/test-mount diagnostic endpoint on the debug state address
+	enableTestMount bool
+	// only list shares whose name starts with this prefix in ListVolumes,
+	// scoping the enumeration to driver managed shares in shared accounts
+	listVolumesSharePrefix string
+	// per-protocol default resource groups, empty means d.cloud.ResourceGroup is used
+	defaultResourceGroupSMB string
+	defaultResourceGroupNFS string
+	// behavior of ControllerExpandVolume when the share has snapshots
+	expandWithSnapshotsPolicy string
+	// behavior of DeleteVolume when the share has snapshots
+	deleteWithSnapshotsPolicy string
+	// maximum length of created file share names
+	shareNameMaxLength int
+	// audit trail of provisioning operations, nil means auditing is disabled
+	auditLog *auditLogger
+	// fsType used for disk-mode volumes when the volume context does not set one
+	defaultDiskFsType string
+	// maximum number of rollover account creation attempts per CreateVolume, 0 disables rollover
+	accountRolloverAttempts int
+	// delay between rollover account creation attempts
+	accountRolloverDelay time.Duration
+	// maximum number of file shares packed into one automatically selected storage account, 0 disables account pooling
+	maxSharesPerAccount int
+	// honor the requested access modes when picking provisioning defaults
+	enableAccessModeDefaults bool
+	// default quota of single-node volumes when no capacity is requested
+	singleNodeDefaultQuotaGiB int
+	// refresh the credentials of already mounted SMB shares on re-stage
+	enableCredentialRefresh bool
+	// warn at mount time when the share quota no longer matches the provisioned capacity
+	enableQuotaVerification bool
+	// number of consecutive failed health probes before NodeGetVolumeStats
+	// reports a mount as abnormal
+	staleMountProbeThreshold int
+	// directory holding transient SMB credential files, swept at startup and
+	// shutdown so stale plain-text credentials never outlive the driver
+	credentialsDir string
+	// base directory of the proxy mounts of disk-mode volumes, empty means the
+	// proxy mount sits beside the staging target
+	proxyMountBase string
+	// worker count and total time budget of the startup mount-leak reconciler
+	mountReconcileWorkers int
+	mountReconcileBudget  time.Duration
+	// timeout of each CSI proxy call on Windows, a hung proxy surfaces as a
+	// DeadlineExceeded error instead of blocking the RPC indefinitely
+	csiProxyTimeout time.Duration
+	// operator overrides of the per-protocol default mount options, empty
+	// means the built-in set of the protocol
+	defaultMountOptionsSMB []string
+	defaultMountOptionsNFS []string
+	// number of NodeStageVolume mount attempts while the share looks like it
+	// has not been fully provisioned yet
+	shareNotReadyRetries int
+	// fall back to provisioning an SMB share when the requested NFS protocol
+	// is not available in the target region or account
+	protocolFallback bool
+	// permissions applied to created staging target directories, 0 means the
+	// directory mode is left untouched
+	mountPermissions os.FileMode
+	// number of SMB global mapping attempts per mount on Windows, transient
+	// mapping failures are retried with backoff up to this bound
+	smbMountRetries int
+	// remount an already staged volume when the requested mount options
+	// changed, off keeps the historical behavior of ignoring the new options
+	remountOnOptionChange bool
+	// time budget of a NodeUnstageVolume unmount, an unmount still blocked on
+	// an unreachable server after this long falls back to a lazy unmount
+	unmountTimeout time.Duration
+	// TTL of cached NodeGetVolumeStats results, 0 disables the cache and
+	// probes the filesystem on every call
+	volumeStatsCacheTTL time.Duration
+	// fsGroupPolicy the driver is deployed with, permission handling stays in
+	// the driver under File(and empty), None disables it entirely and
+	// ReadWriteOnceWithFSType leaves it to kubelet
+	fsGroupPolicy string
+	// stage over an existing mount at the staging target even when it was not
+	// created by this driver
+	forceStageOverForeignMounts bool
+	// maximum number of volumes reported to the scheduler per node, 0 means
+	// unlimited and leaves MaxVolumesPerNode unset in NodeGetInfo
+	maxVolumesPerNode int
+	// User-Agent the management clients send with every request, composed of
+	// the driver name, its version and an optional operator-supplied suffix
+	userAgent string
+	// volume path -> consecutive failed health probes
+	mountProbeFailuresLock sync.Mutex
+	mountProbeFailures     map[string]int
+	// volume path -> cached statfs result, concurrent probes of the same
+	// path coalesce onto the entry in flight
+	volumeStatsCacheLock sync.Mutex
+	volumeStatsCache     map[string]*volumeStatsCacheEntry
+	// staging target path -> volume ID, guards against two different volumes
+	// being staged to the same target path
+	stagedPathsLock sync.Mutex
+	stagedPaths     map[string]string
+	// staging target path -> mount options the volume was staged with, used to
+	// detect option changes on re-stage
+	stagedMountOptions map[string][]string
+	// volume ID -> share tier captured from the volume context at stage time,
+	// used to annotate NodeGetVolumeStats with latency characteristics
+	volumeTiersLock sync.Mutex
+	volumeTiers     map[string]string
+	// volume ID -> time of the last successful stage or health probe, used to
+	// correlate mount age with observed I/O errors
+	lastMountTimesLock sync.Mutex
+	lastMountTimes     map[string]time.Time
+	// subscription ID -> file share client for volumes provisioned outside the
+	// configured subscription, created lazily
+	fileClientsLock sync.Mutex
+	fileClients     map[string]fileclient.Interface
+	// reason the driver failed the pre-flight permission check, nil when ready
+	readyLock      sync.RWMutex
+	notReadyReason error
 }
 
 // NewDriver Creates a NewCSIDriver object. Assumes vendor version is equal to driver version &
 // does not support optional driver plugin info manifest field. Refer to CSI spec for more details.
-func NewDriver(nodeID string) *Driver {
+func NewDriver(options *DriverOptions) *Driver {
 	driver := Driver{}
-	driver.Name = DriverName
+	driver.Name = options.DriverName
+	if driver.Name == "" {
+		driver.Name = DriverName
+	}
 	driver.Version = driverVersion
-	driver.NodeID = nodeID
+	driver.NodeID = options.NodeID
 	driver.volLockMap = newLockMap()
 	driver.subnetLockMap = newLockMap()
+	driver.accountInventory = newAccountInventory(options.AccountInventoryRefreshInterval)
+	driver.allowedSKUs = parseSKUList(options.AllowedStorageAccountSKUs)
+	driver.deniedSKUs = parseSKUList(options.DeniedStorageAccountSKUs)
+	if options.MaxConcurrentMounts > 0 && options.MaxConcurrentNodeMounts > 0 {
+		klog.Fatalf("max-concurrent-mounts(%d) and max-concurrent-node-mounts(%d) are mutually exclusive", options.MaxConcurrentMounts, options.MaxConcurrentNodeMounts)
+	}
+	if options.MaxConcurrentNodeMounts > 0 {
+		// blocking semantics, pod churn waits for a slot instead of failing
+		driver.mountLimiter = newBlockingMountLimiter(options.MaxConcurrentNodeMounts)
+	} else {
+		driver.mountLimiter = newMountLimiter(options.MaxConcurrentMounts)
+	}
+	if options.AccountCreateConcurrency < 0 {
+		klog.Fatalf("invalid account-create-concurrency(%d), must not be negative", options.AccountCreateConcurrency)
+	}
+	driver.accountCreateLimiter = newAccountCreateLimiter(options.AccountCreateConcurrency)
+	driver.requireSecrets = options.RequireSecrets
+	driver.debugStateAddress = options.DebugStateAddress
+	driver.enableTestMount = options.EnableTestMount
+	driver.listVolumesSharePrefix = options.ListVolumesSharePrefix
+	driver.defaultResourceGroupSMB = options.DefaultResourceGroupSMB
+	driver.defaultResourceGroupNFS = options.DefaultResourceGroupNFS
+	if options.DefaultDiskFsType != "" && !isDiskFsType(options.DefaultDiskFsType) {
+		klog.Fatalf("invalid default-disk-fstype(%s), supported fsType list: %v", options.DefaultDiskFsType, supportedDiskFsTypeList)
+	}
+	driver.defaultDiskFsType = options.DefaultDiskFsType
+	if options.AccountRolloverAttempts < 0 {
+		klog.Fatalf("invalid account-rollover-attempts(%d), must not be negative", options.AccountRolloverAttempts)
+	}
+	driver.accountRolloverAttempts = options.AccountRolloverAttempts
+	if options.AccountRolloverDelay < 0 {
+		klog.Fatalf("invalid account-rollover-delay(%v), must not be negative", options.AccountRolloverDelay)
+	}
+	driver.accountRolloverDelay = options.AccountRolloverDelay
+	if options.MaxSharesPerAccount < 0 {
+		klog.Fatalf("invalid max-shares-per-account(%d), must not be negative", options.MaxSharesPerAccount)
+	}
+	driver.maxSharesPerAccount = options.MaxSharesPerAccount
+	driver.enableAccessModeDefaults = options.EnableAccessModeDefaults
+	if options.SingleNodeDefaultQuotaGiB < 0 {
+		klog.Fatalf("invalid single-node-default-quota-gib(%d), must not be negative", options.SingleNodeDefaultQuotaGiB)
+	}
+	driver.singleNodeDefaultQuotaGiB = options.SingleNodeDefaultQuotaGiB
+	driver.enableCredentialRefresh = options.EnableCredentialRefresh
+	driver.enableQuotaVerification = options.EnableQuotaVerification
+	switch {
+	case options.StaleMountProbeThreshold == 0:
+		// a threshold of one keeps the historical behavior of reporting a
+		// mount abnormal on its first failed probe
+		driver.staleMountProbeThreshold = 1
+	case options.StaleMountProbeThreshold < 0:
+		klog.Fatalf("invalid stale-mount-probe-threshold(%d), must be at least 1", options.StaleMountProbeThreshold)
+	default:
+		driver.staleMountProbeThreshold = options.StaleMountProbeThreshold
+	}
+	driver.forceStageOverForeignMounts = options.ForceStageOverForeignMounts
+	if options.MaxVolumesPerNode < 0 {
+		klog.Fatalf("invalid max-volumes-per-node(%d), must not be negative", options.MaxVolumesPerNode)
+	}
+	driver.maxVolumesPerNode = options.MaxVolumesPerNode
+	driver.userAgent = composeUserAgent(driver.Name, options.UserAgentSuffix)
+	driver.credentialsDir = options.CredentialsDir
+	if driver.credentialsDir == "" {
+		driver.credentialsDir = defaultCredentialsDir
+	}
+	driver.proxyMountBase = options.ProxyMountBase
+	switch {
+	case options.MountReconcileWorkers == 0:
+		driver.mountReconcileWorkers = defaultMountReconcileWorkers
+	case options.MountReconcileWorkers < 0:
+		klog.Fatalf("invalid mount-reconcile-workers(%d), must be at least 1", options.MountReconcileWorkers)
+	default:
+		driver.mountReconcileWorkers = options.MountReconcileWorkers
+	}
+	switch {
+	case options.MountReconcileBudget == 0:
+		driver.mountReconcileBudget = defaultMountReconcileBudget
+	case options.MountReconcileBudget < 0:
+		klog.Fatalf("invalid mount-reconcile-budget(%v), must not be negative", options.MountReconcileBudget)
+	default:
+		driver.mountReconcileBudget = options.MountReconcileBudget
+	}
+	if options.CSIProxyTimeout < 0 {
+		klog.Fatalf("invalid csi-proxy-timeout(%v), must not be negative", options.CSIProxyTimeout)
+	}
+	driver.csiProxyTimeout = options.CSIProxyTimeout
+	driver.defaultMountOptionsSMB = parseMountOptionList(options.DefaultMountOptionsSMB)
+	driver.defaultMountOptionsNFS = parseMountOptionList(options.DefaultMountOptionsNFS)
+	switch {
+	case options.ShareNotReadyRetries == 0:
+		driver.shareNotReadyRetries = defaultShareNotReadyRetries
+	case options.ShareNotReadyRetries < 0:
+		klog.Fatalf("invalid share-not-ready-retries(%d), must be at least 1", options.ShareNotReadyRetries)
+	default:
+		driver.shareNotReadyRetries = options.ShareNotReadyRetries
+	}
+	driver.protocolFallback = options.ProtocolFallback
+	if options.MountPermissions > 0777 {
+		klog.Fatalf("invalid mount-permissions(0%o), must not exceed 0777", options.MountPermissions)
+	}
+	driver.mountPermissions = os.FileMode(options.MountPermissions)
+	switch {
+	case options.SmbMountRetries == 0:
+		driver.smbMountRetries = defaultSmbMountRetries
+	case options.SmbMountRetries < 0:
+		klog.Fatalf("invalid smb-mount-retries(%d), must be at least 1", options.SmbMountRetries)
+	default:
+		driver.smbMountRetries = options.SmbMountRetries
+	}
+	driver.remountOnOptionChange = options.RemountOnOptionChange
+	switch {
+	case options.UnmountTimeout == 0:
+		driver.unmountTimeout = defaultUnmountTimeout
+	case options.UnmountTimeout < 0:
+		klog.Fatalf("invalid unmount-timeout(%v), must not be negative", options.UnmountTimeout)
+	default:
+		driver.unmountTimeout = options.UnmountTimeout
+	}
+	if options.VolumeStatsCacheTTL < 0 {
+		klog.Fatalf("invalid volume-stats-cache-ttl(%v), must not be negative", options.VolumeStatsCacheTTL)
+	}
+	driver.volumeStatsCacheTTL = options.VolumeStatsCacheTTL
+	switch options.FSGroupPolicy {
+	case "", fsGroupPolicyNone, fsGroupPolicyFile, fsGroupPolicyReadWriteOnceWithFSType:
+		driver.fsGroupPolicy = options.FSGroupPolicy
+	default:
+		klog.Fatalf("invalid fs-group-policy(%s), supported values: %s, %s, %s", options.FSGroupPolicy, fsGroupPolicyNone, fsGroupPolicyFile, fsGroupPolicyReadWriteOnceWithFSType)
+	}
+	if options.AuditLogPath != "" {
+		sink, err := os.OpenFile(options.AuditLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			klog.Fatalf("failed to open audit log file %s: %v", options.AuditLogPath, err)
+		}
+		driver.auditLog = newAuditLogger(sink)
+	}
+	switch {
+	case options.ShareNameMaxLength == 0:
+		driver.shareNameMaxLength = fileShareNameMaxLength
+	case options.ShareNameMaxLength < minShareNameMaxLength || options.ShareNameMaxLength > fileShareNameMaxLength:
+		klog.Fatalf("invalid share-name-max-length(%d), supported range: %d..%d", options.ShareNameMaxLength, minShareNameMaxLength, fileShareNameMaxLength)
+	default:
+		driver.shareNameMaxLength = options.ShareNameMaxLength
+	}
+	switch options.ExpandWithSnapshotsPolicy {
+	case "", expandWithSnapshotsProceed, expandWithSnapshotsWarn, expandWithSnapshotsBlock:
+		driver.expandWithSnapshotsPolicy = options.ExpandWithSnapshotsPolicy
+	default:
+		klog.Fatalf("invalid expand-with-snapshots-policy(%s), supported values: %s, %s, %s", options.ExpandWithSnapshotsPolicy, expandWithSnapshotsProceed, expandWithSnapshotsWarn, expandWithSnapshotsBlock)
+	}
+	switch options.DeleteWithSnapshotsPolicy {
+	case "", deleteWithSnapshotsInclude, deleteWithSnapshotsFail, deleteWithSnapshotsRetain:
+		driver.deleteWithSnapshotsPolicy = options.DeleteWithSnapshotsPolicy
+	default:
+		klog.Fatalf("invalid delete-with-snapshots-policy(%s), supported values: %s, %s, %s", options.DeleteWithSnapshotsPolicy, deleteWithSnapshotsInclude, deleteWithSnapshotsFail, deleteWithSnapshotsRetain)
+	}
+	driver.stagedPaths = make(map[string]string)
+	driver.stagedMountOptions = make(map[string][]string)
+	driver.volumeTiers = make(map[string]string)
+	driver.fileClients = make(map[string]fileclient.Interface)
+	driver.mountProbeFailures = make(map[string]int)
+	driver.volumeStatsCache = make(map[string]*volumeStatsCacheEntry)
+	driver.lastMountTimes = make(map[string]time.Time)
+	if options.MountOptionProfilesFile != "" {
+		profiles, err := loadMountProfiles(options.MountOptionProfilesFile)
+		if err != nil {
+			klog.Fatalf("failed to load mount option profiles from %s: %v", options.MountOptionProfilesFile, err)
+		}
+		driver.mountProfiles = profiles
+	}
 	return &driver
 }
 
+// topologyLocationKey returns the AccessibleTopology key recording the volume
+// location, derived from the configured driver name
+func (d *Driver) topologyLocationKey() string {
+	return "topology." + d.Name + "/location"
+}
+
+// topologyEdgeZoneKey returns the AccessibleTopology key recording the edge
+// zone the volume is placed in, derived from the configured driver name
+func (d *Driver) topologyEdgeZoneKey() string {
+	return "topology." + d.Name + "/edge-zone"
+}
+
 // Run driver initialization
 func (d *Driver) Run(endpoint, kubeconfig string, testBool bool) {
 	versionMeta, err := GetVersionYAML()
@@ -158,6 +657,7 @@ func (d *Driver) Run(endpoint, kubeconfig string, testBool bool) {
 	d.cloud = cloud
 	// todo: set backoff from cloud provider config
 	d.fileClient = newAzureFileClient(&cloud.Environment, &retry.Backoff{Steps: 1})
+	d.applyUserAgent()
 
 	if d.NodeID == "" {
 		// Disable UseInstanceMetadata for controller to mitigate a timeout issue using IMDS
@@ -166,7 +666,7 @@ func (d *Driver) Run(endpoint, kubeconfig string, testBool bool) {
 		d.cloud.Config.UseInstanceMetadata = false
 	}
 
-	d.mounter, err = mounter.NewSafeMounter()
+	d.mounter, err = mounter.NewSafeMounter(d.csiProxyTimeout)
 	if err != nil {
 		klog.Fatalf("Failed to get safe mounter. Error: %v", err)
 	}
@@ -179,6 +679,8 @@ func (d *Driver) Run(endpoint, kubeconfig string, testBool bool) {
 			csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
 			//csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
 			csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+			csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+			csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
 		})
 	d.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{
 		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
@@ -191,16 +693,108 @@ func (d *Driver) Run(endpoint, kubeconfig string, testBool bool) {
 	d.AddNodeServiceCapabilities([]csi.NodeServiceCapability_RPC_Type{
 		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
 		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
 	})
 
+	if d.NodeID == "" {
+		// only the controller component needs the storage management permissions
+		if err = d.preflightPermissionCheck(context.Background()); err != nil {
+			// fail readiness instead of crashing, so the actionable message is
+			// surfaced via the Probe RPC and the pod events
+			d.setNotReady(err)
+			klog.Errorf("pre-flight permission check failed: %v", err)
+		}
+	}
+
+	if d.debugStateAddress != "" {
+		d.serveDebugState(d.debugStateAddress)
+	}
+
+	if err := d.checkWritablePaths(); err != nil {
+		// nodes with a read-only root filesystem must point the directory
+		// roots at writable tmpfs paths, fail readiness so the actionable
+		// message is surfaced via the Probe RPC and the pod events
+		d.setNotReady(err)
+		klog.Errorf("writable path check failed: %v", err)
+	} else {
+		// a previous instance may have crashed before its own shutdown cleanup
+		// ran, sweep its stale credential files before serving
+		if err := ensureCredentialsDir(d.credentialsDir); err != nil {
+			klog.Fatalf("failed to prepare credentials directory: %v", err)
+		}
+		d.cleanupCredentials("startup")
+		defer d.cleanupCredentials("shutdown")
+	}
+
+	if d.NodeID != "" {
+		// a crashed instance cannot unmount its disk-mode proxy mounts either,
+		// reconcile whatever it left under the configured base directory
+		d.reconcileLeakedMounts(d.collectLeakedMountCandidates())
+	}
+
 	s := csicommon.NewNonBlockingGRPCServer()
 	// Driver d act as IdentityServer, ControllerServer and NodeServer
 	s.Start(endpoint, d, d, d, testBool)
 	s.Wait()
 }
 
+// preflightPermissionCheck verifies the driver identity has the minimum RBAC
+// it needs (storage account read and key list) with harmless read-only probes,
+// so missing permissions surface at startup instead of as per-request 403s
+func (d *Driver) preflightPermissionCheck(ctx context.Context) error {
+	if d.cloud == nil || d.cloud.StorageAccountClient == nil {
+		return nil
+	}
+	accounts, rerr := d.cloud.StorageAccountClient.ListByResourceGroup(ctx, d.cloud.ResourceGroup)
+	if rerr != nil {
+		return fmt.Errorf("driver identity cannot list storage accounts under resource group(%s): %v, grant the identity read access on storage accounts", d.cloud.ResourceGroup, rerr.Error())
+	}
+	for _, account := range accounts {
+		if account.Name == nil {
+			continue
+		}
+		if _, rerr := d.cloud.StorageAccountClient.ListKeys(ctx, d.cloud.ResourceGroup, *account.Name); rerr != nil {
+			return fmt.Errorf("driver identity cannot list keys of storage account(%s): %v, grant the identity the listKeys permission", *account.Name, rerr.Error())
+		}
+		// one probed account is enough, the permission is scoped to the resource group
+		break
+	}
+	klog.V(2).Infof("pre-flight permission check passed under resource group(%s)", d.cloud.ResourceGroup)
+	return nil
+}
+
+// checkWritablePaths verifies the configured directory roots are writable,
+// nodes with a read-only root filesystem must point --credentials-dir and
+// --proxy-mount-base at writable tmpfs paths
+func (d *Driver) checkWritablePaths() error {
+	paths := []string{d.credentialsDir}
+	if d.proxyMountBase != "" {
+		paths = append(paths, d.proxyMountBase)
+	}
+	for _, path := range paths {
+		if err := ensureWritableDir(path); err != nil {
+			return fmt.Errorf("directory root %q is not writable, point it at a writable tmpfs path: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// setNotReady records why the driver must fail its readiness probe
+func (d *Driver) setNotReady(err error) {
+	d.readyLock.Lock()
+	defer d.readyLock.Unlock()
+	d.notReadyReason = err
+}
+
+// readinessError returns the reason the driver is not ready, nil when ready
+func (d *Driver) readinessError() error {
+	d.readyLock.RLock()
+	defer d.readyLock.RUnlock()
+	return d.notReadyReason
+}
+
 // getFileShareQuota return (-1, nil) means file share does not exist
-func (d *Driver) getFileShareQuota(resourceGroupName, accountName, fileShareName string, secrets map[string]string) (int, error) {
+func (d *Driver) getFileShareQuota(subsID, resourceGroupName, accountName, fileShareName string, secrets map[string]string) (int, error) {
 	if len(secrets) > 0 {
 		accountName, accountKey, err := getStorageAccount(secrets)
 		if err != nil {
@@ -221,7 +815,11 @@ func (d *Driver) getFileShareQuota(resourceGroupName, accountName, fileShareName
 		return share.Properties.Quota, nil
 	}
 
-	fileShare, err := d.cloud.GetFileShare(resourceGroupName, accountName, fileShareName)
+	client, err := d.getFileClientForSubscription(subsID)
+	if err != nil {
+		return -1, err
+	}
+	fileShare, err := client.GetFileShare(resourceGroupName, accountName, fileShareName)
 	if err != nil {
 		if strings.Contains(err.Error(), "ShareNotFound") {
 			return -1, nil
@@ -250,36 +848,66 @@ func GetFileShareInfo(id string) (string, string, string, string, error) {
 	return segments[0], segments[1], segments[2], diskName, nil
 }
 
-// check whether mountOptions contains file_mode, dir_mode, vers, if not, append default mode
-func appendDefaultMountOptions(mountOptions []string) []string {
-	var defaultMountOptions = map[string]string{
-		fileMode:   defaultFileMode,
-		dirMode:    defaultDirMode,
-		vers:       defaultVers,
-		actimeo:    defaultActimeo,
-		mfsymlinks: "",
+// getSubscriptionIDFromVolumeID returns the subscription the volume was
+// provisioned in, empty when the volume id does not carry one, i.e. the volume
+// lives in the configured default subscription
+func getSubscriptionIDFromVolumeID(id string) string {
+	segments := strings.Split(id, separator)
+	if len(segments) < 5 {
+		return ""
 	}
+	return segments[4]
+}
+
+// built-in per-protocol default mount options, an explicit option with the
+// same name from the request or the flags suppresses the default
+var (
+	builtinMountOptionsSMB = []string{
+		fileMode + "=" + defaultFileMode,
+		dirMode + "=" + defaultDirMode,
+		vers + "=" + defaultVers,
+		actimeo + "=" + defaultActimeo,
+		mfsymlinks,
+	}
+	builtinMountOptionsNFS = []string{"vers=4", "minorversion=1", "sec=sys"}
+)
 
-	// stores the mount options already included in mountOptions
+// defaultMountOptionsForProtocol returns the default mount options of the
+// protocol, operator overrides from the flags win over the built-in set. SMB
+// and NFS never share defaults, SMB-only options like dir_mode/file_mode must
+// not leak into NFS mounts and vice versa.
+func (d *Driver) defaultMountOptionsForProtocol(protocol string) []string {
+	if protocol == nfs {
+		if len(d.defaultMountOptionsNFS) > 0 {
+			return d.defaultMountOptionsNFS
+		}
+		return builtinMountOptionsNFS
+	}
+	if len(d.defaultMountOptionsSMB) > 0 {
+		return d.defaultMountOptionsSMB
+	}
+	return builtinMountOptionsSMB
+}
+
+// appendDefaultMountOptions appends every default whose option name is not
+// already present in mountOptions, an explicit option always wins over a default
+func appendDefaultMountOptions(mountOptions []string, defaults []string) []string {
+	// stores the defaults already covered by mountOptions
 	included := make(map[string]bool)
 
 	for _, mountOption := range mountOptions {
-		for k := range defaultMountOptions {
-			if strings.HasPrefix(mountOption, k) {
-				included[k] = true
+		for _, defaultOption := range defaults {
+			if strings.HasPrefix(mountOption, strings.SplitN(defaultOption, "=", 2)[0]) {
+				included[defaultOption] = true
 			}
 		}
 	}
 
 	allMountOptions := mountOptions
 
-	for k, v := range defaultMountOptions {
-		if _, isIncluded := included[k]; !isIncluded {
-			if v != "" {
-				allMountOptions = append(allMountOptions, fmt.Sprintf("%s=%s", k, v))
-			} else {
-				allMountOptions = append(allMountOptions, k)
-			}
+	for _, defaultOption := range defaults {
+		if !included[defaultOption] {
+			allMountOptions = append(allMountOptions, defaultOption)
 		}
 	}
 
@@ -298,18 +926,26 @@ func getStorageAccount(secrets map[string]string) (string, string, error) {
 	}
 
 	var accountName, accountKey string
+	var intreeAccountName, intreeAccountKey string
 	for k, v := range secrets {
 		switch strings.ToLower(k) {
 		case "accountname":
 			accountName = v
 		case "azurestorageaccountname": // for compatibility with built-in azurefile plugin
-			accountName = v
+			intreeAccountName = v
 		case "accountkey":
 			accountKey = v
 		case "azurestorageaccountkey": // for compatibility with built-in azurefile plugin
-			accountKey = v
+			intreeAccountKey = v
 		}
 	}
+	// the csi-style fields win when a secret carries both naming conventions
+	if accountName == "" {
+		accountName = intreeAccountName
+	}
+	if accountKey == "" {
+		accountKey = intreeAccountKey
+	}
 
 	if accountName == "" {
 		return "", "", fmt.Errorf("could not find accountname or azurestorageaccountname field secrets(%v)", secrets)
@@ -323,22 +959,59 @@ func getStorageAccount(secrets map[string]string) (string, string, error) {
 	return accountName, accountKey, nil
 }
 
+// getStorageAccountKey returns only the account key field from secrets, used for
+// node-stage secrets that carry the key while the account name comes from the
+// volume context or the volume ID
+func getStorageAccountKey(secrets map[string]string) (string, error) {
+	var intreeAccountKey string
+	for k, v := range secrets {
+		switch strings.ToLower(k) {
+		case "accountkey":
+			if v != "" {
+				return v, nil
+			}
+		case "azurestorageaccountkey":
+			intreeAccountKey = v
+		}
+	}
+	if intreeAccountKey != "" {
+		return intreeAccountKey, nil
+	}
+	return "", fmt.Errorf("could not find accountkey or azurestorageaccountkey field in secrets(%v)", secrets)
+}
+
 // File share names can contain only lowercase letters, numbers, and hyphens,
 // and must begin and end with a letter or a number,
 // and must be from 3 through 63 characters long.
 // The name cannot contain two consecutive hyphens.
 //
 // See https://docs.microsoft.com/en-us/rest/api/storageservices/naming-and-referencing-shares--directories--files--and-metadata#share-names
-func getValidFileShareName(volumeName string) string {
-	fileShareName := strings.ToLower(volumeName)
-	if len(fileShareName) > fileShareNameMaxLength {
-		fileShareName = fileShareName[0:fileShareNameMaxLength]
+// getValidFileShareName builds a valid share name from the volume name: invalid
+// characters are stripped and names longer than maxLength are truncated with a
+// deterministic hash suffix so long names that differ only past the truncation
+// point still map to distinct shares. A maxLength outside the supported range
+// falls back to fileShareNameMaxLength.
+func getValidFileShareName(volumeName string, maxLength int) string {
+	if maxLength < minShareNameMaxLength || maxLength > fileShareNameMaxLength {
+		maxLength = fileShareNameMaxLength
 	}
-	if !checkShareNameBeginAndEnd(fileShareName) || len(fileShareName) < fileShareNameMinLength {
-		fileShareName = util.GenerateVolumeName("pvc-file", uuid.NewUUID().String(), fileShareNameMaxLength)
+	fileShareName := strings.Map(func(r rune) rune {
+		if ('a' <= r && r <= 'z') || ('0' <= r && r <= '9') || r == '-' {
+			return r
+		}
+		return -1
+	}, strings.ToLower(volumeName))
+	fileShareName = strings.Replace(fileShareName, "--", "-", -1)
+	if len(fileShareName) > maxLength {
+		hash := fnv.New32a()
+		hash.Write([]byte(fileShareName))
+		suffix := fmt.Sprintf("%08x", hash.Sum32())
+		fileShareName = strings.TrimRight(fileShareName[0:maxLength-shareNameHashLength-1], "-") + "-" + suffix
+	}
+	if len(fileShareName) < fileShareNameMinLength || !checkShareNameBeginAndEnd(fileShareName) {
+		fileShareName = util.GenerateVolumeName("pvc-file", uuid.NewUUID().String(), maxLength)
 		klog.Warningf("the requested volume name (%q) is invalid, so it is regenerated as (%q)", volumeName, fileShareName)
 	}
-	fileShareName = strings.Replace(fileShareName, "--", "-", -1)
 
 	return fileShareName
 }
@@ -418,6 +1091,60 @@ func createDisk(ctx context.Context, accountName, accountKey, storageEndpointSuf
 	return nil
 }
 
+// createLocalDisk creates the blank fixed vhd backing a disk mode volume
+// directly through an already mounted share, the file layout matches what
+// createDisk uploads via the REST API
+func createLocalDisk(diskPath string, diskSizeBytes int64) error {
+	vhdHeader := vhd.CreateFixedHeader(uint64(diskSizeBytes), &vhd.VHDOptions{})
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, vhdHeader); nil != err {
+		return fmt.Errorf("failed to write VHDHeader(%+v): %v", vhdHeader, err)
+	}
+	headerBytes := buf.Bytes()
+
+	f, err := os.OpenFile(diskPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(diskSizeBytes); err != nil {
+		return err
+	}
+	// the footer of a fixed vhd occupies the last 512 bytes of the file
+	if _, err := f.WriteAt(headerBytes[:vhd.VHD_HEADER_SIZE], diskSizeBytes-int64(vhd.VHD_HEADER_SIZE)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// resizeDisk grows the vhd file backing a disk mode volume to diskSizeBytes
+// and rewrites the fixed vhd header at the new end of the file
+func resizeDisk(ctx context.Context, accountName, accountKey, storageEndpointSuffix, fileShareName, diskName string, diskSizeBytes int64) error {
+	vhdHeader := vhd.CreateFixedHeader(uint64(diskSizeBytes), &vhd.VHDOptions{})
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, vhdHeader); nil != err {
+		return fmt.Errorf("failed to write VHDHeader(%+v): %v", vhdHeader, err)
+	}
+	headerBytes := buf.Bytes()
+	start := diskSizeBytes - int64(len(headerBytes))
+	end := diskSizeBytes - 1
+
+	fileURL, err := getFileURL(accountName, accountKey, storageEndpointSuffix, fileShareName, diskName)
+	if err != nil {
+		return err
+	}
+	if fileURL == nil {
+		return fmt.Errorf("getFileURL(%s,%s,%s,%s) return empty fileURL", accountName, storageEndpointSuffix, fileShareName, diskName)
+	}
+	if _, err = fileURL.Resize(ctx, diskSizeBytes); err != nil {
+		return err
+	}
+	if _, err = fileURL.UploadRange(ctx, end-start, bytes.NewReader(headerBytes[:vhd.VHD_HEADER_SIZE]), nil); err != nil {
+		return err
+	}
+	return nil
+}
+
 func IsCorruptedDir(dir string) bool {
 	_, pathErr := mount.PathExists(dir)
 	return pathErr != nil && mount.IsCorruptedMnt(pathErr)
@@ -452,6 +1179,11 @@ func (d *Driver) GetAccountInfo(volumeID string, secrets, reqContext map[string]
 	if rgName == "" {
 		rgName = d.cloud.ResourceGroup
 	}
+	if canonical, normErr := normalizeProtocol(protocol); normErr == nil {
+		// invalid values are rejected by the RPC handlers, here the canonical
+		// value only decides whether an account key is needed
+		protocol = canonical
+	}
 	if protocol == nfs && fileShareName != "" {
 		// nfs protocol does not need account key, return directly
 		return rgName, accountName, accountKey, fileShareName, diskName, err
@@ -471,6 +1203,11 @@ func (d *Driver) GetAccountInfo(volumeID string, secrets, reqContext map[string]
 		account, accountKey, err = getStorageAccount(secrets)
 		if account != "" {
 			accountName = account
+		} else if accountName != "" {
+			// node-stage secrets created from dedicated StorageClass secret fields
+			// may carry only the account key, the account name then comes from the
+			// volume context or the volume ID
+			accountKey, err = getStorageAccountKey(secrets)
 		}
 	}
 	return rgName, accountName, accountKey, fileShareName, diskName, err
@@ -488,6 +1225,89 @@ func isSupportedProtocol(protocol string) bool {
 	return false
 }
 
+// protocolAliases maps common spellings of the protocol parameter to the
+// canonical protocol values
+var protocolAliases = map[string]string{
+	smb:       smb,
+	cifs:      smb,
+	nfs:       nfs,
+	"nfs4":    nfs,
+	"nfsv4":   nfs,
+	"nfsv4.1": nfs,
+}
+
+// normalizeProtocol maps the protocol parameter to its canonical value,
+// tolerating common aliases like cifs or nfsv4, truly unknown values are
+// rejected
+func normalizeProtocol(protocol string) (string, error) {
+	if protocol == "" {
+		return "", nil
+	}
+	if canonical, ok := protocolAliases[strings.ToLower(protocol)]; ok {
+		return canonical, nil
+	}
+	return "", fmt.Errorf("protocol(%s) is not supported, supported protocol list: %v", protocol, supportedProtocolList)
+}
+
+// loadMountProfiles reads named mount option profiles from a yaml file mapping
+// profile names to mount option lists
+func loadMountProfiles(path string) (map[string][]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read mount option profiles file: %v", err)
+	}
+	profiles := make(map[string][]string)
+	if err := yaml.Unmarshal(content, &profiles); err != nil {
+		return nil, fmt.Errorf("could not parse mount option profiles file: %v", err)
+	}
+	return profiles, nil
+}
+
+// parseSKUList parses a comma separated SKU list into a slice, skipping empty entries
+// parseMountOptionList splits a comma separated mount option list, dropping
+// empty entries
+func parseMountOptionList(mountOptions string) []string {
+	var result []string
+	for _, option := range strings.Split(mountOptions, ",") {
+		if option = strings.TrimSpace(option); option != "" {
+			result = append(result, option)
+		}
+	}
+	return result
+}
+
+func parseSKUList(skus string) []string {
+	var result []string
+	for _, sku := range strings.Split(skus, ",") {
+		if sku = strings.TrimSpace(sku); sku != "" {
+			result = append(result, sku)
+		}
+	}
+	return result
+}
+
+// isAllowedSKU checks the given sku name against the configured allow/deny lists,
+// empty sku(cluster default) is always allowed
+func (d *Driver) isAllowedSKU(sku string) bool {
+	if sku == "" {
+		return true
+	}
+	for _, v := range d.deniedSKUs {
+		if strings.EqualFold(sku, v) {
+			return false
+		}
+	}
+	if len(d.allowedSKUs) == 0 {
+		return true
+	}
+	for _, v := range d.allowedSKUs {
+		if strings.EqualFold(sku, v) {
+			return true
+		}
+	}
+	return false
+}
+
 // CreateFileShare creates a file share
 func (d *Driver) CreateFileShare(accountOptions *azure.AccountOptions, shareOptions *fileclient.ShareOptions, secrets map[string]string) error {
 	if len(secrets) > 0 {
@@ -512,6 +1332,79 @@ func (d *Driver) DeleteFileShare(resourceGroup, accountName, shareName string, s
 	return d.cloud.DeleteFileShare(resourceGroup, accountName, shareName)
 }
 
+// composeUserAgent returns the User-Agent the management clients send with
+// every request, e.g. "file.csi.azure.com/v1.0.0 aks-cluster-prod", so Azure
+// support cases can be correlated to a driver deployment
+func composeUserAgent(driverName, suffix string) string {
+	userAgent := fmt.Sprintf("%s/%s", driverName, driverVersion)
+	if suffix != "" {
+		userAgent = userAgent + " " + suffix
+	}
+	return userAgent
+}
+
+// applyUserAgent rebuilds the management clients the driver uses so their
+// requests carry the composed User-Agent, the cloud provider initializes them
+// without one and does not expose a way to set it afterwards
+func (d *Driver) applyUserAgent() {
+	servicePrincipalToken, err := auth.GetServicePrincipalToken(&d.cloud.AzureAuthConfig, &d.cloud.Environment)
+	if err != nil {
+		klog.Warningf("could not rebuild the management clients with user agent(%s): %v", d.userAgent, err)
+		return
+	}
+	config := &azclients.ClientConfig{
+		CloudName:               d.cloud.Config.Cloud,
+		Location:                d.cloud.Config.Location,
+		SubscriptionID:          d.cloud.SubscriptionID,
+		ResourceManagerEndpoint: d.cloud.Environment.ResourceManagerEndpoint,
+		Authorizer:              autorest.NewBearerAuthorizer(servicePrincipalToken),
+		// rate limiting disabled, a nil config would crash the client constructors
+		RateLimitConfig: &azclients.RateLimitConfig{},
+		Backoff:         &retry.Backoff{Steps: 1},
+		UserAgent:       d.userAgent,
+	}
+	if d.cloud.Config.CloudProviderBackoff {
+		config.Backoff = &retry.Backoff{
+			Steps:    d.cloud.Config.CloudProviderBackoffRetries,
+			Factor:   d.cloud.Config.CloudProviderBackoffExponent,
+			Duration: time.Duration(d.cloud.Config.CloudProviderBackoffDuration) * time.Second,
+			Jitter:   d.cloud.Config.CloudProviderBackoffJitter,
+		}
+	}
+	d.cloud.StorageAccountClient = storageaccountclient.New(config)
+	d.cloud.FileClient = fileclient.New(config)
+	d.cloud.SubnetsClient = subnetclient.New(config)
+	klog.V(2).Infof("management clients rebuilt with user agent(%s)", d.userAgent)
+}
+
+// getFileClientForSubscription returns the file share client bound to the
+// given subscription, the cloud default client is reused when subsID is empty
+// or matches the configured subscription
+func (d *Driver) getFileClientForSubscription(subsID string) (fileclient.Interface, error) {
+	if subsID == "" || strings.EqualFold(subsID, d.cloud.SubscriptionID) {
+		return d.cloud.FileClient, nil
+	}
+	subsID = strings.ToLower(subsID)
+	d.fileClientsLock.Lock()
+	defer d.fileClientsLock.Unlock()
+	if client, ok := d.fileClients[subsID]; ok {
+		return client, nil
+	}
+	servicePrincipalToken, err := auth.GetServicePrincipalToken(&d.cloud.AzureAuthConfig, &d.cloud.Environment)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build credentials for subscription(%s): %v", subsID, err)
+	}
+	client := fileclient.New(&azclients.ClientConfig{
+		SubscriptionID:          subsID,
+		ResourceManagerEndpoint: d.cloud.Environment.ResourceManagerEndpoint,
+		Authorizer:              autorest.NewBearerAuthorizer(servicePrincipalToken),
+		Backoff:                 &retry.Backoff{Steps: 1},
+		UserAgent:               d.userAgent,
+	})
+	d.fileClients[subsID] = client
+	return client, nil
+}
+
 // ResizeFileShare resizes a file share
 func (d *Driver) ResizeFileShare(resourceGroup, accountName, shareName string, sizeGiB int, secrets map[string]string) error {
 	if len(secrets) > 0 {
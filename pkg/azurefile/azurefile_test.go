@@ -25,7 +25,9 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2019-06-01/storage"
@@ -38,6 +40,7 @@ import (
 	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/fileclient/mockfileclient"
 	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/storageaccountclient/mockstorageaccountclient"
 	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
 )
 
 const (
@@ -50,14 +53,14 @@ var (
 )
 
 func NewFakeDriver() *Driver {
-	driver := NewDriver(fakeNodeID)
+	driver := NewDriver(&DriverOptions{NodeID: fakeNodeID})
 	driver.Name = fakeDriverName
 	driver.Version = vendorVersion
 	return driver
 }
 
 func TestNewFakeDriver(t *testing.T) {
-	d := NewDriver(fakeNodeID)
+	d := NewDriver(&DriverOptions{NodeID: fakeNodeID})
 	assert.NotNil(t, d)
 }
 
@@ -135,7 +138,7 @@ func TestAppendDefaultMountOptions(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		result := appendDefaultMountOptions(test.options)
+		result := appendDefaultMountOptions(test.options, builtinMountOptionsSMB)
 		sort.Strings(result)
 		sort.Strings(test.expected)
 
@@ -145,6 +148,42 @@ func TestAppendDefaultMountOptions(t *testing.T) {
 	}
 }
 
+func TestDefaultMountOptionsForProtocol(t *testing.T) {
+	d := NewFakeDriver()
+
+	// without operator overrides each protocol gets its built-in set
+	smbDefaults := d.defaultMountOptionsForProtocol(smb)
+	if !reflect.DeepEqual(smbDefaults, builtinMountOptionsSMB) {
+		t.Errorf("smb defaults: %q, expected: %q", smbDefaults, builtinMountOptionsSMB)
+	}
+	nfsDefaults := d.defaultMountOptionsForProtocol(nfs)
+	if !reflect.DeepEqual(nfsDefaults, builtinMountOptionsNFS) {
+		t.Errorf("nfs defaults: %q, expected: %q", nfsDefaults, builtinMountOptionsNFS)
+	}
+
+	// the SMB-only options must not leak into the NFS set and vice versa
+	for _, option := range nfsDefaults {
+		for _, prefix := range []string{fileMode, dirMode, actimeo, mfsymlinks} {
+			if strings.HasPrefix(option, prefix) {
+				t.Errorf("nfs defaults %q contain SMB option %q", nfsDefaults, option)
+			}
+		}
+	}
+	for _, option := range smbDefaults {
+		if strings.HasPrefix(option, "sec=") || strings.HasPrefix(option, "minorversion=") {
+			t.Errorf("smb defaults %q contain NFS option %q", smbDefaults, option)
+		}
+	}
+
+	// an operator override replaces only the set it is configured for
+	d.defaultMountOptionsNFS = parseMountOptionList("vers=4.1, sec=sys")
+	assert.Equal(t, []string{"vers=4.1", "sec=sys"}, d.defaultMountOptionsForProtocol(nfs))
+	assert.Equal(t, builtinMountOptionsSMB, d.defaultMountOptionsForProtocol(smb))
+
+	d.defaultMountOptionsSMB = parseMountOptionList("dir_mode=0755,file_mode=0755")
+	assert.Equal(t, []string{"dir_mode=0755", "file_mode=0755"}, d.defaultMountOptionsForProtocol(smb))
+}
+
 func TestGetFileShareInfo(t *testing.T) {
 	tests := []struct {
 		id                string
@@ -261,6 +300,28 @@ func TestGetStorageAccount(t *testing.T) {
 			expected2: "testkey",
 			expected3: nil,
 		},
+		{
+			options: map[string]string{
+				"accountname":             "csiaccount",
+				"accountkey":              "csikey",
+				"azurestorageaccountname": "intreeaccount",
+				"azurestorageaccountkey":  "intreekey",
+			},
+			expected1: "csiaccount",
+			expected2: "csikey",
+			expected3: nil,
+		},
+		{
+			options: map[string]string{
+				"accountname":             "",
+				"accountkey":              "",
+				"azurestorageaccountname": "intreeaccount",
+				"azurestorageaccountkey":  "intreekey",
+			},
+			expected1: "intreeaccount",
+			expected2: "intreekey",
+			expected3: nil,
+		},
 		{
 			options: map[string]string{
 				"accountname": "",
@@ -315,6 +376,49 @@ func TestGetStorageAccount(t *testing.T) {
 	}
 }
 
+func TestGetStorageAccountKey(t *testing.T) {
+	tests := []struct {
+		secrets     map[string]string
+		expectedKey string
+		expectErr   bool
+	}{
+		{
+			secrets:     map[string]string{"accountkey": "testkey"},
+			expectedKey: "testkey",
+		},
+		{
+			secrets:     map[string]string{"azurestorageaccountkey": "testkey"},
+			expectedKey: "testkey",
+		},
+		{
+			secrets:     map[string]string{"accountkey": "csikey", "azurestorageaccountkey": "intreekey"},
+			expectedKey: "csikey",
+		},
+		{
+			secrets:   map[string]string{"azurestorageaccountkey": ""},
+			expectErr: true,
+		},
+		{
+			secrets:   map[string]string{"unrelated": "value"},
+			expectErr: true,
+		},
+		{
+			secrets:   nil,
+			expectErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		key, err := getStorageAccountKey(test.secrets)
+		if test.expectErr {
+			assert.Error(t, err, fmt.Sprintf("secrets: %v", test.secrets))
+		} else {
+			assert.NoError(t, err, fmt.Sprintf("secrets: %v", test.secrets))
+			assert.Equal(t, test.expectedKey, key)
+		}
+	}
+}
+
 func TestGetValidFileShareName(t *testing.T) {
 	tests := []struct {
 		volumeName string
@@ -336,10 +440,6 @@ func TestGetValidFileShareName(t *testing.T) {
 			volumeName: "A2Z",
 			expected:   "a2z",
 		},
-		{
-			volumeName: "1234567891234567891234567891234567891234567891234567891234567891",
-			expected:   "123456789123456789123456789123456789123456789123456789123456789",
-		},
 		{
 			volumeName: "aq",
 			expected:   "pvc-file-dynamic",
@@ -347,7 +447,7 @@ func TestGetValidFileShareName(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		result := getValidFileShareName(test.volumeName)
+		result := getValidFileShareName(test.volumeName, fileShareNameMaxLength)
 		if test.volumeName == "aq" {
 			assert.Contains(t, result, test.expected)
 		} else if !reflect.DeepEqual(result, test.expected) {
@@ -356,6 +456,30 @@ func TestGetValidFileShareName(t *testing.T) {
 	}
 }
 
+func TestGetValidFileShareNameTruncation(t *testing.T) {
+	longName := strings.Repeat("a", 80) + "1"
+	longName2 := strings.Repeat("a", 80) + "2"
+
+	// a long name is truncated to the maximum length with a hash suffix and
+	// the truncation is deterministic
+	result := getValidFileShareName(longName, fileShareNameMaxLength)
+	assert.Equal(t, fileShareNameMaxLength, len(result))
+	assert.True(t, strings.HasPrefix(result, strings.Repeat("a", fileShareNameMaxLength-shareNameHashLength-1)))
+	assert.Equal(t, result, getValidFileShareName(longName, fileShareNameMaxLength))
+
+	// two long names differing only past the truncation point map to distinct shares
+	result2 := getValidFileShareName(longName2, fileShareNameMaxLength)
+	assert.Equal(t, fileShareNameMaxLength, len(result2))
+	assert.NotEqual(t, result, result2)
+
+	// a custom maximum length is honored
+	shortResult := getValidFileShareName(longName, 20)
+	assert.Equal(t, 20, len(shortResult))
+
+	// invalid characters are stripped before truncation
+	assert.Equal(t, "a2z", getValidFileShareName("a_2.z", fileShareNameMaxLength))
+}
+
 func TestCheckShareNameBeginAndEnd(t *testing.T) {
 	tests := []struct {
 		fileShareName string
@@ -485,12 +609,45 @@ func TestNewDriver(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		result := NewDriver(test.nodeID)
+		result := NewDriver(&DriverOptions{NodeID: test.nodeID})
 		assert.NotNil(t, result)
 		assert.Equal(t, result.NodeID, test.nodeID)
 	}
 }
 
+func TestComposeUserAgent(t *testing.T) {
+	tests := []struct {
+		desc       string
+		driverName string
+		suffix     string
+		expected   string
+	}{
+		{
+			desc:       "no suffix configured",
+			driverName: DriverName,
+			suffix:     "",
+			expected:   fmt.Sprintf("%s/%s", DriverName, driverVersion),
+		},
+		{
+			desc:       "operator-supplied suffix is appended",
+			driverName: DriverName,
+			suffix:     "aks-cluster-prod",
+			expected:   fmt.Sprintf("%s/%s aks-cluster-prod", DriverName, driverVersion),
+		},
+	}
+
+	for _, test := range tests {
+		if userAgent := composeUserAgent(test.driverName, test.suffix); userAgent != test.expected {
+			t.Errorf("test(%s): got user agent(%s), expected(%s)", test.desc, userAgent, test.expected)
+		}
+	}
+
+	// the composed User-Agent ends up on the driver so every client it builds
+	// carries it
+	d := NewDriver(&DriverOptions{NodeID: fakeNodeID, UserAgentSuffix: "aks-cluster-prod"})
+	assert.Equal(t, fmt.Sprintf("%s/%s aks-cluster-prod", DriverName, driverVersion), d.userAgent)
+}
+
 func TestGetFileURL(t *testing.T) {
 	tests := []struct {
 		accountName           string
@@ -624,6 +781,38 @@ func TestGetAccountInfo(t *testing.T) {
 			expectFileShareName: "test_sharename",
 			expectDiskName:      "test_diskname",
 		},
+		{
+			// node-stage secret carrying only the account key, the account name
+			// comes from the volume context
+			volumeID: "vol_ns##",
+			rgName:   "vol_ns",
+			secrets: map[string]string{
+				"azurestorageaccountkey": "testkey",
+			},
+			reqContext: map[string]string{
+				storageAccountField: "test_accountname",
+				shareNameField:      "test_sharename",
+			},
+			expectErr:           false,
+			err:                 nil,
+			expectAccountName:   "test_accountname",
+			expectFileShareName: "test_sharename",
+			expectDiskName:      "",
+		},
+		{
+			// node-stage secret without any of the expected account key fields
+			volumeID: "vol_ns##",
+			rgName:   "vol_ns",
+			secrets: map[string]string{
+				"unrelated": "value",
+			},
+			reqContext: map[string]string{
+				storageAccountField: "test_accountname",
+				shareNameField:      "test_sharename",
+			},
+			expectErr: true,
+			err:       fmt.Errorf("could not find accountkey or azurestorageaccountkey field in secrets(map[unrelated:value])"),
+		},
 		{
 			volumeID: "uniqe-volumeid-nfs",
 			rgName:   "vol_nfs",
@@ -747,7 +936,7 @@ func TestGetFileShareQuota(t *testing.T) {
 		mockFileClient := mockfileclient.NewMockInterface(ctrl)
 		d.cloud.FileClient = mockFileClient
 		mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(test.mockedFileShareResp, test.mockedFileShareErr).AnyTimes()
-		quota, err := d.getFileShareQuota(resourceGroupName, accountName, fileShareName, map[string]string{})
+		quota, err := d.getFileShareQuota("", resourceGroupName, accountName, fileShareName, map[string]string{})
 		if !reflect.DeepEqual(err, test.expectedError) {
 			t.Errorf("test name: %s, Unexpected error: %v, expected error: %v", test.desc, err, test.expectedError)
 		}
@@ -876,3 +1065,190 @@ func TestIsSupportedProtocol(t *testing.T) {
 		}
 	}
 }
+
+func TestNormalizeProtocol(t *testing.T) {
+	tests := []struct {
+		protocol    string
+		expected    string
+		expectError bool
+	}{
+		{
+			protocol: "",
+			expected: "",
+		},
+		{
+			protocol: "smb",
+			expected: smb,
+		},
+		{
+			protocol: "cifs",
+			expected: smb,
+		},
+		{
+			protocol: "CIFS",
+			expected: smb,
+		},
+		{
+			protocol: "nfs",
+			expected: nfs,
+		},
+		{
+			protocol: "nfs4",
+			expected: nfs,
+		},
+		{
+			protocol: "nfsv4",
+			expected: nfs,
+		},
+		{
+			protocol: "NFSv4.1",
+			expected: nfs,
+		},
+		{
+			protocol:    "glusterfs",
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		result, err := normalizeProtocol(test.protocol)
+		if test.expectError != (err != nil) {
+			t.Errorf("normalizeProtocol(%s) returned with error(%v), expectError(%v)", test.protocol, err, test.expectError)
+		}
+		if result != test.expected {
+			t.Errorf("normalizeProtocol(%s) returned with %v, not equal to %v", test.protocol, result, test.expected)
+		}
+	}
+}
+
+func TestPreflightPermissionCheck(t *testing.T) {
+	accountName := "stoacc"
+	accounts := []storage.Account{
+		{Name: &accountName},
+	}
+	forbidden := &retry.Error{HTTPStatusCode: 403, RawError: fmt.Errorf("AuthorizationFailed")}
+
+	tests := []struct {
+		desc            string
+		listAccountsErr *retry.Error
+		listKeysErr     *retry.Error
+		expectedErrMsg  string
+	}{
+		{
+			desc: "all permissions granted",
+		},
+		{
+			desc:            "account list permission missing",
+			listAccountsErr: forbidden,
+			expectedErrMsg:  "driver identity cannot list storage accounts under resource group(rg)",
+		},
+		{
+			desc:           "key list permission missing",
+			listKeysErr:    forbidden,
+			expectedErrMsg: "driver identity cannot list keys of storage account(stoacc)",
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.cloud = &azure.Cloud{}
+		d.cloud.ResourceGroup = "rg"
+
+		ctrl := gomock.NewController(t)
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), "rg").Return(accounts, test.listAccountsErr).Times(1)
+		if test.listAccountsErr == nil {
+			mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), "rg", accountName).Return(storage.AccountListKeysResult{}, test.listKeysErr).Times(1)
+		}
+
+		err := d.preflightPermissionCheck(context.Background())
+		if test.expectedErrMsg == "" {
+			assert.NoError(t, err, test.desc)
+		} else if assert.Error(t, err, test.desc) {
+			assert.Contains(t, err.Error(), test.expectedErrMsg, test.desc)
+		}
+		ctrl.Finish()
+	}
+}
+
+func TestCheckWritablePaths(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+
+	// both configured roots are writable
+	d := NewFakeDriver()
+	d.credentialsDir = filepath.Join(t.TempDir(), "credentials")
+	d.proxyMountBase = filepath.Join(t.TempDir(), "proxy-mounts")
+	assert.NoError(t, d.checkWritablePaths())
+
+	// a root below a plain file cannot be created, e.g. because the node's
+	// root filesystem is read-only
+	blocker := filepath.Join(t.TempDir(), "blocker")
+	assert.NoError(t, os.WriteFile(blocker, nil, 0600))
+	d.credentialsDir = filepath.Join(blocker, "credentials")
+	err := d.checkWritablePaths()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "is not writable, point it at a writable tmpfs path")
+	}
+}
+
+func TestIsAllowedSKU(t *testing.T) {
+	tests := []struct {
+		desc           string
+		allowedSKUs    string
+		deniedSKUs     string
+		sku            string
+		expectedResult bool
+	}{
+		{
+			desc:           "empty sku is always allowed",
+			deniedSKUs:     "Premium_LRS",
+			sku:            "",
+			expectedResult: true,
+		},
+		{
+			desc:           "no allow/deny list configured",
+			sku:            "Premium_LRS",
+			expectedResult: true,
+		},
+		{
+			desc:           "sku in allowed list",
+			allowedSKUs:    "Standard_LRS,Standard_GRS",
+			sku:            "Standard_LRS",
+			expectedResult: true,
+		},
+		{
+			desc:           "sku not in allowed list",
+			allowedSKUs:    "Standard_LRS",
+			sku:            "Premium_LRS",
+			expectedResult: false,
+		},
+		{
+			desc:           "sku in denied list",
+			deniedSKUs:     "Premium_LRS",
+			sku:            "premium_lrs",
+			expectedResult: false,
+		},
+		{
+			desc:           "denied list takes precedence over allowed list",
+			allowedSKUs:    "Premium_LRS",
+			deniedSKUs:     "Premium_LRS",
+			sku:            "Premium_LRS",
+			expectedResult: false,
+		},
+	}
+
+	for _, test := range tests {
+		d := NewDriver(&DriverOptions{
+			NodeID:                    fakeNodeID,
+			AllowedStorageAccountSKUs: test.allowedSKUs,
+			DeniedStorageAccountSKUs:  test.deniedSKUs,
+		})
+		result := d.isAllowedSKU(test.sku)
+		if result != test.expectedResult {
+			t.Errorf("test[%s]: isAllowedSKU(%s) returned with %v, not equal to %v", test.desc, test.sku, result, test.expectedResult)
+		}
+	}
+}
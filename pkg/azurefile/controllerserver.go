@@ -20,7 +20,10 @@ import (
 	"context"
 	"fmt"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	volumehelper "sigs.k8s.io/azurefile-csi-driver/pkg/util"
 
@@ -28,6 +31,7 @@ import (
 	"github.com/Azure/azure-storage-file-go/azfile"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	"github.com/pborman/uuid"
 
 	"google.golang.org/grpc/codes"
@@ -79,12 +83,26 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	if err := isValidVolumeCapabilities(volumeCapabilities); err != nil {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("CreateVolume Volume capabilities not valid: %v", err))
 	}
+	// cloning/restoring a volume from a content source is not implemented,
+	// reject such requests instead of silently provisioning an empty volume
+	if req.GetVolumeContentSource() != nil {
+		return nil, status.Error(codes.InvalidArgument, "CreateVolume from a volume content source is not supported yet")
+	}
 
 	capacityBytes := req.GetCapacityRange().GetRequiredBytes()
 	requestGiB := volumehelper.RoundUpGiB(capacityBytes)
 	if requestGiB == 0 {
 		requestGiB = defaultAzureFileQuota
-		klog.Warningf("no quota specified, set as default value(%d GiB)", defaultAzureFileQuota)
+		if d.enableAccessModeDefaults && d.singleNodeDefaultQuotaGiB > 0 && isSingleNodeAccessMode(volumeCapabilities) {
+			// single-node volumes are typically smaller, honor the policy default
+			requestGiB = int64(d.singleNodeDefaultQuotaGiB)
+		}
+		klog.Warningf("no quota specified, set as default value(%d GiB)", requestGiB)
+	}
+
+	requestGiB, err := clampToCapacityLimit(requestGiB, req.GetCapacityRange())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume capacity range not valid: %v", err)
 	}
 
 	parameters := req.GetParameters()
@@ -92,6 +110,7 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		parameters = make(map[string]string)
 	}
 	var sku, resourceGroup, location, account, fileShareName, diskName, fsType, storeAccountKey, secretNamespace, protocol, customTags string
+	var accessPolicyPerms, accessPolicyExpiry, edgeZone, quotaMarginPercent, shareTier, subsID string
 
 	// Apply ProvisionerParameters (case-insensitive). We leave validation of
 	// the values to the cloud provider.
@@ -103,6 +122,8 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 			sku = v
 		case locationField:
 			location = v
+		case edgeZoneField:
+			edgeZone = v
 		case storageAccountField:
 			account = v
 		case resourceGroupField:
@@ -121,22 +142,73 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 			protocol = v
 		case tagsField:
 			customTags = v
+		case quotaMarginPercentField:
+			quotaMarginPercent = v
+		case accessPolicyPermsField:
+			accessPolicyPerms = v
+		case accessPolicyExpiryField:
+			accessPolicyExpiry = v
+		case shareTierField:
+			shareTier = v
+		case subsIDField:
+			subsID = v
 		default:
 			//don't return error here since there are some parameters(e.g. fsType) used in later process
 			//return nil, fmt.Errorf("invalid option %q", k)
 		}
 	}
 
+	if d.enableAccessModeDefaults && fsType == "" && protocol != nfs && isSingleNodeAccessMode(volumeCapabilities) {
+		// per the access mode policy single-node volumes default to disk mode,
+		// multi-node volumes keep the plain share mount
+		fsType = d.defaultDiskFsType
+		if fsType == "" {
+			fsType = ext4
+		}
+		parameters[fsTypeField] = fsType
+		klog.V(2).Infof("volume(%s) only requests single node access modes, defaulting fsType to %s", req.GetName(), fsType)
+	}
+
 	if !isSupportedFsType(fsType) {
 		return nil, status.Errorf(codes.InvalidArgument, "fsType(%s) is not supported, supported fsType list: %v", fsType, supportedFsTypeList)
 	}
 
-	if !isSupportedProtocol(protocol) {
-		return nil, status.Errorf(codes.InvalidArgument, "protocol(%s) is not supported, supported protocol list: %v", protocol, supportedProtocolList)
+	normalizedProtocol, protoErr := normalizeProtocol(protocol)
+	if protoErr != nil {
+		return nil, status.Error(codes.InvalidArgument, protoErr.Error())
+	}
+	if normalizedProtocol != protocol {
+		// reflect the canonical value in the volume context handed to the node
+		parameters[protocolField] = normalizedProtocol
+	}
+	protocol = normalizedProtocol
+
+	if edgeZone != "" {
+		if err := validateEdgeZone(location, edgeZone); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s(%s): %v", edgeZoneField, edgeZone, err)
+		}
+	}
+
+	if quotaMarginPercent != "" {
+		margin, err := strconv.Atoi(quotaMarginPercent)
+		if err != nil || margin < 0 || margin > maxQuotaMarginPercent {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s(%s): must be an integer between 0 and %d", quotaMarginPercentField, quotaMarginPercent, maxQuotaMarginPercent)
+		}
+		if margin > 0 {
+			// provision headroom above the rounded up request size, rounding the
+			// margin up to the next GiB, and reflect it in the returned capacity
+			requestGiB = (requestGiB*int64(100+margin) + 99) / 100
+			if requestGiB, err = clampToCapacityLimit(requestGiB, req.GetCapacityRange()); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "CreateVolume capacity range not valid: %v", err)
+			}
+			capacityBytes = volumehelper.GiBToBytes(requestGiB)
+		}
 	}
 
 	enableHTTPSTrafficOnly := true
 	shareProtocol := storage.SMB
+	// remembered so a protocol fallback can restore the SMB key handling
+	smbStoreAccountKey := storeAccountKey
 	var vnetResourceIDs []string
 	if fsType == nfs || protocol == nfs {
 		protocol = nfs
@@ -160,6 +232,24 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		}
 	}
 
+	var accessPolicyExpiryDuration time.Duration
+	if accessPolicyPerms != "" || accessPolicyExpiry != "" {
+		if err := validateAccessPolicyPermissions(accessPolicyPerms); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s(%s): %v", accessPolicyPermsField, accessPolicyPerms, err)
+		}
+		var err error
+		if accessPolicyExpiryDuration, err = time.ParseDuration(accessPolicyExpiry); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s(%s): %v", accessPolicyExpiryField, accessPolicyExpiry, err)
+		}
+		if accessPolicyExpiryDuration <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "%s(%s) must be greater than zero", accessPolicyExpiryField, accessPolicyExpiry)
+		}
+	}
+
+	if !d.isAllowedSKU(sku) {
+		return nil, status.Errorf(codes.InvalidArgument, "sku(%s) is not allowed, allowed SKU list: %v, denied SKU list: %v", sku, d.allowedSKUs, d.deniedSKUs)
+	}
+
 	fileShareSize := int(requestGiB)
 	// account kind should be FileStorage for Premium File
 	accountKind := string(storage.StorageV2)
@@ -169,6 +259,11 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 			fileShareSize = minimumPremiumShareSize
 		}
 	}
+	if fileShareSize > maxShareSizeGiB {
+		// no account of any tier can satisfy this, fail before touching the
+		// storage API instead of surfacing an opaque share creation error
+		return nil, status.Errorf(codes.OutOfRange, "requested size(%dGiB) of volume(%s) exceeds the maximum size of a single file share(%dGiB)", fileShareSize, req.GetName(), maxShareSizeGiB)
+	}
 
 	validFileShareName := fileShareName
 	if validFileShareName == "" {
@@ -180,17 +275,54 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 			// use "pvcd" prefix for vhd disk file share
 			name = strings.Replace(name, "pvc", "pvcd", 1)
 		}
-		validFileShareName = getValidFileShareName(name)
+		validFileShareName = getValidFileShareName(name, d.shareNameMaxLength)
 	}
 
 	if resourceGroup == "" {
-		resourceGroup = d.cloud.ResourceGroup
+		resourceGroup = d.defaultResourceGroup(protocol)
+	}
+
+	crossSubscription := subsID != "" && !strings.EqualFold(subsID, d.cloud.SubscriptionID)
+	if crossSubscription {
+		if account == "" {
+			// storage accounts cannot be automatically selected or created in
+			// another subscription, the account inventory and
+			// EnsureStorageAccount only cover the configured one
+			return nil, status.Errorf(codes.InvalidArgument, "%s(%s) requires an explicit %s parameter", subsIDField, subsID, storageAccountField)
+		}
+		if len(req.GetSecrets()) == 0 && storeAccountKey != storeAccountKeyFalse {
+			// the account key cannot be fetched through the default subscription
+			// clients, mounts must use secrets provisioned out of band
+			klog.V(2).Infof("volume(%s) is provisioned in subscription(%s), skipping account key storage", req.GetName(), subsID)
+			storeAccountKey = storeAccountKeyFalse
+		}
+	}
+	fileClient, err := d.getFileClientForSubscription(subsID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get file share client for subscription(%s): %v", subsID, err)
+	}
+
+	// when reusing an account, make sure its kind supports the requested
+	// protocol and tier instead of letting share creation fail opaquely
+	if account != "" && len(req.GetSecrets()) == 0 && d.cloud.StorageAccountClient != nil &&
+		(protocol == nfs || strings.HasPrefix(strings.ToLower(sku), "premium")) {
+		if err := d.validateAccountKind(ctx, resourceGroup, account, protocol, sku); err != nil {
+			return nil, err
+		}
 	}
 
 	tags, err := azure.ConvertTagsToMap(customTags)
 	if err != nil {
 		return nil, err
 	}
+	if edgeZone != "" {
+		// the storage management API version in use cannot express an extended
+		// location directly, record the edge zone placement as an account tag
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[edgeZoneTagKey] = edgeZone
+	}
 
 	accountOptions := &azure.AccountOptions{
 		Name:                      account,
@@ -207,27 +339,149 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	accountName := account
 	if len(req.GetSecrets()) == 0 && accountName == "" {
 		lockKey := sku + accountKind + resourceGroup + location
-		d.volLockMap.LockEntry(lockKey)
+		lockEntryTimed(d.volLockMap, lockKey, "CreateVolume")
 		defer d.volLockMap.UnlockEntry(lockKey)
 
-		err = wait.ExponentialBackoff(d.cloud.RequestBackoff(), func() (bool, error) {
-			var retErr error
-			accountName, accountKey, retErr = d.cloud.EnsureStorageAccount(accountOptions, fileShareAccountNamePrefix)
-			if isRetriableError(retErr) {
-				klog.Warningf("EnsureStorageAccount(%s) failed with error(%v), waiting for retring", account, retErr)
-				return false, nil
+		if d.maxSharesPerAccount > 0 && d.cloud.StorageAccountClient != nil {
+			// pack the share into an existing matching account until the pool
+			// fills up, only then create a brand new account
+			pooledAccount, perr := d.pickPooledAccount(ctx, accountOptions)
+			if perr != nil {
+				return nil, status.Errorf(codes.Internal, "failed to select a pooled storage account: %v", perr)
+			}
+			if pooledAccount == "" {
+				if err := d.accountCreateLimiter.acquire(d.cloud.SubscriptionID); err != nil {
+					return nil, status.Errorf(codes.Aborted, "account creation for file share(%s) rejected: %v", validFileShareName, err)
+				}
+				// EnsureStorageAccount cannot be used here, it would keep
+				// returning one of the full matching accounts
+				pooledAccount, err = d.createRolloverAccount(ctx, accountOptions)
+				d.accountCreateLimiter.release(d.cloud.SubscriptionID)
+				if err != nil {
+					return nil, status.Errorf(codes.Internal, "failed to create a new storage account for the pool: %v", err)
+				}
+				klog.V(2).Infof("every matching account holds %d file share(s) already, created storage account(%s) for file share(%s)", d.maxSharesPerAccount, pooledAccount, validFileShareName)
+			} else {
+				klog.V(2).Infof("packing file share(%s) into existing storage account(%s)", validFileShareName, pooledAccount)
+			}
+			accountName = pooledAccount
+		} else {
+			// EnsureStorageAccount may create a brand new account, keep the number
+			// of concurrent creations under the subscription-wide throttling limit
+			if err := d.accountCreateLimiter.acquire(d.cloud.SubscriptionID); err != nil {
+				return nil, status.Errorf(codes.Aborted, "account creation for file share(%s) rejected: %v", validFileShareName, err)
+			}
+			defer d.accountCreateLimiter.release(d.cloud.SubscriptionID)
+
+			err = wait.ExponentialBackoff(d.cloud.RequestBackoff(), func() (bool, error) {
+				var retErr error
+				accountName, accountKey, retErr = d.cloud.EnsureStorageAccount(accountOptions, fileShareAccountNamePrefix)
+				if isRetriableError(retErr) {
+					klog.Warningf("EnsureStorageAccount(%s) failed with error(%v), waiting for retring", account, retErr)
+					return false, nil
+				}
+				return true, retErr
+			})
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to ensure storage account: %v", err)
+			}
+
+			// a freshly created account may still be in a transitional provisioning
+			// state where share creation fails, wait until it settles
+			if d.cloud.StorageAccountClient != nil {
+				if err := d.waitForAccountReady(ctx, resourceGroup, accountName); err != nil {
+					return nil, status.Errorf(codes.Internal, "storage account(%s) is not ready: %v", accountName, err)
+				}
+				// the selected account may be reused while a DeleteVolume or an
+				// external process is deleting it, losing that race fails share
+				// creation confusingly, skip the account and create a fresh one
+				deleting, derr := d.accountBeingDeleted(ctx, resourceGroup, accountName)
+				if derr != nil {
+					klog.Warningf("could not read the provisioning state of storage account(%s): %v", accountName, derr)
+				} else if deleting {
+					klog.Warningf("storage account(%s) is being deleted, skipping it for file share(%s)", accountName, validFileShareName)
+					if accountName, err = d.createRolloverAccount(ctx, accountOptions); err != nil {
+						return nil, status.Errorf(codes.Internal, "failed to create a replacement storage account: %v", err)
+					}
+					accountKey = ""
+				}
 			}
-			return true, retErr
-		})
-		if err != nil {
-			return nil, status.Errorf(codes.Internal, "failed to ensure storage account: %v", err)
 		}
 	}
 
-	if quota, err := d.getFileShareQuota(resourceGroup, accountName, validFileShareName, req.GetSecrets()); err != nil {
+	if fileShareName != "" && len(req.GetSecrets()) == 0 && fileClient != nil {
+		// reusing an explicitly named share, make sure it was created with the
+		// requested protocol instead of returning a volume that cannot be mounted
+		if err := d.validateShareProtocol(fileClient, resourceGroup, accountName, validFileShareName, shareProtocol); err != nil {
+			return nil, err
+		}
+	}
+
+	// buildVolumeResponse assembles the CreateVolumeResponse from the current
+	// provisioning state, it is shared between the regular path and the
+	// idempotent fast path below
+	buildVolumeResponse := func() *csi.CreateVolumeResponse {
+		var accessibleTopology []*csi.Topology
+		if edgeZone != "" {
+			accessibleTopology = []*csi.Topology{
+				{
+					Segments: map[string]string{
+						d.topologyLocationKey(): location,
+						d.topologyEdgeZoneKey(): edgeZone,
+					},
+				},
+			}
+		}
+
+		volumeID := fmt.Sprintf(volumeIDTemplate, resourceGroup, accountName, validFileShareName, diskName)
+		if crossSubscription {
+			// record the subscription in the volume id so DeleteVolume and the node
+			// RPCs resolve the same subscription later
+			volumeID = volumeID + separator + strings.ToLower(subsID)
+		}
+
+		// record disk-mode explicitly so downstream logic does not have to re-infer
+		// it from fsType or diskName presence
+		if parameters == nil {
+			parameters = make(map[string]string)
+		}
+		parameters[diskModeField] = strconv.FormatBool(isDiskFsType(fsType))
+		// record the provisioned capacity so the node plugin can detect out-of-band
+		// quota changes at mount time
+		parameters[requestedSizeGiBField] = strconv.Itoa(fileShareSize)
+		if shareTier != "" {
+			// record the tier in a normalized form so the node plugin can report
+			// latency characteristics in NodeGetVolumeStats
+			parameters[shareTierField] = strings.ToLower(shareTier)
+		}
+
+		return &csi.CreateVolumeResponse{
+			Volume: &csi.Volume{
+				VolumeId:           volumeID,
+				CapacityBytes:      capacityBytes,
+				VolumeContext:      parameters,
+				AccessibleTopology: accessibleTopology,
+			},
+		}
+	}
+
+	quota, err := d.getFileShareQuota(subsID, resourceGroup, accountName, validFileShareName, req.GetSecrets())
+	if err != nil {
 		return nil, status.Errorf(codes.Internal, err.Error())
-	} else if quota != -1 && quota != fileShareSize {
-		return nil, status.Errorf(codes.AlreadyExists, "request file share(%s) already exists, but its capacity(%v) is different from (%v)", validFileShareName, quota, fileShareSize)
+	}
+	if quota != -1 {
+		if quota != fileShareSize {
+			return nil, status.Errorf(codes.AlreadyExists, "request file share(%s) already exists, but its capacity(%v) is different from (%v)", validFileShareName, quota, fileShareSize)
+		}
+		if fileShareName != "" && !isDiskFsType(fsType) && accessPolicyPerms == "" &&
+			(storeAccountKey == storeAccountKeyFalse || len(req.GetSecrets()) > 0) {
+			// the explicitly named share already exists with the requested
+			// capacity and no follow-up provisioning step is pending, treat this
+			// as a retried request and return the existing volume without
+			// re-running share creation
+			klog.V(2).Infof("file share(%s) on account(%s) already exists with the requested capacity(%d GiB), returning the existing volume", validFileShareName, accountName, fileShareSize)
+			return buildVolumeResponse(), nil
+		}
 	}
 	accountOptions.Name = accountName
 	shareOptions := &fileclient.ShareOptions{
@@ -238,17 +492,119 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 
 	klog.V(2).Infof("begin to create file share(%s) on account(%s) type(%s) rg(%s) location(%s) size(%d) protocol(%s)", validFileShareName, accountName, sku, resourceGroup, location, fileShareSize, shareProtocol)
 	err = wait.ExponentialBackoff(d.cloud.RequestBackoff(), func() (bool, error) {
-		err := d.CreateFileShare(accountOptions, shareOptions, req.GetSecrets())
+		var err error
+		if crossSubscription {
+			// the share lands in an existing account of another subscription,
+			// use the client bound to that subscription directly
+			err = fileClient.CreateFileShare(resourceGroup, accountName, shareOptions)
+		} else {
+			err = d.CreateFileShare(accountOptions, shareOptions, req.GetSecrets())
+		}
 		if isRetriableError(err) {
 			klog.Warningf("CreateFileShare(%s) on account(%s) failed with error(%v), waiting for retring", validFileShareName, account, err)
 			return false, nil
 		}
 		return true, err
 	})
+	d.auditLog.record(auditOpCreateVolume, "", accountName, validFileShareName, requesterMetadata(parameters), err)
+	if isAccountFullError(err) && d.accountRolloverAttempts > 0 &&
+		account == "" && len(req.GetSecrets()) == 0 && d.cloud.StorageAccountClient != nil {
+		// the automatically selected account is full, roll over to a brand new
+		// account, pacing the attempts so account creation does not get throttled
+		for attempt := 1; isAccountFullError(err); attempt++ {
+			if attempt > d.accountRolloverAttempts {
+				return nil, statusWithReason(codes.ResourceExhausted, reasonQuotaExceeded, "account(%s) is still full after %d rollover attempt(s) when creating file share(%s): %v", accountName, d.accountRolloverAttempts, validFileShareName, err)
+			}
+			klog.Warningf("account(%s) cannot fit file share(%s)(%v), rolling over to a new account in %v", accountName, validFileShareName, err, d.accountRolloverDelay)
+			select {
+			case <-ctx.Done():
+				return nil, status.Errorf(codes.Aborted, "CreateVolume for volume(%s) was cancelled while waiting to roll over: %v", req.GetName(), ctx.Err())
+			case <-time.After(d.accountRolloverDelay):
+			}
+			if acquireErr := d.accountCreateLimiter.acquire(d.cloud.SubscriptionID); acquireErr != nil {
+				return nil, status.Errorf(codes.Aborted, "rollover account creation for file share(%s) rejected: %v", validFileShareName, acquireErr)
+			}
+			accountName, err = d.createRolloverAccount(ctx, accountOptions)
+			d.accountCreateLimiter.release(d.cloud.SubscriptionID)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to create rollover storage account: %v", err)
+			}
+			accountOptions.Name = accountName
+			accountKey = ""
+			err = wait.ExponentialBackoff(d.cloud.RequestBackoff(), func() (bool, error) {
+				err := d.CreateFileShare(accountOptions, shareOptions, req.GetSecrets())
+				if isRetriableError(err) {
+					klog.Warningf("CreateFileShare(%s) on account(%s) failed with error(%v), waiting for retring", validFileShareName, accountName, err)
+					return false, nil
+				}
+				return true, err
+			})
+			d.auditLog.record(auditOpCreateVolume, "", accountName, validFileShareName, requesterMetadata(parameters), err)
+		}
+	}
+	if shareProtocol == storage.NFS && isNfsUnavailableError(err) {
+		if !d.protocolFallback {
+			return nil, status.Errorf(codes.FailedPrecondition, "NFS file share(%s) cannot be provisioned on account(%s): %v, enable --protocol-fallback to fall back to SMB", validFileShareName, accountName, err)
+		}
+		klog.Warningf("NFS file share(%s) cannot be provisioned on account(%s)(%v), falling back to SMB", validFileShareName, accountName, err)
+		// the storage account keeps its NFS oriented settings (premium sku,
+		// network rules, relaxed https enforcement), only the share protocol
+		// and the key handling change
+		protocol = smb
+		shareProtocol = storage.SMB
+		shareOptions.Protocol = shareProtocol
+		storeAccountKey = smbStoreAccountKey
+		if crossSubscription && len(req.GetSecrets()) == 0 {
+			// same restriction as above, the account key cannot be fetched
+			// through the default subscription clients
+			storeAccountKey = storeAccountKeyFalse
+		}
+		// record the protocol that was actually provisioned so the node plugin
+		// mounts the share over SMB
+		parameters[protocolField] = protocol
+		err = wait.ExponentialBackoff(d.cloud.RequestBackoff(), func() (bool, error) {
+			var err error
+			if crossSubscription {
+				err = fileClient.CreateFileShare(resourceGroup, accountName, shareOptions)
+			} else {
+				err = d.CreateFileShare(accountOptions, shareOptions, req.GetSecrets())
+			}
+			if isRetriableError(err) {
+				klog.Warningf("CreateFileShare(%s) on account(%s) failed with error(%v), waiting for retring", validFileShareName, accountName, err)
+				return false, nil
+			}
+			return true, err
+		})
+		d.auditLog.record(auditOpCreateVolume, "", accountName, validFileShareName, requesterMetadata(parameters), err)
+	}
 	if err != nil {
+		if strings.Contains(err.Error(), accountCapacityLimitExceed) {
+			return nil, statusWithReason(codes.ResourceExhausted, reasonQuotaExceeded, "account(%s) hit the provisioned capacity limit when creating file share(%s): %v", accountName, validFileShareName, err)
+		}
+		if strings.Contains(err.Error(), shareCountLimitExceed) {
+			return nil, statusWithReason(codes.ResourceExhausted, reasonQuotaExceeded, "account(%s) hit the file share count limit when creating file share(%s): %v", accountName, validFileShareName, err)
+		}
+		if reason := errorReason(err); reason != "" {
+			return nil, statusWithReason(codes.Internal, reason, "failed to create file share(%s) on account(%s) type(%s) rg(%s) location(%s) size(%d), error: %v", validFileShareName, account, sku, resourceGroup, location, fileShareSize, err)
+		}
 		return nil, fmt.Errorf("failed to create file share(%s) on account(%s) type(%s) rg(%s) location(%s) size(%d), error: %v", validFileShareName, account, sku, resourceGroup, location, fileShareSize, err)
 	}
 	klog.V(2).Infof("create file share %s on storage account %s successfully", validFileShareName, accountName)
+	d.accountInventory.recordShare(accountName, validFileShareName, int64(fileShareSize))
+
+	if accessPolicyPerms != "" {
+		if accountKey == "" {
+			if accountKey, err = d.GetStorageAccesskey(accountOptions, req.GetSecrets(), secretNamespace); err != nil {
+				return nil, fmt.Errorf("failed to GetStorageAccesskey on account(%s) rg(%s), error: %v", accountOptions.Name, accountOptions.ResourceGroup, err)
+			}
+		}
+		// use the file share name as the stored access policy identifier so apps can mint SAS tokens against it
+		if err := d.setShareAccessPolicy(ctx, accountName, accountKey, validFileShareName, validFileShareName, accessPolicyPerms, accessPolicyExpiryDuration); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to set access policy on file share(%s): %v", validFileShareName, err)
+		}
+		klog.V(2).Infof("set access policy(%s) with permissions(%s) on file share(%s) successfully", validFileShareName, accessPolicyPerms, validFileShareName)
+		parameters[accessPolicyIDField] = validFileShareName
+	}
 
 	if isDiskFsType(fsType) && diskName == "" {
 		if accountKey == "" {
@@ -289,14 +645,7 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		}
 	}
 
-	volumeID := fmt.Sprintf(volumeIDTemplate, resourceGroup, accountName, validFileShareName, diskName)
-	return &csi.CreateVolumeResponse{
-		Volume: &csi.Volume{
-			VolumeId:      volumeID,
-			CapacityBytes: capacityBytes,
-			VolumeContext: parameters,
-		},
-	}, nil
+	return buildVolumeResponse(), nil
 }
 
 // DeleteVolume delete an azure file
@@ -321,17 +670,104 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 		resourceGroupName = d.cloud.ResourceGroup
 	}
 
-	if err := d.DeleteFileShare(resourceGroupName, accountName, fileShareName, req.GetSecrets()); err != nil {
+	if subsID := getSubscriptionIDFromVolumeID(volumeID); subsID != "" &&
+		!strings.EqualFold(subsID, d.cloud.SubscriptionID) && len(req.GetSecrets()) == 0 {
+		// the volume was provisioned in another subscription, delete the share
+		// through the client bound to that subscription
+		fileClient, err := d.getFileClientForSubscription(subsID)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get file share client for subscription(%s): %v", subsID, err)
+		}
+		err = fileClient.DeleteFileShare(resourceGroupName, accountName, fileShareName)
+		d.auditLog.record(auditOpDeleteVolume, volumeID, accountName, fileShareName, nil, err)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "DeleteFileShare %s under account(%s) rg(%s) subscription(%s) failed with error: %v", fileShareName, accountName, resourceGroupName, subsID, err)
+		}
+		klog.V(2).Infof("azure file(%s) under rg(%s) account(%s) subscription(%s) volume(%s) is deleted successfully", fileShareName, resourceGroupName, accountName, subsID, volumeID)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	if d.deleteWithSnapshotsPolicy != "" {
+		hasSnapshots, err := d.shareHasSnapshots(ctx, volumeID, req.GetSecrets())
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to check snapshots of volume(%s): %v", volumeID, err)
+		}
+		action, err := d.resolveDeleteWithSnapshots(volumeID, hasSnapshots)
+		if err != nil {
+			return nil, err
+		}
+		switch action {
+		case retainShare:
+			err = d.orphanFileShare(ctx, volumeID, req.GetSecrets())
+			d.auditLog.record(auditOpDeleteVolume, volumeID, accountName, fileShareName, nil, err)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to orphan file share(%s) of volume(%s): %v", fileShareName, volumeID, err)
+			}
+			d.accountInventory.releaseShare(accountName, fileShareName)
+			klog.V(2).Infof("azure file(%s) under rg(%s) account(%s) volume(%s) is retained together with its snapshots", fileShareName, resourceGroupName, accountName, volumeID)
+			return &csi.DeleteVolumeResponse{}, nil
+		case deleteShareAndSnapshots:
+			err = d.deleteFileShareIncludingSnapshots(ctx, volumeID, req.GetSecrets())
+			d.auditLog.record(auditOpDeleteVolume, volumeID, accountName, fileShareName, nil, err)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to delete file share(%s) of volume(%s) including snapshots: %v", fileShareName, volumeID, err)
+			}
+			d.accountInventory.releaseShare(accountName, fileShareName)
+			klog.V(2).Infof("azure file(%s) under rg(%s) account(%s) volume(%s) is deleted together with its snapshots", fileShareName, resourceGroupName, accountName, volumeID)
+			return &csi.DeleteVolumeResponse{}, nil
+		}
+	}
+
+	err = d.DeleteFileShare(resourceGroupName, accountName, fileShareName, req.GetSecrets())
+	d.auditLog.record(auditOpDeleteVolume, volumeID, accountName, fileShareName, nil, err)
+	if err != nil {
+		if reason := errorReason(err); reason != "" {
+			return nil, statusWithReason(codes.Internal, reason, "DeleteFileShare %s under account(%s) rg(%s) failed with error: %v", fileShareName, accountName, resourceGroupName, err)
+		}
 		return nil, status.Errorf(codes.Internal, "DeleteFileShare %s under account(%s) rg(%s) failed with error: %v", fileShareName, accountName, resourceGroupName, err)
 	}
+	d.accountInventory.releaseShare(accountName, fileShareName)
 	klog.V(2).Infof("azure file(%s) under rg(%s) account(%s) volume(%s) is deleted successfully", fileShareName, resourceGroupName, accountName, volumeID)
 
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
 // ControllerGetVolume get volume
-func (d *Driver) ControllerGetVolume(context.Context, *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+func (d *Driver) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	resourceGroupName, accountName, fileShareName, diskName, err := GetFileShareInfo(volumeID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "GetFileShareInfo(%s) failed with error: %v", volumeID, err)
+	}
+
+	// statically provisioned volumes never went through CreateVolume, the live
+	// share quota is the only authoritative capacity source for them
+	var capacityBytes int64
+	if d.cloud != nil && accountName != "" && fileShareName != "" {
+		if resourceGroupName == "" {
+			resourceGroupName = d.cloud.ResourceGroup
+		}
+		if quota, err := d.getFileShareQuota(getSubscriptionIDFromVolumeID(volumeID), resourceGroupName, accountName, fileShareName, nil); err != nil {
+			// a capacity of zero means unknown, failing the RPC over it would
+			// hide the volume context this call is mainly used for
+			klog.Warningf("ControllerGetVolume: could not read the quota of share(%s) of volume(%s): %v", fileShareName, volumeID, err)
+		} else if quota > 0 {
+			capacityBytes = volumehelper.GiBToBytes(int64(quota))
+		}
+	}
+
+	return &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      volumeID,
+			CapacityBytes: capacityBytes,
+			VolumeContext: map[string]string{
+				diskModeField: strconv.FormatBool(diskName != ""),
+			},
+		},
+	}, nil
 }
 
 // ValidateVolumeCapabilities return the capabilities of the volume
@@ -353,7 +789,7 @@ func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Valida
 		resourceGroupName = d.cloud.ResourceGroup
 	}
 
-	if quota, err := d.getFileShareQuota(resourceGroupName, accountName, fileShareName, req.GetSecrets()); err != nil {
+	if quota, err := d.getFileShareQuota(getSubscriptionIDFromVolumeID(volumeID), resourceGroupName, accountName, fileShareName, req.GetSecrets()); err != nil {
 		return nil, status.Errorf(codes.Internal, "error checking if volume(%s) exists: %v", volumeID, err)
 	} else if quota == -1 {
 		return nil, status.Errorf(codes.NotFound, "the requested volume(%s) does not exist.", volumeID)
@@ -380,12 +816,58 @@ func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.Control
 
 // GetCapacity returns the capacity of the total available storage pool
 func (d *Driver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	if d.accountInventory.expired() {
+		if err := d.refreshAccountInventory(ctx, d.cloud.ResourceGroup); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to refresh account inventory: %v", err)
+		}
+	}
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: volumehelper.GiBToBytes(d.accountInventory.availableGiB()),
+	}, nil
 }
 
-// ListVolumes return all available volumes
+// ListVolumes returns the provisioned volumes tracked by the account
+// inventory. In shared accounts the enumeration can be scoped to the shares
+// this driver manages via the configured share name prefix, so unrelated
+// shares are never listed.
 func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	start := 0
+	if token := req.GetStartingToken(); token != "" {
+		parsed, err := strconv.Atoi(token)
+		if err != nil || parsed < 0 {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token(%s)", token)
+		}
+		start = parsed
+	}
+
+	resourceGroup := ""
+	if d.cloud != nil {
+		resourceGroup = d.cloud.ResourceGroup
+		if d.accountInventory.expired() && d.cloud.StorageAccountClient != nil {
+			if err := d.refreshAccountInventory(ctx, resourceGroup); err != nil {
+				// serve the stale inventory rather than failing the enumeration
+				klog.Warningf("ListVolumes: account inventory refresh failed: %v", err)
+			}
+		}
+	}
+
+	volumeIDs := d.accountInventory.listVolumeIDs(resourceGroup, d.listVolumesSharePrefix)
+	if start > len(volumeIDs) {
+		return nil, status.Errorf(codes.Aborted, "starting token(%d) is beyond the %d known volume(s)", start, len(volumeIDs))
+	}
+	end := len(volumeIDs)
+	nextToken := ""
+	if max := int(req.GetMaxEntries()); max > 0 && start+max < end {
+		end = start + max
+		nextToken = strconv.Itoa(end)
+	}
+	entries := []*csi.ListVolumesResponse_Entry{}
+	for _, volumeID := range volumeIDs[start:end] {
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{VolumeId: volumeID},
+		})
+	}
+	return &csi.ListVolumesResponse{Entries: entries, NextToken: nextToken}, nil
 }
 
 // ControllerPublishVolume make a volume available on some required node
@@ -445,7 +927,7 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.Controlle
 		return nil, status.Error(codes.Internal, fmt.Sprintf("getFileURL(%s,%s,%s,%s) returned empty fileURL", accountName, storageEndpointSuffix, fileShareName, diskName))
 	}
 
-	d.volLockMap.LockEntry(volumeID)
+	lockEntryTimed(d.volLockMap, volumeID, "ControllerPublishVolume")
 	defer d.volLockMap.UnlockEntry(volumeID)
 	properties, err := fileURL.GetProperties(ctx)
 	if err != nil {
@@ -503,7 +985,7 @@ func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.Control
 		return nil, status.Error(codes.Internal, fmt.Sprintf("getFileURL(%s,%s,%s,%s) returned empty fileURL", accountName, storageEndpointSuffix, fileShareName, diskName))
 	}
 
-	d.volLockMap.LockEntry(volumeID)
+	lockEntryTimed(d.volLockMap, volumeID, "ControllerUnpublishVolume")
 	defer d.volLockMap.UnlockEntry(volumeID)
 
 	if _, err = fileURL.SetMetadata(ctx, azfile.Metadata{metaDataNode: ""}); err != nil {
@@ -556,6 +1038,7 @@ func (d *Driver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequ
 	}
 
 	snapshotShare, err := shareURL.CreateSnapshot(ctx, azfile.Metadata{snapshotNameKey: snapshotName})
+	d.auditLog.record(auditOpCreateSnapshot, sourceVolumeID, "", snapshotName, nil, err)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "create snapshot from(%s) failed with %v, shareURL: %q", sourceVolumeID, err, shareURL)
 	}
@@ -605,6 +1088,7 @@ func (d *Driver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequ
 	}
 
 	_, err = shareURL.WithSnapshot(snapshot).Delete(ctx, azfile.DeleteSnapshotsOptionNone)
+	d.auditLog.record(auditOpDeleteSnapshot, req.SnapshotId, "", snapshot, nil, err)
 	if err != nil {
 		if strings.Contains(err.Error(), "ShareSnapshotNotFound") {
 			klog.Warningf("the specify snapshot(%s) was not found", snapshot)
@@ -642,15 +1126,35 @@ func (d *Driver) ControllerExpandVolume(ctx context.Context, req *csi.Controller
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("GetAccountInfo(%s) failed with error: %v", volumeID, err))
 	}
-	if diskName != "" {
-		// todo: figure out how to support vhd disk resize
-		return nil, status.Error(codes.Unimplemented, fmt.Sprintf("vhd disk volume(%s) is not supported on ControllerExpandVolume", volumeID))
+
+	if d.expandWithSnapshotsPolicy == expandWithSnapshotsWarn || d.expandWithSnapshotsPolicy == expandWithSnapshotsBlock {
+		hasSnapshots, err := d.shareHasSnapshots(ctx, volumeID, req.GetSecrets())
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to check snapshots of volume(%s): %v", volumeID, err)
+		}
+		if err := d.checkExpandWithSnapshots(volumeID, hasSnapshots); err != nil {
+			return nil, err
+		}
 	}
 
 	if err = d.ResizeFileShare(resourceGroupName, accountName, fileShareName, int(requestGiB), req.GetSecrets()); err != nil {
 		return nil, status.Errorf(codes.Internal, "expand volume error: %v", err)
 	}
 
+	if diskName != "" {
+		// the share quota is grown first so the bigger vhd fits, then the vhd
+		// file itself, the filesystem resize happens in NodeExpandVolume
+		_, _, accountKey, _, _, err := d.GetAccountInfo(volumeID, req.GetSecrets(), map[string]string{})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "GetAccountInfo(%s) failed with error: %v", volumeID, err)
+		}
+		if err := resizeDisk(ctx, accountName, accountKey, d.cloud.Environment.StorageEndpointSuffix, fileShareName, diskName, volumehelper.GiBToBytes(requestGiB)); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to resize VHD disk: %v", err)
+		}
+		klog.V(2).Infof("ControllerExpandVolume(%s) successfully, currentQuota: %d Gi, vhd file(%s) resized", volumeID, int(requestGiB), diskName)
+		return &csi.ControllerExpandVolumeResponse{CapacityBytes: capacityBytes, NodeExpansionRequired: true}, nil
+	}
+
 	klog.V(2).Infof("ControllerExpandVolume(%s) successfully, currentQuota: %d Gi", volumeID, int(requestGiB))
 	return &csi.ControllerExpandVolumeResponse{CapacityBytes: capacityBytes}, nil
 }
@@ -728,6 +1232,524 @@ func (d *Driver) snapshotExists(ctx context.Context, sourceVolumeID, snapshotNam
 	return false, azfile.ShareItem{}, nil
 }
 
+// shareHasSnapshots returns whether the file share backing the volume has any
+// existing snapshots
+func (d *Driver) shareHasSnapshots(ctx context.Context, volumeID string, secrets map[string]string) (bool, error) {
+	serviceURL, fileShareName, err := d.getServiceURL(volumeID, secrets)
+	if err != nil {
+		return false, err
+	}
+	if fileShareName == "" {
+		return false, fmt.Errorf("failed to get file share from %s", volumeID)
+	}
+
+	listResp, err := serviceURL.ListSharesSegment(ctx, azfile.Marker{}, azfile.ListSharesOptions{Prefix: fileShareName, Detail: azfile.ListSharesDetail{Snapshots: true}})
+	if err != nil {
+		return false, err
+	}
+	for _, share := range listResp.ShareItems {
+		if share.Name == fileShareName && share.Snapshot != nil {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// actions DeleteVolume takes for a share that has snapshots, resolved from the
+// delete-with-snapshots policy
+type deleteSnapshotsAction int
+
+const (
+	deleteShareOnly deleteSnapshotsAction = iota
+	deleteShareAndSnapshots
+	retainShare
+)
+
+// resolveDeleteWithSnapshots maps the delete-with-snapshots policy onto the
+// action DeleteVolume takes, deleting a share that still has snapshots fails
+// on Azure unless the snapshots are deleted with it
+func (d *Driver) resolveDeleteWithSnapshots(volumeID string, hasSnapshots bool) (deleteSnapshotsAction, error) {
+	if !hasSnapshots {
+		return deleteShareOnly, nil
+	}
+	switch d.deleteWithSnapshotsPolicy {
+	case deleteWithSnapshotsFail:
+		return deleteShareOnly, status.Errorf(codes.FailedPrecondition, "volume(%s) has existing snapshots and the delete-with-snapshots-policy is fail, delete the snapshots before deleting the volume", volumeID)
+	case deleteWithSnapshotsRetain:
+		return retainShare, nil
+	case deleteWithSnapshotsInclude:
+		return deleteShareAndSnapshots, nil
+	}
+	return deleteShareOnly, nil
+}
+
+// listShareSnapshots returns the snapshot timestamps of the file share,
+// overridable in unit tests
+var listShareSnapshots = func(ctx context.Context, serviceURL azfile.ServiceURL, fileShareName string) ([]string, error) {
+	listResp, err := serviceURL.ListSharesSegment(ctx, azfile.Marker{}, azfile.ListSharesOptions{Prefix: fileShareName, Detail: azfile.ListSharesDetail{Snapshots: true}})
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []string
+	for _, share := range listResp.ShareItems {
+		if share.Name == fileShareName && share.Snapshot != nil {
+			snapshots = append(snapshots, *share.Snapshot)
+		}
+	}
+	return snapshots, nil
+}
+
+// deleteShareSnapshot deletes a single snapshot of the file share, overridable
+// in unit tests
+var deleteShareSnapshot = func(ctx context.Context, serviceURL azfile.ServiceURL, fileShareName, snapshot string) error {
+	_, err := serviceURL.NewShareURL(fileShareName).WithSnapshot(snapshot).Delete(ctx, azfile.DeleteSnapshotsOptionNone)
+	return err
+}
+
+// deleteShareWithSnapshots deletes the file share together with any snapshot
+// still attached to it, overridable in unit tests
+var deleteShareWithSnapshots = func(ctx context.Context, serviceURL azfile.ServiceURL, fileShareName string) error {
+	_, err := serviceURL.NewShareURL(fileShareName).Delete(ctx, azfile.DeleteSnapshotsOptionInclude)
+	return err
+}
+
+// isSnapshotAlreadyDeletedError returns true when a snapshot delete failed
+// because the snapshot is already gone, which a retry after a cancelled delete
+// runs into for the snapshots the first pass removed
+func isSnapshotAlreadyDeletedError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), string(azfile.ServiceCodeShareNotFound))
+}
+
+// deleteFileShareIncludingSnapshots deletes the snapshots of the file share
+// backing the volume one by one and then the share itself. The loop honors the
+// request context so a cancelled delete stops promptly, and every snapshot
+// delete is idempotent so the retry resumes where the first pass stopped
+func (d *Driver) deleteFileShareIncludingSnapshots(ctx context.Context, volumeID string, secrets map[string]string) error {
+	serviceURL, fileShareName, err := d.getServiceURL(volumeID, secrets)
+	if err != nil {
+		return err
+	}
+	if fileShareName == "" {
+		return fmt.Errorf("failed to get file share from %s", volumeID)
+	}
+	snapshots, err := listShareSnapshots(ctx, serviceURL, fileShareName)
+	if err != nil {
+		return fmt.Errorf("failed to list the snapshots of share(%s): %v", fileShareName, err)
+	}
+	for i, snapshot := range snapshots {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return fmt.Errorf("snapshot deletion of share(%s) interrupted with %d of %d snapshots left, a retry picks up the rest: %v", fileShareName, len(snapshots)-i, len(snapshots), ctxErr)
+		}
+		if err := deleteShareSnapshot(ctx, serviceURL, fileShareName, snapshot); err != nil {
+			if isSnapshotAlreadyDeletedError(err) {
+				klog.V(4).Infof("snapshot(%s) of share(%s) is already deleted", snapshot, fileShareName)
+				continue
+			}
+			return fmt.Errorf("failed to delete snapshot(%s) of share(%s): %v", snapshot, fileShareName, err)
+		}
+	}
+	// the share itself, including any snapshot that raced in after the listing
+	return deleteShareWithSnapshots(ctx, serviceURL, fileShareName)
+}
+
+// orphanFileShare detaches the share from the volume by marking it orphaned
+// instead of deleting it, Azure Files cannot rename a share so marker metadata
+// stands in for a rename
+func (d *Driver) orphanFileShare(ctx context.Context, volumeID string, secrets map[string]string) error {
+	serviceURL, fileShareName, err := d.getServiceURL(volumeID, secrets)
+	if err != nil {
+		return err
+	}
+	if fileShareName == "" {
+		return fmt.Errorf("failed to get file share from %s", volumeID)
+	}
+	metadata := azfile.Metadata{
+		"orphanedby": d.Name,
+		"orphanedat": time.Now().UTC().Format(time.RFC3339),
+	}
+	_, err = serviceURL.NewShareURL(fileShareName).SetMetadata(ctx, metadata)
+	return err
+}
+
+// checkExpandWithSnapshots applies the expand-with-snapshots policy: expanding a
+// share that has snapshots is blocked, logged or silently allowed
+func (d *Driver) checkExpandWithSnapshots(volumeID string, hasSnapshots bool) error {
+	if !hasSnapshots {
+		return nil
+	}
+	switch d.expandWithSnapshotsPolicy {
+	case expandWithSnapshotsBlock:
+		return status.Errorf(codes.FailedPrecondition, "volume(%s) has existing snapshots and the expand-with-snapshots-policy is %s, delete the snapshots before expanding the volume", volumeID, expandWithSnapshotsBlock)
+	case expandWithSnapshotsWarn:
+		klog.Warningf("volume(%s) has existing snapshots, expanding may have cost implications for the snapshots", volumeID)
+	}
+	return nil
+}
+
+// setShareAccessPolicy creates or updates a stored access policy on the file share
+// with the given identifier, permissions and expiry
+func (d *Driver) setShareAccessPolicy(ctx context.Context, accountName, accountKey, fileShareName, policyID, permissions string, expiry time.Duration) error {
+	credential, err := azfile.NewSharedKeyCredential(accountName, accountKey)
+	if err != nil {
+		return fmt.Errorf("NewSharedKeyCredential(%s) failed with error: %v", accountName, err)
+	}
+	u, err := url.Parse(fmt.Sprintf(serviceURLTemplate, accountName, d.cloud.Environment.StorageEndpointSuffix))
+	if err != nil {
+		return fmt.Errorf("parse serviceURLTemplate error: %v", err)
+	}
+	shareURL := azfile.NewServiceURL(*u, azfile.NewPipeline(credential, azfile.PipelineOptions{})).NewShareURL(fileShareName)
+
+	expiryTime := time.Now().UTC().Add(expiry)
+	_, err = shareURL.SetPermissions(ctx, []azfile.SignedIdentifier{
+		{
+			ID: policyID,
+			AccessPolicy: &azfile.AccessPolicy{
+				Expiry:     &expiryTime,
+				Permission: &permissions,
+			},
+		},
+	})
+	return err
+}
+
+// validateAccessPolicyPermissions checks the stored access policy permission string
+// only contains supported permission characters
+func validateAccessPolicyPermissions(permissions string) error {
+	if permissions == "" {
+		return fmt.Errorf("permissions must not be empty")
+	}
+	for _, c := range permissions {
+		if !strings.ContainsRune(accessPolicyPermissionChars, c) {
+			return fmt.Errorf("permission char(%c) is not supported, supported chars: %s", c, accessPolicyPermissionChars)
+		}
+	}
+	return nil
+}
+
+// validateAccountKind detects the kind of a reused storage account and checks
+// the requested protocol and tier are supported by it
+func (d *Driver) validateAccountKind(ctx context.Context, resourceGroup, accountName, protocol, sku string) error {
+	account, rerr := d.cloud.StorageAccountClient.GetProperties(ctx, resourceGroup, accountName)
+	if rerr != nil {
+		return status.Errorf(codes.Internal, "failed to get properties of account(%s) under rg(%s): %v", accountName, resourceGroup, rerr.Error())
+	}
+	if account.Kind == "" {
+		return nil
+	}
+	if protocol == nfs && account.Kind != storage.FileStorage {
+		return status.Errorf(codes.InvalidArgument, "NFS protocol requires account kind %s but account(%s) is %s", storage.FileStorage, accountName, account.Kind)
+	}
+	if strings.HasPrefix(strings.ToLower(sku), "premium") && account.Kind != storage.FileStorage {
+		return status.Errorf(codes.InvalidArgument, "sku(%s) requires account kind %s but account(%s) is %s", sku, storage.FileStorage, accountName, account.Kind)
+	}
+	return nil
+}
+
+// backoff for polling a newly created storage account out of its transitional
+// provisioning states
+var accountReadyBackoff = wait.Backoff{Duration: 3 * time.Second, Factor: 2, Steps: 6}
+
+// waitForAccountReady polls the storage account provisioning state until the
+// account left the transitional 'Creating' and 'ResolvingDNS' states, share
+// creation fails transiently while the account is still in one of those
+func (d *Driver) waitForAccountReady(ctx context.Context, resourceGroup, accountName string) error {
+	var lastState storage.ProvisioningState
+	err := wait.ExponentialBackoff(accountReadyBackoff, func() (bool, error) {
+		account, rerr := d.cloud.StorageAccountClient.GetProperties(ctx, resourceGroup, accountName)
+		if rerr != nil {
+			return false, rerr.Error()
+		}
+		lastState = ""
+		if account.AccountProperties != nil {
+			lastState = account.AccountProperties.ProvisioningState
+		}
+		if lastState == storage.Creating || lastState == storage.ResolvingDNS {
+			klog.V(2).Infof("storage account(%s) is in provisioning state(%s), waiting for it to become ready", accountName, lastState)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return fmt.Errorf("storage account(%s) never became ready, last provisioning state: %s", accountName, lastState)
+	}
+	return err
+}
+
+// the storage management enum has no constant for the deleting state the API
+// reports while an account deletion is in flight
+const accountProvisioningStateDeleting = storage.ProvisioningState("Deleting")
+
+// accountBeingDeleted reports whether the storage account is in a deleting
+// provisioning state, reusing such an account loses the race against the
+// deletion and fails share creation confusingly
+func (d *Driver) accountBeingDeleted(ctx context.Context, resourceGroup, accountName string) (bool, error) {
+	account, rerr := d.cloud.StorageAccountClient.GetProperties(ctx, resourceGroup, accountName)
+	if rerr != nil {
+		return false, rerr.Error()
+	}
+	return account.AccountProperties != nil && account.AccountProperties.ProvisioningState == accountProvisioningStateDeleting, nil
+}
+
+// defaultResourceGroup returns the resource group to create the volume in when
+// the volume parameters do not specify one, preferring the per-protocol default
+// over the resource group from the cloud config
+func (d *Driver) defaultResourceGroup(protocol string) string {
+	if protocol == nfs {
+		if d.defaultResourceGroupNFS != "" {
+			return d.defaultResourceGroupNFS
+		}
+	} else if d.defaultResourceGroupSMB != "" {
+		return d.defaultResourceGroupSMB
+	}
+	return d.cloud.ResourceGroup
+}
+
+// validateShareProtocol checks that an existing share a volume wants to reuse
+// was created with the requested protocol, the share protocol cannot be
+// changed after creation
+func (d *Driver) validateShareProtocol(fileClient fileclient.Interface, resourceGroup, accountName, fileShareName string, shareProtocol storage.EnabledProtocols) error {
+	share, err := fileClient.GetFileShare(resourceGroup, accountName, fileShareName)
+	if err != nil {
+		if strings.Contains(err.Error(), "ShareNotFound") {
+			return nil
+		}
+		return status.Errorf(codes.Internal, "failed to get file share(%s) on account(%s): %v", fileShareName, accountName, err)
+	}
+	existingProtocol := storage.SMB
+	if share.FileShareProperties != nil && share.FileShareProperties.EnabledProtocols != "" {
+		existingProtocol = share.FileShareProperties.EnabledProtocols
+	}
+	if existingProtocol != shareProtocol {
+		return status.Errorf(codes.InvalidArgument, "file share(%s) on account(%s) was created with protocol %s, it cannot be reused for a %s volume", fileShareName, accountName, existingProtocol, shareProtocol)
+	}
+	return nil
+}
+
+// isSingleNodeAccessMode returns true when every requested access mode only
+// ever attaches the volume to a single node
+func isSingleNodeAccessMode(capabilities []*csi.VolumeCapability) bool {
+	if len(capabilities) == 0 {
+		return false
+	}
+	for _, capability := range capabilities {
+		switch capability.GetAccessMode().GetMode() {
+		case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isAccountFullError returns true when share creation failed because the
+// account cannot hold more provisioned capacity or more shares
+func isAccountFullError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return strings.Contains(err.Error(), accountCapacityLimitExceed) || strings.Contains(err.Error(), shareCountLimitExceed)
+}
+
+// nfsUnavailableErrors are markers of share creation failures caused by the
+// target region or account not supporting the NFS protocol
+var nfsUnavailableErrors = []string{
+	"InvalidProtocols",
+	"FeatureNotSupportedForAccount",
+	"NFS protocol is not supported",
+}
+
+// isNfsUnavailableError returns true when share creation failed because the
+// storage service cannot provision an NFS share on the selected account
+func isNfsUnavailableError(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, marker := range nfsUnavailableErrors {
+		if strings.Contains(err.Error(), marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// statusWithReason builds a status error that carries a machine-readable
+// reason code in its details, so automation can branch on the reason without
+// matching the human-readable message
+func statusWithReason(code codes.Code, reason string, format string, args ...interface{}) error {
+	st := status.Newf(code, format, args...)
+	detailed, err := st.WithDetails(&wrappers.StringValue{Value: reason})
+	if err != nil {
+		// the reason code is advisory, fall back to the plain status error
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// errorReason classifies an Azure error into a machine-readable reason code,
+// returns an empty string when the error does not match a known class
+func errorReason(err error) string {
+	if err == nil {
+		return ""
+	}
+	switch {
+	case strings.Contains(err.Error(), accountCapacityLimitExceed), strings.Contains(err.Error(), shareCountLimitExceed):
+		return reasonQuotaExceeded
+	case strings.Contains(err.Error(), accountNotProvisioned), strings.Contains(err.Error(), resourceNotFound):
+		return reasonAccountNotFound
+	case strings.Contains(err.Error(), tooManyRequests), strings.Contains(err.Error(), clientThrottled):
+		return reasonThrottled
+	}
+	return ""
+}
+
+// rolloverAccountName generates a fresh storage account name for a rollover
+// attempt, storage account names are at most 24 lowercase alphanumerics
+func rolloverAccountName() string {
+	name := fileShareAccountNamePrefix + strings.ReplaceAll(uuid.NewUUID().String(), "-", "")
+	if len(name) > 24 {
+		name = name[:24]
+	}
+	return name
+}
+
+// createRolloverAccount creates a brand new storage account for a rollover
+// attempt, EnsureStorageAccount cannot be used here since it would keep
+// returning the full account that triggered the rollover
+func (d *Driver) createRolloverAccount(ctx context.Context, accountOptions *azure.AccountOptions) (string, error) {
+	accountName := rolloverAccountName()
+
+	var networkRuleSet *storage.NetworkRuleSet
+	if len(accountOptions.VirtualNetworkResourceIDs) > 0 {
+		virtualNetworkRules := []storage.VirtualNetworkRule{}
+		for _, subnetID := range accountOptions.VirtualNetworkResourceIDs {
+			subnetID := subnetID
+			virtualNetworkRules = append(virtualNetworkRules, storage.VirtualNetworkRule{
+				VirtualNetworkResourceID: &subnetID,
+				Action:                   storage.Allow,
+			})
+		}
+		networkRuleSet = &storage.NetworkRuleSet{
+			VirtualNetworkRules: &virtualNetworkRules,
+			DefaultAction:       storage.DefaultActionDeny,
+		}
+	}
+
+	location := accountOptions.Location
+	if location == "" {
+		location = d.cloud.Location
+	}
+	var tags map[string]*string
+	if len(accountOptions.Tags) > 0 {
+		tags = make(map[string]*string, len(accountOptions.Tags))
+		for k, v := range accountOptions.Tags {
+			value := v
+			tags[k] = &value
+		}
+	}
+	enableHTTPSTrafficOnly := accountOptions.EnableHTTPSTrafficOnly
+
+	klog.V(2).Infof("begin to create rollover storage account(%s) type(%s) kind(%s) rg(%s) location(%s)", accountName, accountOptions.Type, accountOptions.Kind, accountOptions.ResourceGroup, location)
+	cp := storage.AccountCreateParameters{
+		Sku:  &storage.Sku{Name: storage.SkuName(accountOptions.Type)},
+		Kind: storage.Kind(accountOptions.Kind),
+		AccountPropertiesCreateParameters: &storage.AccountPropertiesCreateParameters{
+			EnableHTTPSTrafficOnly: &enableHTTPSTrafficOnly,
+			NetworkRuleSet:         networkRuleSet,
+		},
+		Tags:     tags,
+		Location: &location,
+	}
+	if rerr := d.cloud.StorageAccountClient.Create(ctx, accountOptions.ResourceGroup, accountName, cp); rerr != nil {
+		return "", fmt.Errorf("failed to create storage account(%s): %v", accountName, rerr)
+	}
+	if err := d.waitForAccountReady(ctx, accountOptions.ResourceGroup, accountName); err != nil {
+		return "", fmt.Errorf("storage account(%s) is not ready: %v", accountName, err)
+	}
+	return accountName, nil
+}
+
+// pickPooledAccount returns an existing driver-created storage account matching
+// the requested sku, kind and location that still has room for another file
+// share under the --max-shares-per-account limit, or an empty string when every
+// matching account is full. Share counts come from the account inventory, so
+// only shares provisioned by this driver count against the limit
+func (d *Driver) pickPooledAccount(ctx context.Context, accountOptions *azure.AccountOptions) (string, error) {
+	accounts, rerr := d.cloud.StorageAccountClient.ListByResourceGroup(ctx, accountOptions.ResourceGroup)
+	if rerr != nil {
+		return "", rerr.Error()
+	}
+
+	location := accountOptions.Location
+	if location == "" {
+		location = d.cloud.Location
+	}
+	var candidates []string
+	for _, account := range accounts {
+		if account.Name == nil || !strings.HasPrefix(*account.Name, fileShareAccountNamePrefix) {
+			continue
+		}
+		if account.Sku == nil || accountOptions.Type != "" && !strings.EqualFold(string(account.Sku.Name), accountOptions.Type) {
+			continue
+		}
+		if !strings.EqualFold(string(account.Kind), accountOptions.Kind) {
+			continue
+		}
+		if location != "" && (account.Location == nil || !strings.EqualFold(*account.Location, location)) {
+			continue
+		}
+		if account.AccountProperties != nil && account.AccountProperties.ProvisioningState == accountProvisioningStateDeleting {
+			continue
+		}
+		candidates = append(candidates, *account.Name)
+	}
+
+	// walk the candidates in a stable order so concurrent provisioners fill the
+	// same account before moving on to the next one
+	sort.Strings(candidates)
+	counts := d.accountInventory.accountShareCounts()
+	for _, name := range candidates {
+		if counts[name] < d.maxSharesPerAccount {
+			return name, nil
+		}
+	}
+	return "", nil
+}
+
+// validateEdgeZone checks the edge zone name and the region it is combined with,
+// edge zones are only addressable relative to an explicitly specified location
+func validateEdgeZone(location, edgeZone string) error {
+	if location == "" {
+		return fmt.Errorf("an edge zone requires the %s parameter to be set", locationField)
+	}
+	if strings.EqualFold(location, edgeZone) {
+		return fmt.Errorf("edge zone must differ from location(%s)", location)
+	}
+	for _, c := range edgeZone {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			return fmt.Errorf("edge zone name must only contain lowercase letters and digits")
+		}
+	}
+	return nil
+}
+
+// clampToCapacityLimit makes sure the rounded up request size never exceeds the
+// LimitBytes of the capacity range. If rounding up exceeds the limit, the size is
+// clamped to the largest GiB multiple below the limit, and an error is returned
+// when that is below the required minimum.
+func clampToCapacityLimit(requestGiB int64, capRange *csi.CapacityRange) (int64, error) {
+	limitBytes := capRange.GetLimitBytes()
+	if limitBytes <= 0 || volumehelper.GiBToBytes(requestGiB) <= limitBytes {
+		return requestGiB, nil
+	}
+
+	maxGiB := volumehelper.BytesToGiB(limitBytes)
+	if maxGiB == 0 || volumehelper.GiBToBytes(maxGiB) < capRange.GetRequiredBytes() {
+		return 0, fmt.Errorf("required bytes(%d) rounded up to GiB granularity exceeds limit bytes(%d)", capRange.GetRequiredBytes(), limitBytes)
+	}
+	klog.V(2).Infof("clamp request size(%d GiB) to %d GiB to not exceed limit bytes(%d)", requestGiB, maxGiB, limitBytes)
+	return maxGiB, nil
+}
+
 // isValidVolumeCapabilities validates the given VolumeCapability array is valid
 func isValidVolumeCapabilities(volCaps []*csi.VolumeCapability) error {
 	if len(volCaps) == 0 {
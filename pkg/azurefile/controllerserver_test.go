@@ -25,12 +25,18 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	volumehelper "sigs.k8s.io/azurefile-csi-driver/pkg/util"
 
 	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2020-06-30/compute"
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2019-06-01/network"
+	"github.com/Azure/azure-storage-file-go/azfile"
 	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2019-06-01/storage"
 	azure2 "github.com/Azure/go-autorest/autorest/azure"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/mock/gomock"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -38,8 +44,10 @@ import (
 	"k8s.io/client-go/kubernetes/fake"
 	cloudprovider "k8s.io/cloud-provider"
 
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/fileclient"
 	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/fileclient/mockfileclient"
 	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/storageaccountclient/mockstorageaccountclient"
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/subnetclient/mocksubnetclient"
 	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/vmclient/mockvmclient"
 	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
 	"sigs.k8s.io/cloud-provider-azure/pkg/retry"
@@ -166,6 +174,59 @@ func TestCreateVolume(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "Volume content source not supported",
+			testFunc: func(t *testing.T) {
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-content-source",
+					CapacityRange:      stdCapRange,
+					VolumeCapabilities: stdVolCap,
+					VolumeContentSource: &csi.VolumeContentSource{
+						Type: &csi.VolumeContentSource_Snapshot{
+							Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "snapshot_1"},
+						},
+					},
+				}
+
+				ctx := context.Background()
+				d := NewFakeDriver()
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				expectedErr := status.Error(codes.InvalidArgument, "CreateVolume from a volume content source is not supported yet")
+				_, err := d.CreateVolume(ctx, req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "Denied storage account SKU",
+			testFunc: func(t *testing.T) {
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-denied-sku",
+					CapacityRange:      stdCapRange,
+					VolumeCapabilities: stdVolCap,
+					Parameters:         map[string]string{skuNameField: "Premium_LRS"},
+				}
+
+				ctx := context.Background()
+				d := NewFakeDriver()
+				d.deniedSKUs = parseSKUList("Premium_LRS")
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				expectedErr := status.Errorf(codes.InvalidArgument, "sku(Premium_LRS) is not allowed, allowed SKU list: %v, denied SKU list: %v", d.allowedSKUs, d.deniedSKUs)
+				_, err := d.CreateVolume(ctx, req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
 		{
 			name: "No valid key with zero request gib",
 			testFunc: func(t *testing.T) {
@@ -217,6 +278,7 @@ func TestCreateVolume(t *testing.T) {
 
 				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
 				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{Kind: storage.FileStorage}, nil).AnyTimes()
 				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
 				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
 
@@ -286,6 +348,7 @@ func TestCreateVolume(t *testing.T) {
 
 				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
 				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{Kind: storage.FileStorage}, nil).AnyTimes()
 				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
 				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
 
@@ -341,6 +404,7 @@ func TestCreateVolume(t *testing.T) {
 
 				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
 				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{Kind: storage.FileStorage}, nil).AnyTimes()
 				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
 				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
 				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: nil}}, fmt.Errorf("test error")).AnyTimes()
@@ -414,6 +478,7 @@ func TestCreateVolume(t *testing.T) {
 				}
 
 				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{Kind: storage.FileStorage}, nil).AnyTimes()
 				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
 				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
 				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: nil}}, nil).AnyTimes()
@@ -486,6 +551,7 @@ func TestCreateVolume(t *testing.T) {
 
 				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
 				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{Kind: storage.FileStorage}, nil).AnyTimes()
 				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
 				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
 				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &fakeShareQuota}}, nil).AnyTimes()
@@ -504,6 +570,263 @@ func TestCreateVolume(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "Invalid access policy permissions",
+			testFunc: func(t *testing.T) {
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-invalid-access-policy",
+					CapacityRange:      stdCapRange,
+					VolumeCapabilities: stdVolCap,
+					Parameters: map[string]string{
+						accessPolicyPermsField:  "rwx",
+						accessPolicyExpiryField: "720h",
+					},
+				}
+
+				ctx := context.Background()
+				d := NewFakeDriver()
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				expectedErr := status.Errorf(codes.InvalidArgument, "invalid %s(rwx): permission char(x) is not supported, supported chars: %s", accessPolicyPermsField, accessPolicyPermissionChars)
+				_, err := d.CreateVolume(ctx, req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "Invalid access policy expiry",
+			testFunc: func(t *testing.T) {
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-invalid-access-policy-expiry",
+					CapacityRange:      stdCapRange,
+					VolumeCapabilities: stdVolCap,
+					Parameters: map[string]string{
+						accessPolicyPermsField:  "rl",
+						accessPolicyExpiryField: "invalid",
+					},
+				}
+
+				ctx := context.Background()
+				d := NewFakeDriver()
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				_, err := d.CreateVolume(ctx, req)
+				if status.Code(err) != codes.InvalidArgument {
+					t.Errorf("Unexpected error: %v, expected InvalidArgument", err)
+				}
+			},
+		},
+		{
+			name: "Account capacity limit exceeded",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					storageAccountField: "stoacc",
+					resourceGroupField:  "rg",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-account-capacity-limit",
+					VolumeCapabilities: stdVolCap,
+					CapacityRange:      stdCapRange,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).AnyTimes()
+				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("storage service error: %s", accountCapacityLimitExceed)).Times(1)
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				ctx := context.Background()
+
+				_, err := d.CreateVolume(ctx, req)
+				if status.Code(err) != codes.ResourceExhausted {
+					t.Errorf("Unexpected error: %v, expected ResourceExhausted", err)
+				}
+				if !strings.Contains(err.Error(), "account(stoacc) hit the provisioned capacity limit") {
+					t.Errorf("Unexpected error message: %v", err)
+				}
+			},
+		},
+		{
+			name: "Account share count limit exceeded",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					storageAccountField: "stoacc",
+					resourceGroupField:  "rg",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-share-count-limit",
+					VolumeCapabilities: stdVolCap,
+					CapacityRange:      stdCapRange,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).AnyTimes()
+				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("storage service error: %s", shareCountLimitExceed)).Times(1)
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				ctx := context.Background()
+
+				_, err := d.CreateVolume(ctx, req)
+				if status.Code(err) != codes.ResourceExhausted {
+					t.Errorf("Unexpected error: %v, expected ResourceExhausted", err)
+				}
+				if !strings.Contains(err.Error(), "account(stoacc) hit the file share count limit") {
+					t.Errorf("Unexpected error message: %v", err)
+				}
+			},
+		},
+		{
+			name: "Machine readable reason code attached on capacity limit error",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					storageAccountField: "stoacc",
+					resourceGroupField:  "rg",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-capacity-limit-reason",
+					VolumeCapabilities: stdVolCap,
+					CapacityRange:      stdCapRange,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).AnyTimes()
+				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("storage service error: %s", accountCapacityLimitExceed)).Times(1)
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				ctx := context.Background()
+
+				_, err := d.CreateVolume(ctx, req)
+				if status.Code(err) != codes.ResourceExhausted {
+					t.Errorf("Unexpected error: %v, expected ResourceExhausted", err)
+				}
+				assert.Equal(t, reasonQuotaExceeded, errorReasonDetail(err))
+			},
+		},
+		{
+			name: "Create in a non-default subscription",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					storageAccountField: "stoacc",
+					resourceGroupField:  "rg",
+					subsIDField:         "subs2",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-cross-subscription",
+					VolumeCapabilities: stdVolCap,
+					CapacityRange:      stdCapRange,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+				d.cloud.SubscriptionID = "subs1"
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				// the default subscription client stays untouched, every share
+				// operation must go through the subs2 client
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.fileClients["subs2"] = mockFileClient
+
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).AnyTimes()
+				mockFileClient.EXPECT().CreateFileShare("rg", "stoacc", gomock.Any()).Return(nil).Times(1)
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				ctx := context.Background()
+
+				resp, err := d.CreateVolume(ctx, req)
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				assert.True(t, strings.HasSuffix(resp.Volume.VolumeId, "#subs2"), "volume id(%s) should carry the subscription", resp.Volume.VolumeId)
+			},
+		},
+		{
+			name: "Non-default subscription requires an explicit account",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					resourceGroupField: "rg",
+					subsIDField:        "subs2",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-cross-subscription-no-account",
+					VolumeCapabilities: stdVolCap,
+					CapacityRange:      stdCapRange,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+				d.cloud.SubscriptionID = "subs1"
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				ctx := context.Background()
+
+				expectedErr := status.Errorf(codes.InvalidArgument, "%s(subs2) requires an explicit %s parameter", subsIDField, storageAccountField)
+				_, err := d.CreateVolume(ctx, req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v, expected error: %v", err, expectedErr)
+				}
+			},
+		},
 		{
 			name: "Create disk returns error",
 			testFunc: func(t *testing.T) {
@@ -574,6 +897,7 @@ func TestCreateVolume(t *testing.T) {
 
 					mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
 					mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{Kind: storage.FileStorage}, nil).AnyTimes()
 					mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
 					mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
 					mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &fakeShareQuota}}, nil).AnyTimes()
@@ -630,42 +954,1539 @@ func TestCreateVolume(t *testing.T) {
 					Parameters:         allParam,
 				}
 
-				d := NewFakeDriver()
-				d.cloud = &azure.Cloud{}
-				d.cloud.KubeClient = fake.NewSimpleClientset()
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+				d.cloud.KubeClient = fake.NewSimpleClientset()
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+
+				mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+				d.cloud.StorageAccountClient = mockStorageAccountsClient
+
+				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{Kind: storage.FileStorage}, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &fakeShareQuota}}, nil).AnyTimes()
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				ctx := context.Background()
+
+				_, err := d.CreateVolume(ctx, req)
+				if !reflect.DeepEqual(err, nil) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "NFS unavailable falls back to SMB",
+			testFunc: func(t *testing.T) {
+				name := "baz"
+				sku := "sku"
+				kind := "StorageV2"
+				location := "centralus"
+				value := "foo bar"
+				accounts := []storage.Account{
+					{Name: &name, Sku: &storage.Sku{Name: storage.SkuName(sku)}, Kind: storage.Kind(kind), Location: &location},
+				}
+				keys := storage.AccountListKeysResult{
+					Keys: &[]storage.AccountKey{
+						{Value: &value},
+					},
+				}
+
+				allParam := map[string]string{
+					locationField:       "loc",
+					storageAccountField: "stoacc",
+					resourceGroupField:  "rg",
+					protocolField:       "nfs",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-nfs-fallback",
+					VolumeCapabilities: stdVolCap,
+					CapacityRange:      lessThanPremCapRange,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.protocolFallback = true
+				d.cloud = &azure.Cloud{
+					Config: azure.Config{
+						ResourceGroup: "rg",
+						Location:      "loc",
+						VnetName:      "fake-vnet",
+						SubnetName:    "fake-subnet",
+					},
+				}
+				d.cloud.KubeClient = fake.NewSimpleClientset()
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+
+				mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+				d.cloud.StorageAccountClient = mockStorageAccountsClient
+
+				mockSubnetClient := mocksubnetclient.NewMockInterface(ctrl)
+				d.cloud.SubnetsClient = mockSubnetClient
+				mockSubnetClient.EXPECT().Get(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(network.Subnet{}, nil).AnyTimes()
+				mockSubnetClient.EXPECT().CreateOrUpdate(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+
+				var nfsAttempts, smbAttempts int
+				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+					func(_, _ string, shareOptions *fileclient.ShareOptions) error {
+						if shareOptions.Protocol == storage.NFS {
+							nfsAttempts++
+							return fmt.Errorf("storage.FileSharesClient#Create: Failure responding to request: StatusCode=400 -- Original Error: Code=\"InvalidProtocols\" Message=\"The protocols specified are invalid.\"")
+						}
+						smbAttempts++
+						return nil
+					}).AnyTimes()
+				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{Kind: storage.FileStorage}, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &fakeShareQuota}}, nil).AnyTimes()
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				res, err := d.CreateVolume(context.Background(), req)
+				if !reflect.DeepEqual(err, nil) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				assert.Equal(t, 1, nfsAttempts)
+				assert.Equal(t, 1, smbAttempts)
+				assert.Equal(t, smb, res.Volume.VolumeContext[protocolField])
+			},
+		},
+		{
+			name: "NFS unavailable without protocol fallback fails",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					locationField:       "loc",
+					storageAccountField: "stoacc",
+					resourceGroupField:  "rg",
+					protocolField:       "nfs",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-nfs-no-fallback",
+					VolumeCapabilities: stdVolCap,
+					CapacityRange:      lessThanPremCapRange,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{
+					Config: azure.Config{
+						ResourceGroup: "rg",
+						Location:      "loc",
+						VnetName:      "fake-vnet",
+						SubnetName:    "fake-subnet",
+					},
+				}
+				d.cloud.KubeClient = fake.NewSimpleClientset()
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+
+				mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+				d.cloud.StorageAccountClient = mockStorageAccountsClient
+
+				mockSubnetClient := mocksubnetclient.NewMockInterface(ctrl)
+				d.cloud.SubnetsClient = mockSubnetClient
+				mockSubnetClient.EXPECT().Get(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(network.Subnet{}, nil).AnyTimes()
+				mockSubnetClient.EXPECT().CreateOrUpdate(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+
+				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("Code=\"InvalidProtocols\" Message=\"The protocols specified are invalid.\"")).AnyTimes()
+				mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{Kind: storage.FileStorage}, nil).AnyTimes()
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &fakeShareQuota}}, nil).AnyTimes()
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				_, err := d.CreateVolume(context.Background(), req)
+				if status.Code(err) != codes.FailedPrecondition {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				assert.Contains(t, err.Error(), "--protocol-fallback")
+			},
+		},
+		{
+			name: "Requested size over the per-share maximum",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					skuNameField:        "premium",
+					locationField:       "loc",
+					storageAccountField: "stoacc",
+					resourceGroupField:  "rg",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-over-max-size",
+					VolumeCapabilities: stdVolCap,
+					CapacityRange:      &csi.CapacityRange{RequiredBytes: volumehelper.GiBToBytes(maxShareSizeGiB + 1)},
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				_, err := d.CreateVolume(context.Background(), req)
+				if status.Code(err) != codes.OutOfRange {
+					t.Errorf("Unexpected error: %v, expected OutOfRange", err)
+				}
+				if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("maximum size of a single file share(%dGiB)", maxShareSizeGiB)) {
+					t.Errorf("error(%v) does not name the per-share maximum", err)
+				}
+			},
+		},
+		{
+			name: "Requested size at the per-share maximum",
+			testFunc: func(t *testing.T) {
+				name := "baz"
+				sku := "sku"
+				kind := "StorageV2"
+				location := "centralus"
+				value := "foo bar"
+				accounts := []storage.Account{
+					{Name: &name, Sku: &storage.Sku{Name: storage.SkuName(sku)}, Kind: storage.Kind(kind), Location: &location},
+				}
+				keys := storage.AccountListKeysResult{
+					Keys: &[]storage.AccountKey{
+						{Value: &value},
+					},
+				}
+
+				allParam := map[string]string{
+					skuNameField:         "premium",
+					locationField:        "loc",
+					storageAccountField:  "stoacc",
+					resourceGroupField:   "rg",
+					secretNamespaceField: "default",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-at-max-size",
+					VolumeCapabilities: stdVolCap,
+					CapacityRange:      &csi.CapacityRange{RequiredBytes: volumehelper.GiBToBytes(maxShareSizeGiB)},
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+				d.cloud.KubeClient = fake.NewSimpleClientset()
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+
+				mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+				d.cloud.StorageAccountClient = mockStorageAccountsClient
+
+				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{Kind: storage.FileStorage}, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+				maxQuota := int32(maxShareSizeGiB)
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &maxQuota}}, nil).AnyTimes()
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				_, err := d.CreateVolume(context.Background(), req)
+				if !reflect.DeepEqual(err, nil) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "Account creation limiter saturated",
+			testFunc: func(t *testing.T) {
+				name := "baz"
+				sku := "sku"
+				kind := "StorageV2"
+				location := "centralus"
+				value := "foo bar"
+				accounts := []storage.Account{
+					{Name: &name, Sku: &storage.Sku{Name: storage.SkuName(sku)}, Kind: storage.Kind(kind), Location: &location},
+				}
+				keys := storage.AccountListKeysResult{
+					Keys: &[]storage.AccountKey{
+						{Value: &value},
+					},
+				}
+
+				allParam := map[string]string{
+					skuNameField:         "premium",
+					locationField:        "loc",
+					resourceGroupField:   "rg",
+					shareNameField:       "",
+					storeAccountKeyField: "storeaccountkey",
+					secretNamespaceField: "default",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-throttled",
+					VolumeCapabilities: stdVolCap,
+					CapacityRange:      lessThanPremCapRange,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+				d.cloud.KubeClient = fake.NewSimpleClientset()
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				// saturate the per-subscription account creation budget
+				d.accountCreateLimiter = newAccountCreateLimiter(1)
+				assert.NoError(t, d.accountCreateLimiter.acquire(d.cloud.SubscriptionID))
+
+				expectedErr := status.Errorf(codes.Aborted, "account creation for file share(%s) rejected: subscription(%s) already runs 1 concurrent account creation(s)", "random-vol-name-throttled", d.cloud.SubscriptionID)
+				_, err := d.CreateVolume(context.Background(), req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+
+				// share operations on an existing account are not throttled by
+				// the account creation limiter
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+
+				mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+				d.cloud.StorageAccountClient = mockStorageAccountsClient
+
+				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{Kind: storage.FileStorage}, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &fakeShareQuota}}, nil).AnyTimes()
+
+				allParam[storageAccountField] = "stoacc"
+				_, err = d.CreateVolume(context.Background(), req)
+				if !reflect.DeepEqual(err, nil) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "Account being deleted is skipped with rollover",
+			testFunc: func(t *testing.T) {
+				name := "delacct"
+				sku := "sku"
+				kind := "StorageV2"
+				location := "loc"
+				value := "foo bar"
+				accounts := []storage.Account{
+					{Name: &name, Sku: &storage.Sku{Name: storage.SkuName(sku)}, Kind: storage.Kind(kind), Location: &location},
+				}
+				keys := storage.AccountListKeysResult{
+					Keys: &[]storage.AccountKey{
+						{Value: &value},
+					},
+				}
+
+				allParam := map[string]string{
+					skuNameField:         sku,
+					locationField:        location,
+					resourceGroupField:   "rg",
+					shareNameField:       "",
+					storeAccountKeyField: "storeaccountkey",
+					secretNamespaceField: "default",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-deleting-account",
+					VolumeCapabilities: stdVolCap,
+					CapacityRange:      lessThanPremCapRange,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+				d.cloud.KubeClient = fake.NewSimpleClientset()
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+
+				mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+				d.cloud.StorageAccountClient = mockStorageAccountsClient
+
+				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).AnyTimes()
+				// the reused candidate reports a deleting provisioning state,
+				// any other (the rollover) account is ready
+				mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+					func(_ context.Context, _, accountName string) (storage.Account, *retry.Error) {
+						state := storage.Succeeded
+						if accountName == name {
+							state = accountProvisioningStateDeleting
+						}
+						return storage.Account{Kind: storage.StorageV2, AccountProperties: &storage.AccountProperties{ProvisioningState: state}}, nil
+					}).AnyTimes()
+
+				resp, err := d.CreateVolume(context.Background(), req)
+				if !reflect.DeepEqual(err, nil) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				if resp != nil && strings.Contains(resp.Volume.VolumeId, "#delacct#") {
+					t.Errorf("the share was created on the account being deleted: %s", resp.Volume.VolumeId)
+				}
+			},
+		},
+		{
+			name: "Invalid quota margin percent",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					quotaMarginPercentField: "200",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-invalid-quota-margin",
+					VolumeCapabilities: stdVolCap,
+					CapacityRange:      stdCapRange,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				expectedErr := status.Errorf(codes.InvalidArgument, "invalid %s(%s): must be an integer between 0 and %d", quotaMarginPercentField, "200", maxQuotaMarginPercent)
+				_, err := d.CreateVolume(context.Background(), req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v, expected error: %v", err, expectedErr)
+				}
+			},
+		},
+		{
+			name: "Quota margin percent applied",
+			testFunc: func(t *testing.T) {
+				tests := []struct {
+					desc                  string
+					margin                string
+					expectedCapacityBytes int64
+					expectedQuota         int32
+				}{
+					{
+						desc:                  "10 percent margin on top of the rounded size",
+						margin:                "10",
+						expectedCapacityBytes: volumehelper.GiBToBytes(110),
+						expectedQuota:         110,
+					},
+					{
+						desc:                  "zero margin keeps the exact rounded size",
+						margin:                "0",
+						expectedCapacityBytes: volumehelper.GiBToBytes(100),
+						expectedQuota:         100,
+					},
+				}
+				for _, test := range tests {
+					allParam := map[string]string{
+						storageAccountField:     "stoacc",
+						resourceGroupField:      "rg",
+						quotaMarginPercentField: test.margin,
+						storeAccountKeyField:    storeAccountKeyFalse,
+					}
+
+					req := &csi.CreateVolumeRequest{
+						Name:               "random-vol-name-quota-margin",
+						VolumeCapabilities: stdVolCap,
+						CapacityRange:      &csi.CapacityRange{RequiredBytes: volumehelper.GiBToBytes(100)},
+						Parameters:         allParam,
+					}
+
+					d := NewFakeDriver()
+					d.cloud = &azure.Cloud{}
+
+					ctrl := gomock.NewController(t)
+					defer ctrl.Finish()
+
+					mockFileClient := mockfileclient.NewMockInterface(ctrl)
+					d.cloud.FileClient = mockFileClient
+
+					var shareOptions *fileclient.ShareOptions
+					mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).AnyTimes()
+					mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+						func(_, _ string, options *fileclient.ShareOptions) error {
+							shareOptions = options
+							return nil
+						}).Times(1)
+
+					d.AddControllerServiceCapabilities(
+						[]csi.ControllerServiceCapability_RPC_Type{
+							csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+						})
+
+					res, err := d.CreateVolume(context.Background(), req)
+					if !reflect.DeepEqual(err, nil) {
+						t.Errorf("test[%s]: unexpected error: %v", test.desc, err)
+						continue
+					}
+					assert.Equal(t, test.expectedCapacityBytes, res.Volume.CapacityBytes, test.desc)
+					if assert.NotNil(t, shareOptions, test.desc) {
+						assert.Equal(t, int(test.expectedQuota), shareOptions.RequestGiB, test.desc)
+					}
+				}
+			},
+		},
+		{
+			name: "Edge zone without location",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					edgeZoneField: "microsoftlosangeles1",
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-edge-zone-no-location",
+					VolumeCapabilities: stdVolCap,
+					CapacityRange:      stdCapRange,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				expectedErr := status.Errorf(codes.InvalidArgument, "invalid %s(%s): an edge zone requires the %s parameter to be set", edgeZoneField, "microsoftlosangeles1", locationField)
+				_, err := d.CreateVolume(context.Background(), req)
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v, expected error: %v", err, expectedErr)
+				}
+			},
+		},
+		{
+			name: "Edge zone passed to account creation",
+			testFunc: func(t *testing.T) {
+				value := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+				keys := storage.AccountListKeysResult{
+					Keys: &[]storage.AccountKey{
+						{Value: &value},
+					},
+				}
+
+				allParam := map[string]string{
+					skuNameField:         "premium",
+					locationField:        "centralus",
+					edgeZoneField:        "microsoftlosangeles1",
+					storeAccountKeyField: storeAccountKeyFalse,
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-edge-zone",
+					VolumeCapabilities: stdVolCap,
+					CapacityRange:      lessThanPremCapRange,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+				d.cloud.KubeClient = fake.NewSimpleClientset()
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+
+				mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+				d.cloud.StorageAccountClient = mockStorageAccountsClient
+
+				var createParams storage.AccountCreateParameters
+				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{Kind: storage.FileStorage}, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any()).Return([]storage.Account{}, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+					func(_ context.Context, _, _ string, parameters storage.AccountCreateParameters) *retry.Error {
+						createParams = parameters
+						return nil
+					}).Times(1)
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &fakeShareQuota}}, nil).AnyTimes()
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				res, err := d.CreateVolume(context.Background(), req)
+				if !reflect.DeepEqual(err, nil) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				if assert.NotNil(t, createParams.Tags[edgeZoneTagKey]) {
+					assert.Equal(t, "microsoftlosangeles1", *createParams.Tags[edgeZoneTagKey])
+				}
+				expectedTopology := []*csi.Topology{
+					{
+						Segments: map[string]string{
+							d.topologyLocationKey(): "centralus",
+							d.topologyEdgeZoneKey(): "microsoftlosangeles1",
+						},
+					},
+				}
+				assert.Equal(t, expectedTopology, res.Volume.AccessibleTopology)
+			},
+		},
+		{
+			name: "Protocol specific default resource group used for account creation",
+			testFunc: func(t *testing.T) {
+				value := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+				keys := storage.AccountListKeysResult{
+					Keys: &[]storage.AccountKey{
+						{Value: &value},
+					},
+				}
+
+				allParam := map[string]string{
+					skuNameField:         "standard_lrs",
+					storeAccountKeyField: storeAccountKeyFalse,
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-default-rg",
+					VolumeCapabilities: stdVolCap,
+					CapacityRange:      lessThanPremCapRange,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+				d.cloud.ResourceGroup = "cloud-rg"
+				d.defaultResourceGroupSMB = "smb-rg"
+				d.cloud.KubeClient = fake.NewSimpleClientset()
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+
+				mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+				d.cloud.StorageAccountClient = mockStorageAccountsClient
+
+				var createRG string
+				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any()).Return([]storage.Account{}, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+					func(_ context.Context, resourceGroup, _ string, _ storage.AccountCreateParameters) *retry.Error {
+						createRG = resourceGroup
+						return nil
+					}).Times(1)
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &fakeShareQuota}}, nil).AnyTimes()
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				res, err := d.CreateVolume(context.Background(), req)
+				if !reflect.DeepEqual(err, nil) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				assert.Equal(t, "smb-rg", createRG)
+				// a share-mode volume records diskmode false in the volume context
+				assert.Equal(t, "false", res.Volume.VolumeContext[diskModeField])
+			},
+		},
+		{
+			name: "Rollover to a new account succeeds when the selected account is full",
+			testFunc: func(t *testing.T) {
+				value := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+				keys := storage.AccountListKeysResult{
+					Keys: &[]storage.AccountKey{
+						{Value: &value},
+					},
+				}
+
+				allParam := map[string]string{
+					skuNameField:         "standard_lrs",
+					storeAccountKeyField: storeAccountKeyFalse,
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-rollover",
+					VolumeCapabilities: stdVolCap,
+					CapacityRange:      lessThanPremCapRange,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+				d.cloud.ResourceGroup = "rg"
+				d.cloud.KubeClient = fake.NewSimpleClientset()
+				d.accountRolloverAttempts = 2
+				d.accountRolloverDelay = time.Millisecond
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+
+				mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+				d.cloud.StorageAccountClient = mockStorageAccountsClient
+
+				var createdAccounts []string
+				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any()).Return([]storage.Account{}, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+					func(_ context.Context, _, accountName string, _ storage.AccountCreateParameters) *retry.Error {
+						createdAccounts = append(createdAccounts, accountName)
+						return nil
+					}).Times(2)
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &fakeShareQuota}}, nil).AnyTimes()
+				// the first account fills up, the rollover account accepts the share
+				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("storage service error: %s", accountCapacityLimitExceed)).Times(1)
+				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).Times(1)
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				_, err := d.CreateVolume(context.Background(), req)
+				if !reflect.DeepEqual(err, nil) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				assert.Equal(t, 2, len(createdAccounts))
+				if len(createdAccounts) == 2 && createdAccounts[0] == createdAccounts[1] {
+					t.Errorf("rollover reused the full account(%s)", createdAccounts[0])
+				}
+			},
+		},
+		{
+			name: "Rollover attempts exhausted",
+			testFunc: func(t *testing.T) {
+				value := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+				keys := storage.AccountListKeysResult{
+					Keys: &[]storage.AccountKey{
+						{Value: &value},
+					},
+				}
+
+				allParam := map[string]string{
+					skuNameField:         "standard_lrs",
+					storeAccountKeyField: storeAccountKeyFalse,
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-rollover-exhausted",
+					VolumeCapabilities: stdVolCap,
+					CapacityRange:      lessThanPremCapRange,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+				d.cloud.ResourceGroup = "rg"
+				d.cloud.KubeClient = fake.NewSimpleClientset()
+				d.accountRolloverAttempts = 1
+				d.accountRolloverDelay = time.Millisecond
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+
+				mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+				d.cloud.StorageAccountClient = mockStorageAccountsClient
+
+				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any()).Return([]storage.Account{}, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).Times(2)
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &fakeShareQuota}}, nil).AnyTimes()
+				// every account fills up immediately, the single rollover attempt is not enough
+				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("storage service error: %s", accountCapacityLimitExceed)).Times(2)
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				_, err := d.CreateVolume(context.Background(), req)
+				if status.Code(err) != codes.ResourceExhausted {
+					t.Errorf("Unexpected error: %v, expected ResourceExhausted", err)
+				}
+				if err == nil || !strings.Contains(err.Error(), "rollover attempt") {
+					t.Errorf("Unexpected error message: %v", err)
+				}
+			},
+		},
+		{
+			name: "Account pooling packs shares up to the limit before creating a new account",
+			testFunc: func(t *testing.T) {
+				value := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+				keys := storage.AccountListKeysResult{
+					Keys: &[]storage.AccountKey{
+						{Value: &value},
+					},
+				}
+
+				allParam := map[string]string{
+					skuNameField:         "standard_lrs",
+					storeAccountKeyField: storeAccountKeyFalse,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+				d.cloud.ResourceGroup = "rg"
+				d.cloud.Location = "loc"
+				d.cloud.KubeClient = fake.NewSimpleClientset()
+				d.maxSharesPerAccount = 2
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+
+				mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+				d.cloud.StorageAccountClient = mockStorageAccountsClient
+
+				// the account listing reflects the accounts created so far
+				var createdAccounts []storage.Account
+				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.Account{}, nil).AnyTimes()
+				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any()).DoAndReturn(
+					func(_ context.Context, _ string) ([]storage.Account, *retry.Error) {
+						return createdAccounts, nil
+					}).AnyTimes()
+				// two shares fit into one account, the third needs a second one
+				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+					func(_ context.Context, _, accountName string, cp storage.AccountCreateParameters) *retry.Error {
+						name := accountName
+						createdAccounts = append(createdAccounts, storage.Account{Name: &name, Sku: cp.Sku, Kind: cp.Kind, Location: cp.Location})
+						return nil
+					}).Times(2)
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).AnyTimes()
+				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).Times(3)
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				var usedAccounts []string
+				for i := 0; i < 3; i++ {
+					req := &csi.CreateVolumeRequest{
+						Name:               fmt.Sprintf("random-vol-name-pool-%d", i),
+						VolumeCapabilities: stdVolCap,
+						CapacityRange:      lessThanPremCapRange,
+						Parameters:         allParam,
+					}
+					resp, err := d.CreateVolume(context.Background(), req)
+					if !reflect.DeepEqual(err, nil) {
+						t.Fatalf("Unexpected error: %v", err)
+					}
+					// the account the share landed on is recorded in the volume id
+					usedAccounts = append(usedAccounts, strings.Split(resp.Volume.VolumeId, separator)[1])
+				}
+				assert.Equal(t, 2, len(createdAccounts))
+				assert.Equal(t, usedAccounts[0], usedAccounts[1])
+				assert.NotEqual(t, usedAccounts[0], usedAccounts[2])
+			},
+		},
+		{
+			name: "Access mode policy picks the single-node default quota",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					storageAccountField:  "stoacc",
+					resourceGroupField:   "rg",
+					fsTypeField:          "smb",
+					storeAccountKeyField: storeAccountKeyFalse,
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-single-node-quota",
+					VolumeCapabilities: stdVolCap,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+				d.enableAccessModeDefaults = true
+				d.singleNodeDefaultQuotaGiB = 10
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+
+				var shareGiB int
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).AnyTimes()
+				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+					func(_, _ string, shareOptions *fileclient.ShareOptions) error {
+						shareGiB = shareOptions.RequestGiB
+						return nil
+					}).Times(1)
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				_, err := d.CreateVolume(context.Background(), req)
+				if !reflect.DeepEqual(err, nil) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				assert.Equal(t, 10, shareGiB)
+			},
+		},
+		{
+			name: "Access mode policy defaults single-node volumes to disk mode",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					storageAccountField:  "stoacc",
+					resourceGroupField:   "rg",
+					shareNameField:       "sharename",
+					diskNameField:        "disk.vhd",
+					storeAccountKeyField: storeAccountKeyFalse,
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-single-node-disk-mode",
+					VolumeCapabilities: stdVolCap,
+					CapacityRange:      stdCapRange,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+				d.enableAccessModeDefaults = true
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).AnyTimes()
+				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).Times(1)
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				res, err := d.CreateVolume(context.Background(), req)
+				if !reflect.DeepEqual(err, nil) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				assert.Equal(t, ext4, res.Volume.VolumeContext[fsTypeField])
+				assert.Equal(t, "true", res.Volume.VolumeContext[diskModeField])
+			},
+		},
+		{
+			name: "Access mode policy leaves multi-node volumes on share defaults",
+			testFunc: func(t *testing.T) {
+				multiNodeVolCap := []*csi.VolumeCapability{
+					{
+						AccessType: &csi.VolumeCapability_Mount{
+							Mount: &csi.VolumeCapability_MountVolume{},
+						},
+						AccessMode: &csi.VolumeCapability_AccessMode{
+							Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+						},
+					},
+				}
+				allParam := map[string]string{
+					storageAccountField:  "stoacc",
+					resourceGroupField:   "rg",
+					storeAccountKeyField: storeAccountKeyFalse,
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-multi-node-defaults",
+					VolumeCapabilities: multiNodeVolCap,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+				d.enableAccessModeDefaults = true
+				d.singleNodeDefaultQuotaGiB = 10
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+
+				var shareGiB int
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{}, fmt.Errorf("ShareNotFound")).AnyTimes()
+				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+					func(_, _ string, shareOptions *fileclient.ShareOptions) error {
+						shareGiB = shareOptions.RequestGiB
+						return nil
+					}).Times(1)
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				res, err := d.CreateVolume(context.Background(), req)
+				if !reflect.DeepEqual(err, nil) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				assert.Equal(t, defaultAzureFileQuota, shareGiB)
+				assert.Equal(t, "false", res.Volume.VolumeContext[diskModeField])
+			},
+		},
+		{
+			name: "Reuse of an existing share with matching protocol",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					storageAccountField:  "stoacc",
+					resourceGroupField:   "rg",
+					shareNameField:       "existingshare",
+					storeAccountKeyField: storeAccountKeyFalse,
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-share-reuse",
+					VolumeCapabilities: stdVolCap,
+					CapacityRange:      lessThanPremCapRange,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &fakeShareQuota, EnabledProtocols: storage.SMB}}, nil).AnyTimes()
+				// the share already exists with the requested capacity, the retried
+				// request must return it without re-running share creation
+				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				res, err := d.CreateVolume(context.Background(), req)
+				if !reflect.DeepEqual(err, nil) {
+					t.Errorf("Unexpected error: %v", err)
+				}
+				assert.Equal(t, "rg#stoacc#existingshare#", res.Volume.VolumeId)
+			},
+		},
+		{
+			name: "Reuse of an existing share with a conflicting capacity",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					storageAccountField:  "stoacc",
+					resourceGroupField:   "rg",
+					shareNameField:       "existingshare",
+					storeAccountKeyField: storeAccountKeyFalse,
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-share-reuse-capacity",
+					VolumeCapabilities: stdVolCap,
+					CapacityRange:      stdCapRange,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &fakeShareQuota, EnabledProtocols: storage.SMB}}, nil).AnyTimes()
+				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				_, err := d.CreateVolume(context.Background(), req)
+				expectedErr := status.Errorf(codes.AlreadyExists, "request file share(existingshare) already exists, but its capacity(100) is different from (5)")
+				if !reflect.DeepEqual(err, expectedErr) {
+					t.Errorf("Unexpected error: %v, expected: %v", err, expectedErr)
+				}
+			},
+		},
+		{
+			name: "Reuse of an existing share with mismatched protocol",
+			testFunc: func(t *testing.T) {
+				allParam := map[string]string{
+					storageAccountField:  "stoacc",
+					resourceGroupField:   "rg",
+					shareNameField:       "existingshare",
+					storeAccountKeyField: storeAccountKeyFalse,
+				}
+
+				req := &csi.CreateVolumeRequest{
+					Name:               "random-vol-name-share-reuse-mismatch",
+					VolumeCapabilities: stdVolCap,
+					CapacityRange:      lessThanPremCapRange,
+					Parameters:         allParam,
+				}
+
+				d := NewFakeDriver()
+				d.cloud = &azure.Cloud{}
+
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
+
+				// the named share only speaks NFS while the volume requests SMB
+				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &fakeShareQuota, EnabledProtocols: storage.NFS}}, nil).AnyTimes()
+
+				d.AddControllerServiceCapabilities(
+					[]csi.ControllerServiceCapability_RPC_Type{
+						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+					})
+
+				_, err := d.CreateVolume(context.Background(), req)
+				if status.Code(err) != codes.InvalidArgument {
+					t.Errorf("Unexpected error: %v, expected InvalidArgument", err)
+				}
+				if err == nil || !strings.Contains(err.Error(), "was created with protocol NFS") {
+					t.Errorf("Unexpected error message: %v", err)
+				}
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, tc.testFunc)
+	}
+}
+
+func TestValidateAccountKind(t *testing.T) {
+	tests := []struct {
+		desc        string
+		kind        storage.Kind
+		protocol    string
+		sku         string
+		expectedErr error
+	}{
+		{
+			desc:        "NFS on FileStorage account",
+			kind:        storage.FileStorage,
+			protocol:    nfs,
+			sku:         "Premium_LRS",
+			expectedErr: nil,
+		},
+		{
+			desc:        "NFS on StorageV2 account",
+			kind:        storage.StorageV2,
+			protocol:    nfs,
+			sku:         "Premium_LRS",
+			expectedErr: status.Errorf(codes.InvalidArgument, "NFS protocol requires account kind %s but account(%s) is %s", storage.FileStorage, "stoacc", storage.StorageV2),
+		},
+		{
+			desc:        "premium sku on StorageV2 account",
+			kind:        storage.StorageV2,
+			protocol:    smb,
+			sku:         "Premium_LRS",
+			expectedErr: status.Errorf(codes.InvalidArgument, "sku(%s) requires account kind %s but account(%s) is %s", "Premium_LRS", storage.FileStorage, "stoacc", storage.StorageV2),
+		},
+		{
+			desc:        "standard sku on StorageV2 account",
+			kind:        storage.StorageV2,
+			protocol:    smb,
+			sku:         "Standard_LRS",
+			expectedErr: nil,
+		},
+		{
+			desc:        "unknown kind is not validated",
+			kind:        "",
+			protocol:    nfs,
+			sku:         "Premium_LRS",
+			expectedErr: nil,
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		d.cloud = &azure.Cloud{}
+
+		ctrl := gomock.NewController(t)
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), "rg", "stoacc").Return(storage.Account{Kind: test.kind}, nil).Times(1)
+
+		err := d.validateAccountKind(context.Background(), "rg", "stoacc", test.protocol, test.sku)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		}
+		ctrl.Finish()
+	}
+}
+
+func TestDefaultResourceGroup(t *testing.T) {
+	d := NewFakeDriver()
+	d.cloud = &azure.Cloud{}
+	d.cloud.ResourceGroup = "cloud-rg"
+
+	tests := []struct {
+		desc       string
+		smbDefault string
+		nfsDefault string
+		protocol   string
+		expected   string
+	}{
+		{
+			desc:     "no per-protocol default falls back to cloud config",
+			protocol: smb,
+			expected: "cloud-rg",
+		},
+		{
+			desc:       "SMB default used for SMB protocol",
+			smbDefault: "smb-rg",
+			nfsDefault: "nfs-rg",
+			protocol:   smb,
+			expected:   "smb-rg",
+		},
+		{
+			desc:       "SMB default used when protocol is empty",
+			smbDefault: "smb-rg",
+			nfsDefault: "nfs-rg",
+			protocol:   "",
+			expected:   "smb-rg",
+		},
+		{
+			desc:       "NFS default used for NFS protocol",
+			smbDefault: "smb-rg",
+			nfsDefault: "nfs-rg",
+			protocol:   nfs,
+			expected:   "nfs-rg",
+		},
+		{
+			desc:       "NFS without default falls back to cloud config",
+			smbDefault: "smb-rg",
+			protocol:   nfs,
+			expected:   "cloud-rg",
+		},
+	}
+
+	for _, test := range tests {
+		d.defaultResourceGroupSMB = test.smbDefault
+		d.defaultResourceGroupNFS = test.nfsDefault
+		result := d.defaultResourceGroup(test.protocol)
+		if result != test.expected {
+			t.Errorf("test(%s): got(%s), expected(%s)", test.desc, result, test.expected)
+		}
+	}
+}
+
+func TestWaitForAccountReady(t *testing.T) {
+	d := NewFakeDriver()
+	d.cloud = &azure.Cloud{}
+
+	savedBackoff := accountReadyBackoff
+	accountReadyBackoff = wait.Backoff{Duration: 1 * time.Millisecond, Factor: 2, Steps: 3}
+	defer func() { accountReadyBackoff = savedBackoff }()
+
+	accountInState := func(state storage.ProvisioningState) storage.Account {
+		return storage.Account{AccountProperties: &storage.AccountProperties{ProvisioningState: state}}
+	}
+
+	tests := []struct {
+		desc        string
+		states      []storage.ProvisioningState
+		expectedErr error
+	}{
+		{
+			desc:        "account ready right away",
+			states:      []storage.ProvisioningState{storage.Succeeded},
+			expectedErr: nil,
+		},
+		{
+			desc:        "account ready after polling out of Creating",
+			states:      []storage.ProvisioningState{storage.Creating, storage.ResolvingDNS, storage.Succeeded},
+			expectedErr: nil,
+		},
+		{
+			desc:        "account never becomes ready",
+			states:      []storage.ProvisioningState{storage.Creating, storage.Creating, storage.Creating},
+			expectedErr: fmt.Errorf("storage account(accountname) never became ready, last provisioning state: Creating"),
+		},
+	}
+
+	for _, test := range tests {
+		ctrl := gomock.NewController(t)
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+
+		calls := 0
+		mockStorageAccountsClient.EXPECT().GetProperties(gomock.Any(), "rg", "accountname").DoAndReturn(
+			func(_ context.Context, _, _ string) (storage.Account, *retry.Error) {
+				state := test.states[len(test.states)-1]
+				if calls < len(test.states) {
+					state = test.states[calls]
+				}
+				calls++
+				return accountInState(state), nil
+			}).AnyTimes()
+
+		err := d.waitForAccountReady(context.Background(), "rg", "accountname")
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test(%s): got(%v), expected(%v)", test.desc, err, test.expectedErr)
+		}
+		ctrl.Finish()
+	}
+}
+
+func TestCheckExpandWithSnapshots(t *testing.T) {
+	d := NewFakeDriver()
+
+	tests := []struct {
+		desc         string
+		policy       string
+		hasSnapshots bool
+		expectedErr  error
+	}{
+		{
+			desc:         "proceed policy expands a share with snapshots",
+			policy:       expandWithSnapshotsProceed,
+			hasSnapshots: true,
+			expectedErr:  nil,
+		},
+		{
+			desc:         "warn policy expands a share with snapshots",
+			policy:       expandWithSnapshotsWarn,
+			hasSnapshots: true,
+			expectedErr:  nil,
+		},
+		{
+			desc:         "block policy rejects expanding a share with snapshots",
+			policy:       expandWithSnapshotsBlock,
+			hasSnapshots: true,
+			expectedErr:  status.Errorf(codes.FailedPrecondition, "volume(vol_1) has existing snapshots and the expand-with-snapshots-policy is block, delete the snapshots before expanding the volume"),
+		},
+		{
+			desc:         "block policy expands a share without snapshots",
+			policy:       expandWithSnapshotsBlock,
+			hasSnapshots: false,
+			expectedErr:  nil,
+		},
+	}
+
+	for _, test := range tests {
+		d.expandWithSnapshotsPolicy = test.policy
+		err := d.checkExpandWithSnapshots("vol_1", test.hasSnapshots)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test(%s): got(%v), expected(%v)", test.desc, err, test.expectedErr)
+		}
+	}
+}
 
-				ctrl := gomock.NewController(t)
-				defer ctrl.Finish()
+func TestResolveDeleteWithSnapshots(t *testing.T) {
+	d := NewFakeDriver()
 
-				mockFileClient := mockfileclient.NewMockInterface(ctrl)
-				d.cloud.FileClient = mockFileClient
+	tests := []struct {
+		desc           string
+		policy         string
+		hasSnapshots   bool
+		expectedAction deleteSnapshotsAction
+		expectedErr    error
+	}{
+		{
+			desc:           "include policy deletes the snapshots with the share",
+			policy:         deleteWithSnapshotsInclude,
+			hasSnapshots:   true,
+			expectedAction: deleteShareAndSnapshots,
+		},
+		{
+			desc:           "fail policy rejects deletion of a share with snapshots",
+			policy:         deleteWithSnapshotsFail,
+			hasSnapshots:   true,
+			expectedAction: deleteShareOnly,
+			expectedErr:    status.Errorf(codes.FailedPrecondition, "volume(vol_1) has existing snapshots and the delete-with-snapshots-policy is fail, delete the snapshots before deleting the volume"),
+		},
+		{
+			desc:           "retain policy keeps the share and its snapshots",
+			policy:         deleteWithSnapshotsRetain,
+			hasSnapshots:   true,
+			expectedAction: retainShare,
+		},
+		{
+			desc:           "a share without snapshots is always deleted plainly",
+			policy:         deleteWithSnapshotsFail,
+			hasSnapshots:   false,
+			expectedAction: deleteShareOnly,
+		},
+	}
 
-				mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
-				d.cloud.StorageAccountClient = mockStorageAccountsClient
+	for _, test := range tests {
+		d.deleteWithSnapshotsPolicy = test.policy
+		action, err := d.resolveDeleteWithSnapshots("vol_1", test.hasSnapshots)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test(%s): got(%v), expected(%v)", test.desc, err, test.expectedErr)
+		}
+		if action != test.expectedAction {
+			t.Errorf("test(%s): got action(%d), expected(%d)", test.desc, action, test.expectedAction)
+		}
+	}
+}
 
-				mockFileClient.EXPECT().CreateFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
-				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
-				mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any()).Return(accounts, nil).AnyTimes()
-				mockStorageAccountsClient.EXPECT().Create(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(nil).AnyTimes()
-				mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &fakeShareQuota}}, nil).AnyTimes()
+// errorReasonDetail extracts the machine-readable reason code attached to a
+// status error, returns an empty string when no reason detail is present
+func errorReasonDetail(err error) string {
+	for _, detail := range status.Convert(err).Details() {
+		if reason, ok := detail.(*wrappers.StringValue); ok {
+			return reason.GetValue()
+		}
+	}
+	return ""
+}
 
-				d.AddControllerServiceCapabilities(
-					[]csi.ControllerServiceCapability_RPC_Type{
-						csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-					})
+func TestErrorReason(t *testing.T) {
+	tests := []struct {
+		desc           string
+		err            error
+		expectedReason string
+	}{
+		{
+			desc:           "nil error has no reason",
+			err:            nil,
+			expectedReason: "",
+		},
+		{
+			desc:           "capacity limit maps to quota exceeded",
+			err:            fmt.Errorf("storage service error: %s", accountCapacityLimitExceed),
+			expectedReason: reasonQuotaExceeded,
+		},
+		{
+			desc:           "share count limit maps to quota exceeded",
+			err:            fmt.Errorf("storage service error: %s", shareCountLimitExceed),
+			expectedReason: reasonQuotaExceeded,
+		},
+		{
+			desc:           "missing account maps to account not found",
+			err:            fmt.Errorf("storage service error: %s", resourceNotFound),
+			expectedReason: reasonAccountNotFound,
+		},
+		{
+			desc:           "throttling maps to throttled",
+			err:            fmt.Errorf("storage service error: %s", clientThrottled),
+			expectedReason: reasonThrottled,
+		},
+		{
+			desc:           "unclassified error has no reason",
+			err:            fmt.Errorf("test error"),
+			expectedReason: "",
+		},
+	}
 
-				ctx := context.Background()
+	for _, test := range tests {
+		if reason := errorReason(test.err); reason != test.expectedReason {
+			t.Errorf("test(%s): got reason(%s), expected(%s)", test.desc, reason, test.expectedReason)
+		}
+	}
+}
 
-				_, err := d.CreateVolume(ctx, req)
-				if !reflect.DeepEqual(err, nil) {
-					t.Errorf("Unexpected error: %v", err)
-				}
-			},
+func TestValidateEdgeZone(t *testing.T) {
+	tests := []struct {
+		desc        string
+		location    string
+		edgeZone    string
+		expectError bool
+	}{
+		{
+			desc:        "valid combination",
+			location:    "centralus",
+			edgeZone:    "microsoftlosangeles1",
+			expectError: false,
+		},
+		{
+			desc:        "missing location",
+			location:    "",
+			edgeZone:    "microsoftlosangeles1",
+			expectError: true,
+		},
+		{
+			desc:        "edge zone equals location",
+			location:    "centralus",
+			edgeZone:    "CentralUS",
+			expectError: true,
+		},
+		{
+			desc:        "invalid edge zone name",
+			location:    "centralus",
+			edgeZone:    "Los_Angeles",
+			expectError: true,
 		},
 	}
 
-	for _, tc := range testCases {
-		t.Run(tc.name, tc.testFunc)
+	for _, test := range tests {
+		err := validateEdgeZone(test.location, test.edgeZone)
+		if (err != nil) != test.expectError {
+			t.Errorf("test[%s]: unexpected error: %v", test.desc, err)
+		}
 	}
 }
 
@@ -764,6 +2585,69 @@ func TestDeleteVolume(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "Delete resolves the subscription from the volume id",
+			testFunc: func(t *testing.T) {
+				req := &csi.DeleteVolumeRequest{
+					VolumeId: "vol_1#f5713de20cde511e8ba4900#fileshare#diskname#subs2",
+					Secrets:  map[string]string{},
+				}
+
+				ctx := context.Background()
+				d := NewFakeDriver()
+				d.Cap = []*csi.ControllerServiceCapability{
+					{
+						Type: &csi.ControllerServiceCapability_Rpc{
+							Rpc: &csi.ControllerServiceCapability_RPC{Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME},
+						},
+					},
+				}
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud = &azure.Cloud{}
+				d.cloud.SubscriptionID = "subs1"
+				// the delete must go through the subs2 client, not the default one
+				d.fileClients["subs2"] = mockFileClient
+				mockFileClient.EXPECT().DeleteFileShare("vol_1", "f5713de20cde511e8ba4900", "fileshare").Return(nil).Times(1)
+
+				_, err := d.DeleteVolume(ctx, req)
+				if err != nil {
+					t.Errorf("Unexpected error: %v", err)
+				}
+			},
+		},
+		{
+			name: "Machine readable reason code attached on throttled delete",
+			testFunc: func(t *testing.T) {
+				req := &csi.DeleteVolumeRequest{
+					VolumeId: "vol_1#f5713de20cde511e8ba4900#fileshare#diskname#",
+					Secrets:  map[string]string{},
+				}
+
+				ctx := context.Background()
+				d := NewFakeDriver()
+				d.Cap = []*csi.ControllerServiceCapability{
+					{
+						Type: &csi.ControllerServiceCapability_Rpc{
+							Rpc: &csi.ControllerServiceCapability_RPC{Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME},
+						},
+					},
+				}
+				ctrl := gomock.NewController(t)
+				defer ctrl.Finish()
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud = &azure.Cloud{}
+				d.cloud.FileClient = mockFileClient
+				mockFileClient.EXPECT().DeleteFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(fmt.Errorf("storage service error: %s", tooManyRequests)).Times(1)
+
+				_, err := d.DeleteVolume(ctx, req)
+				if status.Code(err) != codes.Internal {
+					t.Errorf("Unexpected error: %v, expected Internal", err)
+				}
+				assert.Equal(t, reasonThrottled, errorReasonDetail(err))
+			},
+		},
 		{
 			name: "Valid request",
 			testFunc: func(t *testing.T) {
@@ -803,12 +2687,55 @@ func TestDeleteVolume(t *testing.T) {
 
 func TestControllerGetVolume(t *testing.T) {
 	d := NewFakeDriver()
-	req := csi.ControllerGetVolumeRequest{}
-	resp, err := d.ControllerGetVolume(context.Background(), &req)
+
+	// volume ID is required
+	resp, err := d.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{})
 	assert.Nil(t, resp)
-	if !reflect.DeepEqual(err, status.Error(codes.Unimplemented, "")) {
+	if !reflect.DeepEqual(err, status.Error(codes.InvalidArgument, "Volume ID missing in request")) {
 		t.Errorf("Unexpected error: %v", err)
 	}
+
+	// a disk-mode volume reports diskmode true
+	resp, err = d.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{
+		VolumeId: "rg#f5713de20cde511e8ba4900#sharename#diskname.vhd",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "true", resp.Volume.VolumeContext[diskModeField])
+
+	// a share-mode volume reports diskmode false, without a cloud client the
+	// capacity stays unknown
+	resp, err = d.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{
+		VolumeId: "rg#f5713de20cde511e8ba4900#sharename",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "false", resp.Volume.VolumeContext[diskModeField])
+	assert.Equal(t, int64(0), resp.Volume.CapacityBytes)
+
+	// a pre-provisioned volume derives its capacity from the live share quota
+	fakeShareQuota := int32(100)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	d.cloud = &azure.Cloud{}
+	mockFileClient := mockfileclient.NewMockInterface(ctrl)
+	d.cloud.FileClient = mockFileClient
+	mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &fakeShareQuota}}, nil).AnyTimes()
+
+	resp, err = d.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{
+		VolumeId: "rg#f5713de20cde511e8ba4900#sharename",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, volumehelper.GiBToBytes(int64(fakeShareQuota)), resp.Volume.CapacityBytes)
+
+	// a quota lookup failure must not fail the RPC
+	mockFileClientErr := mockfileclient.NewMockInterface(ctrl)
+	d.cloud.FileClient = mockFileClientErr
+	mockFileClientErr.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{}, fmt.Errorf("test error")).AnyTimes()
+
+	resp, err = d.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{
+		VolumeId: "rg#f5713de20cde511e8ba4900#sharename",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), resp.Volume.CapacityBytes)
 }
 
 func TestControllerGetCapabilities(t *testing.T) {
@@ -1350,7 +3277,8 @@ func TestControllerExpandVolume(t *testing.T) {
 
 				ctrl := gomock.NewController(t)
 				defer ctrl.Finish()
-				value := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+				// not valid base64, the vhd resize fails fast when building the credential
+				value := "foo bar"
 				key := storage.AccountListKeysResult{
 					Keys: &[]storage.AccountKey{
 						{Value: &value},
@@ -1365,14 +3293,21 @@ func TestControllerExpandVolume(t *testing.T) {
 				ctx := context.Background()
 				mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
 				d.cloud.StorageAccountClient = mockStorageAccountsClient
+				mockFileClient := mockfileclient.NewMockInterface(ctrl)
+				d.cloud.FileClient = mockFileClient
 				d.cloud.KubeClient = clientSet
 				d.cloud.Environment = azure2.Environment{StorageEndpointSuffix: "abc"}
 				mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), "vol_1", gomock.Any()).Return(key, nil).AnyTimes()
+				// the share quota must be grown before the vhd file is resized
+				mockFileClient.EXPECT().ResizeFileShare("vol_1", "f5713de20cde511e8ba4900", "filename", int(volumehelper.RoundUpGiB(stdVolSize))).Return(nil).Times(1)
 
-				expectErr := status.Error(codes.Unimplemented, "vhd disk volume(vol_1#f5713de20cde511e8ba4900#filename#diskname#) is not supported on ControllerExpandVolume")
 				_, err := d.ControllerExpandVolume(ctx, req)
-				if !reflect.DeepEqual(err, expectErr) {
-					t.Errorf("Unexpected error: %v", err)
+				if status.Code(err) != codes.Internal {
+					t.Errorf("Unexpected error: %v, expected Internal", err)
+				}
+				// the vhd resize step was reached, it fails against the fake account key
+				if !strings.Contains(err.Error(), "failed to resize VHD disk") {
+					t.Errorf("Unexpected error message: %v", err)
 				}
 			},
 		},
@@ -1627,21 +3562,170 @@ func TestSnapshotExists(t *testing.T) {
 }
 
 func TestGetCapacity(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	name := "f5713de20cde511e8ba4900"
+	accounts := []storage.Account{
+		{Name: &name},
+	}
+
 	d := NewFakeDriver()
+	d.cloud = &azure.Cloud{}
+	mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+	d.cloud.StorageAccountClient = mockStorageAccountsClient
+	mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any()).Return(accounts, nil).Times(1)
+
 	req := csi.GetCapacityRequest{}
 	resp, err := d.GetCapacity(context.Background(), &req)
-	assert.Nil(t, resp)
-	if !reflect.DeepEqual(err, status.Error(codes.Unimplemented, "")) {
-		t.Errorf("Unexpected error: %v", err)
+	assert.NoError(t, err)
+	assert.Equal(t, volumehelper.GiBToBytes(accountCapacityGiB), resp.AvailableCapacity)
+
+	// second call should be served from the cached inventory without a relist
+	resp, err = d.GetCapacity(context.Background(), &req)
+	assert.NoError(t, err)
+	assert.Equal(t, volumehelper.GiBToBytes(accountCapacityGiB), resp.AvailableCapacity)
+
+	// after a refresh the recorded share usage should be reflected
+	d.accountInventory.recordShare(name, "fileshare", 100)
+	d.accountInventory.lastRefresh = time.Time{}
+	mockStorageAccountsClient.EXPECT().ListByResourceGroup(gomock.Any(), gomock.Any()).Return(accounts, nil).Times(1)
+	resp, err = d.GetCapacity(context.Background(), &req)
+	assert.NoError(t, err)
+	assert.Equal(t, volumehelper.GiBToBytes(accountCapacityGiB-100), resp.AvailableCapacity)
+}
+
+func TestValidateAccessPolicyPermissions(t *testing.T) {
+	tests := []struct {
+		permissions string
+		expectError bool
+	}{
+		{
+			permissions: "rcwdl",
+			expectError: false,
+		},
+		{
+			permissions: "rl",
+			expectError: false,
+		},
+		{
+			permissions: "",
+			expectError: true,
+		},
+		{
+			permissions: "rwx",
+			expectError: true,
+		},
+		{
+			permissions: "R",
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		err := validateAccessPolicyPermissions(test.permissions)
+		if (err != nil) != test.expectError {
+			t.Errorf("validateAccessPolicyPermissions(%s) returned with %v, expected error: %v", test.permissions, err, test.expectError)
+		}
+	}
+}
+
+func TestClampToCapacityLimit(t *testing.T) {
+	gib := int64(1024 * 1024 * 1024)
+	tests := []struct {
+		desc        string
+		requestGiB  int64
+		capRange    *csi.CapacityRange
+		expected    int64
+		expectError bool
+	}{
+		{
+			desc:       "no limit specified",
+			requestGiB: 5,
+			capRange:   &csi.CapacityRange{RequiredBytes: 5 * gib},
+			expected:   5,
+		},
+		{
+			desc:       "rounded up size within limit",
+			requestGiB: 5,
+			capRange:   &csi.CapacityRange{RequiredBytes: 4*gib + 1, LimitBytes: 10 * gib},
+			expected:   5,
+		},
+		{
+			desc:       "rounded up size exceeds limit, clamp to largest GiB multiple below limit",
+			requestGiB: defaultAzureFileQuota,
+			capRange:   &csi.CapacityRange{LimitBytes: 50 * gib},
+			expected:   50,
+		},
+		{
+			desc:        "limit below required minimum",
+			requestGiB:  5,
+			capRange:    &csi.CapacityRange{RequiredBytes: 4*gib + 1, LimitBytes: 5*gib - 1},
+			expectError: true,
+		},
+		{
+			desc:        "limit below one GiB",
+			requestGiB:  1,
+			capRange:    &csi.CapacityRange{RequiredBytes: 1, LimitBytes: gib - 1},
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		result, err := clampToCapacityLimit(test.requestGiB, test.capRange)
+		if test.expectError {
+			if err == nil {
+				t.Errorf("test[%s]: expected error, got none", test.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test[%s]: unexpected error: %v", test.desc, err)
+		}
+		if result != test.expected {
+			t.Errorf("test[%s]: got %d, expected %d", test.desc, result, test.expected)
+		}
 	}
 }
 
 func TestListVolumes(t *testing.T) {
 	d := NewFakeDriver()
-	req := csi.ListVolumesRequest{}
-	resp, err := d.ListVolumes(context.Background(), &req)
-	assert.Nil(t, resp)
-	if !reflect.DeepEqual(err, status.Error(codes.Unimplemented, "")) {
+	d.accountInventory.recordShare("stoacc", "pvc-share-a", 100)
+	d.accountInventory.recordShare("stoacc", "pvc-share-b", 100)
+	d.accountInventory.recordShare("stoacc", "unrelated-share", 100)
+
+	// without a prefix every tracked share is listed
+	resp, err := d.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(resp.Entries))
+
+	// only shares matching the configured prefix are listed
+	d.listVolumesSharePrefix = "pvc-"
+	resp, err = d.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(resp.Entries)) {
+		assert.Equal(t, "#stoacc#pvc-share-a#", resp.Entries[0].Volume.VolumeId)
+		assert.Equal(t, "#stoacc#pvc-share-b#", resp.Entries[1].Volume.VolumeId)
+	}
+	assert.Equal(t, "", resp.NextToken)
+
+	// pagination walks the filtered result set
+	resp, err = d.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 1})
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(resp.Entries)) {
+		assert.Equal(t, "#stoacc#pvc-share-a#", resp.Entries[0].Volume.VolumeId)
+	}
+	assert.Equal(t, "1", resp.NextToken)
+	resp, err = d.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 1, StartingToken: resp.NextToken})
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(resp.Entries)) {
+		assert.Equal(t, "#stoacc#pvc-share-b#", resp.Entries[0].Volume.VolumeId)
+	}
+	assert.Equal(t, "", resp.NextToken)
+
+	// a malformed starting token aborts the enumeration
+	_, err = d.ListVolumes(context.Background(), &csi.ListVolumesRequest{StartingToken: "not-a-number"})
+	if !reflect.DeepEqual(err, status.Errorf(codes.Aborted, "invalid starting token(%s)", "not-a-number")) {
 		t.Errorf("Unexpected error: %v", err)
 	}
 }
@@ -1655,3 +3739,72 @@ func TestListSnapshots(t *testing.T) {
 		t.Errorf("Unexpected error: %v", err)
 	}
 }
+
+func TestDeleteFileShareIncludingSnapshots(t *testing.T) {
+	d := NewFakeDriver()
+	d.cloud = &azure.Cloud{}
+	volumeID := "vol_1#f5713de20cde511e8ba4900#test_sharename"
+	secrets := map[string]string{
+		"accountname": "f5713de20cde511e8ba4900",
+		"accountkey":  base64.StdEncoding.EncodeToString([]byte("acc_key")),
+	}
+
+	originalList := listShareSnapshots
+	originalDeleteSnapshot := deleteShareSnapshot
+	originalDeleteShare := deleteShareWithSnapshots
+	defer func() {
+		listShareSnapshots = originalList
+		deleteShareSnapshot = originalDeleteSnapshot
+		deleteShareWithSnapshots = originalDeleteShare
+	}()
+
+	listShareSnapshots = func(_ context.Context, _ azfile.ServiceURL, _ string) ([]string, error) {
+		return []string{"s1", "s2", "s3", "s4"}, nil
+	}
+	var deleted []string
+	shareDeletes := 0
+	deleteShareWithSnapshots = func(_ context.Context, _ azfile.ServiceURL, _ string) error {
+		shareDeletes++
+		return nil
+	}
+
+	// cancellation mid-loop stops promptly and leaves the share in place
+	ctx, cancel := context.WithCancel(context.Background())
+	deleteShareSnapshot = func(_ context.Context, _ azfile.ServiceURL, _, snapshot string) error {
+		deleted = append(deleted, snapshot)
+		if snapshot == "s2" {
+			cancel()
+		}
+		return nil
+	}
+	err := d.deleteFileShareIncludingSnapshots(ctx, volumeID, secrets)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "interrupted")
+		assert.Contains(t, err.Error(), "2 of 4 snapshots left")
+	}
+	assert.Equal(t, []string{"s1", "s2"}, deleted)
+	assert.Equal(t, 0, shareDeletes)
+
+	// the retry skips the snapshots the first pass already removed
+	deleted = nil
+	deleteShareSnapshot = func(_ context.Context, _ azfile.ServiceURL, _, snapshot string) error {
+		deleted = append(deleted, snapshot)
+		if snapshot == "s1" || snapshot == "s2" {
+			return fmt.Errorf("storage error: service code %s", azfile.ServiceCodeShareNotFound)
+		}
+		return nil
+	}
+	assert.NoError(t, d.deleteFileShareIncludingSnapshots(context.Background(), volumeID, secrets))
+	assert.Equal(t, []string{"s1", "s2", "s3", "s4"}, deleted)
+	assert.Equal(t, 1, shareDeletes)
+
+	// any other snapshot delete failure surfaces
+	deleteShareSnapshot = func(_ context.Context, _ azfile.ServiceURL, _, snapshot string) error {
+		return fmt.Errorf("throttled")
+	}
+	err = d.deleteFileShareIncludingSnapshots(context.Background(), volumeID, secrets)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "throttled")
+	}
+	assert.Equal(t, 1, shareDeletes)
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// default location of the SMB credentials directory, /run is a tmpfs on any
+// systemd based node so plain-text credentials never reach a persistent disk
+const defaultCredentialsDir = "/run/azurefile-csi/credentials"
+
+const (
+	// the directory is only readable by the driver itself
+	credentialsDirMode = os.FileMode(0700)
+	// individual credential files are never shared with other processes
+	credentialFileMode = os.FileMode(0600)
+)
+
+// ensureCredentialsDir creates the dedicated credentials directory with mode
+// 0700, tightening the mode if a previous instance left it wider
+func ensureCredentialsDir(dir string) error {
+	if err := os.MkdirAll(dir, credentialsDirMode); err != nil {
+		return fmt.Errorf("failed to create credentials directory %s: %v", dir, err)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("failed to stat credentials directory %s: %v", dir, err)
+	}
+	if info.Mode().Perm() != credentialsDirMode {
+		if err := os.Chmod(dir, credentialsDirMode); err != nil {
+			return fmt.Errorf("failed to tighten mode of credentials directory %s: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// ensureWritableDir creates dir if needed and verifies it is writable by
+// creating and removing a probe file, catching read-only filesystems whose
+// directories already exist and pass a plain MkdirAll
+func ensureWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", dir, err)
+	}
+	probe, err := os.CreateTemp(dir, ".probe")
+	if err != nil {
+		return fmt.Errorf("failed to write a probe file under %s: %v", dir, err)
+	}
+	path := probe.Name()
+	probe.Close()
+	return os.Remove(path)
+}
+
+// cleanupCredentialsDir removes every credential file under dir, returning the
+// number of files removed. A crashed driver instance cannot run its own
+// shutdown cleanup, so the same sweep runs again at startup to catch stale
+// files it left behind
+func cleanupCredentialsDir(dir string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read credentials directory %s: %v", dir, err)
+	}
+	removed := 0
+	for _, entry := range entries {
+		if entry.IsDir() {
+			// nothing below the driver ever creates subdirectories here, leave
+			// anything unexpected alone instead of deleting it recursively
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if err := os.Remove(path); err != nil {
+			return removed, fmt.Errorf("failed to remove stale credential file %s: %v", path, err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// writeCredentialFile writes data to a fresh 0600 file named name under the
+// credentials directory and returns its path
+func writeCredentialFile(dir, name string, data []byte) (string, error) {
+	if err := ensureCredentialsDir(dir); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, name)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, credentialFileMode)
+	if err != nil {
+		return "", fmt.Errorf("failed to create credential file %s: %v", path, err)
+	}
+	defer f.Close()
+	// the file may survive from a previous instance with a wider mode,
+	// OpenFile only applies the mode on creation
+	if err := f.Chmod(credentialFileMode); err != nil {
+		return "", fmt.Errorf("failed to tighten mode of credential file %s: %v", path, err)
+	}
+	if _, err := f.Write(data); err != nil {
+		return "", fmt.Errorf("failed to write credential file %s: %v", path, err)
+	}
+	return path, nil
+}
+
+// volumeCredentialFile returns the path of the per-volume credentials file
+// under the credentials directory, path separators in the volume ID are
+// flattened so the file always lands directly in the directory
+func (d *Driver) volumeCredentialFile(volumeID string) string {
+	name := strings.NewReplacer("/", "_", "\\", "_").Replace(volumeID)
+	return filepath.Join(d.credentialsDir, name)
+}
+
+// shredCredentialFile overwrites the file with zeros before deleting it, a
+// best effort to keep the key from lingering on the backing storage after the
+// file is gone
+func shredCredentialFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("credential file %s is a directory", path)
+	}
+	if f, err := os.OpenFile(path, os.O_WRONLY, 0); err == nil {
+		zeros := make([]byte, info.Size())
+		if _, err := f.WriteAt(zeros, 0); err == nil {
+			// flush the zeros before the delete, removing the file alone only
+			// drops the directory entry
+			f.Sync()
+		}
+		f.Close()
+	}
+	return os.Remove(path)
+}
+
+// removeVolumeCredentials shreds the credentials file of the volume as part of
+// its unstage, missing files are expected since not every mount writes one
+func (d *Driver) removeVolumeCredentials(volumeID string) {
+	path := d.volumeCredentialFile(volumeID)
+	if err := shredCredentialFile(path); err != nil {
+		if !os.IsNotExist(err) {
+			klog.Warningf("credential file %s of volume(%s) could not be shredded: %v", path, volumeID, err)
+		}
+		return
+	}
+	klog.V(2).Infof("credential file %s of volume(%s) shredded on unstage", path, volumeID)
+}
+
+// cleanupCredentials sweeps the credentials directory, it runs at startup to
+// remove files a crashed instance left behind and again at shutdown
+func (d *Driver) cleanupCredentials(phase string) {
+	removed, err := cleanupCredentialsDir(d.credentialsDir)
+	if err != nil {
+		klog.Errorf("credential cleanup on %s failed: %v", phase, err)
+		return
+	}
+	if removed > 0 {
+		klog.V(2).Infof("removed %d stale credential file(s) from %s on %s", removed, d.credentialsDir, phase)
+	}
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/utils/mount"
+	"sigs.k8s.io/azurefile-csi-driver/test/utils/testutil"
+)
+
+func TestCleanupCredentialsDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "credentials")
+
+	// a missing directory is not an error, the first start has nothing to sweep
+	removed, err := cleanupCredentialsDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, removed)
+
+	// stale files left behind by a crashed instance are removed, unexpected
+	// subdirectories are left alone
+	assert.NoError(t, ensureCredentialsDir(dir))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "vol-1"), []byte("username=u,password=p"), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "vol-2"), []byte("username=u,password=p"), 0600))
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "subdir"), 0700))
+
+	removed, err = cleanupCredentialsDir(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, removed)
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "subdir", entries[0].Name())
+	}
+}
+
+func TestWriteCredentialFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skipf("Skipping test on %s", runtime.GOOS)
+	}
+	dir := filepath.Join(t.TempDir(), "credentials")
+
+	path, err := writeCredentialFile(dir, "vol-1", []byte("username=u,password=p"))
+	assert.NoError(t, err)
+
+	dirInfo, err := os.Stat(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, credentialsDirMode, dirInfo.Mode().Perm())
+
+	fileInfo, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, credentialFileMode, fileInfo.Mode().Perm())
+
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "username=u,password=p", string(data))
+
+	// rewriting an existing file replaces its content and keeps the tight mode
+	path, err = writeCredentialFile(dir, "vol-1", []byte("username=u,password=p2"))
+	assert.NoError(t, err)
+	data, err = os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "username=u,password=p2", string(data))
+	fileInfo, err = os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, credentialFileMode, fileInfo.Mode().Perm())
+}
+
+func TestShredCredentialFile(t *testing.T) {
+	dir := t.TempDir()
+
+	// a missing file surfaces as IsNotExist so callers can treat it as fine
+	err := shredCredentialFile(filepath.Join(dir, "missing"))
+	assert.True(t, os.IsNotExist(err))
+
+	// a directory is never shredded
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "subdir"), 0700))
+	err = shredCredentialFile(filepath.Join(dir, "subdir"))
+	assert.Error(t, err)
+
+	path := filepath.Join(dir, "vol-1")
+	assert.NoError(t, os.WriteFile(path, []byte("username=u,password=p"), 0600))
+	assert.NoError(t, shredCredentialFile(path))
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestNodeUnstageVolumeRemovesCredentials(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skipf("Skipping test on %s", runtime.GOOS)
+	}
+	dir := filepath.Join(t.TempDir(), "credentials")
+	volumeID := "vol_1#f5713de20cde511e8ba4900#test_sharename"
+
+	d := NewFakeDriver()
+	d.credentialsDir = dir
+	d.mounter = &mount.SafeFormatAndMount{Interface: &fakeMounter{}}
+
+	path, err := writeCredentialFile(dir, filepath.Base(d.volumeCredentialFile(volumeID)), []byte("username=u,password=p"))
+	assert.NoError(t, err)
+
+	stagingPath := testutil.GetWorkDirPath("unstage_credentials", t)
+	assert.NoError(t, os.MkdirAll(stagingPath, 0755))
+	_, err = d.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: stagingPath,
+	})
+	assert.NoError(t, err)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "credential file %s should be gone after unstage", path)
+}
+
+func TestDriverCleanupCredentialsOnStartup(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "credentials")
+	assert.NoError(t, ensureCredentialsDir(dir))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "stale"), []byte("username=u,password=p"), 0600))
+
+	d := NewFakeDriver()
+	d.credentialsDir = dir
+	d.cleanupCredentials("startup")
+
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
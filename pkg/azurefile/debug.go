@@ -0,0 +1,98 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// debugState is a sanitized snapshot of the internal driver state exposed via
+// the /debug/state endpoint, secrets such as account keys are never included
+type debugState struct {
+	// entries currently held in the volume lock map
+	HeldVolumeLocks []string `json:"heldVolumeLocks"`
+	// entries currently held in the subnet lock map
+	HeldSubnetLocks []string `json:"heldSubnetLocks"`
+	// number of tracked shares per storage account in the inventory
+	InventoryShareCounts map[string]int `json:"inventoryShareCounts"`
+	// names of the loaded mount option profiles
+	MountProfiles []string `json:"mountProfiles"`
+	// number of mount operations currently running on the node
+	InFlightMounts int `json:"inFlightMounts"`
+	// number of mount operations waiting for a free slot
+	QueuedMounts int `json:"queuedMounts"`
+	// volume ID -> time of the last successful stage or health probe
+	LastMountTimes map[string]string `json:"lastMountTimes"`
+}
+
+// dumpDebugState collects the sanitized internal driver state
+func (d *Driver) dumpDebugState() debugState {
+	profiles := make([]string, 0, len(d.mountProfiles))
+	for name := range d.mountProfiles {
+		profiles = append(profiles, name)
+	}
+	sort.Strings(profiles)
+	d.lastMountTimesLock.Lock()
+	lastMountTimes := make(map[string]string, len(d.lastMountTimes))
+	for volumeID, mounted := range d.lastMountTimes {
+		lastMountTimes[volumeID] = mounted.UTC().Format(time.RFC3339)
+	}
+	d.lastMountTimesLock.Unlock()
+	return debugState{
+		HeldVolumeLocks:      d.volLockMap.lockedEntries(),
+		HeldSubnetLocks:      d.subnetLockMap.lockedEntries(),
+		InventoryShareCounts: d.accountInventory.accountShareCounts(),
+		MountProfiles:        profiles,
+		InFlightMounts:       d.mountLimiter.inFlight(),
+		QueuedMounts:         d.mountLimiter.queued(),
+		LastMountTimes:       lastMountTimes,
+	}
+}
+
+// handleDebugState serves the /debug/state endpoint
+func (d *Driver) handleDebugState(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(d.dumpDebugState()); err != nil {
+		klog.Warningf("failed to encode debug state: %v", err)
+	}
+}
+
+// serveDebugState exposes the /debug/state endpoint on the given address
+func (d *Driver) serveDebugState(address string) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		klog.Warningf("failed to get listener for debug state endpoint: %v", err)
+		return
+	}
+	m := http.NewServeMux()
+	m.HandleFunc("/debug/state", d.handleDebugState)
+	if d.enableTestMount {
+		m.HandleFunc("/debug/test-mount", d.handleTestMount)
+	}
+	go func() {
+		defer l.Close()
+		if err := http.Serve(l, m); err != nil {
+			klog.Warningf("debug state server failure(%v), address(%v)", err, address)
+		}
+	}()
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2021 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDumpDebugState(t *testing.T) {
+	d := NewFakeDriver()
+	d.mountProfiles = map[string][]string{"vetted": {"nostrictsync"}}
+	d.accountInventory.recordShare("testaccount", "testshare", 100)
+	d.volLockMap.LockEntry("vol_1")
+	defer d.volLockMap.UnlockEntry("vol_1")
+
+	state := d.dumpDebugState()
+	assert.Equal(t, []string{"vol_1"}, state.HeldVolumeLocks)
+	assert.Equal(t, []string{}, state.HeldSubnetLocks)
+	assert.Equal(t, map[string]int{"testaccount": 1}, state.InventoryShareCounts)
+	assert.Equal(t, []string{"vetted"}, state.MountProfiles)
+	assert.Equal(t, 0, state.InFlightMounts)
+	assert.Equal(t, 0, state.QueuedMounts)
+
+	d.volLockMap.UnlockEntry("vol_1")
+	d.volLockMap.LockEntry("vol_1")
+	state = d.dumpDebugState()
+	assert.Equal(t, []string{"vol_1"}, state.HeldVolumeLocks)
+}
+
+func TestHandleDebugState(t *testing.T) {
+	d := NewFakeDriver()
+	d.accountInventory.recordShare("testaccount", "testshare", 100)
+	d.volLockMap.LockEntry("vol_1")
+	defer d.volLockMap.UnlockEntry("vol_1")
+
+	w := httptest.NewRecorder()
+	d.handleDebugState(w, httptest.NewRequest("GET", "/debug/state", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	body := w.Body.String()
+	var state debugState
+	assert.NoError(t, json.Unmarshal([]byte(body), &state))
+	assert.Equal(t, []string{"vol_1"}, state.HeldVolumeLocks)
+	// only account names may appear in the dump, never keys or other secrets
+	assert.True(t, strings.Contains(body, "testaccount"))
+	assert.False(t, strings.Contains(body, "key"))
+}
@@ -18,13 +18,18 @@ package azurefile
 
 import (
 	"fmt"
+	"os"
 	"strings"
+	"syscall"
 
 	"k8s.io/utils/mount"
 )
 
 type fakeMounter struct {
 	mount.FakeMounter
+	// number of leading MountSensitive calls on a "share_not_ready" source
+	// that fail as if the share had not been provisioned yet
+	notReadyFailuresLeft int
 }
 
 // Mount overrides mount.FakeMounter.Mount.
@@ -35,18 +40,43 @@ func (f *fakeMounter) Mount(source string, target string, fstype string, options
 		return fmt.Errorf("fake Mount: target error")
 	}
 
-	return nil
+	return f.FakeMounter.Mount(source, target, fstype, options)
 }
 
 // MountSensitive overrides mount.FakeMounter.MountSensitive.
 func (f *fakeMounter) MountSensitive(source string, target string, fstype string, options []string, sensitiveOptions []string) error {
+	if strings.Contains(source, "share_not_ready") && f.notReadyFailuresLeft > 0 {
+		f.notReadyFailuresLeft--
+		return fmt.Errorf("mount error(2): No such file or directory")
+	}
 	if strings.Contains(source, "error_mount_sens") {
 		return fmt.Errorf("fake MountSensitive: source error")
 	} else if strings.Contains(target, "error_mount_sens") {
 		return fmt.Errorf("fake MountSensitive: target error")
 	}
+	for _, option := range sensitiveOptions {
+		if strings.Contains(option, "invalid-key") {
+			return fmt.Errorf("mount error(13): Permission denied")
+		}
+	}
+	if strings.Contains(target, "error_remount") {
+		for _, option := range options {
+			if option == "remount" {
+				return fmt.Errorf("fake MountSensitive: remount error")
+			}
+		}
+	}
 
-	return nil
+	return f.FakeMounter.MountSensitive(source, target, fstype, options, sensitiveOptions)
+}
+
+// Unmount overrides mount.FakeMounter.Unmount.
+func (f *fakeMounter) Unmount(target string) error {
+	if strings.Contains(target, "hang_unmount") {
+		// an unmount against an unreachable server blocks indefinitely
+		select {}
+	}
+	return f.FakeMounter.Unmount(target)
 }
 
 //IsLikelyNotMountPoint overrides mount.FakeMounter.IsLikelyNotMountPoint.
@@ -54,6 +84,9 @@ func (f *fakeMounter) IsLikelyNotMountPoint(file string) (bool, error) {
 	if strings.Contains(file, "error_is_likely") {
 		return false, fmt.Errorf("fake IsLikelyNotMountPoint: fake error")
 	}
+	if strings.Contains(file, "not_exist_race") {
+		return true, &os.PathError{Op: "stat", Path: file, Err: syscall.ENOENT}
+	}
 	if strings.Contains(file, "false_is_likely") {
 		return false, nil
 	}
@@ -50,6 +50,9 @@ func (f *Driver) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoReques
 // Currently the spec does not dictate what you should return either.
 // Hence, return an empty response
 func (f *Driver) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	if err := f.readinessError(); err != nil {
+		return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: false}}, status.Errorf(codes.FailedPrecondition, "driver is not ready: %v", err)
+	}
 	return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: true}}, nil
 }
 
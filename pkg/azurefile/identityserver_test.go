@@ -18,6 +18,7 @@ package azurefile
 
 import (
 	"context"
+	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/stretchr/testify/assert"
 	"testing"
@@ -32,6 +33,14 @@ func TestGetPluginInfo(t *testing.T) {
 	assert.Equal(t, resp.Name, fakeDriverName)
 	assert.Equal(t, resp.GetVendorVersion(), vendorVersion)
 
+	// Check with a configured driver name
+	d = NewDriver(&DriverOptions{NodeID: fakeNodeID, DriverName: "file2.csi.azure.com"})
+	d.Version = vendorVersion
+	req = csi.GetPluginInfoRequest{}
+	resp, err = d.GetPluginInfo(context.Background(), &req)
+	assert.NoError(t, err)
+	assert.Equal(t, resp.Name, "file2.csi.azure.com")
+
 	//Check error when driver name is empty
 	d = NewFakeDriver()
 	d.Name = ""
@@ -59,6 +68,20 @@ func TestProbe(t *testing.T) {
 	assert.Equal(t, resp.Ready.Value, true)
 }
 
+func TestProbeNotReady(t *testing.T) {
+	d := NewFakeDriver()
+	d.setNotReady(fmt.Errorf("driver identity cannot list storage accounts under resource group(rg)"))
+	resp, err := d.Probe(context.Background(), &csi.ProbeRequest{})
+	assert.Error(t, err)
+	assert.Equal(t, resp.Ready.Value, false)
+
+	// clearing the reason recovers readiness
+	d.setNotReady(nil)
+	resp, err = d.Probe(context.Background(), &csi.ProbeRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, resp.Ready.Value, true)
+}
+
 func TestGetPluginCapabilities(t *testing.T) {
 	d := NewFakeDriver()
 	req := csi.GetPluginCapabilitiesRequest{}
@@ -0,0 +1,118 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// operationQueueDepth tracks how many operations are currently waiting for
+	// a volume lock or a mount slot, partitioned by operation type, so
+	// operators can see queueing build up before requests start timing out
+	operationQueueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "azurefile_csi_operation_queue_depth",
+			Help: "Number of operations currently waiting for a volume lock or mount slot, partitioned by operation type.",
+		},
+		[]string{"operation"},
+	)
+
+	// operationLockWaitSeconds records how long operations queued before they
+	// could proceed, the main input for tuning concurrency limits
+	operationLockWaitSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "azurefile_csi_operation_lock_wait_duration_seconds",
+			// 1ms up to ~4.4 minutes, gRPC deadlines cap anything longer
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+			Help:    "Time operations spent waiting for a volume lock or mount slot before proceeding, partitioned by operation type.",
+		},
+		[]string{"operation"},
+	)
+
+	// nodeMountDurationSeconds records how long the mount call of a
+	// NodeStageVolume took, partitioned by protocol and outcome, so slow SMB
+	// mounts stand out from healthy nfs or disk-mode ones
+	nodeMountDurationSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "azurefile_node_mount_duration_seconds",
+			// 10ms up to ~1.8 minutes, the share-not-ready retry loop caps
+			// anything longer
+			Buckets: prometheus.ExponentialBuckets(0.01, 3, 9),
+			Help:    "Time the mount call of NodeStageVolume took, partitioned by protocol (smb/nfs/disk) and outcome (success/error).",
+		},
+		[]string{"protocol", "outcome"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(operationQueueDepth)
+	prometheus.MustRegister(operationLockWaitSeconds)
+	prometheus.MustRegister(nodeMountDurationSeconds)
+}
+
+// mountProtocolLabel maps a staged volume onto the protocol label of the
+// mount duration histogram
+func mountProtocolLabel(protocol string, isDiskMount bool) string {
+	switch {
+	case isDiskMount:
+		return "disk"
+	case protocol == nfs:
+		return nfs
+	default:
+		return "smb"
+	}
+}
+
+// observeMountDuration feeds a completed NodeStageVolume mount call into the
+// mount duration histogram under the given protocol label
+func observeMountDuration(start time.Time, protocol string, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	nodeMountDurationSeconds.WithLabelValues(protocol, outcome).Observe(time.Since(start).Seconds())
+}
+
+// lockEntryTimed acquires the lock of entry like lockMap.LockEntry does,
+// recording the time spent queued behind other holders under the given
+// operation label
+func lockEntryTimed(lm *lockMap, entry, operation string) {
+	start := time.Now()
+	operationQueueDepth.WithLabelValues(operation).Inc()
+	lm.LockEntry(entry)
+	operationQueueDepth.WithLabelValues(operation).Dec()
+	operationLockWaitSeconds.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// acquireMountSlotTimed acquires a mount slot like mountLimiter.acquire does,
+// recording the time spent queued under the given operation label. Rejected
+// or cancelled waits do not contribute a wait-time sample so the histogram
+// only reflects operations that actually proceeded
+func acquireMountSlotTimed(ctx context.Context, l *mountLimiter, operation string) error {
+	start := time.Now()
+	operationQueueDepth.WithLabelValues(operation).Inc()
+	err := l.acquire(ctx)
+	operationQueueDepth.WithLabelValues(operation).Dec()
+	if err == nil {
+		operationLockWaitSeconds.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	}
+	return err
+}
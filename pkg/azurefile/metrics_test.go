@@ -0,0 +1,113 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+// lockWaitSamples returns the sample count and sum of the wait-time histogram
+// for the given operation label
+func lockWaitSamples(t *testing.T, operation string) (uint64, float64) {
+	observer, err := operationLockWaitSeconds.GetMetricWithLabelValues(operation)
+	assert.NoError(t, err)
+	m := &dto.Metric{}
+	assert.NoError(t, observer.(prometheus.Histogram).Write(m))
+	return m.Histogram.GetSampleCount(), m.Histogram.GetSampleSum()
+}
+
+// mountDurationSamples returns the sample count of the mount duration
+// histogram for the given protocol and outcome labels
+func mountDurationSamples(t *testing.T, protocol, outcome string) uint64 {
+	observer, err := nodeMountDurationSeconds.GetMetricWithLabelValues(protocol, outcome)
+	assert.NoError(t, err)
+	m := &dto.Metric{}
+	assert.NoError(t, observer.(prometheus.Histogram).Write(m))
+	return m.Histogram.GetSampleCount()
+}
+
+func TestMountProtocolLabel(t *testing.T) {
+	assert.Equal(t, "disk", mountProtocolLabel(cifs, true))
+	assert.Equal(t, nfs, mountProtocolLabel(nfs, false))
+	assert.Equal(t, "smb", mountProtocolLabel(cifs, false))
+	assert.Equal(t, "smb", mountProtocolLabel("", false))
+}
+
+func TestLockEntryTimedRecordsContention(t *testing.T) {
+	lm := newLockMap()
+	lm.LockEntry("entry")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		lockEntryTimed(lm, "entry", "TestLockContention")
+		lm.UnlockEntry("entry")
+	}()
+
+	// hold the entry long enough that the contending goroutine measurably waits
+	time.Sleep(50 * time.Millisecond)
+	lm.UnlockEntry("entry")
+	<-done
+
+	count, sum := lockWaitSamples(t, "TestLockContention")
+	assert.Equal(t, uint64(1), count)
+	assert.Greater(t, sum, 0.0)
+
+	// the queue drained, no waiter must be left behind in the depth gauge
+	depth := &dto.Metric{}
+	assert.NoError(t, operationQueueDepth.WithLabelValues("TestLockContention").Write(depth))
+	assert.Equal(t, 0.0, depth.Gauge.GetValue())
+}
+
+func TestAcquireMountSlotTimed(t *testing.T) {
+	limiter := newMountLimiter(1)
+	assert.NoError(t, limiter.acquire(context.Background()))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := acquireMountSlotTimed(context.Background(), limiter, "TestMountContention"); err != nil {
+			t.Errorf("Unexpected error: %v", err)
+			return
+		}
+		limiter.release()
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	limiter.release()
+	<-done
+
+	count, sum := lockWaitSamples(t, "TestMountContention")
+	assert.Equal(t, uint64(1), count)
+	assert.Greater(t, sum, 0.0)
+
+	// a cancelled wait contributes no wait-time sample
+	assert.NoError(t, limiter.acquire(context.Background()))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, acquireMountSlotTimed(ctx, limiter, "TestMountContention"))
+	limiter.release()
+
+	count, _ = lockWaitSamples(t, "TestMountContention")
+	assert.Equal(t, uint64(1), count)
+}
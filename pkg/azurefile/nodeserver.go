@@ -17,20 +17,28 @@ limitations under the License.
 package azurefile
 
 import (
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 
+	volumehelper "sigs.k8s.io/azurefile-csi-driver/pkg/util"
+
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
 	"k8s.io/kubernetes/pkg/volume"
 	"k8s.io/kubernetes/pkg/volume/util"
+	"k8s.io/utils/mount"
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -51,6 +59,24 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 		return nil, status.Error(codes.InvalidArgument, "Target path not provided")
 	}
 
+	if context := req.GetVolumeContext(); strings.EqualFold(context[ephemeralField], "true") {
+		// an inline ephemeral volume carries the full volume context and is
+		// staged and published in one call, mount the share directly at the
+		// target path instead of bind mounting a staging path
+		klog.V(2).Infof("NodePublishVolume: ephemeral volume(%s) mount on %s", req.GetVolumeId(), target)
+		_, err := d.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          req.GetVolumeId(),
+			StagingTargetPath: target,
+			VolumeContext:     context,
+			VolumeCapability:  req.GetVolumeCapability(),
+			Secrets:           req.GetSecrets(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
 	source := req.GetStagingTargetPath()
 	if len(source) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Staging target not provided")
@@ -60,6 +86,8 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 	if req.GetReadonly() {
 		mountOptions = append(mountOptions, "ro")
 	}
+	// honor mount flags kubelet passes on the volume capability, e.g. noexec
+	mountOptions = util.JoinMountOptions(req.GetVolumeCapability().GetMount().GetMountFlags(), mountOptions)
 
 	mnt, err := d.ensureMountPoint(target)
 	if err != nil {
@@ -99,9 +127,11 @@ func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublish
 	volumeID := req.GetVolumeId()
 
 	klog.V(2).Infof("NodeUnpublishVolume: unmounting volume %s on %s", volumeID, targetPath)
-	err := CleanupMountPoint(d.mounter, targetPath, false)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to unmount target %q: %v", targetPath, err)
+	if err := CleanupMountPoint(d.mounter, targetPath, false); err != nil {
+		if !isIgnorableUnmountError(err) {
+			return nil, status.Errorf(codes.Internal, "failed to unmount target %q: %v", targetPath, err)
+		}
+		klog.V(2).Infof("NodeUnpublishVolume: target %s does not exist or is not a mount point(%v), treating as success", targetPath, err)
 	}
 	klog.V(2).Infof("NodeUnpublishVolume: unmount volume %s on %s successfully", volumeID, targetPath)
 
@@ -126,7 +156,43 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 	context := req.GetVolumeContext()
 	mountFlags := req.GetVolumeCapability().GetMount().GetMountFlags()
 
-	_, accountName, accountKey, fileShareName, diskName, err := d.GetAccountInfo(volumeID, req.GetSecrets(), context)
+	if err := validateMountOptions(mountFlags); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "volume(%s) has malformed mount options: %v", volumeID, err)
+	}
+
+	if err := acquireMountSlotTimed(ctx, d.mountLimiter, "NodeStageVolume"); err != nil {
+		return nil, status.Errorf(codes.Aborted, "NodeStageVolume for volume(%s) aborted: %v", volumeID, err)
+	}
+	defer d.mountLimiter.release()
+
+	if err := d.acquireStagedPath(targetPath, volumeID); err != nil {
+		return nil, err
+	}
+	staged := false
+	defer func() {
+		if staged {
+			d.recordMountSuccess(volumeID)
+		} else {
+			d.releaseStagedPath(targetPath, volumeID)
+		}
+	}()
+
+	if d.requireSecrets && len(req.GetSecrets()) == 0 {
+		// nfs protocol does not need an account key, everything else does
+		nfsProtocol := false
+		for k, v := range context {
+			if strings.EqualFold(k, protocolField) {
+				if canonical, err := normalizeProtocol(v); err == nil && canonical == nfs {
+					nfsProtocol = true
+				}
+			}
+		}
+		if !nfsProtocol {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("no secrets provided for volume(%s) while secrets are required", volumeID))
+		}
+	}
+
+	rgName, accountName, accountKey, fileShareName, diskName, err := d.GetAccountInfo(volumeID, req.GetSecrets(), context)
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("GetAccountInfo(%s) failed with error: %v", volumeID, err))
 	}
@@ -138,24 +204,248 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 	}
 	// don't respect fsType from req.GetVolumeCapability().GetMount().GetFsType()
 	// since it's ext4 by default on Linux
-	var fsType, server, protocol string
+	var fsType, server, protocol, mountProfile, echoInterval, handleCache, encryptInTransit, requireEncrypt, shareTier, requestedSizeGiB, createDisk, port, diskMountOptions, smbVersion, fileModePerm, dirModePerm, secNfs, endpointSuffix, extraMountOptions, serverAddress string
 	for k, v := range context {
 		switch strings.ToLower(k) {
 		case fsTypeField:
 			fsType = v
+		case shareTierField:
+			shareTier = v
+		case requestedSizeGiBField:
+			requestedSizeGiB = v
 		case protocolField:
 			protocol = v
 		case diskNameField:
 			diskName = v
 		case serverNameField:
 			server = v
+		case serverAddressField:
+			serverAddress = v
+		case endpointSuffixField:
+			endpointSuffix = v
+		case portField:
+			port = v
+		case mountProfileField:
+			mountProfile = v
+		case mountOptionsField:
+			extraMountOptions = v
+		case echoIntervalField:
+			echoInterval = v
+		case handleCacheField:
+			handleCache = v
+		case encryptInTransitField:
+			encryptInTransit = v
+		case requireEncryptField:
+			requireEncrypt = v
+		case smbVersionField:
+			smbVersion = v
+		case fileModeField:
+			fileModePerm = v
+		case dirModeField:
+			dirModePerm = v
+		case secNfsField:
+			secNfs = v
+		case createDiskField:
+			createDisk = v
+		case diskMountOptionsField:
+			diskMountOptions = v
+		default:
+			if isUnknownVolumeContextKey(k) {
+				// newer provisioners may hand out keys this node does not know
+				// yet, tolerate them so mixed-version clusters keep working
+				klog.V(4).Infof("NodeStageVolume: ignoring unknown volume context key %q of volume(%s)", k, volumeID)
+			}
 		}
 	}
 
+	if protocol, err = normalizeProtocol(protocol); err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("volume(%s): %v", volumeID, err))
+	}
+	fsType = d.resolveFsType(fsType, diskName)
+	if protocol == nfs && (diskName != "" || isDiskFsType(fsType)) {
+		// a contradictory volume context, the vhd of a disk-mode volume lives
+		// on an SMB backed file share and cannot be reached over nfs
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("volume(%s) combines disk-mode fields(%s: %q, %s: %q) with the nfs protocol, disk-mode volumes are only supported on SMB backed file shares", volumeID, diskNameField, diskName, fsTypeField, fsType))
+	}
+	d.recordVolumeTier(volumeID, shareTier)
+
+	if d.enableQuotaVerification && requestedSizeGiB != "" {
+		// best effort, a quota changed out of band is worth a warning but must
+		// never fail the mount
+		d.verifyShareQuota(volumeID, rgName, accountName, fileShareName, requestedSizeGiB, req.GetSecrets())
+	}
+
+	if mountProfile != "" {
+		profileOptions, exists := d.mountProfiles[mountProfile]
+		if !exists {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("mount profile(%s) referenced by volume(%s) is not defined", mountProfile, volumeID))
+		}
+		// profile options are merged beneath the per-volume mount flags
+		mountFlags = mergeMountOptions(profileOptions, mountFlags)
+	}
+
+	if extraMountOptions != "" {
+		extraMountOpts := parseMountOptionList(extraMountOptions)
+		if err := validateMountOptions(extraMountOpts); err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s(%s) in volume(%s): %v", mountOptionsField, extraMountOptions, volumeID, err))
+		}
+		// arbitrary kernel options the driver has no dedicated key for, a
+		// user-supplied key overrides the driver default of the same name while
+		// explicit mount flags from the volume capability still win
+		mountFlags = mergeMountOptions(extraMountOpts, mountFlags)
+	}
+
+	if echoInterval != "" {
+		interval, err := strconv.Atoi(echoInterval)
+		if err != nil || interval <= 0 {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s(%s) in volume(%s): must be a positive integer of seconds", echoIntervalField, echoInterval, volumeID))
+		}
+		if protocol != nfs && runtime.GOOS != "windows" {
+			// control how quickly the cifs client detects a dead connection
+			mountFlags = mergeMountOptions(mountFlags, []string{fmt.Sprintf("echo_interval=%d", interval)})
+		}
+	}
+
+	if port != "" {
+		portNumber, err := strconv.Atoi(port)
+		if err != nil || portNumber < 1 || portNumber > 65535 {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s(%s) in volume(%s): must be an integer between 1 and 65535", portField, port, volumeID))
+		}
+		if protocol != nfs && runtime.GOOS != "windows" {
+			// environments routing SMB through a proxy listen on a
+			// non-standard port, the cifs client defaults to 445
+			mountFlags = mergeMountOptions(mountFlags, []string{fmt.Sprintf("port=%d", portNumber)})
+		}
+	}
+
+	if smbVersion != "" {
+		if !isSupportedSmbVersion(smbVersion) {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s(%s) in volume(%s): supported versions are %v", smbVersionField, smbVersion, volumeID, supportedSmbVersionList))
+		}
+		if protocol != nfs && runtime.GOOS != "windows" {
+			// pin the negotiated SMB dialect, an explicit vers= entry in the
+			// mount flags still wins over the volume context key
+			mountFlags = mergeMountOptions([]string{fmt.Sprintf("%s=%s", vers, smbVersion)}, mountFlags)
+		}
+	}
+
+	if fileModePerm != "" {
+		if !isValidFileMode(fileModePerm) {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s(%s) in volume(%s): must be an octal permission mode like 0777", fileModeField, fileModePerm, volumeID))
+		}
+		if protocol != nfs && runtime.GOOS != "windows" {
+			// permissions of files in the mounted share, an explicit file_mode
+			// entry in the mount flags still wins over the volume context key
+			mountFlags = mergeMountOptions([]string{fmt.Sprintf("%s=%s", fileMode, fileModePerm)}, mountFlags)
+		}
+	}
+
+	if dirModePerm != "" {
+		if !isValidFileMode(dirModePerm) {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s(%s) in volume(%s): must be an octal permission mode like 0777", dirModeField, dirModePerm, volumeID))
+		}
+		if protocol != nfs && runtime.GOOS != "windows" {
+			// permissions of directories in the mounted share, same precedence
+			// as file_mode
+			mountFlags = mergeMountOptions([]string{fmt.Sprintf("%s=%s", dirMode, dirModePerm)}, mountFlags)
+		}
+	}
+
+	if secNfs != "" {
+		if !isSupportedNfsSec(secNfs) {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s(%s) in volume(%s): supported values are %v", secNfsField, secNfs, volumeID, supportedNfsSecList))
+		}
+		if protocol == nfs {
+			// pick the kerberos security flavor of the nfs mount, an explicit
+			// sec= entry in the mount flags still wins over the context key
+			mountFlags = mergeMountOptions([]string{fmt.Sprintf("sec=%s", secNfs)}, mountFlags)
+		}
+	}
+
+	if handleCache != "" {
+		option := strings.ToLower(handleCache)
+		if option != handleCacheEnabled && option != handleCacheDisabled {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s(%s) in volume(%s): supported values are %s and %s", handleCacheField, handleCache, volumeID, handleCacheEnabled, handleCacheDisabled))
+		}
+		if protocol != nfs && runtime.GOOS != "windows" {
+			// leases back the SMB handle cache, disabling them avoids oplock
+			// contention when many clients open the same files
+			mountFlags = mergeMountOptions(mountFlags, []string{option})
+		}
+	}
+
+	if encryptInTransit != "" {
+		enabled, err := strconv.ParseBool(encryptInTransit)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s(%s) in volume(%s): %v", encryptInTransitField, encryptInTransit, volumeID, err))
+		}
+		if enabled {
+			if protocol != nfs {
+				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("%s is only supported with the nfs protocol, volume(%s) mounts over smb", encryptInTransitField, volumeID))
+			}
+			if !nfsTLSSupported() {
+				return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("volume(%s) requests encryption in transit but the aznfs mount helper is not installed on this node", volumeID))
+			}
+			// the aznfs mount helper tunnels the nfs traffic through stunnel
+			// when the tls option is present
+			mountFlags = mergeMountOptions(mountFlags, []string{"tls"})
+		}
+	}
+
+	encryptionRequired := false
+	if requireEncrypt != "" {
+		if encryptionRequired, err = strconv.ParseBool(requireEncrypt); err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s(%s) in volume(%s): %v", requireEncryptField, requireEncrypt, volumeID, err))
+		}
+	}
+	if encryptionRequired {
+		if protocol == nfs {
+			if !nfsTLSSupported() {
+				return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("volume(%s) requires encryption in transit but the aznfs mount helper is not installed on this node", volumeID))
+			}
+			mountFlags = mergeMountOptions(mountFlags, []string{"tls"})
+		} else if runtime.GOOS == "windows" {
+			// the SMB client behind the csi proxy negotiates encryption on its
+			// own, the driver cannot rule out an unencrypted downgrade there
+			return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("volume(%s) requires encryption in transit, which cannot be guaranteed for smb mounts on windows", volumeID))
+		}
+	}
+
+	var diskMountOpts []string
+	if diskMountOptions != "" {
+		if diskMountOpts, err = parseDiskMountOptions(diskMountOptions); err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s(%s) in volume(%s): %v", diskMountOptionsField, diskMountOptions, volumeID, err))
+		}
+	}
+
+	createDiskIfMissing := false
+	if createDisk != "" {
+		enabled, err := strconv.ParseBool(createDisk)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s(%s) in volume(%s): %v", createDiskField, createDisk, volumeID, err))
+		}
+		createDiskIfMissing = enabled
+	}
+
+	if serverAddress != "" {
+		if !isValidServerAddress(serverAddress) {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s(%s) in volume(%s): must be an IP address or hostname", serverAddressField, serverAddress, volumeID))
+		}
+		// shares behind a private endpoint may only be reachable by IP or an
+		// alternate hostname, authentication still uses the account name
+		server = serverAddress
+	}
+
 	osSeparator := string(os.PathSeparator)
 	if strings.TrimSpace(server) == "" {
-		// server address is "accountname.file.core.windows.net" by default
-		server = fmt.Sprintf("%s.file.%s", accountName, d.cloud.Environment.StorageEndpointSuffix)
+		// server address is "accountname.file.core.windows.net" by default,
+		// air-gapped and sovereign clouds may route specific shares through a
+		// different endpoint suffix than the cluster default
+		suffix := d.cloud.Environment.StorageEndpointSuffix
+		if endpointSuffix != "" {
+			suffix = endpointSuffix
+		}
+		server = fmt.Sprintf("%s.file.%s", accountName, suffix)
 	}
 	source := fmt.Sprintf("%s%s%s%s%s", osSeparator, osSeparator, server, osSeparator, fileShareName)
 	if protocol == nfs {
@@ -170,27 +460,56 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 			return nil, status.Errorf(codes.Internal, "diskname could not be empty, targetPath: %s", targetPath)
 		}
 		cifsMountFlags = []string{"dir_mode=0777,file_mode=0777,cache=strict,actimeo=30", "nostrictsync"}
-		cifsMountPath = filepath.Join(filepath.Dir(targetPath), proxyMount)
+		cifsMountPath = d.proxyMountPathForTarget(targetPath)
 	}
 
 	var mountOptions, sensitiveMountOptions []string
+	var username string
 	if protocol == nfs {
-		mountOptions = util.JoinMountOptions(mountFlags, []string{"vers=4,minorversion=1,sec=sys"})
+		// mount flags from the volume capability take precedence over the defaults
+		mountOptions = mergeMountOptions(d.defaultMountOptionsForProtocol(nfs), mountFlags)
 	} else {
+		// allow an explicit username(e.g. DOMAIN\user or UPN format) from secrets or
+		// volume context to be used verbatim instead of deriving it from the account name
+		username, err = getUsernameOverride(req.GetSecrets(), context)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s field in volume(%s): %v", usernameField, volumeID, err))
+		}
 		if runtime.GOOS == "windows" {
-			mountOptions = []string{fmt.Sprintf("AZURE\\%s", accountName)}
+			if username == "" {
+				username = fmt.Sprintf("AZURE\\%s", accountName)
+			}
+			mountOptions = []string{username}
 			sensitiveMountOptions = []string{accountKey}
 		} else {
+			if username == "" {
+				username = accountName
+			}
 			if err := os.MkdirAll(targetPath, 0750); err != nil {
 				return nil, status.Error(codes.Internal, fmt.Sprintf("MkdirAll %s failed with error: %v", targetPath, err))
 			}
+			if err := d.chmodIfConfigured(targetPath); err != nil {
+				return nil, status.Error(codes.Internal, fmt.Sprintf("Chmod %s failed with error: %v", targetPath, err))
+			}
 			// parameters suggested by https://azure.microsoft.com/en-us/documentation/articles/storage-how-to-use-files-linux/
-			sensitiveMountOptions = []string{fmt.Sprintf("username=%s,password=%s", accountName, accountKey)}
-			mountOptions = appendDefaultMountOptions(cifsMountFlags)
+			sensitiveMountOptions = []string{fmt.Sprintf("username=%s,password=%s", username, accountKey)}
+			mountOptions = appendDefaultMountOptions(cifsMountFlags, d.defaultMountOptionsForProtocol(protocol))
+			if encryptionRequired {
+				if mountOptions, err = ensureSealedMountOptions(mountOptions); err != nil {
+					return nil, status.Error(codes.FailedPrecondition, fmt.Sprintf("volume(%s) requires encryption in transit: %v", volumeID, err))
+				}
+			}
 		}
 	}
 
-	klog.V(2).Infof("cifsMountPath(%v) fstype(%v) volumeID(%v) context(%v) mountflags(%v) mountOptions(%v)", cifsMountPath, fsType, volumeID, context, mountFlags, mountOptions)
+	if runtime.GOOS != "windows" && !isDiskMount && isReadOnlyAccessMode(volumeCapability) {
+		// a reader-only access mode denies writes at the share mount itself,
+		// the read-only bind mount at publish time alone still leaves the
+		// staging mount writable
+		mountOptions = util.JoinMountOptions(mountOptions, []string{"ro"})
+	}
+
+	klog.V(2).Infof("cifsMountPath(%v) fstype(%v) volumeID(%v) source(%v) context(%v) mountflags(%v) mountOptions(%v)", cifsMountPath, fsType, volumeID, source, context, mountFlags, mountOptions)
 
 	isDirMounted, err := d.ensureMountPoint(cifsMountPath)
 	if err != nil {
@@ -198,6 +517,34 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 	}
 	if isDirMounted {
 		klog.V(2).Infof("NodeStageVolume: volume %s is already mounted on %s", volumeID, targetPath)
+		if err := d.checkExistingMount(volumeID, cifsMountPath, source, protocol); err != nil {
+			return nil, err
+		}
+		if d.stagedMountOptionsChanged(targetPath, mountOptions) {
+			if d.remountOnOptionChange {
+				// unmount only, the staging directory must survive so the
+				// mount with the new options lands on the same path
+				klog.V(2).Infof("NodeStageVolume: volume %s is mounted on %s with different mount options, remounting", volumeID, cifsMountPath)
+				if err := retryCleanupMountPoint(func() error {
+					return d.mounter.Unmount(cifsMountPath)
+				}); err != nil && !isIgnorableUnmountError(err) {
+					return nil, status.Errorf(codes.Internal, "volume(%s) unmount of %q for remount failed with %v", volumeID, cifsMountPath, err)
+				}
+				isDirMounted = false
+			} else {
+				klog.Warningf("NodeStageVolume: volume %s is mounted on %s with different mount options, keeping the existing mount, set --remount-on-option-change to remount", volumeID, cifsMountPath)
+			}
+		}
+	}
+	if isDirMounted {
+		if d.enableCredentialRefresh && protocol != nfs && runtime.GOOS != "windows" {
+			// the account key may have rotated while the share stayed mounted,
+			// refresh the credentials of the existing mount when it no longer
+			// passes authentication
+			if err := d.refreshMountCredentials(volumeID, source, cifsMountPath, mountOptions, sensitiveMountOptions); err != nil {
+				return nil, status.Errorf(codes.Internal, "volume(%s) credential refresh on %q failed with %v", volumeID, cifsMountPath, err)
+			}
+		}
 	} else {
 		mountFsType := cifs
 		if protocol == nfs {
@@ -206,11 +553,37 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 		if err := prepareStagePath(cifsMountPath, d.mounter); err != nil {
 			return nil, fmt.Errorf("prepare stage path failed for %s with error: %v", cifsMountPath, err)
 		}
-		if err := wait.PollImmediate(1*time.Second, 2*time.Minute, func() (bool, error) {
-			return true, SMBMount(d.mounter, source, cifsMountPath, mountFsType, mountOptions, sensitiveMountOptions)
-		}); err != nil {
-			return nil, status.Error(codes.Internal, fmt.Sprintf("volume(%s) mount %q on %q failed with %v", volumeID, source, cifsMountPath, err))
+		mountFn := func() error {
+			return SMBMount(d.mounter, source, cifsMountPath, mountFsType, mountOptions, sensitiveMountOptions)
 		}
+		if runtime.GOOS == "windows" && protocol != nfs {
+			smbMountFn := mountFn
+			mountFn = func() error {
+				return d.retrySmbMapping(volumeID, smbMountFn)
+			}
+		}
+		mountStart := time.Now()
+		mountErr := mountWithProgress(volumeID, source, cifsMountPath, mountProgressInterval, func() error {
+			return d.retryWhileShareNotReady(volumeID, mountFn)
+		})
+		if mountErr != nil && protocol != nfs && runtime.GOOS != "windows" &&
+			isAuthFailedMountError(mountErr) && d.cloud.StorageAccountClient != nil {
+			// the key from the secret may have just been rotated out, retry once
+			// with the account's other key so mounts keep working until the
+			// secret catches up
+			altKey, keyErr := d.getAlternateAccountKey(ctx, rgName, accountName, accountKey)
+			if keyErr != nil {
+				klog.Warningf("volume(%s) mount failed with an auth error and no alternate key of account(%s) is available: %v", volumeID, accountName, keyErr)
+			} else {
+				klog.V(2).Infof("volume(%s) mount failed with an auth error, retrying with the alternate key of account(%s)", volumeID, accountName)
+				mountErr = SMBMount(d.mounter, source, cifsMountPath, mountFsType, mountOptions, []string{fmt.Sprintf("username=%s,password=%s", username, altKey)})
+			}
+		}
+		observeMountDuration(mountStart, mountProtocolLabel(protocol, isDiskMount), mountErr)
+		if mountErr != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("volume(%s) mount %q on %q failed with %v", volumeID, source, cifsMountPath, mountErr))
+		}
+		d.recordStagedMountOptions(targetPath, mountOptions)
 		klog.V(2).Infof("volume(%s) mount %q on %q succeeded", volumeID, source, cifsMountPath)
 	}
 
@@ -221,6 +594,7 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 		}
 		if mnt {
 			klog.V(2).Infof("NodeStageVolume: volume %s is already mounted on %s", volumeID, targetPath)
+			staged = true
 			return &csi.NodeStageVolumeResponse{}, nil
 		}
 
@@ -230,14 +604,55 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 			// following mount options are only valid for ext2/ext3/ext4 file systems
 			options = util.JoinMountOptions(options, []string{"noatime", "barrier=1", "errors=remount-ro"})
 		}
+		// options requested by the volume override the built-in defaults
+		options = mergeMountOptions(options, diskMountOpts)
+
+		if _, err := os.Stat(diskPath); err != nil {
+			if !os.IsNotExist(err) {
+				return nil, status.Errorf(codes.Internal, "could not stat disk %q of volume(%s): %v", diskPath, volumeID, err)
+			}
+			if !createDiskIfMissing {
+				return nil, status.Errorf(codes.NotFound, "vhd %q of volume(%s) does not exist on the share, set the %s field to let the driver recreate it", diskPath, volumeID, createDiskField)
+			}
+			if requestedSizeGiB == "" {
+				// statically provisioned volumes carry no requestedsizegib in
+				// their volume context, fall back to the live share quota
+				if quota, quotaErr := d.getFileShareQuota(getSubscriptionIDFromVolumeID(volumeID), rgName, accountName, fileShareName, req.GetSecrets()); quotaErr == nil && quota > 0 {
+					requestedSizeGiB = strconv.Itoa(quota)
+				} else {
+					klog.Warningf("NodeStageVolume: could not derive the size of vhd %s of volume(%s) from the share quota(%d): %v", diskPath, volumeID, quota, quotaErr)
+				}
+			}
+			sizeGiB, convErr := strconv.Atoi(requestedSizeGiB)
+			if convErr != nil || sizeGiB <= 0 {
+				return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("cannot recreate vhd %q of volume(%s): invalid %s(%s)", diskPath, volumeID, requestedSizeGiBField, requestedSizeGiB))
+			}
+			klog.V(2).Infof("NodeStageVolume: vhd %s of volume %s does not exist, recreating it with size %dGiB", diskPath, volumeID, sizeGiB)
+			// the blank vhd gets its filesystem from the format step below
+			if err := createLocalDisk(diskPath, volumehelper.GiBToBytes(int64(sizeGiB))); err != nil {
+				return nil, status.Errorf(codes.Internal, "could not recreate vhd %q of volume(%s): %v", diskPath, volumeID, err)
+			}
+		}
+
+		existingFormat, err := getDiskFormat(d.mounter, diskPath)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "could not determine whether disk %q of volume(%s) already has a filesystem: %v", diskPath, volumeID, err)
+		}
+		if err := checkDiskFormat(existingFormat, fsType, diskPath, volumeID); err != nil {
+			return nil, err
+		}
+		if existingFormat != "" {
+			klog.V(2).Infof("NodeStageVolume: disk %s of volume %s already has a %s filesystem, the format step will be skipped", diskPath, volumeID, existingFormat)
+		}
 
 		klog.V(2).Infof("NodeStageVolume: volume %s formatting %s and mounting at %s with mount options(%s)", volumeID, targetPath, diskPath, options)
 		// FormatAndMount will format only if needed
 		if err := d.mounter.FormatAndMount(diskPath, targetPath, fsType, options); err != nil {
-			return nil, status.Error(codes.Internal, fmt.Sprintf("could not format %q and mount it at %q", targetPath, diskPath))
+			return nil, status.Error(codes.Internal, fmt.Sprintf("volume(%s) could not format %q and mount it at %q, volume source(%q): %v", volumeID, targetPath, diskPath, source, err))
 		}
 		klog.V(2).Infof("NodeStageVolume: volume %s format %s and mounting at %s successfully", volumeID, targetPath, diskPath)
 	}
+	staged = true
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
@@ -253,15 +668,28 @@ func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolu
 	}
 
 	klog.V(2).Infof("NodeUnstageVolume: CleanupMountPoint volume %s on %s", volumeID, stagingTargetPath)
-	if err := CleanupSMBMountPoint(d.mounter, stagingTargetPath, false); err != nil {
+	if err := d.unmountWithTimeout(stagingTargetPath, func() error {
+		return retryCleanupMountPoint(func() error {
+			return CleanupSMBMountPoint(d.mounter, stagingTargetPath, false)
+		})
+	}); err != nil && !isIgnorableUnmountError(err) {
 		return nil, status.Errorf(codes.Internal, "failed to unmount staging target %q: %v", stagingTargetPath, err)
 	}
 
-	targetPath := filepath.Join(filepath.Dir(stagingTargetPath), proxyMount)
+	targetPath := d.proxyMountPathForTarget(stagingTargetPath)
 	klog.V(2).Infof("NodeUnstageVolume: CleanupMountPoint volume %s on %s", volumeID, targetPath)
-	if err := CleanupMountPoint(d.mounter, targetPath, false); err != nil {
+	if err := d.unmountWithTimeout(targetPath, func() error {
+		return retryCleanupMountPoint(func() error {
+			return CleanupMountPoint(d.mounter, targetPath, false)
+		})
+	}); err != nil && !isIgnorableUnmountError(err) {
 		return nil, status.Errorf(codes.Internal, "failed to unmount staging target %q: %v", targetPath, err)
 	}
+	d.releaseStagedPath(stagingTargetPath, volumeID)
+	d.forgetVolumeTier(volumeID)
+	d.forgetMountTime(volumeID)
+	// the account key of the volume must not linger once the volume is gone
+	d.removeVolumeCredentials(volumeID)
 	klog.V(2).Infof("NodeUnstageVolume: unmount volume %s on %s successfully", volumeID, stagingTargetPath)
 
 	return &csi.NodeUnstageVolumeResponse{}, nil
@@ -276,9 +704,15 @@ func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabi
 
 // NodeGetInfo return info of the node on which this plugin is running
 func (d *Driver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
-	return &csi.NodeGetInfoResponse{
+	resp := &csi.NodeGetInfoResponse{
 		NodeId: d.NodeID,
-	}, nil
+	}
+	if d.maxVolumesPerNode > 0 {
+		// a zero MaxVolumesPerNode means unlimited per the CSI spec, only set
+		// it when the operator configured a limit
+		resp.MaxVolumesPerNode = int64(d.maxVolumesPerNode)
+	}
+	return resp, nil
 }
 
 // NodeGetVolumeStats get volume stats
@@ -293,15 +727,23 @@ func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeS
 	_, err := os.Stat(req.VolumePath)
 	if err != nil {
 		if os.IsNotExist(err) {
+			d.clearMountProbeFailures(req.VolumePath)
 			return nil, status.Errorf(codes.NotFound, "path %s does not exist", req.VolumePath)
 		}
-		return nil, status.Errorf(codes.Internal, "failed to stat file %s: %v", req.VolumePath, err)
+		// a stat error on an existing path is the signature of a stale mount
+		return d.staleMountResponse(req.VolumePath, err), nil
+	}
+
+	if !d.isVolumePathMounted(req.VolumePath) {
+		return nil, status.Errorf(codes.Internal, "volume path %s exists but is not a mount point, refusing to report stats of the underlying filesystem", req.VolumePath)
 	}
 
-	volumeMetrics, err := volume.NewMetricsStatFS(req.VolumePath).GetMetrics()
+	volumeMetrics, err := d.cachedVolumeMetrics(req.VolumePath)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to get metrics: %v", err)
+		return d.staleMountResponse(req.VolumePath, err), nil
 	}
+	d.clearMountProbeFailures(req.VolumePath)
+	d.recordMountSuccess(req.VolumeId)
 
 	available, ok := volumeMetrics.Available.AsInt64()
 	if !ok {
@@ -316,20 +758,7 @@ func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeS
 		return nil, status.Errorf(codes.Internal, "failed to transform volume used size(%v)", volumeMetrics.Used)
 	}
 
-	inodesFree, ok := volumeMetrics.InodesFree.AsInt64()
-	if !ok {
-		return nil, status.Errorf(codes.Internal, "failed to transform disk inodes free(%v)", volumeMetrics.InodesFree)
-	}
-	inodes, ok := volumeMetrics.Inodes.AsInt64()
-	if !ok {
-		return nil, status.Errorf(codes.Internal, "failed to transform disk inodes(%v)", volumeMetrics.Inodes)
-	}
-	inodesUsed, ok := volumeMetrics.InodesUsed.AsInt64()
-	if !ok {
-		return nil, status.Errorf(codes.Internal, "failed to transform disk inodes used(%v)", volumeMetrics.InodesUsed)
-	}
-
-	return &csi.NodeGetVolumeStatsResponse{
+	resp := &csi.NodeGetVolumeStatsResponse{
 		Usage: []*csi.VolumeUsage{
 			{
 				Unit:      csi.VolumeUsage_BYTES,
@@ -337,20 +766,89 @@ func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeS
 				Total:     capacity,
 				Used:      used,
 			},
-			{
-				Unit:      csi.VolumeUsage_INODES,
-				Available: inodesFree,
-				Total:     inodes,
-				Used:      inodesUsed,
-			},
 		},
-	}, nil
+	}
+
+	if runtime.GOOS != "windows" {
+		// inode usage comes from statfs and is not meaningful for the SMB
+		// client on windows, which reports no inode counters
+		inodesFree, ok := volumeMetrics.InodesFree.AsInt64()
+		if !ok {
+			return nil, status.Errorf(codes.Internal, "failed to transform disk inodes free(%v)", volumeMetrics.InodesFree)
+		}
+		inodes, ok := volumeMetrics.Inodes.AsInt64()
+		if !ok {
+			return nil, status.Errorf(codes.Internal, "failed to transform disk inodes(%v)", volumeMetrics.Inodes)
+		}
+		inodesUsed, ok := volumeMetrics.InodesUsed.AsInt64()
+		if !ok {
+			return nil, status.Errorf(codes.Internal, "failed to transform disk inodes used(%v)", volumeMetrics.InodesUsed)
+		}
+		resp.Usage = append(resp.Usage, &csi.VolumeUsage{
+			Unit:      csi.VolumeUsage_INODES,
+			Available: inodesFree,
+			Total:     inodes,
+			Used:      inodesUsed,
+		})
+	}
+	if message := shareTierConditionMessage(d.getVolumeTier(req.VolumeId)); message != "" {
+		// informational only, the volume is healthy
+		resp.VolumeCondition = &csi.VolumeCondition{Abnormal: false, Message: message}
+	}
+	return resp, nil
 }
 
 // NodeExpandVolume node expand volume
-// N/A for azure file
+// only disk mode volumes need a node side resize, the filesystem inside the
+// vhd has to be grown after the share quota was expanded
 func (d *Driver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	volumePath := req.GetVolumePath()
+	if len(volumePath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume path missing in request")
+	}
+
+	_, _, _, diskName, err := GetFileShareInfo(volumeID)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("GetFileShareInfo(%s) failed with error: %v", volumeID, err))
+	}
+	if diskName == "" {
+		// a file share grows transparently with its quota, only disk mode
+		// volumes need a node side filesystem resize
+		return &csi.NodeExpandVolumeResponse{CapacityBytes: req.GetCapacityRange().GetRequiredBytes()}, nil
+	}
+
+	devicePath, refCount, err := mount.GetDeviceNameFromMount(d.mounter, volumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to determine device path of volume(%s) at %s: %v", volumeID, volumePath, err)
+	}
+	if refCount == 0 || devicePath == "" {
+		// the disk is attached from the vhd file on the proxy mount, fall back
+		// to that path when the mount table does not resolve the device
+		devicePath = filepath.Join(d.proxyMountPathForTarget(volumePath), diskName)
+	}
+	fsType, err := getDiskFormat(d.mounter, devicePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "could not determine the filesystem of disk %q of volume(%s): %v", devicePath, volumeID, err)
+	}
+	var output []byte
+	switch fsType {
+	case xfs:
+		// xfs is grown through the mounted filesystem
+		output, err = d.mounter.Exec.Command("xfs_growfs", "-d", volumePath).CombinedOutput()
+	case ext2, ext3, ext4:
+		output, err = d.mounter.Exec.Command("resize2fs", devicePath).CombinedOutput()
+	default:
+		return nil, status.Errorf(codes.Internal, "disk %q of volume(%s) has no resizable filesystem(%q)", devicePath, volumeID, fsType)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to resize %s filesystem of volume(%s) on %s: %v, output: %q", fsType, volumeID, devicePath, err, string(output))
+	}
+	klog.V(2).Infof("NodeExpandVolume: resized %s filesystem of volume(%s) on %s successfully", fsType, volumeID, devicePath)
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: req.GetCapacityRange().GetRequiredBytes()}, nil
 }
 
 // ensureMountPoint: create mount point if not exists
@@ -386,9 +884,757 @@ func (d *Driver) ensureMountPoint(target string) (bool, error) {
 		klog.Errorf("MakeDir failed on target: %s (%v)", target, err)
 		return !notMnt, err
 	}
+	if err := d.chmodIfConfigured(target); err != nil {
+		klog.Errorf("Chmod failed on target: %s (%v)", target, err)
+		return !notMnt, err
+	}
 	return !notMnt, nil
 }
 
+// chmodIfConfigured applies the configured mount-permissions to a freshly
+// created mount point, a zero mode leaves the directory untouched. Under the
+// None fsGroupPolicy no permissions are ever changed and under
+// ReadWriteOnceWithFSType kubelet applies them itself, only File(and the
+// empty default) keeps permission handling in the driver
+func (d *Driver) chmodIfConfigured(target string) error {
+	if d.mountPermissions == 0 {
+		return nil
+	}
+	switch d.fsGroupPolicy {
+	case fsGroupPolicyNone, fsGroupPolicyReadWriteOnceWithFSType:
+		return nil
+	}
+	return os.Chmod(target, d.mountPermissions)
+}
+
+// isRetriableUnmountError returns true for transient unmount failures worth
+// retrying, e.g. the mount point still being busy or a timeout, while
+// non-transient errors like bad arguments fail fast
+func isRetriableUnmountError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.ETIMEDOUT) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "device or resource busy") || strings.Contains(msg, "timed out")
+}
+
+// isIgnorableUnmountError returns true for unmount failures that mean there is
+// nothing left to unmount: the target path does not exist or is not a mount
+// point, an unmount is idempotent in both cases
+func isIgnorableUnmountError(err error) bool {
+	if err == nil {
+		return true
+	}
+	if os.IsNotExist(err) || errors.Is(err, syscall.ENOENT) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "no such file or directory") ||
+		strings.Contains(msg, "not a mount point") ||
+		strings.Contains(msg, "not mounted")
+}
+
+// default time budget of a NodeUnstageVolume unmount before the lazy
+// unmount fallback
+const defaultUnmountTimeout = 30 * time.Second
+
+// unmountWithTimeout runs cleanup, bounding it by the configured unmount
+// timeout. An unmount still blocked on an unreachable server after the budget
+// is abandoned and a lazy unmount of target is attempted so the kernel
+// detaches the mount once the server answers again
+func (d *Driver) unmountWithTimeout(target string, cleanup func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- cleanup()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(d.unmountTimeout):
+	}
+	klog.Warningf("unmount of %q did not finish within %v, falling back to a lazy unmount", target, d.unmountTimeout)
+	if err := lazyUnmount(target); err != nil {
+		return fmt.Errorf("unmount of %q timed out after %v and the lazy unmount fallback failed: %v", target, d.unmountTimeout, err)
+	}
+	return nil
+}
+
+// retryCleanupMountPoint retries the mount point cleanup with exponential
+// backoff as long as the failure is transient
+func retryCleanupMountPoint(cleanup func() error) error {
+	var lastErr error
+	backoff := wait.Backoff{Duration: 500 * time.Millisecond, Factor: 2, Steps: 4}
+	err := wait.ExponentialBackoff(backoff, func() (bool, error) {
+		if lastErr = cleanup(); lastErr == nil {
+			return true, nil
+		}
+		if isRetriableUnmountError(lastErr) {
+			klog.Warningf("cleanup mount point failed with transient error(%v), waiting for retrying", lastErr)
+			return false, nil
+		}
+		return true, lastErr
+	})
+	if err == wait.ErrWaitTimeout {
+		return lastErr
+	}
+	return err
+}
+
+// default number of mount attempts while the share looks not ready yet
+const defaultShareNotReadyRetries = 3
+
+const (
+	defaultSmbMountRetries = 3
+	smbMountRetryDelay     = 500 * time.Millisecond
+)
+
+// isShareNotReadyMountError returns true when a mount failure looks like the
+// share has not materialized yet, which happens when NodeStageVolume races
+// with dynamic provisioning of the share, mount error(2) is how mount.cifs
+// reports a share the server does not know about
+func isShareNotReadyMountError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "mount error(2)") ||
+		strings.Contains(msg, "no such file or directory") ||
+		strings.Contains(msg, "not ready")
+}
+
+// retryWhileShareNotReady retries the mount with backoff as long as the
+// failure indicates the share is still being provisioned, permanent errors
+// fail on the first attempt. The number of attempts is bounded by
+// shareNotReadyRetries so a permanently missing share still surfaces
+func (d *Driver) retryWhileShareNotReady(volumeID string, mountFunc func() error) error {
+	var lastErr error
+	backoff := wait.Backoff{Duration: 500 * time.Millisecond, Factor: 2, Steps: d.shareNotReadyRetries}
+	err := wait.ExponentialBackoff(backoff, func() (bool, error) {
+		if lastErr = mountFunc(); lastErr == nil {
+			return true, nil
+		}
+		if isShareNotReadyMountError(lastErr) {
+			klog.Warningf("volume(%s) mount failed because the share does not look ready yet(%v), retrying", volumeID, lastErr)
+			return false, nil
+		}
+		return true, lastErr
+	})
+	if err == wait.ErrWaitTimeout {
+		return lastErr
+	}
+	return err
+}
+
+// retrySmbMapping retries transient SMB global mapping failures on windows,
+// where NewSmbGlobalMapping occasionally fails on a healthy share, logging
+// each failed attempt. The last error is returned unchanged so callers keep
+// their error format
+func (d *Driver) retrySmbMapping(volumeID string, mountFunc func() error) error {
+	var lastErr error
+	attempt := 0
+	backoff := wait.Backoff{Duration: smbMountRetryDelay, Factor: 2, Steps: d.smbMountRetries}
+	err := wait.ExponentialBackoff(backoff, func() (bool, error) {
+		attempt++
+		if lastErr = mountFunc(); lastErr == nil {
+			return true, nil
+		}
+		klog.Warningf("volume(%s) SMB mapping attempt %d of %d failed: %v", volumeID, attempt, d.smbMountRetries, lastErr)
+		return false, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return lastErr
+	}
+	return err
+}
+
+// isAuthFailedMountError returns true when a mount failure looks like an
+// authentication problem, e.g. the account key used was rotated out
+func isAuthFailedMountError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "permission denied") || strings.Contains(msg, "access denied") ||
+		strings.Contains(msg, "mount error(13)")
+}
+
+// getAlternateAccountKey fetches the key of the account that differs from the
+// one a failed mount used, either key is valid for mounting so a rotation of
+// one of them must not break mounts
+func (d *Driver) getAlternateAccountKey(ctx context.Context, resourceGroup, accountName, currentKey string) (string, error) {
+	result, rerr := d.cloud.StorageAccountClient.ListKeys(ctx, resourceGroup, accountName)
+	if rerr != nil {
+		return "", fmt.Errorf("could not list keys of account(%s): %v", accountName, rerr.Error())
+	}
+	if result.Keys != nil {
+		for _, k := range *result.Keys {
+			if k.Value != nil && *k.Value != "" && *k.Value != currentKey {
+				return *k.Value, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("account(%s) has no key different from the one already tried", accountName)
+}
+
+// resolveFsType applies the configured default fsType to disk-mode volumes
+// when the volume context does not set one, plain SMB/NFS share mounts never
+// get a filesystem forced onto them
+func (d *Driver) resolveFsType(fsType, diskName string) string {
+	if fsType == "" && diskName != "" {
+		return d.defaultDiskFsType
+	}
+	return fsType
+}
+
+// proxyMountPathForTarget returns the proxy mount point of a disk-mode
+// volume, beside its staging target by default. On nodes with a read-only
+// root filesystem the configured base directory is used instead, with a hash
+// of the staging target keeping the per-volume mount points apart.
+func (d *Driver) proxyMountPathForTarget(targetPath string) string {
+	if d.proxyMountBase == "" {
+		return filepath.Join(filepath.Dir(targetPath), proxyMount)
+	}
+	h := fnv.New32a()
+	h.Write([]byte(filepath.Dir(targetPath)))
+	return filepath.Join(d.proxyMountBase, fmt.Sprintf("%s-%x", proxyMount, h.Sum32()))
+}
+
+// knownVolumeContextFields are the volume context keys the node consumes,
+// either in the NodeStageVolume parameter switch, in GetAccountInfo, or as
+// dynamic provisioning parameters copied into the volume context
+var knownVolumeContextFields = map[string]struct{}{
+	fsTypeField:             {},
+	protocolField:           {},
+	diskNameField:           {},
+	serverNameField:         {},
+	serverAddressField:      {},
+	endpointSuffixField:     {},
+	portField:               {},
+	shareTierField:          {},
+	requestedSizeGiBField:   {},
+	mountProfileField:       {},
+	mountOptionsField:       {},
+	echoIntervalField:       {},
+	handleCacheField:        {},
+	encryptInTransitField:   {},
+	requireEncryptField:     {},
+	smbVersionField:         {},
+	fileModeField:           {},
+	dirModeField:            {},
+	secNfsField:             {},
+	createDiskField:         {},
+	diskMountOptionsField:   {},
+	resourceGroupField:      {},
+	storageAccountField:     {},
+	storageAccountTypeField: {},
+	skuNameField:            {},
+	shareNameField:          {},
+	secretNamespaceField:    {},
+	usernameField:           {},
+	subsIDField:             {},
+	diskModeField:           {},
+	storeAccountKeyField:    {},
+	locationField:           {},
+	edgeZoneField:           {},
+	tagsField:               {},
+	quotaMarginPercentField: {},
+	accessPolicyPermsField:  {},
+	accessPolicyExpiryField: {},
+	accessPolicyIDField:     {},
+}
+
+// isUnknownVolumeContextKey reports whether a volume context key is unknown to
+// this node, unknown keys are logged and skipped instead of failing the stage
+// so nodes running an older driver tolerate parameters of newer provisioners
+func isUnknownVolumeContextKey(key string) bool {
+	if strings.HasPrefix(key, "csi.storage.k8s.io/") {
+		// metadata the external-provisioner adds on its own
+		return false
+	}
+	_, known := knownVolumeContextFields[strings.ToLower(key)]
+	return !known
+}
+
+// safeDiskMountOptions is the allowlist of inner filesystem mount options a
+// disk-mode volume may request for its loop device mount, keyed by option
+// name. Anything outside it, e.g. dev or suid, could weaken the node's
+// security posture and is rejected
+var safeDiskMountOptions = map[string]struct{}{
+	"noatime":     {},
+	"nodiratime":  {},
+	"relatime":    {},
+	"strictatime": {},
+	"lazytime":    {},
+	"discard":     {},
+	"barrier":     {},
+	"commit":      {},
+	"errors":      {},
+}
+
+// parseDiskMountOptions validates the requested inner filesystem mount options
+// of a disk-mode volume against the safe allowlist, these are separate from
+// the outer SMB mount options of the share carrying the vhd
+func parseDiskMountOptions(diskMountOptions string) ([]string, error) {
+	options := parseMountOptionList(diskMountOptions)
+	for _, option := range options {
+		if _, safe := safeDiskMountOptions[strings.SplitN(option, "=", 2)[0]]; !safe {
+			return nil, fmt.Errorf("disk mount option(%s) is not in the safe set", option)
+		}
+	}
+	return options, nil
+}
+
+// ensureSealedMountOptions adds the seal option, which forces SMB3 encryption
+// on the wire, and rejects option sets negotiating a protocol version that
+// cannot encrypt, mounting those would silently downgrade to plaintext
+func ensureSealedMountOptions(mountOptions []string) ([]string, error) {
+	for _, entry := range mountOptions {
+		for _, option := range strings.Split(entry, ",") {
+			option = strings.TrimSpace(option)
+			if strings.HasPrefix(option, vers+"=") {
+				if version := strings.TrimPrefix(option, vers+"="); !strings.HasPrefix(version, "3") {
+					return nil, fmt.Errorf("smb version(%s) cannot encrypt in transit, encryption requires smb 3.x", version)
+				}
+			}
+		}
+	}
+	return mergeMountOptions(mountOptions, []string{seal}), nil
+}
+
+// validateMountOptions checks every mount option, splitting comma-separated
+// entries, and aggregates all malformed ones into a single error so users can
+// fix them in one pass instead of one failed mount at a time. An option must
+// look like "flag" or "key=value".
+func validateMountOptions(mountFlags []string) error {
+	var invalid []string
+	for _, entry := range mountFlags {
+		for _, option := range strings.Split(entry, ",") {
+			option = strings.TrimSpace(option)
+			if option == "" || strings.HasPrefix(option, "=") || strings.HasSuffix(option, "=") ||
+				strings.ContainsAny(option, " \t") || strings.Count(option, "=") > 1 {
+				invalid = append(invalid, option)
+			}
+		}
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("invalid mount options %q, each option must be a flag or a key=value pair", invalid)
+	}
+	return nil
+}
+
+// interval between heartbeat log lines while a mount is still in progress
+const mountProgressInterval = 30 * time.Second
+
+// mountWithProgress runs mountFunc and logs a periodic heartbeat while it is
+// still running so operators can tell a slow mount from a hung one
+func mountWithProgress(volumeID, source, target string, interval time.Duration, mountFunc func() error) error {
+	start := time.Now()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				klog.Warningf("volume(%s) still mounting %q on %q after %v", volumeID, source, target, time.Since(start).Round(time.Second))
+			}
+		}
+	}()
+	return mountFunc()
+}
+
+// acquireStagedPath marks the staging target path as in use by the given
+// volume, rejecting the stage if another volume already staged to the path
+func (d *Driver) acquireStagedPath(targetPath, volumeID string) error {
+	d.stagedPathsLock.Lock()
+	defer d.stagedPathsLock.Unlock()
+	if existing, ok := d.stagedPaths[targetPath]; ok && existing != volumeID {
+		return status.Errorf(codes.FailedPrecondition, "staging target path(%s) is already in use by volume(%s)", targetPath, existing)
+	}
+	d.stagedPaths[targetPath] = volumeID
+	return nil
+}
+
+// releaseStagedPath removes the staging target path record of the given volume
+func (d *Driver) releaseStagedPath(targetPath, volumeID string) {
+	d.stagedPathsLock.Lock()
+	defer d.stagedPathsLock.Unlock()
+	if existing, ok := d.stagedPaths[targetPath]; ok && existing == volumeID {
+		delete(d.stagedPaths, targetPath)
+		delete(d.stagedMountOptions, targetPath)
+	}
+}
+
+// recordStagedMountOptions remembers the mount options a volume was staged
+// with so a later re-stage can detect that the options changed
+func (d *Driver) recordStagedMountOptions(targetPath string, mountOptions []string) {
+	d.stagedPathsLock.Lock()
+	defer d.stagedPathsLock.Unlock()
+	d.stagedMountOptions[targetPath] = normalizeMountOptions(mountOptions)
+}
+
+// stagedMountOptionsChanged reports whether the volume staged at targetPath
+// was mounted with different options than the requested ones, a path without
+// a record(e.g. staged before a driver restart) counts as unchanged
+func (d *Driver) stagedMountOptionsChanged(targetPath string, mountOptions []string) bool {
+	d.stagedPathsLock.Lock()
+	defer d.stagedPathsLock.Unlock()
+	recorded, ok := d.stagedMountOptions[targetPath]
+	if !ok {
+		return false
+	}
+	requested := normalizeMountOptions(mountOptions)
+	if len(recorded) != len(requested) {
+		return true
+	}
+	for i := range recorded {
+		if recorded[i] != requested[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeMountOptions returns a sorted copy of the mount options so option
+// sets compare independent of their order
+func normalizeMountOptions(mountOptions []string) []string {
+	normalized := make([]string, len(mountOptions))
+	copy(normalized, mountOptions)
+	sort.Strings(normalized)
+	return normalized
+}
+
+// isReadOnlyAccessMode reports whether the requested access mode only allows
+// reads, such volumes never need a writable share mount
+func isReadOnlyAccessMode(volumeCapability *csi.VolumeCapability) bool {
+	switch volumeCapability.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	}
+	return false
+}
+
+// diskPartitionFormat is the special value GetDiskFormat reports when blkid
+// finds a partition table on the disk instead of a plain filesystem
+const diskPartitionFormat = "unknown data, probably partitions"
+
+// checkDiskFormat decides whether the vhd may be handed to FormatAndMount,
+// which only formats unformatted disks. A partitioned vhd or one already
+// carrying a different filesystem than the requested fsType is rejected up
+// front with a clear error, FormatAndMount would otherwise try to mount the
+// foreign content directly and surface a misleading mount failure
+func checkDiskFormat(existingFormat, fsType, diskPath, volumeID string) error {
+	if existingFormat == "" {
+		// blank disk, FormatAndMount will create the filesystem
+		return nil
+	}
+	if strings.Contains(existingFormat, diskPartitionFormat) {
+		return status.Errorf(codes.FailedPrecondition, "disk %q of volume(%s) contains a partition table and cannot be formatted or mounted as %s, it will never be formatted by the driver since that would destroy its content", diskPath, volumeID, fsType)
+	}
+	if existingFormat != fsType {
+		// the disk carries data in a foreign filesystem, mounting it as is
+		// would hand the workload something else than what it asked for
+		return status.Errorf(codes.AlreadyExists, "disk %q of volume(%s) already has a %s filesystem while %s was requested, it will never be reformatted by the driver since that would destroy its content", diskPath, volumeID, existingFormat, fsType)
+	}
+	return nil
+}
+
+// aznfsMountHelperPath is where the aznfs package installs its mount helper,
+// TLS-wrapped nfs mounts are only possible when the helper is present
+const aznfsMountHelperPath = "/sbin/mount.aznfs"
+
+// nfsTLSSupported reports whether this node can mount nfs shares with
+// encryption in transit, overridable in unit tests
+var nfsTLSSupported = func() bool {
+	_, err := os.Stat(aznfsMountHelperPath)
+	return err == nil
+}
+
+// getVolumeMetrics reads the filesystem statistics of the volume path,
+// overridable in unit tests
+var getVolumeMetrics = func(path string) (*volume.Metrics, error) {
+	return volume.NewMetricsStatFS(path).GetMetrics()
+}
+
+// volumeStatsCacheEntry is one cached statfs result, done is closed once the
+// probe filling the entry finished
+type volumeStatsCacheEntry struct {
+	done      chan struct{}
+	metrics   *volume.Metrics
+	err       error
+	fetchedAt time.Time
+}
+
+// cachedVolumeMetrics returns the filesystem statistics of the volume path,
+// served from the cache within the configured TTL so kubelet probing hundreds
+// of volumes does not cause a statfs storm. Concurrent callers for the same
+// path coalesce onto a single probe.
+func (d *Driver) cachedVolumeMetrics(path string) (*volume.Metrics, error) {
+	if d.volumeStatsCacheTTL <= 0 {
+		return getVolumeMetrics(path)
+	}
+	for {
+		d.volumeStatsCacheLock.Lock()
+		entry, ok := d.volumeStatsCache[path]
+		if !ok {
+			entry = &volumeStatsCacheEntry{done: make(chan struct{})}
+			d.volumeStatsCache[path] = entry
+			d.volumeStatsCacheLock.Unlock()
+			entry.metrics, entry.err = getVolumeMetrics(path)
+			entry.fetchedAt = time.Now()
+			close(entry.done)
+			return entry.metrics, entry.err
+		}
+		d.volumeStatsCacheLock.Unlock()
+		<-entry.done
+		if entry.err == nil && time.Since(entry.fetchedAt) < d.volumeStatsCacheTTL {
+			return entry.metrics, nil
+		}
+		// the entry expired or recorded a failure, drop it and probe again
+		d.volumeStatsCacheLock.Lock()
+		if d.volumeStatsCache[path] == entry {
+			delete(d.volumeStatsCache, path)
+		}
+		d.volumeStatsCacheLock.Unlock()
+	}
+}
+
+// isVolumePathMounted reports whether the volume path is backed by an actual
+// mount point. Statistics of a bare directory would describe the node root
+// filesystem instead of the share, so stats are skipped on such paths. A nil
+// mounter or a failed check count as mounted to keep the probe best effort
+func (d *Driver) isVolumePathMounted(volumePath string) bool {
+	if d.mounter == nil {
+		return true
+	}
+	notMnt, err := d.mounter.IsLikelyNotMountPoint(volumePath)
+	if err != nil {
+		klog.Warningf("could not determine whether %s is a mount point: %v", volumePath, err)
+		return true
+	}
+	return !notMnt
+}
+
+// recordMountProbeFailure counts a failed health probe of the volume path and
+// returns the number of consecutive failures so far
+func (d *Driver) recordMountProbeFailure(path string) int {
+	d.mountProbeFailuresLock.Lock()
+	defer d.mountProbeFailuresLock.Unlock()
+	d.mountProbeFailures[path]++
+	return d.mountProbeFailures[path]
+}
+
+// clearMountProbeFailures resets the probe history of the volume path after a
+// successful probe
+func (d *Driver) clearMountProbeFailures(path string) {
+	d.mountProbeFailuresLock.Lock()
+	defer d.mountProbeFailuresLock.Unlock()
+	delete(d.mountProbeFailures, path)
+}
+
+// staleMountResponse reports the health of a volume path that failed its probe,
+// the mount is only flagged abnormal after staleMountProbeThreshold consecutive
+// failures so a transient blip does not mark a healthy mount stale
+func (d *Driver) staleMountResponse(path string, probeErr error) *csi.NodeGetVolumeStatsResponse {
+	failures := d.recordMountProbeFailure(path)
+	if failures < d.staleMountProbeThreshold {
+		klog.Warningf("volume path %s failed its health probe(%v), %d of %d consecutive failures before it is reported abnormal", path, probeErr, failures, d.staleMountProbeThreshold)
+		return &csi.NodeGetVolumeStatsResponse{
+			VolumeCondition: &csi.VolumeCondition{Abnormal: false, Message: fmt.Sprintf("mount probe failed transiently: %v", probeErr)},
+		}
+	}
+	klog.Warningf("volume path %s is stale after %d consecutive failed health probes: %v", path, failures, probeErr)
+	return &csi.NodeGetVolumeStatsResponse{
+		VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("mount is stale after %d consecutive failed probes: %v", failures, probeErr)},
+	}
+}
+
+// probeMountAuth accesses the mount point and returns the error the access
+// failed with, overridable in unit tests
+var probeMountAuth = func(target string) error {
+	_, err := ioutil.ReadDir(target)
+	return err
+}
+
+// checkExistingMount inspects the mount already present at target and only
+// accepts it as this driver's own mount when its source and filesystem type
+// match what the driver would have mounted there. Staging over a mount left
+// behind by something else(e.g. another driver) would shadow or corrupt
+// foreign data, so it fails unless the operator explicitly opted in
+func (d *Driver) checkExistingMount(volumeID, target, expectedSource, protocol string) error {
+	mountPoints, err := d.mounter.List()
+	if err != nil {
+		// listing mounts is best effort, keep the historical behavior of
+		// trusting the mount point when the mount table cannot be read
+		klog.Warningf("could not list mounts to inspect the existing mount on %q: %v", target, err)
+		return nil
+	}
+	expectedType := cifs
+	if protocol == nfs {
+		expectedType = nfs
+	}
+	for _, mountPoint := range mountPoints {
+		if mountPoint.Path != target {
+			continue
+		}
+		// nfs mounts may surface as nfs4 in the mount table
+		if mountPoint.Device == expectedSource && strings.HasPrefix(mountPoint.Type, expectedType) {
+			return nil
+		}
+		if d.forceStageOverForeignMounts {
+			klog.Warningf("volume(%s) staging target %q already carries a foreign mount(source %q, fstype %q), staging over it as requested", volumeID, target, mountPoint.Device, mountPoint.Type)
+			return nil
+		}
+		return status.Errorf(codes.FailedPrecondition, "volume(%s) staging target %q already carries a foreign mount(source %q, fstype %q), refusing to stage over it, set --force-stage-over-foreign-mounts to override", volumeID, target, mountPoint.Device, mountPoint.Type)
+	}
+	return nil
+}
+
+// refreshMountCredentials re-keys an SMB mount whose account key rotated while
+// it stayed mounted, preferring an in-place remount over a disruptive
+// unmount/mount cycle
+func (d *Driver) refreshMountCredentials(volumeID, source, target string, mountOptions, sensitiveMountOptions []string) error {
+	probeErr := probeMountAuth(target)
+	if probeErr == nil || !isAuthFailedMountError(probeErr) {
+		return nil
+	}
+	klog.V(2).Infof("volume(%s) mount on %q failed authentication(%v), refreshing credentials", volumeID, target, probeErr)
+	remountErr := d.mounter.MountSensitive(source, target, cifs, append([]string{"remount"}, mountOptions...), sensitiveMountOptions)
+	if remountErr == nil {
+		klog.V(2).Infof("volume(%s) credentials on %q refreshed in place", volumeID, target)
+		return nil
+	}
+	klog.Warningf("volume(%s) in-place credential refresh on %q failed(%v), falling back to unmount and mount", volumeID, target, remountErr)
+	// keep the mount point directory, the share is mounted right back onto it
+	if err := d.mounter.Unmount(target); err != nil && !isIgnorableUnmountError(err) {
+		return fmt.Errorf("failed to unmount %q for credential refresh: %v", target, err)
+	}
+	return SMBMount(d.mounter, source, target, cifs, mountOptions, sensitiveMountOptions)
+}
+
+// verifyShareQuota fetches the share quota and warns when it no longer matches
+// the capacity the volume was provisioned with, catching out-of-band quota
+// changes early without failing the mount
+func (d *Driver) verifyShareQuota(volumeID, rgName, accountName, fileShareName, requestedSizeGiB string, secrets map[string]string) {
+	declaredGiB, err := strconv.Atoi(requestedSizeGiB)
+	if err != nil || declaredGiB <= 0 {
+		klog.Warningf("volume(%s) has an invalid %s(%s) in its volume context, skipping quota verification", volumeID, requestedSizeGiBField, requestedSizeGiB)
+		return
+	}
+	quota, err := d.getFileShareQuota(getSubscriptionIDFromVolumeID(volumeID), rgName, accountName, fileShareName, secrets)
+	if err != nil {
+		klog.Warningf("volume(%s) quota verification of share(%s) failed: %v", volumeID, fileShareName, err)
+		return
+	}
+	if quota != -1 && quota != declaredGiB {
+		klog.Warningf("volume(%s) share(%s) quota(%d GiB) does not match the provisioned capacity(%d GiB), the quota was changed out of band", volumeID, fileShareName, quota, declaredGiB)
+	}
+}
+
+// recordVolumeTier remembers the share tier of a staged volume so that
+// NodeGetVolumeStats can report it, an empty tier clears the record
+func (d *Driver) recordVolumeTier(volumeID, shareTier string) {
+	d.volumeTiersLock.Lock()
+	defer d.volumeTiersLock.Unlock()
+	if shareTier == "" {
+		delete(d.volumeTiers, volumeID)
+		return
+	}
+	d.volumeTiers[volumeID] = strings.ToLower(shareTier)
+}
+
+// getVolumeTier returns the recorded share tier of the volume, if any
+func (d *Driver) getVolumeTier(volumeID string) string {
+	d.volumeTiersLock.Lock()
+	defer d.volumeTiersLock.Unlock()
+	return d.volumeTiers[volumeID]
+}
+
+// forgetVolumeTier drops the share tier record of an unstaged volume
+func (d *Driver) forgetVolumeTier(volumeID string) {
+	d.volumeTiersLock.Lock()
+	defer d.volumeTiersLock.Unlock()
+	delete(d.volumeTiers, volumeID)
+}
+
+// recordMountSuccess remembers when the volume last mounted or passed a health
+// probe so operators can correlate mount age with observed I/O errors
+func (d *Driver) recordMountSuccess(volumeID string) {
+	d.lastMountTimesLock.Lock()
+	defer d.lastMountTimesLock.Unlock()
+	d.lastMountTimes[volumeID] = time.Now()
+}
+
+// lastMountTime returns when the volume last mounted or passed a health probe,
+// the zero time when the volume has no record
+func (d *Driver) lastMountTime(volumeID string) time.Time {
+	d.lastMountTimesLock.Lock()
+	defer d.lastMountTimesLock.Unlock()
+	return d.lastMountTimes[volumeID]
+}
+
+// forgetMountTime drops the last-successful-mount record of an unstaged volume
+func (d *Driver) forgetMountTime(volumeID string) {
+	d.lastMountTimesLock.Lock()
+	defer d.lastMountTimesLock.Unlock()
+	delete(d.lastMountTimes, volumeID)
+}
+
+// shareTierConditionMessage returns an informational note for tiers with
+// higher first-byte latency, or an empty string for tiers without one
+func shareTierConditionMessage(shareTier string) string {
+	switch shareTier {
+	case "cool", "archive":
+		return fmt.Sprintf("share is on the %s tier, reads may observe higher first-byte latency", shareTier)
+	default:
+		return ""
+	}
+}
+
+// mergeMountOptions merges base mount options beneath overriding options, a base
+// option is dropped when the override list already sets the same option key
+func mergeMountOptions(base, override []string) []string {
+	merged := make([]string, 0, len(base)+len(override))
+	for _, baseOption := range base {
+		key := strings.SplitN(baseOption, "=", 2)[0]
+		overridden := false
+		for _, overrideOption := range override {
+			if strings.SplitN(overrideOption, "=", 2)[0] == key {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			merged = append(merged, baseOption)
+		}
+	}
+	return append(merged, override...)
+}
+
+// getUsernameOverride returns the explicit SMB username from secrets or volume
+// context, volume context takes precedence. An empty string is returned when no
+// override is set, an error when the field is set to an empty value.
+func getUsernameOverride(secrets, context map[string]string) (string, error) {
+	var username string
+	for _, m := range []map[string]string{secrets, context} {
+		for k, v := range m {
+			if strings.EqualFold(k, usernameField) {
+				if strings.TrimSpace(v) == "" {
+					return "", fmt.Errorf("%s field is set but empty", usernameField)
+				}
+				username = v
+			}
+		}
+	}
+	return username, nil
+}
+
 func makeDir(pathname string) error {
 	err := os.MkdirAll(pathname, os.FileMode(0755))
 	if err != nil {
@@ -17,26 +17,41 @@ limitations under the License.
 package azurefile
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
+	"time"
 
 	"sigs.k8s.io/azurefile-csi-driver/test/utils/testutil"
 
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2019-06-01/storage"
 	azure2 "github.com/Azure/go-autorest/autorest/azure"
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"k8s.io/kubernetes/pkg/volume"
 	"k8s.io/utils/exec"
 	testingexec "k8s.io/utils/exec/testing"
 	"k8s.io/utils/mount"
 
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/fileclient/mockfileclient"
+
+	"sigs.k8s.io/cloud-provider-azure/pkg/azureclients/storageaccountclient/mockstorageaccountclient"
 	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
 )
 
@@ -60,6 +75,14 @@ func TestNodeGetInfo(t *testing.T) {
 	resp, err := d.NodeGetInfo(context.Background(), &req)
 	assert.NoError(t, err)
 	assert.Equal(t, resp.GetNodeId(), fakeNodeID)
+	// no limit configured, MaxVolumesPerNode stays unset so the scheduler
+	// treats the node as unlimited
+	assert.Equal(t, int64(0), resp.GetMaxVolumesPerNode())
+
+	d.maxVolumesPerNode = 16
+	resp, err = d.NodeGetInfo(context.Background(), &req)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(16), resp.GetMaxVolumesPerNode())
 }
 
 func TestNodeGetCapabilities(t *testing.T) {
@@ -211,9 +234,51 @@ func TestNodePublishVolume(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestNodePublishVolumeEphemeral(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+	targetPath := testutil.GetWorkDirPath("target_ephemeral", t)
+
+	d := NewFakeDriver()
+	fm := &fakeMounter{}
+	d.mounter = &mount.SafeFormatAndMount{
+		Interface: fm,
+	}
+	d.cloud = &azure.Cloud{
+		Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+	}
+
+	// an ephemeral volume is staged and published in one call, the share is
+	// mounted directly at the target path without a staging path
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:   "vol_1#f5713de20cde511e8ba4900#test_sharename",
+		TargetPath: targetPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{},
+			},
+		},
+		VolumeContext: map[string]string{
+			ephemeralField:  "true",
+			shareNameField:  "test_sharename",
+			serverNameField: "test_servername",
+		},
+		Secrets: map[string]string{"accountname": "k8s", "accountkey": "testkey"},
+	}
+	_, err := d.NodePublishVolume(context.Background(), req)
+	assert.NoError(t, err)
+	if assert.Len(t, fm.MountPoints, 1) {
+		assert.Equal(t, targetPath, fm.MountPoints[0].Path)
+	}
+	assert.NoError(t, os.RemoveAll(targetPath))
+}
+
 func TestNodeUnpublishVolume(t *testing.T) {
 	errorTarget := testutil.GetWorkDirPath("error_is_likely_target", t)
 	targetFile := testutil.GetWorkDirPath("abc.go", t)
+	notExistRaceTarget := testutil.GetWorkDirPath("not_exist_race_target", t)
+	notExistTarget := testutil.GetWorkDirPath("not_exist_target", t)
 
 	tests := []struct {
 		desc         string
@@ -245,6 +310,23 @@ func TestNodeUnpublishVolume(t *testing.T) {
 				WindowsError: status.Error(codes.Internal, fmt.Sprintf("failed to unmount target %#v: could not cast to csi proxy class", errorTarget)),
 			},
 		},
+		{
+			desc: "[Success] Target does not exist",
+			req:  csi.NodeUnpublishVolumeRequest{TargetPath: notExistTarget, VolumeId: "vol_1"},
+			expectedErr: testutil.TestError{
+				// todo: Not a desired error. This will need a better fix
+				WindowsError: status.Error(codes.Internal, fmt.Sprintf("failed to unmount target %#v: could not cast to csi proxy class", notExistTarget)),
+			},
+		},
+		{
+			desc:         "[Success] Target removed between existence and mount point check",
+			req:          csi.NodeUnpublishVolumeRequest{TargetPath: notExistRaceTarget, VolumeId: "vol_1"},
+			skipOnDarwin: true,
+			expectedErr: testutil.TestError{
+				// todo: Not a desired error. This will need a better fix
+				WindowsError: status.Error(codes.Internal, fmt.Sprintf("failed to unmount target %#v: could not cast to csi proxy class", notExistRaceTarget)),
+			},
+		},
 		{
 			desc: "[Success] Valid request",
 			req:  csi.NodeUnpublishVolumeRequest{TargetPath: targetFile, VolumeId: "vol_1"},
@@ -257,6 +339,7 @@ func TestNodeUnpublishVolume(t *testing.T) {
 
 	// Setup
 	_ = makeDir(errorTarget)
+	_ = makeDir(notExistRaceTarget)
 	d := NewFakeDriver()
 	fakeMounter := &fakeMounter{}
 	fakeExec := &testingexec.FakeExec{ExactOrder: true}
@@ -279,6 +362,48 @@ func TestNodeUnpublishVolume(t *testing.T) {
 	// Clean up
 	err := os.RemoveAll(errorTarget)
 	assert.NoError(t, err)
+	err = os.RemoveAll(notExistRaceTarget)
+	assert.NoError(t, err)
+}
+
+func TestIsIgnorableUnmountError(t *testing.T) {
+	tests := []struct {
+		desc     string
+		err      error
+		expected bool
+	}{
+		{
+			desc:     "no error",
+			err:      nil,
+			expected: true,
+		},
+		{
+			desc:     "target does not exist",
+			err:      &os.PathError{Op: "stat", Path: "/target", Err: syscall.ENOENT},
+			expected: true,
+		},
+		{
+			desc:     "target is not a mount point",
+			err:      errors.New("/target is not a mount point"),
+			expected: true,
+		},
+		{
+			desc:     "target not mounted",
+			err:      errors.New("umount: /target: not mounted"),
+			expected: true,
+		},
+		{
+			desc:     "genuine unmount error",
+			err:      syscall.EBUSY,
+			expected: false,
+		},
+	}
+
+	for _, test := range tests {
+		if result := isIgnorableUnmountError(test.err); result != test.expected {
+			t.Errorf("test(%s): got(%v), expected(%v)", test.desc, result, test.expected)
+		}
+	}
 }
 
 func TestNodeStageVolume(t *testing.T) {
@@ -294,6 +419,8 @@ func TestNodeStageVolume(t *testing.T) {
 		azureStagingTargetPath = testutil.GetWorkDirPath("azure.go", t)
 		proxyMountPath         = testutil.GetWorkDirPath("proxy-mount", t)
 		testDiskPath           = fmt.Sprintf("%s/test_disk", proxyMountPath)
+		missingDiskPath        = fmt.Sprintf("%s/missing_disk", proxyMountPath)
+		createdDiskPath        = fmt.Sprintf("%s/created_disk", proxyMountPath)
 	)
 
 	volContextEmptyDiskName := map[string]string{
@@ -326,12 +453,50 @@ func TestNodeStageVolume(t *testing.T) {
 		shareNameField:  "test_sharename",
 		serverNameField: "test_servername",
 	}
+	volContextNfsAlias := map[string]string{
+		protocolField:       "NFSv4",
+		storageAccountField: "test_account",
+		shareNameField:      "test_sharename",
+		serverNameField:     "test_servername",
+	}
+	volContextBadProtocol := map[string]string{
+		protocolField:   "glusterfs",
+		shareNameField:  "test_sharename",
+		serverNameField: "test_servername",
+	}
+	volContextUnknownKey := map[string]string{
+		fsTypeField:                   "test_field",
+		diskNameField:                 "test_disk",
+		shareNameField:                "test_sharename",
+		serverNameField:               "test_servername",
+		"newmountfeature":             "enabled",
+		"csi.storage.k8s.io/pvc/name": "test-pvc",
+	}
+	volContextMissingDisk := map[string]string{
+		fsTypeField:     "ext4",
+		diskNameField:   "missing_disk",
+		shareNameField:  "test_sharename",
+		serverNameField: "test_servername",
+	}
+	volContextCreateDisk := map[string]string{
+		fsTypeField:           "ext4",
+		diskNameField:         "created_disk",
+		shareNameField:        "test_sharename",
+		serverNameField:       "test_servername",
+		createDiskField:       "true",
+		requestedSizeGiBField: "1",
+	}
 
 	secrets := map[string]string{
 		"accountname": "k8s",
 		"accountkey":  "testkey",
 	}
 
+	intreeSecrets := map[string]string{
+		"azurestorageaccountname": "k8s",
+		"azurestorageaccountkey":  "testkey",
+	}
+
 	tests := []struct {
 		desc         string
 		req          csi.NodeStageVolumeRequest
@@ -402,6 +567,21 @@ func TestNodeStageVolume(t *testing.T) {
 				WindowsError: fmt.Errorf("prepare stage path failed for %s with error: could not cast to csi proxy class", errorMountSensSource),
 			},
 		},
+		{
+			desc: "[Error] Failed nfs mount mocked by MountSensitive",
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1#f5713de20cde511e8ba4900#test_sharename", StagingTargetPath: errorMountSensSource,
+				VolumeCapability: &stdVolCap,
+				VolumeContext: map[string]string{
+					protocolField:   "nfs",
+					shareNameField:  "test_sharename",
+					serverNameField: "test_servername",
+				}},
+			skipOnDarwin: true,
+			expectedErr: testutil.TestError{
+				DefaultError: status.Errorf(codes.Internal, fmt.Sprintf("volume(vol_1#f5713de20cde511e8ba4900#test_sharename) mount \"test_servername:/f5713de20cde511e8ba4900/test_sharename\" on %#v failed with fake MountSensitive: target error", errorMountSensSource)),
+				WindowsError: fmt.Errorf("prepare stage path failed for %s with error: could not cast to csi proxy class", errorMountSensSource),
+			},
+		},
 		{
 			desc: "[Error] FormatAndMount mocked by exec commands",
 			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: sourceTest,
@@ -409,12 +589,13 @@ func TestNodeStageVolume(t *testing.T) {
 				VolumeContext:    volContextFsType,
 				Secrets:          secrets},
 			execScripts: []ExecArgs{
+				{"blkid", []string{"-p", "-s", "TYPE", "-s", "PTTYPE", "-o", "export", testDiskPath}, "", &testingexec.FakeExitError{Status: 2}},
 				{"blkid", []string{"-p", "-s", "TYPE", "-s", "PTTYPE", "-o", "export", testDiskPath}, "", &testingexec.FakeExitError{Status: 2}},
 				{"mkfs.ext4", []string{"-F", "-m0", testDiskPath}, "", fmt.Errorf("formatting failed")},
 			},
 			skipOnDarwin: true,
 			expectedErr: testutil.TestError{
-				DefaultError: status.Errorf(codes.Internal, "could not format %#v and mount it at %#v", sourceTest, testDiskPath),
+				DefaultError: status.Errorf(codes.Internal, "volume(vol_1##) could not format %#v and mount it at %#v, volume source(\"//test_servername/test_sharename\"): format of disk %#v failed: type:(\"ext4\") target:(%#v) options:(\"barrier=1,errors=remount-ro,loop,noatime,defaults\") errcode:(formatting failed) output:() ", sourceTest, testDiskPath, testDiskPath, sourceTest),
 				WindowsError: fmt.Errorf("prepare stage path failed for %s with error: could not cast to csi proxy class", proxyMountPath),
 			},
 		},
@@ -428,6 +609,45 @@ func TestNodeStageVolume(t *testing.T) {
 				WindowsError: fmt.Errorf("prepare stage path failed for %s with error: could not cast to csi proxy class", sourceTest),
 			},
 		},
+		{
+			desc: "[Success] Valid request with in-tree style secret field names",
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: sourceTest,
+				VolumeCapability: &stdVolCap,
+				VolumeContext:    volContext,
+				Secrets:          intreeSecrets},
+			expectedErr: testutil.TestError{
+				WindowsError: fmt.Errorf("prepare stage path failed for %s with error: could not cast to csi proxy class", sourceTest),
+			},
+		},
+		{
+			desc: "[Error] Unknown protocol value",
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: sourceTest,
+				VolumeCapability: &stdVolCap,
+				VolumeContext:    volContextBadProtocol,
+				Secrets:          secrets},
+			expectedErr: testutil.TestError{
+				DefaultError: status.Error(codes.InvalidArgument, fmt.Sprintf("volume(vol_1##): protocol(glusterfs) is not supported, supported protocol list: %v", supportedProtocolList)),
+			},
+		},
+		{
+			desc: "[Success] Valid request with an nfs protocol alias",
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: sourceTest,
+				VolumeCapability: &stdVolCap,
+				VolumeContext:    volContextNfsAlias},
+			expectedErr: testutil.TestError{
+				WindowsError: fmt.Errorf("prepare stage path failed for %s with error: could not cast to csi proxy class", sourceTest),
+			},
+		},
+		{
+			desc: "[Success] Valid request with an unknown volume context key",
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: sourceTest,
+				VolumeCapability: &stdVolCap,
+				VolumeContext:    volContextUnknownKey,
+				Secrets:          secrets},
+			expectedErr: testutil.TestError{
+				WindowsError: fmt.Errorf("prepare stage path failed for %s with error: could not cast to csi proxy class", sourceTest),
+			},
+		},
 		{
 			desc: "[Success] Valid request with share name empty",
 			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: sourceTest,
@@ -455,6 +675,7 @@ func TestNodeStageVolume(t *testing.T) {
 				VolumeContext:    volContextFsType,
 				Secrets:          secrets},
 			execScripts: []ExecArgs{
+				{"blkid", []string{"-p", "-s", "TYPE", "-s", "PTTYPE", "-o", "export", testDiskPath}, "", &testingexec.FakeExitError{Status: 2}},
 				{"blkid", []string{"-p", "-s", "TYPE", "-s", "PTTYPE", "-o", "export", testDiskPath}, "", nil},
 				{"mkfs.ext4", []string{"-F", "-m0", testDiskPath}, "", nil},
 			},
@@ -462,10 +683,89 @@ func TestNodeStageVolume(t *testing.T) {
 				WindowsError: fmt.Errorf("prepare stage path failed for %s with error: could not cast to csi proxy class", proxyMountPath),
 			},
 		},
+		{
+			desc: "[Success] Disk with an existing filesystem is not formatted",
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: sourceTest,
+				VolumeCapability: &stdVolCap,
+				VolumeContext:    volContextFsType,
+				Secrets:          secrets},
+			execScripts: []ExecArgs{
+				{"blkid", []string{"-p", "-s", "TYPE", "-s", "PTTYPE", "-o", "export", testDiskPath}, "TYPE=ext4\n", nil},
+				{"blkid", []string{"-p", "-s", "TYPE", "-s", "PTTYPE", "-o", "export", testDiskPath}, "TYPE=ext4\n", nil},
+				{"fsck", []string{"-a", testDiskPath}, "", nil},
+			},
+			expectedErr: testutil.TestError{
+				WindowsError: fmt.Errorf("prepare stage path failed for %s with error: could not cast to csi proxy class", proxyMountPath),
+			},
+		},
+		{
+			desc: "[Error] Disk with a partition table is never formatted",
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: sourceTest,
+				VolumeCapability: &stdVolCap,
+				VolumeContext:    volContextFsType,
+				Secrets:          secrets},
+			execScripts: []ExecArgs{
+				{"blkid", []string{"-p", "-s", "TYPE", "-s", "PTTYPE", "-o", "export", testDiskPath}, "PTTYPE=dos\n", nil},
+			},
+			skipOnDarwin: true,
+			expectedErr: testutil.TestError{
+				DefaultError: status.Errorf(codes.FailedPrecondition, "disk %q of volume(vol_1##) contains a partition table and cannot be formatted or mounted as ext4, it will never be formatted by the driver since that would destroy its content", testDiskPath),
+				WindowsError: fmt.Errorf("prepare stage path failed for %s with error: could not cast to csi proxy class", proxyMountPath),
+			},
+		},
+		{
+			desc: "[Error] Disk with a mismatching filesystem is never reformatted",
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: sourceTest,
+				VolumeCapability: &stdVolCap,
+				VolumeContext:    volContextFsType,
+				Secrets:          secrets},
+			execScripts: []ExecArgs{
+				{"blkid", []string{"-p", "-s", "TYPE", "-s", "PTTYPE", "-o", "export", testDiskPath}, "TYPE=xfs\n", nil},
+			},
+			skipOnDarwin: true,
+			expectedErr: testutil.TestError{
+				DefaultError: status.Errorf(codes.AlreadyExists, "disk %q of volume(vol_1##) already has a xfs filesystem while ext4 was requested, it will never be reformatted by the driver since that would destroy its content", testDiskPath),
+				WindowsError: fmt.Errorf("prepare stage path failed for %s with error: could not cast to csi proxy class", proxyMountPath),
+			},
+		},
+		{
+			desc: "[Error] Missing vhd without the createdisk field",
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: sourceTest,
+				VolumeCapability: &stdVolCap,
+				VolumeContext:    volContextMissingDisk,
+				Secrets:          secrets},
+			expectedErr: testutil.TestError{
+				DefaultError: status.Errorf(codes.NotFound, "vhd %q of volume(vol_1##) does not exist on the share, set the %s field to let the driver recreate it", missingDiskPath, createDiskField),
+				WindowsError: fmt.Errorf("prepare stage path failed for %s with error: could not cast to csi proxy class", proxyMountPath),
+			},
+		},
+		{
+			desc: "[Success] Missing vhd is recreated when createdisk is set",
+			req: csi.NodeStageVolumeRequest{VolumeId: "vol_1##", StagingTargetPath: sourceTest,
+				VolumeCapability: &stdVolCap,
+				VolumeContext:    volContextCreateDisk,
+				Secrets:          secrets},
+			execScripts: []ExecArgs{
+				{"blkid", []string{"-p", "-s", "TYPE", "-s", "PTTYPE", "-o", "export", createdDiskPath}, "", &testingexec.FakeExitError{Status: 2}},
+				{"blkid", []string{"-p", "-s", "TYPE", "-s", "PTTYPE", "-o", "export", createdDiskPath}, "", &testingexec.FakeExitError{Status: 2}},
+				{"mkfs.ext4", []string{"-F", "-m0", createdDiskPath}, "", nil},
+			},
+			expectedErr: testutil.TestError{
+				WindowsError: fmt.Errorf("prepare stage path failed for %s with error: could not cast to csi proxy class", proxyMountPath),
+			},
+		},
 	}
 
 	// Setup
 	d := NewFakeDriver()
+	// the disk mode cases expect the vhd of the volume to already sit on the
+	// mounted share
+	if err := os.MkdirAll(proxyMountPath, 0755); err != nil {
+		t.Fatalf("could not create %s: %v", proxyMountPath, err)
+	}
+	if err := ioutil.WriteFile(testDiskPath, nil, 0644); err != nil {
+		t.Fatalf("could not create %s: %v", testDiskPath, err)
+	}
 
 	for _, test := range tests {
 		if test.skipOnDarwin && runtime.GOOS == "darwin" {
@@ -497,83 +797,2429 @@ func TestNodeStageVolume(t *testing.T) {
 
 	}
 
+	if runtime.GOOS != "windows" {
+		// the recreated vhd must exist with the requested size
+		info, err := os.Stat(createdDiskPath)
+		assert.NoError(t, err)
+		if err == nil {
+			assert.Equal(t, int64(1024*1024*1024), info.Size())
+		}
+	}
+
 	// Clean up
 	err := os.RemoveAll(sourceTest)
 	assert.NoError(t, err)
 	err = os.RemoveAll(proxyMount)
 	assert.NoError(t, err)
+	err = os.RemoveAll(proxyMountPath)
+	assert.NoError(t, err)
 	err = os.RemoveAll(errorMountSensSource)
 	assert.NoError(t, err)
 }
 
-func TestNodeUnstageVolume(t *testing.T) {
-	var (
-		errorTarget = testutil.GetWorkDirPath("error_is_likely_target", t)
-		targetFile  = testutil.GetWorkDirPath("abc.go", t)
-	)
+func TestProxyMountPathForTarget(t *testing.T) {
+	d := NewFakeDriver()
+
+	// beside the staging target by default
+	expected := filepath.Join("/var/lib/kubelet/plugins/globalmount", proxyMount)
+	if result := d.proxyMountPathForTarget("/var/lib/kubelet/plugins/globalmount/target"); result != expected {
+		t.Errorf("proxyMountPathForTarget returned %q, expected %q", result, expected)
+	}
+
+	// under the configured base with one mount point per staging target
+	d.proxyMountBase = "/mnt/azurefile-proxy"
+	stagePath := d.proxyMountPathForTarget("/var/lib/kubelet/plugins/vol-1/globalmount")
+	unstagePath := d.proxyMountPathForTarget("/var/lib/kubelet/plugins/vol-1/globalmount")
+	otherPath := d.proxyMountPathForTarget("/var/lib/kubelet/plugins/vol-2/globalmount")
+	if !strings.HasPrefix(stagePath, d.proxyMountBase+string(os.PathSeparator)) {
+		t.Errorf("proxyMountPathForTarget returned %q, expected a path under %q", stagePath, d.proxyMountBase)
+	}
+	if stagePath != unstagePath {
+		t.Errorf("stage and unstage disagree on the proxy mount path: %q != %q", stagePath, unstagePath)
+	}
+	if stagePath == otherPath {
+		t.Errorf("two volumes share the proxy mount path %q", stagePath)
+	}
+}
 
+func TestIsUnknownVolumeContextKey(t *testing.T) {
 	tests := []struct {
-		desc         string
-		req          csi.NodeUnstageVolumeRequest
-		skipOnDarwin bool
-		expectedErr  testutil.TestError
+		desc     string
+		key      string
+		expected bool
 	}{
 		{
-			desc: "[Error] Volume ID missing",
-			req:  csi.NodeUnstageVolumeRequest{StagingTargetPath: targetTest},
-			expectedErr: testutil.TestError{
-				DefaultError: status.Error(codes.InvalidArgument, "Volume ID missing in request"),
-			},
+			desc:     "key of the node stage switch is known",
+			key:      fsTypeField,
+			expected: false,
 		},
 		{
-			desc: "[Error] Target missing",
-			req:  csi.NodeUnstageVolumeRequest{VolumeId: "vol_1"},
-			expectedErr: testutil.TestError{
-				DefaultError: status.Error(codes.InvalidArgument, "Staging target not provided"),
-			},
+			desc:     "key consumed by GetAccountInfo is known",
+			key:      storageAccountField,
+			expected: false,
 		},
 		{
-			desc:         "[Error] CleanupMountPoint error mocked by IsLikelyNotMountPoint",
-			req:          csi.NodeUnstageVolumeRequest{StagingTargetPath: errorTarget, VolumeId: "vol_1"},
-			skipOnDarwin: true,
-			expectedErr: testutil.TestError{
-				DefaultError: status.Error(codes.Internal, fmt.Sprintf("failed to unmount staging target %#v: fake IsLikelyNotMountPoint: fake error", errorTarget)),
-				WindowsError: status.Error(codes.Internal, fmt.Sprintf("failed to unmount staging target %#v: could not cast to csi proxy class", errorTarget)),
-			},
+			desc:     "known key matches case-insensitively",
+			key:      "ShareName",
+			expected: false,
 		},
 		{
-			desc: "[Success] Valid request",
-			req:  csi.NodeUnstageVolumeRequest{StagingTargetPath: targetFile, VolumeId: "vol_1"},
-			expectedErr: testutil.TestError{
-				WindowsError: status.Error(codes.Internal, fmt.Sprintf("failed to unmount staging target %#v: could not cast to csi proxy class", targetFile)),
-			},
+			desc:     "external-provisioner metadata is known",
+			key:      "csi.storage.k8s.io/pvc/name",
+			expected: false,
+		},
+		{
+			desc:     "unknown key is reported",
+			key:      "newmountfeature",
+			expected: true,
 		},
 	}
+	for _, test := range tests {
+		if result := isUnknownVolumeContextKey(test.key); result != test.expected {
+			t.Errorf("test(%s): got(%v), expected(%v)", test.desc, result, test.expected)
+		}
+	}
+}
+
+func TestNodeStageVolumeForeignMount(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+	foreignTarget := "./false_is_likely_foreign_target"
+	stdVolCap := csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+	}
+	req := csi.NodeStageVolumeRequest{
+		VolumeId:          "vol_1##",
+		StagingTargetPath: foreignTarget,
+		VolumeCapability:  &stdVolCap,
+		VolumeContext: map[string]string{
+			shareNameField:  "test_sharename",
+			serverNameField: "test_servername",
+		},
+		Secrets: map[string]string{
+			"accountname": "k8s",
+			"accountkey":  "testkey",
+		},
+	}
+
+	buildDriver := func(existingMount mount.MountPoint) (*Driver, *fakeMounter) {
+		d := NewFakeDriver()
+		m := &fakeMounter{}
+		m.MountPoints = []mount.MountPoint{existingMount}
+		d.mounter = &mount.SafeFormatAndMount{
+			Interface: m,
+		}
+		d.cloud = &azure.Cloud{
+			Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+		}
+		return d, m
+	}
+
+	// a mount created by something else at the staging target is rejected
+	d, _ := buildDriver(mount.MountPoint{Device: "/dev/sdb1", Path: foreignTarget, Type: "ext4"})
+	_, err := d.NodeStageVolume(context.Background(), &req)
+	expectedErr := status.Errorf(codes.FailedPrecondition, "volume(vol_1##) staging target %q already carries a foreign mount(source %q, fstype %q), refusing to stage over it, set --force-stage-over-foreign-mounts to override", foreignTarget, "/dev/sdb1", "ext4")
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("Unexpected error: %v, expected error: %v", err, expectedErr)
+	}
+
+	// the driver's own mount passes idempotently without mounting again
+	d, m := buildDriver(mount.MountPoint{Device: "//test_servername/test_sharename", Path: foreignTarget, Type: "cifs"})
+	_, err = d.NodeStageVolume(context.Background(), &req)
+	assert.NoError(t, err)
+	assert.Len(t, m.MountPoints, 1)
+
+	// the force flag stages over the foreign mount anyway
+	d, _ = buildDriver(mount.MountPoint{Device: "/dev/sdb1", Path: foreignTarget, Type: "ext4"})
+	d.forceStageOverForeignMounts = true
+	_, err = d.NodeStageVolume(context.Background(), &req)
+	assert.NoError(t, err)
+
+	err = os.RemoveAll(foreignTarget)
+	assert.NoError(t, err)
+}
+
+func TestNodeStageVolumeServerAddress(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+	stdVolCap := csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+	}
+	buildReq := func(serverAddress string) *csi.NodeStageVolumeRequest {
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1#f5713de20cde511e8ba4900#test_sharename",
+			StagingTargetPath: targetTest,
+			VolumeCapability:  &stdVolCap,
+			VolumeContext: map[string]string{
+				shareNameField:     "test_sharename",
+				serverAddressField: serverAddress,
+			},
+			Secrets: map[string]string{"accountname": "k8s", "accountkey": "testkey"},
+		}
+	}
 
-	// Setup
-	_ = makeDir(errorTarget)
 	d := NewFakeDriver()
 	fakeMounter := &fakeMounter{}
-	fakeExec := &testingexec.FakeExec{ExactOrder: true}
 	d.mounter = &mount.SafeFormatAndMount{
 		Interface: fakeMounter,
-		Exec:      fakeExec,
+	}
+	d.cloud = &azure.Cloud{
+		Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
 	}
 
-	for _, test := range tests {
-		if test.skipOnDarwin && runtime.GOOS == "darwin" {
-			continue
-		}
-		_, err := d.NodeUnstageVolume(context.Background(), &test.req)
-		if !testutil.AssertError(err, &test.expectedErr) {
-			t.Errorf("Desc: %v\nUnexcpected error: %v\nExpected: %v", test.desc, err, test.expectedErr.GetExpectedError())
+	// implausible addresses are rejected before any mount is attempted
+	for _, invalid := range []string{"bad host", "-bad.example", "under_score.example", "trailing.example-"} {
+		_, err := d.NodeStageVolume(context.Background(), buildReq(invalid))
+		expectedErr := status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s(%s) in volume(%s): must be an IP address or hostname", serverAddressField, invalid, "vol_1#f5713de20cde511e8ba4900#test_sharename"))
+		if !reflect.DeepEqual(err, expectedErr) {
+			t.Errorf("serverAddress(%s): unexpected error: %v, expected error: %v", invalid, err, expectedErr)
 		}
 	}
+	assert.Empty(t, fakeMounter.MountPoints)
 
-	// Clean up
-	err := os.RemoveAll(errorTarget)
+	// a private endpoint IP replaces the FQDN in the source path
+	_, err := d.NodeStageVolume(context.Background(), buildReq("10.0.0.4"))
 	assert.NoError(t, err)
-}
+	if assert.Len(t, fakeMounter.MountPoints, 1) {
+		assert.Equal(t, "//10.0.0.4/test_sharename", fakeMounter.MountPoints[0].Device)
+	}
+	assert.NoError(t, os.RemoveAll(targetTest))
+
+	// an alternate hostname works the same way
+	fakeMounter.MountPoints = nil
+	_, err = d.NodeStageVolume(context.Background(), buildReq("k8s.privatelink.file.core.windows.net"))
+	assert.NoError(t, err)
+	if assert.Len(t, fakeMounter.MountPoints, 1) {
+		assert.Equal(t, "//k8s.privatelink.file.core.windows.net/test_sharename", fakeMounter.MountPoints[0].Device)
+	}
+	assert.NoError(t, os.RemoveAll(targetTest))
+}
+
+func TestNodeStageVolumeRemountOnOptionChange(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+	target := testutil.GetWorkDirPath("false_is_likely_remount_target", t)
+	stdVolCap := csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+	}
+	buildReq := func(mountOptions string) *csi.NodeStageVolumeRequest {
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1##",
+			StagingTargetPath: target,
+			VolumeCapability:  &stdVolCap,
+			VolumeContext: map[string]string{
+				shareNameField:    "test_sharename",
+				serverNameField:   "test_servername",
+				mountOptionsField: mountOptions,
+			},
+			Secrets: map[string]string{
+				"accountname": "k8s",
+				"accountkey":  "testkey",
+			},
+		}
+	}
+	buildDriver := func(remountOnOptionChange bool) (*Driver, *fakeMounter) {
+		d := NewFakeDriver()
+		d.remountOnOptionChange = remountOnOptionChange
+		m := &fakeMounter{}
+		m.MountPoints = []mount.MountPoint{{Device: "//test_servername/test_sharename", Path: target, Type: "cifs"}}
+		d.mounter = &mount.SafeFormatAndMount{
+			Interface: m,
+		}
+		d.cloud = &azure.Cloud{
+			Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+		}
+		// the options the existing mount was staged with
+		d.recordStagedMountOptions(target, appendDefaultMountOptions([]string{"actimeo=5"}, builtinMountOptionsSMB))
+		return d, m
+	}
+
+	// matching options leave the existing mount untouched
+	d, m := buildDriver(true)
+	_, err := d.NodeStageVolume(context.Background(), buildReq("actimeo=5"))
+	assert.NoError(t, err)
+	if assert.Len(t, m.MountPoints, 1) {
+		assert.Empty(t, m.MountPoints[0].Opts)
+	}
+
+	// changed options trigger an unmount and a mount with the new options
+	d, m = buildDriver(true)
+	_, err = d.NodeStageVolume(context.Background(), buildReq("actimeo=10"))
+	assert.NoError(t, err)
+	if assert.Len(t, m.MountPoints, 1) {
+		assert.Contains(t, m.MountPoints[0].Opts, "actimeo=10")
+	}
+
+	// without the flag the existing mount and its options are kept
+	d, m = buildDriver(false)
+	_, err = d.NodeStageVolume(context.Background(), buildReq("actimeo=10"))
+	assert.NoError(t, err)
+	if assert.Len(t, m.MountPoints, 1) {
+		assert.Empty(t, m.MountPoints[0].Opts)
+	}
+
+	assert.NoError(t, os.RemoveAll(target))
+}
+
+func TestNodeStageVolumeMountFlags(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+	stdVolCap := csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{
+				MountFlags: []string{"vers=4.1", "noresvport"},
+			},
+		},
+	}
+	req := csi.NodeStageVolumeRequest{
+		VolumeId:          "vol_1#f5713de20cde511e8ba4900#test_sharename",
+		StagingTargetPath: targetTest,
+		VolumeCapability:  &stdVolCap,
+		VolumeContext: map[string]string{
+			protocolField:   "nfs",
+			shareNameField:  "test_sharename",
+			serverNameField: "test_servername",
+		},
+	}
+
+	d := NewFakeDriver()
+	fakeMounter := &fakeMounter{}
+	d.mounter = &mount.SafeFormatAndMount{
+		Interface: fakeMounter,
+	}
+	d.cloud = &azure.Cloud{
+		Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+	}
+
+	_, err := d.NodeStageVolume(context.Background(), &req)
+	assert.NoError(t, err)
+
+	// the mount flags from the volume capability must reach the mounter,
+	// overriding the conflicting default option
+	expectedOpts := []string{"minorversion=1", "sec=sys", "vers=4.1", "noresvport"}
+	if assert.Len(t, fakeMounter.MountPoints, 1) {
+		assert.Equal(t, expectedOpts, fakeMounter.MountPoints[0].Opts)
+	}
+
+	err = os.RemoveAll(targetTest)
+	assert.NoError(t, err)
+}
+
+func TestNodeStageVolumeEndpointSuffixOverride(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+	stdVolCap := csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+	}
+	buildReq := func(volumeContext map[string]string) *csi.NodeStageVolumeRequest {
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1#f5713de20cde511e8ba4900#test_sharename",
+			StagingTargetPath: targetTest,
+			VolumeCapability:  &stdVolCap,
+			VolumeContext:     volumeContext,
+			Secrets: map[string]string{
+				"accountname": "k8s",
+				"accountkey":  "testkey",
+			},
+		}
+	}
+
+	d := NewFakeDriver()
+	fakeMounter := &fakeMounter{}
+	d.mounter = &mount.SafeFormatAndMount{
+		Interface: fakeMounter,
+	}
+	d.cloud = &azure.Cloud{
+		Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+	}
+
+	// the volume context key overrides the cloud-derived endpoint suffix
+	_, err := d.NodeStageVolume(context.Background(), buildReq(map[string]string{
+		shareNameField:      "test_sharename",
+		endpointSuffixField: "override_suffix",
+	}))
+	assert.NoError(t, err)
+	if assert.Len(t, fakeMounter.MountPoints, 1) {
+		assert.Equal(t, "//k8s.file.override_suffix/test_sharename", fakeMounter.MountPoints[0].Device)
+	}
+	assert.NoError(t, os.RemoveAll(targetTest))
+
+	// without the key the cloud suffix is used
+	fakeMounter.MountPoints = nil
+	_, err = d.NodeStageVolume(context.Background(), buildReq(map[string]string{
+		shareNameField: "test_sharename",
+	}))
+	assert.NoError(t, err)
+	if assert.Len(t, fakeMounter.MountPoints, 1) {
+		assert.Equal(t, "//k8s.file.test_suffix/test_sharename", fakeMounter.MountPoints[0].Device)
+	}
+	assert.NoError(t, os.RemoveAll(targetTest))
+}
+
+func TestNodeStageVolumeMountDurationMetric(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+	stdVolCap := csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+	}
+	buildReq := func(server string) *csi.NodeStageVolumeRequest {
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1#f5713de20cde511e8ba4900#test_sharename",
+			StagingTargetPath: targetTest,
+			VolumeCapability:  &stdVolCap,
+			VolumeContext: map[string]string{
+				shareNameField:  "test_sharename",
+				serverNameField: server,
+			},
+			Secrets: map[string]string{
+				"accountname": "k8s",
+				"accountkey":  "testkey",
+			},
+		}
+	}
+
+	d := NewFakeDriver()
+	d.mounter = &mount.SafeFormatAndMount{
+		Interface: &fakeMounter{},
+	}
+	d.cloud = &azure.Cloud{
+		Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+	}
+
+	successBefore := mountDurationSamples(t, "smb", "success")
+	errorBefore := mountDurationSamples(t, "smb", "error")
+
+	// a successful mount contributes one sample to the success bucket
+	_, err := d.NodeStageVolume(context.Background(), buildReq("test_servername"))
+	assert.NoError(t, err)
+	assert.Equal(t, successBefore+1, mountDurationSamples(t, "smb", "success"))
+	assert.Equal(t, errorBefore, mountDurationSamples(t, "smb", "error"))
+	assert.NoError(t, os.RemoveAll(targetTest))
+
+	// a failed mount contributes one sample to the error bucket
+	_, err = d.NodeStageVolume(context.Background(), buildReq("error_mount_sens"))
+	assert.Error(t, err)
+	assert.Equal(t, successBefore+1, mountDurationSamples(t, "smb", "success"))
+	assert.Equal(t, errorBefore+1, mountDurationSamples(t, "smb", "error"))
+	assert.NoError(t, os.RemoveAll(targetTest))
+}
+
+func TestNodeStageVolumeStagedPathConflict(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+	stdVolCap := csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+	}
+	buildReq := func(volumeID string) *csi.NodeStageVolumeRequest {
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          volumeID,
+			StagingTargetPath: targetTest,
+			VolumeCapability:  &stdVolCap,
+			VolumeContext: map[string]string{
+				protocolField:   "nfs",
+				shareNameField:  "test_sharename",
+				serverNameField: "test_servername",
+			},
+		}
+	}
+
+	d := NewFakeDriver()
+	d.mounter = &mount.SafeFormatAndMount{
+		Interface: &fakeMounter{},
+	}
+	d.cloud = &azure.Cloud{
+		Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+	}
+
+	// first stage succeeds and records the staged path
+	_, err := d.NodeStageVolume(context.Background(), buildReq("vol_1#acc#share1"))
+	assert.NoError(t, err)
+
+	// re-staging the same volume to the same path is idempotent
+	_, err = d.NodeStageVolume(context.Background(), buildReq("vol_1#acc#share1"))
+	assert.NoError(t, err)
+
+	// a different volume staged to the same path is rejected
+	_, err = d.NodeStageVolume(context.Background(), buildReq("vol_2#acc#share2"))
+	expectedErr := status.Errorf(codes.FailedPrecondition, "staging target path(%s) is already in use by volume(%s)", targetTest, "vol_1#acc#share1")
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("Unexpected error: %v, expected error: %v", err, expectedErr)
+	}
+
+	// unstaging frees the path for other volumes
+	_, err = d.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          "vol_1#acc#share1",
+		StagingTargetPath: targetTest,
+	})
+	assert.NoError(t, err)
+	_, err = d.NodeStageVolume(context.Background(), buildReq("vol_2#acc#share2"))
+	assert.NoError(t, err)
+
+	err = os.RemoveAll(targetTest)
+	assert.NoError(t, err)
+}
+
+func TestNodeStageVolumeEchoInterval(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+	stdVolCap := csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+	}
+	buildReq := func(echoInterval string) *csi.NodeStageVolumeRequest {
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1#f5713de20cde511e8ba4900#test_sharename",
+			StagingTargetPath: targetTest,
+			VolumeCapability:  &stdVolCap,
+			VolumeContext: map[string]string{
+				shareNameField:    "test_sharename",
+				serverNameField:   "test_servername",
+				echoIntervalField: echoInterval,
+			},
+			Secrets: map[string]string{"accountname": "k8s", "accountkey": "testkey"},
+		}
+	}
+
+	d := NewFakeDriver()
+	fakeMounter := &fakeMounter{}
+	d.mounter = &mount.SafeFormatAndMount{
+		Interface: fakeMounter,
+	}
+	d.cloud = &azure.Cloud{
+		Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+	}
+
+	// invalid values are rejected before any mount is attempted
+	for _, invalid := range []string{"0", "-1", "ten"} {
+		_, err := d.NodeStageVolume(context.Background(), buildReq(invalid))
+		expectedErr := status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s(%s) in volume(%s): must be a positive integer of seconds", echoIntervalField, invalid, "vol_1#f5713de20cde511e8ba4900#test_sharename"))
+		if !reflect.DeepEqual(err, expectedErr) {
+			t.Errorf("echoInterval(%s): unexpected error: %v, expected error: %v", invalid, err, expectedErr)
+		}
+	}
+
+	// a valid value is threaded into the cifs mount options
+	_, err := d.NodeStageVolume(context.Background(), buildReq("30"))
+	assert.NoError(t, err)
+	if assert.Len(t, fakeMounter.MountPoints, 1) {
+		assert.Contains(t, fakeMounter.MountPoints[0].Opts, "echo_interval=30")
+	}
+
+	err = os.RemoveAll(targetTest)
+	assert.NoError(t, err)
+}
+
+func TestNodeStageVolumePort(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+	stdVolCap := csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+	}
+	buildReq := func(port string) *csi.NodeStageVolumeRequest {
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1#f5713de20cde511e8ba4900#test_sharename",
+			StagingTargetPath: targetTest,
+			VolumeCapability:  &stdVolCap,
+			VolumeContext: map[string]string{
+				shareNameField:  "test_sharename",
+				serverNameField: "test_servername",
+				portField:       port,
+			},
+			Secrets: map[string]string{"accountname": "k8s", "accountkey": "testkey"},
+		}
+	}
+
+	d := NewFakeDriver()
+	fakeMounter := &fakeMounter{}
+	d.mounter = &mount.SafeFormatAndMount{
+		Interface: fakeMounter,
+	}
+	d.cloud = &azure.Cloud{
+		Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+	}
+
+	// out-of-range and malformed ports are rejected before any mount is attempted
+	for _, invalid := range []string{"0", "-1", "65536", "https"} {
+		_, err := d.NodeStageVolume(context.Background(), buildReq(invalid))
+		expectedErr := status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s(%s) in volume(%s): must be an integer between 1 and 65535", portField, invalid, "vol_1#f5713de20cde511e8ba4900#test_sharename"))
+		if !reflect.DeepEqual(err, expectedErr) {
+			t.Errorf("port(%s): unexpected error: %v, expected error: %v", invalid, err, expectedErr)
+		}
+	}
+
+	// a valid port is threaded into the cifs mount options
+	_, err := d.NodeStageVolume(context.Background(), buildReq("8445"))
+	assert.NoError(t, err)
+	if assert.Len(t, fakeMounter.MountPoints, 1) {
+		assert.Contains(t, fakeMounter.MountPoints[0].Opts, "port=8445")
+	}
+
+	err = os.RemoveAll(targetTest)
+	assert.NoError(t, err)
+}
+
+func TestNodeStageVolumeSmbVersion(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+	buildReq := func(smbVersion string, mountFlags []string) *csi.NodeStageVolumeRequest {
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1#f5713de20cde511e8ba4900#test_sharename",
+			StagingTargetPath: targetTest,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{MountFlags: mountFlags},
+				},
+			},
+			VolumeContext: map[string]string{
+				shareNameField:  "test_sharename",
+				serverNameField: "test_servername",
+				smbVersionField: smbVersion,
+			},
+			Secrets: map[string]string{"accountname": "k8s", "accountkey": "testkey"},
+		}
+	}
+	buildDriver := func() (*Driver, *fakeMounter) {
+		d := NewFakeDriver()
+		fm := &fakeMounter{}
+		d.mounter = &mount.SafeFormatAndMount{
+			Interface: fm,
+		}
+		d.cloud = &azure.Cloud{
+			Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+		}
+		return d, fm
+	}
+
+	// a dialect the cifs client cannot negotiate is rejected
+	d, fm := buildDriver()
+	_, err := d.NodeStageVolume(context.Background(), buildReq("3.5", nil))
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Unexpected error: %v, expected InvalidArgument", err)
+	}
+	assert.Empty(t, fm.MountPoints)
+
+	// the context key pins the version and replaces the built-in default
+	d, fm = buildDriver()
+	_, err = d.NodeStageVolume(context.Background(), buildReq("3.1.1", nil))
+	assert.NoError(t, err)
+	if assert.Len(t, fm.MountPoints, 1) {
+		assert.Contains(t, fm.MountPoints[0].Opts, "vers=3.1.1")
+		assert.NotContains(t, fm.MountPoints[0].Opts, fmt.Sprintf("%s=%s", vers, defaultVers))
+	}
+	assert.NoError(t, os.RemoveAll(targetTest))
+
+	// an explicit vers= mount flag wins over the context key
+	d, fm = buildDriver()
+	_, err = d.NodeStageVolume(context.Background(), buildReq("3.1.1", []string{"vers=3.0"}))
+	assert.NoError(t, err)
+	if assert.Len(t, fm.MountPoints, 1) {
+		assert.Contains(t, fm.MountPoints[0].Opts, "vers=3.0")
+		assert.NotContains(t, fm.MountPoints[0].Opts, "vers=3.1.1")
+	}
+	assert.NoError(t, os.RemoveAll(targetTest))
+}
+
+func TestNodeStageVolumeSecNfs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+	buildReq := func(secNfs string, mountFlags []string) *csi.NodeStageVolumeRequest {
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1#f5713de20cde511e8ba4900#test_sharename",
+			StagingTargetPath: targetTest,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{MountFlags: mountFlags},
+				},
+			},
+			VolumeContext: map[string]string{
+				protocolField:   "nfs",
+				shareNameField:  "test_sharename",
+				serverNameField: "test_servername",
+				secNfsField:     secNfs,
+			},
+		}
+	}
+	buildDriver := func() (*Driver, *fakeMounter) {
+		d := NewFakeDriver()
+		fm := &fakeMounter{}
+		d.mounter = &mount.SafeFormatAndMount{
+			Interface: fm,
+		}
+		d.cloud = &azure.Cloud{
+			Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+		}
+		return d, fm
+	}
+
+	// an unknown security flavor is rejected before any mount is attempted
+	d, fm := buildDriver()
+	_, err := d.NodeStageVolume(context.Background(), buildReq("ntlm", nil))
+	expectedErr := status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s(ntlm) in volume(vol_1#f5713de20cde511e8ba4900#test_sharename): supported values are %v", secNfsField, supportedNfsSecList))
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("Unexpected error: %v, expected error: %v", err, expectedErr)
+	}
+	assert.Empty(t, fm.MountPoints)
+
+	// a kerberos flavor is threaded into the nfs mount options
+	for _, sec := range []string{"krb5", "krb5i", "krb5p"} {
+		d, fm = buildDriver()
+		_, err = d.NodeStageVolume(context.Background(), buildReq(sec, nil))
+		assert.NoError(t, err)
+		if assert.Len(t, fm.MountPoints, 1) {
+			assert.Contains(t, fm.MountPoints[0].Opts, "sec="+sec)
+		}
+		assert.NoError(t, os.RemoveAll(targetTest))
+	}
+
+	// an explicit sec= mount flag wins over the context key
+	d, fm = buildDriver()
+	_, err = d.NodeStageVolume(context.Background(), buildReq("krb5", []string{"sec=sys"}))
+	assert.NoError(t, err)
+	if assert.Len(t, fm.MountPoints, 1) {
+		assert.Contains(t, fm.MountPoints[0].Opts, "sec=sys")
+		assert.NotContains(t, fm.MountPoints[0].Opts, "sec=krb5")
+	}
+	assert.NoError(t, os.RemoveAll(targetTest))
+}
+
+func TestNodeStageVolumeFileDirMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+	buildReq := func(fileModePerm, dirModePerm string, mountFlags []string) *csi.NodeStageVolumeRequest {
+		volContext := map[string]string{
+			shareNameField:  "test_sharename",
+			serverNameField: "test_servername",
+		}
+		if fileModePerm != "" {
+			volContext[fileModeField] = fileModePerm
+		}
+		if dirModePerm != "" {
+			volContext[dirModeField] = dirModePerm
+		}
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1#f5713de20cde511e8ba4900#test_sharename",
+			StagingTargetPath: targetTest,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{MountFlags: mountFlags},
+				},
+			},
+			VolumeContext: volContext,
+			Secrets:       map[string]string{"accountname": "k8s", "accountkey": "testkey"},
+		}
+	}
+	buildDriver := func() (*Driver, *fakeMounter) {
+		d := NewFakeDriver()
+		fm := &fakeMounter{}
+		d.mounter = &mount.SafeFormatAndMount{
+			Interface: fm,
+		}
+		d.cloud = &azure.Cloud{
+			Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+		}
+		return d, fm
+	}
+
+	tests := []struct {
+		desc         string
+		fileModePerm string
+		dirModePerm  string
+		mountFlags   []string
+		expectedErr  error
+		expectOpts   []string
+		rejectOpts   []string
+	}{
+		{
+			desc:         "non-octal file mode is rejected",
+			fileModePerm: "07778",
+			expectedErr:  status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s(07778) in volume(vol_1#f5713de20cde511e8ba4900#test_sharename): must be an octal permission mode like 0777", fileModeField)),
+		},
+		{
+			desc:        "non-numeric dir mode is rejected",
+			dirModePerm: "rwxr-xr-x",
+			expectedErr: status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s(rwxr-xr-x) in volume(vol_1#f5713de20cde511e8ba4900#test_sharename): must be an octal permission mode like 0777", dirModeField)),
+		},
+		{
+			desc:         "context modes replace the built-in defaults",
+			fileModePerm: "0555",
+			dirModePerm:  "0750",
+			expectOpts:   []string{"file_mode=0555", "dir_mode=0750"},
+			rejectOpts:   []string{fileMode + "=" + defaultFileMode, dirMode + "=" + defaultDirMode},
+		},
+		{
+			desc:         "an explicit mount flag wins over the context key",
+			fileModePerm: "0555",
+			mountFlags:   []string{"file_mode=0700"},
+			expectOpts:   []string{"file_mode=0700"},
+			rejectOpts:   []string{"file_mode=0555"},
+		},
+	}
+
+	for _, test := range tests {
+		d, fm := buildDriver()
+		_, err := d.NodeStageVolume(context.Background(), buildReq(test.fileModePerm, test.dirModePerm, test.mountFlags))
+		if test.expectedErr != nil {
+			if !reflect.DeepEqual(err, test.expectedErr) {
+				t.Errorf("test(%s): unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+			}
+			assert.Empty(t, fm.MountPoints, test.desc)
+			continue
+		}
+		assert.NoError(t, err, test.desc)
+		if assert.Len(t, fm.MountPoints, 1, test.desc) {
+			for _, opt := range test.expectOpts {
+				assert.Contains(t, fm.MountPoints[0].Opts, opt, test.desc)
+			}
+			for _, opt := range test.rejectOpts {
+				assert.NotContains(t, fm.MountPoints[0].Opts, opt, test.desc)
+			}
+		}
+		assert.NoError(t, os.RemoveAll(targetTest))
+	}
+}
+
+func TestNodeStageVolumeMountPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+	buildReq := func(stagingPath string) *csi.NodeStageVolumeRequest {
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1#f5713de20cde511e8ba4900#test_sharename",
+			StagingTargetPath: stagingPath,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+			},
+			VolumeContext: map[string]string{
+				shareNameField:  "test_sharename",
+				serverNameField: "test_servername",
+			},
+			Secrets: map[string]string{"accountname": "k8s", "accountkey": "testkey"},
+		}
+	}
+	buildDriver := func(mountPermissions os.FileMode) *Driver {
+		d := NewFakeDriver()
+		d.mountPermissions = mountPermissions
+		d.mounter = &mount.SafeFormatAndMount{
+			Interface: &fakeMounter{},
+		}
+		d.cloud = &azure.Cloud{
+			Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+		}
+		return d
+	}
+
+	// the configured permissions are applied to the created staging target
+	stagingPath := testutil.GetWorkDirPath("target_mount_permissions", t)
+	d := buildDriver(0700)
+	_, err := d.NodeStageVolume(context.Background(), buildReq(stagingPath))
+	assert.NoError(t, err)
+	info, err := os.Stat(stagingPath)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	assert.NoError(t, os.RemoveAll(stagingPath))
+
+	// a zero value leaves the mode of the created directory untouched
+	referencePath := testutil.GetWorkDirPath("target_mount_permissions_ref", t)
+	assert.NoError(t, os.MkdirAll(referencePath, 0750))
+	referenceInfo, err := os.Stat(referencePath)
+	assert.NoError(t, err)
+	d = buildDriver(0)
+	_, err = d.NodeStageVolume(context.Background(), buildReq(stagingPath))
+	assert.NoError(t, err)
+	info, err = os.Stat(stagingPath)
+	assert.NoError(t, err)
+	assert.Equal(t, referenceInfo.Mode().Perm(), info.Mode().Perm())
+	assert.NoError(t, os.RemoveAll(stagingPath))
+	assert.NoError(t, os.RemoveAll(referencePath))
+}
+
+func TestNodeStageVolumeFSGroupPolicy(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+	buildReq := func(stagingPath string) *csi.NodeStageVolumeRequest {
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1#f5713de20cde511e8ba4900#test_sharename",
+			StagingTargetPath: stagingPath,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+			},
+			VolumeContext: map[string]string{
+				shareNameField:  "test_sharename",
+				serverNameField: "test_servername",
+			},
+			Secrets: map[string]string{"accountname": "k8s", "accountkey": "testkey"},
+		}
+	}
+	buildDriver := func(fsGroupPolicy string) *Driver {
+		d := NewFakeDriver()
+		d.mountPermissions = 0700
+		d.fsGroupPolicy = fsGroupPolicy
+		d.mounter = &mount.SafeFormatAndMount{
+			Interface: &fakeMounter{},
+		}
+		d.cloud = &azure.Cloud{
+			Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+		}
+		return d
+	}
+
+	// mode a created staging target ends up with when the driver leaves it alone
+	referencePath := testutil.GetWorkDirPath("target_fs_group_policy_ref", t)
+	assert.NoError(t, os.MkdirAll(referencePath, 0750))
+	referenceInfo, err := os.Stat(referencePath)
+	assert.NoError(t, err)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(referencePath))
+	}()
+
+	tests := []struct {
+		policy       string
+		expectedPerm os.FileMode
+	}{
+		// File and the empty default keep permission handling in the driver
+		{policy: fsGroupPolicyFile, expectedPerm: 0700},
+		{policy: "", expectedPerm: 0700},
+		// None and ReadWriteOnceWithFSType leave the directory untouched
+		{policy: fsGroupPolicyNone, expectedPerm: referenceInfo.Mode().Perm()},
+		{policy: fsGroupPolicyReadWriteOnceWithFSType, expectedPerm: referenceInfo.Mode().Perm()},
+	}
+
+	stagingPath := testutil.GetWorkDirPath("target_fs_group_policy", t)
+	for _, test := range tests {
+		d := buildDriver(test.policy)
+		_, err := d.NodeStageVolume(context.Background(), buildReq(stagingPath))
+		assert.NoError(t, err, "policy(%s)", test.policy)
+		info, err := os.Stat(stagingPath)
+		assert.NoError(t, err, "policy(%s)", test.policy)
+		assert.Equal(t, test.expectedPerm, info.Mode().Perm(), "policy(%s)", test.policy)
+		assert.NoError(t, os.RemoveAll(stagingPath))
+	}
+}
+
+func TestNodeStageVolumeHandleCache(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+	stdVolCap := csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+	}
+	buildReq := func(handleCache string) *csi.NodeStageVolumeRequest {
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1#f5713de20cde511e8ba4900#test_sharename",
+			StagingTargetPath: targetTest,
+			VolumeCapability:  &stdVolCap,
+			VolumeContext: map[string]string{
+				shareNameField:   "test_sharename",
+				serverNameField:  "test_servername",
+				handleCacheField: handleCache,
+			},
+			Secrets: map[string]string{"accountname": "k8s", "accountkey": "testkey"},
+		}
+	}
+
+	d := NewFakeDriver()
+	fakeMounter := &fakeMounter{}
+	d.mounter = &mount.SafeFormatAndMount{
+		Interface: fakeMounter,
+	}
+	d.cloud = &azure.Cloud{
+		Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+	}
+
+	// invalid values are rejected before any mount is attempted
+	for _, invalid := range []string{"cache", "true", "no"} {
+		_, err := d.NodeStageVolume(context.Background(), buildReq(invalid))
+		expectedErr := status.Error(codes.InvalidArgument, fmt.Sprintf("invalid %s(%s) in volume(%s): supported values are %s and %s", handleCacheField, invalid, "vol_1#f5713de20cde511e8ba4900#test_sharename", handleCacheEnabled, handleCacheDisabled))
+		if !reflect.DeepEqual(err, expectedErr) {
+			t.Errorf("handleCache(%s): unexpected error: %v, expected error: %v", invalid, err, expectedErr)
+		}
+	}
+
+	// a valid value is threaded into the cifs mount options
+	_, err := d.NodeStageVolume(context.Background(), buildReq("nohandlecache"))
+	assert.NoError(t, err)
+	if assert.Len(t, fakeMounter.MountPoints, 1) {
+		assert.Contains(t, fakeMounter.MountPoints[0].Opts, "nohandlecache")
+	}
+
+	err = os.RemoveAll(targetTest)
+	assert.NoError(t, err)
+}
+
+func TestNodeStageVolumeExtraMountOptions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+	stdVolCap := csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+	}
+	buildReq := func(mountOptions string) *csi.NodeStageVolumeRequest {
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1#f5713de20cde511e8ba4900#test_sharename",
+			StagingTargetPath: targetTest,
+			VolumeCapability:  &stdVolCap,
+			VolumeContext: map[string]string{
+				shareNameField:    "test_sharename",
+				serverNameField:   "test_servername",
+				mountOptionsField: mountOptions,
+			},
+			Secrets: map[string]string{"accountname": "k8s", "accountkey": "testkey"},
+		}
+	}
+
+	d := NewFakeDriver()
+	fakeMounter := &fakeMounter{}
+	d.mounter = &mount.SafeFormatAndMount{
+		Interface: fakeMounter,
+	}
+	d.cloud = &azure.Cloud{
+		Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+	}
+
+	// malformed options are rejected before any mount is attempted
+	for _, invalid := range []string{"=none", "cache=", "nobrl,=1"} {
+		_, err := d.NodeStageVolume(context.Background(), buildReq(invalid))
+		if assert.Error(t, err, "mountOptions(%s)", invalid) {
+			assert.Equal(t, codes.InvalidArgument, status.Code(err), "mountOptions(%s)", invalid)
+			assert.Contains(t, err.Error(), "each option must be a flag or a key=value pair", "mountOptions(%s)", invalid)
+		}
+	}
+	assert.Empty(t, fakeMounter.MountPoints)
+
+	// valid options reach the mounter, a user-supplied key overrides the
+	// driver default of the same name
+	_, err := d.NodeStageVolume(context.Background(), buildReq("nobrl,actimeo=5"))
+	assert.NoError(t, err)
+	if assert.Len(t, fakeMounter.MountPoints, 1) {
+		opts := fakeMounter.MountPoints[0].Opts
+		assert.Contains(t, opts, "nobrl")
+		assert.Contains(t, opts, "actimeo=5")
+		assert.NotContains(t, opts, actimeo+"="+defaultActimeo)
+	}
+
+	err = os.RemoveAll(targetTest)
+	assert.NoError(t, err)
+}
+
+func TestNodeStageVolumeReadOnlyAccessMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+	buildReq := func(mode csi.VolumeCapability_AccessMode_Mode, protocol string) *csi.NodeStageVolumeRequest {
+		volContext := map[string]string{
+			shareNameField:  "test_sharename",
+			serverNameField: "test_servername",
+		}
+		if protocol != "" {
+			volContext[protocolField] = protocol
+		}
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1#f5713de20cde511e8ba4900#test_sharename",
+			StagingTargetPath: targetTest,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+			},
+			VolumeContext: volContext,
+			Secrets:       map[string]string{"accountname": "k8s", "accountkey": "testkey"},
+		}
+	}
+
+	tests := []struct {
+		desc     string
+		mode     csi.VolumeCapability_AccessMode_Mode
+		protocol string
+		expectRo bool
+	}{
+		{
+			desc:     "smb share with a multi node reader only mode is mounted ro",
+			mode:     csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+			expectRo: true,
+		},
+		{
+			desc:     "smb share with a single node reader only mode is mounted ro",
+			mode:     csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+			expectRo: true,
+		},
+		{
+			desc:     "nfs share with a reader only mode is mounted ro",
+			mode:     csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+			protocol: "nfs",
+			expectRo: true,
+		},
+		{
+			desc: "single node writer mode stays writable",
+			mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+		{
+			desc: "multi node multi writer mode stays writable",
+			mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+		},
+	}
+
+	for _, test := range tests {
+		d := NewFakeDriver()
+		fakeMounter := &fakeMounter{}
+		d.mounter = &mount.SafeFormatAndMount{
+			Interface: fakeMounter,
+		}
+		d.cloud = &azure.Cloud{
+			Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+		}
+
+		_, err := d.NodeStageVolume(context.Background(), buildReq(test.mode, test.protocol))
+		assert.NoError(t, err, test.desc)
+		if assert.Len(t, fakeMounter.MountPoints, 1, test.desc) {
+			opts := fakeMounter.MountPoints[0].Opts
+			if test.expectRo {
+				assert.Contains(t, opts, "ro", test.desc)
+			} else {
+				assert.NotContains(t, opts, "ro", test.desc)
+			}
+		}
+
+		err = os.RemoveAll(targetTest)
+		assert.NoError(t, err, test.desc)
+	}
+}
+
+func TestNodeStageVolumeEncryptInTransit(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+	stdVolCap := csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+	}
+	buildReq := func(protocol, encryptInTransit string) *csi.NodeStageVolumeRequest {
+		volContext := map[string]string{
+			shareNameField:        "test_sharename",
+			serverNameField:       "test_servername",
+			encryptInTransitField: encryptInTransit,
+		}
+		if protocol != "" {
+			volContext[protocolField] = protocol
+		}
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1#f5713de20cde511e8ba4900#test_sharename",
+			StagingTargetPath: targetTest,
+			VolumeCapability:  &stdVolCap,
+			VolumeContext:     volContext,
+			Secrets:           map[string]string{"accountname": "k8s", "accountkey": "testkey"},
+		}
+	}
+
+	d := NewFakeDriver()
+	fakeMounter := &fakeMounter{}
+	d.mounter = &mount.SafeFormatAndMount{
+		Interface: fakeMounter,
+	}
+	d.cloud = &azure.Cloud{
+		Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+	}
+
+	originalNFSTLSSupported := nfsTLSSupported
+	defer func() { nfsTLSSupported = originalNFSTLSSupported }()
+	nfsTLSSupported = func() bool { return true }
+
+	// a malformed value is rejected
+	_, err := d.NodeStageVolume(context.Background(), buildReq(nfs, "maybe"))
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Unexpected error: %v, expected InvalidArgument", err)
+	}
+
+	// encryption in transit only applies to nfs mounts
+	_, err = d.NodeStageVolume(context.Background(), buildReq("", "true"))
+	expectedErr := status.Error(codes.InvalidArgument, fmt.Sprintf("%s is only supported with the nfs protocol, volume(%s) mounts over smb", encryptInTransitField, "vol_1#f5713de20cde511e8ba4900#test_sharename"))
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("Unexpected error: %v, expected error: %v", err, expectedErr)
+	}
+
+	// nodes without the aznfs mount helper cannot satisfy the request
+	nfsTLSSupported = func() bool { return false }
+	_, err = d.NodeStageVolume(context.Background(), buildReq(nfs, "true"))
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Unexpected error: %v, expected FailedPrecondition", err)
+	}
+
+	// on a supported node the tls option is threaded into the mount options
+	nfsTLSSupported = func() bool { return true }
+	_, err = d.NodeStageVolume(context.Background(), buildReq(nfs, "true"))
+	assert.NoError(t, err)
+	if assert.Len(t, fakeMounter.MountPoints, 1) {
+		assert.Contains(t, fakeMounter.MountPoints[0].Opts, "tls")
+	}
+
+	err = os.RemoveAll(targetTest)
+	assert.NoError(t, err)
+}
+
+func TestEnsureSealedMountOptions(t *testing.T) {
+	// the seal option is added without duplicating an existing one
+	options, err := ensureSealedMountOptions([]string{"vers=3.1.1", "nostrictsync"})
+	assert.NoError(t, err)
+	assert.Contains(t, options, seal)
+
+	options, err = ensureSealedMountOptions([]string{seal, "vers=3.0"})
+	assert.NoError(t, err)
+	count := 0
+	for _, option := range options {
+		if option == seal {
+			count++
+		}
+	}
+	assert.Equal(t, 1, count)
+
+	// protocol versions below smb3 cannot encrypt
+	_, err = ensureSealedMountOptions([]string{"vers=2.1"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "cannot encrypt in transit")
+	}
+	_, err = ensureSealedMountOptions([]string{"dir_mode=0777,vers=2.0"})
+	assert.Error(t, err)
+}
+
+func TestNodeStageVolumeRequireEncryptInTransit(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+	buildReq := func(requireEncrypt string, mountFlags []string) *csi.NodeStageVolumeRequest {
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1#f5713de20cde511e8ba4900#test_sharename",
+			StagingTargetPath: targetTest,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{MountFlags: mountFlags},
+				},
+			},
+			VolumeContext: map[string]string{
+				shareNameField:      "test_sharename",
+				serverNameField:     "test_servername",
+				requireEncryptField: requireEncrypt,
+			},
+			Secrets: map[string]string{"accountname": "k8s", "accountkey": "testkey"},
+		}
+	}
+
+	d := NewFakeDriver()
+	fakeMounter := &fakeMounter{}
+	d.mounter = &mount.SafeFormatAndMount{
+		Interface: fakeMounter,
+	}
+	d.cloud = &azure.Cloud{
+		Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+	}
+
+	// a malformed value is rejected
+	_, err := d.NodeStageVolume(context.Background(), buildReq("maybe", nil))
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Unexpected error: %v, expected InvalidArgument", err)
+	}
+
+	// mount flags negotiating a version that cannot encrypt are refused
+	_, err = d.NodeStageVolume(context.Background(), buildReq("true", []string{"vers=2.1"}))
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("Unexpected error: %v, expected FailedPrecondition", err)
+	}
+	assert.Empty(t, fakeMounter.MountPoints)
+
+	// an enforced volume mounts with the seal option
+	_, err = d.NodeStageVolume(context.Background(), buildReq("true", nil))
+	assert.NoError(t, err)
+	if assert.Len(t, fakeMounter.MountPoints, 1) {
+		assert.Contains(t, fakeMounter.MountPoints[0].Opts, seal)
+	}
+
+	err = os.RemoveAll(targetTest)
+	assert.NoError(t, err)
+}
+
+func TestIsRetriableUnmountError(t *testing.T) {
+	tests := []struct {
+		desc         string
+		err          error
+		expectedBool bool
+	}{
+		{
+			desc:         "nil error",
+			err:          nil,
+			expectedBool: false,
+		},
+		{
+			desc:         "EBUSY",
+			err:          &os.PathError{Op: "unmount", Path: targetTest, Err: syscall.EBUSY},
+			expectedBool: true,
+		},
+		{
+			desc:         "ETIMEDOUT",
+			err:          syscall.ETIMEDOUT,
+			expectedBool: true,
+		},
+		{
+			desc:         "busy error message",
+			err:          fmt.Errorf("unmount failed: Device or resource busy"),
+			expectedBool: true,
+		},
+		{
+			desc:         "bad argument",
+			err:          syscall.EINVAL,
+			expectedBool: false,
+		},
+	}
+
+	for _, test := range tests {
+		result := isRetriableUnmountError(test.err)
+		if result != test.expectedBool {
+			t.Errorf("test[%s]: isRetriableUnmountError(%v) returned with bool(%v), not equal to expectedBool(%v)",
+				test.desc, test.err, result, test.expectedBool)
+		}
+	}
+}
+
+func TestIsShareNotReadyMountError(t *testing.T) {
+	tests := []struct {
+		desc         string
+		err          error
+		expectedBool bool
+	}{
+		{
+			desc:         "nil error",
+			err:          nil,
+			expectedBool: false,
+		},
+		{
+			desc:         "cifs share not found",
+			err:          fmt.Errorf("mount error(2): No such file or directory"),
+			expectedBool: true,
+		},
+		{
+			desc:         "share not ready message",
+			err:          fmt.Errorf("share is not ready"),
+			expectedBool: true,
+		},
+		{
+			desc:         "auth failure",
+			err:          fmt.Errorf("mount error(13): Permission denied"),
+			expectedBool: false,
+		},
+	}
+
+	for _, test := range tests {
+		result := isShareNotReadyMountError(test.err)
+		if result != test.expectedBool {
+			t.Errorf("test[%s]: isShareNotReadyMountError(%v) returned with bool(%v), not equal to expectedBool(%v)",
+				test.desc, test.err, result, test.expectedBool)
+		}
+	}
+}
+
+func TestRetryCleanupMountPoint(t *testing.T) {
+	// transient EBUSY failures are retried until the cleanup succeeds
+	calls := 0
+	err := retryCleanupMountPoint(func() error {
+		calls++
+		if calls < 2 {
+			return syscall.EBUSY
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+
+	// permanent failures fail fast without retrying
+	calls = 0
+	err = retryCleanupMountPoint(func() error {
+		calls++
+		return syscall.EINVAL
+	})
+	assert.Equal(t, syscall.EINVAL, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestNodeStageVolumeAuthRetry(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+
+	buildDriver := func(keys storage.AccountListKeysResult) (*Driver, *fakeMounter, *gomock.Controller) {
+		d := NewFakeDriver()
+		fakeMounter := &fakeMounter{}
+		d.mounter = &mount.SafeFormatAndMount{
+			Interface: fakeMounter,
+		}
+		d.cloud = &azure.Cloud{
+			Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+		}
+		ctrl := gomock.NewController(t)
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+		return d, fakeMounter, ctrl
+	}
+	buildReq := func() *csi.NodeStageVolumeRequest {
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1#f5713de20cde511e8ba4900#test_sharename",
+			StagingTargetPath: targetTest,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+			},
+			VolumeContext: map[string]string{
+				shareNameField:  "test_sharename",
+				serverNameField: "test_servername",
+			},
+			Secrets: map[string]string{"accountname": "k8s", "accountkey": "invalid-key"},
+		}
+	}
+	keysResult := func(values ...string) storage.AccountListKeysResult {
+		keys := make([]storage.AccountKey, 0, len(values))
+		for i := range values {
+			keys = append(keys, storage.AccountKey{Value: &values[i]})
+		}
+		return storage.AccountListKeysResult{Keys: &keys}
+	}
+
+	// the secret key fails with an auth error, the account's other key is valid
+	d, fm, ctrl := buildDriver(keysResult("invalid-key", "validkey"))
+	_, err := d.NodeStageVolume(context.Background(), buildReq())
+	assert.NoError(t, err)
+	if assert.Len(t, fm.MountPoints, 1) {
+		assert.Contains(t, fm.MountPoints[0].Opts, "username=k8s,password=validkey")
+	}
+	ctrl.Finish()
+	assert.NoError(t, os.RemoveAll(targetTest))
+
+	// both keys are invalid, the auth error surfaces
+	d, _, ctrl = buildDriver(keysResult("invalid-key", "invalid-key2"))
+	_, err = d.NodeStageVolume(context.Background(), buildReq())
+	if assert.Error(t, err) {
+		assert.Equal(t, codes.Internal, status.Code(err))
+		assert.Contains(t, err.Error(), "Permission denied")
+	}
+	ctrl.Finish()
+	assert.NoError(t, os.RemoveAll(targetTest))
+}
+
+func TestNodeStageVolumeShareNotReadyRetry(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+
+	buildDriver := func(notReadyFailures int) (*Driver, *fakeMounter) {
+		d := NewFakeDriver()
+		d.shareNotReadyRetries = 3
+		fakeMounter := &fakeMounter{notReadyFailuresLeft: notReadyFailures}
+		d.mounter = &mount.SafeFormatAndMount{
+			Interface: fakeMounter,
+		}
+		d.cloud = &azure.Cloud{
+			Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+		}
+		return d, fakeMounter
+	}
+	buildReq := func() *csi.NodeStageVolumeRequest {
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1#f5713de20cde511e8ba4900#test_sharename",
+			StagingTargetPath: targetTest,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+			},
+			VolumeContext: map[string]string{
+				shareNameField:  "test_sharename",
+				serverNameField: "share_not_ready_server",
+			},
+			Secrets: map[string]string{"accountname": "k8s", "accountkey": "testkey"},
+		}
+	}
+
+	// the share materializes while the retries are still running
+	d, fm := buildDriver(2)
+	_, err := d.NodeStageVolume(context.Background(), buildReq())
+	assert.NoError(t, err)
+	assert.Len(t, fm.MountPoints, 1)
+	assert.Equal(t, 0, fm.notReadyFailuresLeft)
+	assert.NoError(t, os.RemoveAll(targetTest))
+
+	// a permanently missing share exhausts the retries and surfaces the error
+	d, _ = buildDriver(10)
+	_, err = d.NodeStageVolume(context.Background(), buildReq())
+	if assert.Error(t, err) {
+		assert.Equal(t, codes.Internal, status.Code(err))
+		assert.Contains(t, err.Error(), "mount error(2)")
+	}
+	assert.NoError(t, os.RemoveAll(targetTest))
+
+	// a permanent error is not retried at all
+	d, fm = buildDriver(0)
+	req := buildReq()
+	req.Secrets["accountkey"] = "invalid-key"
+	_, err = d.NodeStageVolume(context.Background(), req)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Permission denied")
+	}
+	assert.Empty(t, fm.MountPoints)
+	assert.NoError(t, os.RemoveAll(targetTest))
+}
+
+// countingMounter tracks how many MountSensitive calls run concurrently
+type countingMounter struct {
+	fakeMounter
+	mu          sync.Mutex
+	current     int
+	maxObserved int
+}
+
+func (c *countingMounter) MountSensitive(source, target, fstype string, options, sensitiveOptions []string) error {
+	c.mu.Lock()
+	c.current++
+	if c.current > c.maxObserved {
+		c.maxObserved = c.current
+	}
+	c.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	c.mu.Lock()
+	c.current--
+	c.mu.Unlock()
+	return c.fakeMounter.MountSensitive(source, target, fstype, options, sensitiveOptions)
+}
+
+func TestNodeStageVolumeBlockingMountLimit(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+	const limit = 2
+	const mounts = 6
+
+	d := NewFakeDriver()
+	cm := &countingMounter{}
+	d.mounter = &mount.SafeFormatAndMount{
+		Interface: cm,
+	}
+	d.cloud = &azure.Cloud{
+		Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+	}
+	d.mountLimiter = newBlockingMountLimiter(limit)
+
+	var wg sync.WaitGroup
+	errs := make([]error, mounts)
+	targets := make([]string, mounts)
+	for i := 0; i < mounts; i++ {
+		wg.Add(1)
+		targets[i] = testutil.GetWorkDirPath(fmt.Sprintf("target_blocking_limit_%d", i), t)
+		go func(i int) {
+			defer wg.Done()
+			req := &csi.NodeStageVolumeRequest{
+				VolumeId:          fmt.Sprintf("vol_%d#f5713de20cde511e8ba4900#test_sharename", i),
+				StagingTargetPath: targets[i],
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{},
+					},
+				},
+				VolumeContext: map[string]string{
+					shareNameField:  "test_sharename",
+					serverNameField: "test_servername",
+				},
+				Secrets: map[string]string{"accountname": "k8s", "accountkey": "testkey"},
+			}
+			_, errs[i] = d.NodeStageVolume(context.Background(), req)
+		}(i)
+	}
+	wg.Wait()
+
+	// every mount succeeds, callers over the limit block instead of erroring
+	for i, err := range errs {
+		assert.NoError(t, err, "mount %d", i)
+	}
+	assert.True(t, cm.maxObserved <= limit, "observed %d concurrent mounts, limit is %d", cm.maxObserved, limit)
+	for _, target := range targets {
+		assert.NoError(t, os.RemoveAll(target))
+	}
+}
+
+func TestRetrySmbMapping(t *testing.T) {
+	d := NewFakeDriver()
+	d.smbMountRetries = 3
+
+	// a mapping that fails twice and then succeeds is retried to success
+	attempts := 0
+	err := d.retrySmbMapping("vol_1", func() error {
+		attempts++
+		if attempts <= 2 {
+			return fmt.Errorf("NewSmbGlobalMapping failed")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+
+	// a persistently failing mapping surfaces the last error unchanged after
+	// the configured number of attempts
+	attempts = 0
+	mappingErr := fmt.Errorf("NewSmbGlobalMapping failed")
+	err = d.retrySmbMapping("vol_1", func() error {
+		attempts++
+		return mappingErr
+	})
+	assert.Equal(t, mappingErr, err)
+	assert.Equal(t, d.smbMountRetries, attempts)
+}
+
+func TestNodeStageVolumeQuotaVerification(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+
+	value := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+	keys := storage.AccountListKeysResult{
+		Keys: &[]storage.AccountKey{
+			{Value: &value},
+		},
+	}
+	fakeShareQuota := int32(100)
+
+	buildDriver := func() (*Driver, *gomock.Controller) {
+		d := NewFakeDriver()
+		fakeMounter := &fakeMounter{}
+		d.mounter = &mount.SafeFormatAndMount{
+			Interface: fakeMounter,
+		}
+		d.cloud = &azure.Cloud{
+			Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+		}
+		d.enableQuotaVerification = true
+		ctrl := gomock.NewController(t)
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+		mockFileClient := mockfileclient.NewMockInterface(ctrl)
+		d.cloud.FileClient = mockFileClient
+		mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &fakeShareQuota}}, nil).AnyTimes()
+		return d, ctrl
+	}
+	buildReq := func(requestedSizeGiB string) *csi.NodeStageVolumeRequest {
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "rg#f5713de20cde511e8ba4900#test_sharename",
+			StagingTargetPath: targetTest,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+			},
+			VolumeContext: map[string]string{
+				shareNameField:        "test_sharename",
+				serverNameField:       "test_servername",
+				requestedSizeGiBField: requestedSizeGiB,
+			},
+		}
+	}
+
+	klog.LogToStderr(false)
+	var buf bytes.Buffer
+	klog.SetOutput(&buf)
+	defer func() {
+		klog.SetOutput(os.Stderr)
+		klog.LogToStderr(true)
+	}()
+
+	// quota matches the provisioned capacity, no warning
+	d, ctrl := buildDriver()
+	_, err := d.NodeStageVolume(context.Background(), buildReq("100"))
+	assert.NoError(t, err)
+	klog.Flush()
+	assert.NotContains(t, buf.String(), "changed out of band")
+	ctrl.Finish()
+	assert.NoError(t, os.RemoveAll(targetTest))
+	buf.Reset()
+
+	// quota was changed out of band, the mismatch is logged
+	d, ctrl = buildDriver()
+	_, err = d.NodeStageVolume(context.Background(), buildReq("50"))
+	assert.NoError(t, err)
+	klog.Flush()
+	assert.Contains(t, buf.String(), "does not match the provisioned capacity")
+	ctrl.Finish()
+	assert.NoError(t, os.RemoveAll(targetTest))
+}
+
+func TestNodeStageVolumeCreateDiskQuotaFallback(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+
+	value := base64.StdEncoding.EncodeToString([]byte("acc_key"))
+	keys := storage.AccountListKeysResult{
+		Keys: &[]storage.AccountKey{
+			{Value: &value},
+		},
+	}
+	fakeShareQuota := int32(2)
+	stagingPath := testutil.GetWorkDirPath("target_quota_fallback", t)
+	proxyPath := testutil.GetWorkDirPath(proxyMount, t)
+	diskPath := fmt.Sprintf("%s/quota_fallback_disk", proxyPath)
+
+	d := NewFakeDriver()
+	fakeExec := &testingexec.FakeExec{ExactOrder: true}
+	for _, script := range []ExecArgs{
+		{"blkid", []string{"-p", "-s", "TYPE", "-s", "PTTYPE", "-o", "export", diskPath}, "", &testingexec.FakeExitError{Status: 2}},
+		{"blkid", []string{"-p", "-s", "TYPE", "-s", "PTTYPE", "-o", "export", diskPath}, "", &testingexec.FakeExitError{Status: 2}},
+		{"mkfs.ext4", []string{"-F", "-m0", diskPath}, "", nil},
+	} {
+		fakeCmd := &testingexec.FakeCmd{}
+		cmdAction := makeFakeCmd(fakeCmd, script.command, script.args...)
+		fakeCmd.CombinedOutputScript = append(fakeCmd.CombinedOutputScript, makeFakeOutput(script.output, script.err))
+		fakeExec.CommandScript = append(fakeExec.CommandScript, cmdAction)
+	}
+	d.mounter = &mount.SafeFormatAndMount{
+		Interface: &fakeMounter{},
+		Exec:      fakeExec,
+	}
+	d.cloud = &azure.Cloud{
+		Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+	}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+	d.cloud.StorageAccountClient = mockStorageAccountsClient
+	mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), gomock.Any()).Return(keys, nil).AnyTimes()
+	mockFileClient := mockfileclient.NewMockInterface(ctrl)
+	d.cloud.FileClient = mockFileClient
+	mockFileClient.EXPECT().GetFileShare(gomock.Any(), gomock.Any(), gomock.Any()).Return(storage.FileShare{FileShareProperties: &storage.FileShareProperties{ShareQuota: &fakeShareQuota}}, nil).AnyTimes()
+
+	// a statically provisioned disk-mode volume: createdisk is set but the
+	// volume context carries no requestedsizegib, the size comes from the quota
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          "rg#f5713de20cde511e8ba4900#test_sharename",
+		StagingTargetPath: stagingPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{},
+			},
+		},
+		VolumeContext: map[string]string{
+			fsTypeField:     "ext4",
+			diskNameField:   "quota_fallback_disk",
+			createDiskField: "true",
+			shareNameField:  "test_sharename",
+			serverNameField: "test_servername",
+		},
+	}
+
+	_, err := d.NodeStageVolume(context.Background(), req)
+	assert.NoError(t, err)
+	info, err := os.Stat(diskPath)
+	assert.NoError(t, err)
+	if err == nil {
+		assert.Equal(t, int64(fakeShareQuota)*1024*1024*1024, info.Size())
+	}
+
+	assert.NoError(t, os.RemoveAll(stagingPath))
+	assert.NoError(t, os.RemoveAll(proxyPath))
+}
+
+func TestParseDiskMountOptions(t *testing.T) {
+	options, err := parseDiskMountOptions("noatime, discard,errors=remount-ro")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"noatime", "discard", "errors=remount-ro"}, options)
+
+	for _, unsafe := range []string{"suid", "dev", "exec", "loop=/dev/loop7"} {
+		_, err = parseDiskMountOptions(unsafe)
+		if assert.Error(t, err, "option %q must be rejected", unsafe) {
+			assert.Contains(t, err.Error(), "not in the safe set")
+		}
+	}
+}
+
+func TestNodeStageVolumeDiskMountOptions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+
+	stagingPath := testutil.GetWorkDirPath("target_disk_mount_options", t)
+	proxyPath := testutil.GetWorkDirPath(proxyMount, t)
+	diskPath := fmt.Sprintf("%s/disk_mount_options_disk", proxyPath)
+
+	d := NewFakeDriver()
+	fakeExec := &testingexec.FakeExec{ExactOrder: true}
+	for _, script := range []ExecArgs{
+		{"blkid", []string{"-p", "-s", "TYPE", "-s", "PTTYPE", "-o", "export", diskPath}, "", &testingexec.FakeExitError{Status: 2}},
+		{"blkid", []string{"-p", "-s", "TYPE", "-s", "PTTYPE", "-o", "export", diskPath}, "", &testingexec.FakeExitError{Status: 2}},
+		{"mkfs.ext4", []string{"-F", "-m0", diskPath}, "", nil},
+	} {
+		fakeCmd := &testingexec.FakeCmd{}
+		cmdAction := makeFakeCmd(fakeCmd, script.command, script.args...)
+		fakeCmd.CombinedOutputScript = append(fakeCmd.CombinedOutputScript, makeFakeOutput(script.output, script.err))
+		fakeExec.CommandScript = append(fakeExec.CommandScript, cmdAction)
+	}
+	fm := &fakeMounter{}
+	d.mounter = &mount.SafeFormatAndMount{
+		Interface: fm,
+		Exec:      fakeExec,
+	}
+	d.cloud = &azure.Cloud{
+		Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+	}
+
+	buildReq := func(diskMountOptions string) *csi.NodeStageVolumeRequest {
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "rg#f5713de20cde511e8ba4900#test_sharename",
+			StagingTargetPath: stagingPath,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+			},
+			VolumeContext: map[string]string{
+				fsTypeField:           "ext4",
+				diskNameField:         "disk_mount_options_disk",
+				createDiskField:       "true",
+				requestedSizeGiBField: "1",
+				diskMountOptionsField: diskMountOptions,
+				shareNameField:        "test_sharename",
+				serverNameField:       "test_servername",
+			},
+			Secrets: map[string]string{"accountname": "k8s", "accountkey": "testkey"},
+		}
+	}
+
+	// an option outside the safe set is rejected before anything is mounted
+	_, err := d.NodeStageVolume(context.Background(), buildReq("suid"))
+	if assert.Error(t, err) {
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+	assert.Empty(t, fm.MountPoints)
+
+	// the safe options reach the inner filesystem mount, overriding the
+	// built-in defaults of the same key, and stay off the outer SMB mount
+	_, err = d.NodeStageVolume(context.Background(), buildReq("discard,errors=continue"))
+	assert.NoError(t, err)
+	var innerOpts, outerOpts []string
+	for _, mountPoint := range fm.MountPoints {
+		switch mountPoint.Path {
+		case stagingPath:
+			innerOpts = mountPoint.Opts
+		case proxyPath:
+			outerOpts = mountPoint.Opts
+		}
+	}
+	assert.Contains(t, innerOpts, "discard")
+	assert.Contains(t, innerOpts, "errors=continue")
+	assert.NotContains(t, innerOpts, "errors=remount-ro")
+	assert.Contains(t, innerOpts, "loop")
+	assert.NotContains(t, outerOpts, "discard")
+
+	assert.NoError(t, os.RemoveAll(stagingPath))
+	assert.NoError(t, os.RemoveAll(proxyPath))
+}
+
+func TestNodeStageVolumeDiskNfsConflict(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+
+	stagingPath := testutil.GetWorkDirPath("target_disk_nfs_conflict", t)
+	proxyPath := testutil.GetWorkDirPath(proxyMount, t)
+	diskPath := fmt.Sprintf("%s/disk_nfs_conflict_disk", proxyPath)
+
+	buildDriver := func(withExec bool) (*Driver, *fakeMounter) {
+		d := NewFakeDriver()
+		fm := &fakeMounter{}
+		d.mounter = &mount.SafeFormatAndMount{
+			Interface: fm,
+		}
+		if withExec {
+			fakeExec := &testingexec.FakeExec{ExactOrder: true}
+			for _, script := range []ExecArgs{
+				{"blkid", []string{"-p", "-s", "TYPE", "-s", "PTTYPE", "-o", "export", diskPath}, "", &testingexec.FakeExitError{Status: 2}},
+				{"blkid", []string{"-p", "-s", "TYPE", "-s", "PTTYPE", "-o", "export", diskPath}, "", &testingexec.FakeExitError{Status: 2}},
+				{"mkfs.ext4", []string{"-F", "-m0", diskPath}, "", nil},
+			} {
+				fakeCmd := &testingexec.FakeCmd{}
+				cmdAction := makeFakeCmd(fakeCmd, script.command, script.args...)
+				fakeCmd.CombinedOutputScript = append(fakeCmd.CombinedOutputScript, makeFakeOutput(script.output, script.err))
+				fakeExec.CommandScript = append(fakeExec.CommandScript, cmdAction)
+			}
+			d.mounter.Exec = fakeExec
+		}
+		d.cloud = &azure.Cloud{
+			Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+		}
+		return d, fm
+	}
+	buildReq := func(protocol string) *csi.NodeStageVolumeRequest {
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "rg#f5713de20cde511e8ba4900#test_sharename",
+			StagingTargetPath: stagingPath,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+			},
+			VolumeContext: map[string]string{
+				fsTypeField:           "ext4",
+				protocolField:         protocol,
+				diskNameField:         "disk_nfs_conflict_disk",
+				createDiskField:       "true",
+				requestedSizeGiBField: "1",
+				shareNameField:        "test_sharename",
+				serverNameField:       "test_servername",
+			},
+			Secrets: map[string]string{"accountname": "k8s", "accountkey": "testkey"},
+		}
+	}
+
+	// disk-mode fields together with nfs are contradictory, nothing is mounted
+	d, fm := buildDriver(false)
+	_, err := d.NodeStageVolume(context.Background(), buildReq(nfs))
+	if assert.Error(t, err) {
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		assert.Contains(t, err.Error(), "disk-mode")
+	}
+	assert.Empty(t, fm.MountPoints)
+
+	// the same disk-mode volume over smb is valid
+	d, fm = buildDriver(true)
+	_, err = d.NodeStageVolume(context.Background(), buildReq(smb))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, fm.MountPoints)
+
+	assert.NoError(t, os.RemoveAll(stagingPath))
+	assert.NoError(t, os.RemoveAll(proxyPath))
+}
+
+func TestNodeStageVolumeCredentialRefresh(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+
+	refreshTarget := "./false_is_likely_refresh_target"
+	fallbackTarget := "./false_is_likely_error_remount_target"
+
+	// simulate an existing mount that no longer passes authentication
+	origProbe := probeMountAuth
+	probeMountAuth = func(string) error {
+		return fmt.Errorf("mount error(13): Permission denied")
+	}
+	defer func() { probeMountAuth = origProbe }()
+
+	buildDriver := func() (*Driver, *fakeMounter) {
+		d := NewFakeDriver()
+		d.enableCredentialRefresh = true
+		fakeMounter := &fakeMounter{}
+		d.mounter = &mount.SafeFormatAndMount{
+			Interface: fakeMounter,
+		}
+		d.cloud = &azure.Cloud{
+			Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+		}
+		return d, fakeMounter
+	}
+	buildReq := func(target string) *csi.NodeStageVolumeRequest {
+		return &csi.NodeStageVolumeRequest{
+			VolumeId:          "vol_1#f5713de20cde511e8ba4900#test_sharename",
+			StagingTargetPath: target,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+			},
+			VolumeContext: map[string]string{
+				shareNameField:  "test_sharename",
+				serverNameField: "test_servername",
+			},
+			Secrets: map[string]string{"accountname": "k8s", "accountkey": "testkey"},
+		}
+	}
+
+	// the rotated key is applied with an in-place remount
+	assert.NoError(t, makeDir(refreshTarget))
+	d, fm := buildDriver()
+	_, err := d.NodeStageVolume(context.Background(), buildReq(refreshTarget))
+	assert.NoError(t, err)
+	if assert.Len(t, fm.MountPoints, 1) {
+		assert.Contains(t, fm.MountPoints[0].Opts, "remount")
+	}
+	assert.NoError(t, os.RemoveAll(refreshTarget))
+
+	// the in-place remount fails, the refresh falls back to unmount and mount
+	assert.NoError(t, makeDir(fallbackTarget))
+	d, fm = buildDriver()
+	_, err = d.NodeStageVolume(context.Background(), buildReq(fallbackTarget))
+	assert.NoError(t, err)
+	if assert.Len(t, fm.MountPoints, 1) {
+		assert.NotContains(t, fm.MountPoints[0].Opts, "remount")
+	}
+	assert.NoError(t, os.RemoveAll(fallbackTarget))
+}
+
+func TestResolveFsType(t *testing.T) {
+	d := NewFakeDriver()
+	d.defaultDiskFsType = ext4
+
+	tests := []struct {
+		desc     string
+		fsType   string
+		diskName string
+		expected string
+	}{
+		{
+			desc:     "default applied to disk-mode volume without fsType",
+			diskName: "diskname.vhd",
+			expected: ext4,
+		},
+		{
+			desc:     "explicit fsType wins over the default",
+			fsType:   xfs,
+			diskName: "diskname.vhd",
+			expected: xfs,
+		},
+		{
+			desc:     "share mount never gets a filesystem forced",
+			expected: "",
+		},
+	}
+
+	for _, test := range tests {
+		result := d.resolveFsType(test.fsType, test.diskName)
+		if result != test.expected {
+			t.Errorf("test(%s): got(%s), expected(%s)", test.desc, result, test.expected)
+		}
+	}
+
+	// without a configured default the fsType stays empty for disk-mode volumes
+	d.defaultDiskFsType = ""
+	assert.Equal(t, "", d.resolveFsType("", "diskname.vhd"))
+}
+
+func TestNodeStageVolumeDefaultFsTypeShareMount(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+	d := NewFakeDriver()
+	d.defaultDiskFsType = ext4
+	fakeMounter := &fakeMounter{}
+	d.mounter = &mount.SafeFormatAndMount{
+		Interface: fakeMounter,
+	}
+	d.cloud = &azure.Cloud{
+		Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+	}
+
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol_1#f5713de20cde511e8ba4900#test_sharename",
+		StagingTargetPath: targetTest,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{},
+			},
+		},
+		VolumeContext: map[string]string{
+			shareNameField:  "test_sharename",
+			serverNameField: "test_servername",
+		},
+		Secrets: map[string]string{"accountname": "k8s", "accountkey": "testkey"},
+	}
+
+	// the disk-mode default must not turn a plain share mount into a disk mount
+	_, err := d.NodeStageVolume(context.Background(), req)
+	assert.NoError(t, err)
+	if assert.Len(t, fakeMounter.MountPoints, 1) {
+		assert.Equal(t, "cifs", fakeMounter.MountPoints[0].Type)
+	}
+
+	// Clean up
+	assert.NoError(t, os.RemoveAll(targetTest))
+}
+
+func TestValidateMountOptions(t *testing.T) {
+	tests := []struct {
+		desc        string
+		mountFlags  []string
+		expectedErr error
+	}{
+		{
+			desc:        "no mount options",
+			mountFlags:  nil,
+			expectedErr: nil,
+		},
+		{
+			desc:        "all options valid",
+			mountFlags:  []string{"nostrictsync", "actimeo=30", "dir_mode=0777,file_mode=0777"},
+			expectedErr: nil,
+		},
+		{
+			desc:        "one bad option among several good ones",
+			mountFlags:  []string{"nostrictsync", "actimeo=", "vers=3.0"},
+			expectedErr: fmt.Errorf("invalid mount options [\"actimeo=\"], each option must be a flag or a key=value pair"),
+		},
+		{
+			desc:        "bad option inside a comma-separated entry",
+			mountFlags:  []string{"dir_mode=0777,=0777", "nostrictsync"},
+			expectedErr: fmt.Errorf("invalid mount options [\"=0777\"], each option must be a flag or a key=value pair"),
+		},
+		{
+			desc:        "multiple bad options aggregated",
+			mountFlags:  []string{"actimeo=", "vers=3.0=1", "nostrictsync"},
+			expectedErr: fmt.Errorf("invalid mount options [\"actimeo=\" \"vers=3.0=1\"], each option must be a flag or a key=value pair"),
+		},
+	}
+
+	for _, test := range tests {
+		err := validateMountOptions(test.mountFlags)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test(%s): got(%v), expected(%v)", test.desc, err, test.expectedErr)
+		}
+	}
+}
+
+func TestNodeStageVolumeMalformedMountOptions(t *testing.T) {
+	d := NewFakeDriver()
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol_1#f5713de20cde511e8ba4900#test_sharename",
+		StagingTargetPath: targetTest,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{
+					MountFlags: []string{"nostrictsync", "actimeo=", "vers=3.0"},
+				},
+			},
+		},
+		Secrets: map[string]string{"accountname": "k8s", "accountkey": "testkey"},
+	}
+
+	_, err := d.NodeStageVolume(context.Background(), req)
+	if assert.Error(t, err) {
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		assert.Contains(t, err.Error(), "\"actimeo=\"")
+		assert.NotContains(t, err.Error(), "nostrictsync")
+	}
+}
+
+func TestMountWithProgress(t *testing.T) {
+	var buf bytes.Buffer
+	klog.LogToStderr(false)
+	klog.SetOutput(&buf)
+	defer func() {
+		klog.SetOutput(os.Stderr)
+		klog.LogToStderr(true)
+	}()
+
+	// a slow mount emits heartbeats while it is still running
+	err := mountWithProgress("vol_1", "//source", "/target", 10*time.Millisecond, func() error {
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	})
+	assert.NoError(t, err)
+	klog.Flush()
+	assert.Contains(t, buf.String(), "volume(vol_1) still mounting \"//source\" on \"/target\" after")
+
+	// a fast mount completes without emitting a heartbeat
+	buf.Reset()
+	err = mountWithProgress("vol_1", "//source", "/target", 10*time.Second, func() error {
+		return nil
+	})
+	assert.NoError(t, err)
+	klog.Flush()
+	assert.NotContains(t, buf.String(), "still mounting")
+}
+
+func TestMergeMountOptions(t *testing.T) {
+	tests := []struct {
+		desc     string
+		base     []string
+		override []string
+		expected []string
+	}{
+		{
+			desc:     "empty base",
+			override: []string{"nostrictsync"},
+			expected: []string{"nostrictsync"},
+		},
+		{
+			desc:     "no overlapping keys",
+			base:     []string{"nostrictsync", "actimeo=30"},
+			override: []string{"vers=3.0"},
+			expected: []string{"nostrictsync", "actimeo=30", "vers=3.0"},
+		},
+		{
+			desc:     "per-volume option wins on conflicting key",
+			base:     []string{"actimeo=30", "vers=2.1"},
+			override: []string{"vers=3.0"},
+			expected: []string{"actimeo=30", "vers=3.0"},
+		},
+	}
+
+	for _, test := range tests {
+		result := mergeMountOptions(test.base, test.override)
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("test[%s]: got %v, expected %v", test.desc, result, test.expected)
+		}
+	}
+}
+
+func TestLoadMountProfiles(t *testing.T) {
+	profileFile := testutil.GetWorkDirPath("mount_profiles_test.yaml", t)
+	content := []byte("vetted: [\"nostrictsync\", \"actimeo=30\"]\nempty: []\n")
+	if err := ioutil.WriteFile(profileFile, content, 0644); err != nil {
+		t.Fatalf("could not write profile file: %v", err)
+	}
+	defer os.Remove(profileFile)
+
+	profiles, err := loadMountProfiles(profileFile)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"vetted": {"nostrictsync", "actimeo=30"}, "empty": {}}, profiles)
+
+	_, err = loadMountProfiles(testutil.GetWorkDirPath("not_exist_profiles.yaml", t))
+	assert.Error(t, err)
+}
+
+func TestNodeStageVolumeUnknownMountProfile(t *testing.T) {
+	stdVolCap := csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+	}
+	req := csi.NodeStageVolumeRequest{
+		VolumeId:          "rg#f5713de20cde511e8ba4900#test_sharename",
+		StagingTargetPath: targetTest,
+		VolumeCapability:  &stdVolCap,
+		VolumeContext: map[string]string{
+			shareNameField:    "test_sharename",
+			serverNameField:   "test_servername",
+			mountProfileField: "not-defined",
+		},
+		Secrets: map[string]string{"accountname": "k8s", "accountkey": "testkey"},
+	}
+
+	d := NewFakeDriver()
+	d.mountProfiles = map[string][]string{"vetted": {"nostrictsync"}}
+	d.cloud = &azure.Cloud{
+		Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+	}
+
+	_, err := d.NodeStageVolume(context.Background(), &req)
+	expectedErr := status.Error(codes.InvalidArgument, fmt.Sprintf("mount profile(not-defined) referenced by volume(%s) is not defined", req.VolumeId))
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("Unexpected error: %v, expected error: %v", err, expectedErr)
+	}
+}
+
+func TestNodeStageVolumeRequireSecrets(t *testing.T) {
+	stdVolCap := csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+	}
+	stagingTarget := testutil.GetWorkDirPath("staging_target_test", t)
+	volContext := map[string]string{
+		shareNameField:  "test_sharename",
+		serverNameField: "test_servername",
+	}
+	req := csi.NodeStageVolumeRequest{
+		VolumeId:          "rg#f5713de20cde511e8ba4900#test_sharename",
+		StagingTargetPath: stagingTarget,
+		VolumeCapability:  &stdVolCap,
+		VolumeContext:     volContext,
+	}
+
+	// secrets required: empty secrets are a hard error
+	d := NewFakeDriver()
+	d.requireSecrets = true
+	d.cloud = &azure.Cloud{
+		Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+	}
+	_, err := d.NodeStageVolume(context.Background(), &req)
+	expectedErr := status.Error(codes.InvalidArgument, fmt.Sprintf("no secrets provided for volume(%s) while secrets are required", req.VolumeId))
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("Unexpected error: %v, expected error: %v", err, expectedErr)
+	}
+
+	if runtime.GOOS != "windows" && runtime.GOOS != "darwin" {
+		// secrets not required: the account key is fetched via the cluster identity
+		d = NewFakeDriver()
+		d.cloud = &azure.Cloud{
+			Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+		}
+		d.mounter = &mount.SafeFormatAndMount{
+			Interface: &fakeMounter{},
+			Exec:      &testingexec.FakeExec{},
+		}
+
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		key := "test-key"
+		keys := storage.AccountListKeysResult{
+			Keys: &[]storage.AccountKey{
+				{Value: &key},
+			},
+		}
+		mockStorageAccountsClient := mockstorageaccountclient.NewMockInterface(ctrl)
+		d.cloud.StorageAccountClient = mockStorageAccountsClient
+		mockStorageAccountsClient.EXPECT().ListKeys(gomock.Any(), gomock.Any(), "f5713de20cde511e8ba4900").Return(keys, nil).Times(1)
+
+		_, err = d.NodeStageVolume(context.Background(), &req)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	}
+
+	// Clean up
+	assert.NoError(t, os.RemoveAll(stagingTarget))
+}
+
+func TestNodeUnstageVolume(t *testing.T) {
+	var (
+		errorTarget = testutil.GetWorkDirPath("error_is_likely_target", t)
+		targetFile  = testutil.GetWorkDirPath("abc.go", t)
+	)
+
+	tests := []struct {
+		desc         string
+		req          csi.NodeUnstageVolumeRequest
+		skipOnDarwin bool
+		expectedErr  testutil.TestError
+	}{
+		{
+			desc: "[Error] Volume ID missing",
+			req:  csi.NodeUnstageVolumeRequest{StagingTargetPath: targetTest},
+			expectedErr: testutil.TestError{
+				DefaultError: status.Error(codes.InvalidArgument, "Volume ID missing in request"),
+			},
+		},
+		{
+			desc: "[Error] Target missing",
+			req:  csi.NodeUnstageVolumeRequest{VolumeId: "vol_1"},
+			expectedErr: testutil.TestError{
+				DefaultError: status.Error(codes.InvalidArgument, "Staging target not provided"),
+			},
+		},
+		{
+			desc:         "[Error] CleanupMountPoint error mocked by IsLikelyNotMountPoint",
+			req:          csi.NodeUnstageVolumeRequest{StagingTargetPath: errorTarget, VolumeId: "vol_1"},
+			skipOnDarwin: true,
+			expectedErr: testutil.TestError{
+				DefaultError: status.Error(codes.Internal, fmt.Sprintf("failed to unmount staging target %#v: fake IsLikelyNotMountPoint: fake error", errorTarget)),
+				WindowsError: status.Error(codes.Internal, fmt.Sprintf("failed to unmount staging target %#v: could not cast to csi proxy class", errorTarget)),
+			},
+		},
+		{
+			desc: "[Success] Valid request",
+			req:  csi.NodeUnstageVolumeRequest{StagingTargetPath: targetFile, VolumeId: "vol_1"},
+			expectedErr: testutil.TestError{
+				WindowsError: status.Error(codes.Internal, fmt.Sprintf("failed to unmount staging target %#v: could not cast to csi proxy class", targetFile)),
+			},
+		},
+	}
+
+	// Setup
+	_ = makeDir(errorTarget)
+	d := NewFakeDriver()
+	fakeMounter := &fakeMounter{}
+	fakeExec := &testingexec.FakeExec{ExactOrder: true}
+	d.mounter = &mount.SafeFormatAndMount{
+		Interface: fakeMounter,
+		Exec:      fakeExec,
+	}
+
+	for _, test := range tests {
+		if test.skipOnDarwin && runtime.GOOS == "darwin" {
+			continue
+		}
+		_, err := d.NodeUnstageVolume(context.Background(), &test.req)
+		if !testutil.AssertError(err, &test.expectedErr) {
+			t.Errorf("Desc: %v\nUnexcpected error: %v\nExpected: %v", test.desc, err, test.expectedErr.GetExpectedError())
+		}
+	}
+
+	// Clean up
+	err := os.RemoveAll(errorTarget)
+	assert.NoError(t, err)
+}
+
+func TestNodeUnstageVolumeUnmountTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+	target := testutil.GetWorkDirPath("false_is_likely_hang_unmount", t)
+	_ = makeDir(target)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(target))
+	}()
+
+	d := NewFakeDriver()
+	d.unmountTimeout = 50 * time.Millisecond
+	d.mounter = &mount.SafeFormatAndMount{
+		Interface: &fakeMounter{},
+	}
+
+	originalLazyUnmount := lazyUnmount
+	defer func() { lazyUnmount = originalLazyUnmount }()
+	lazyCalls := 0
+	lazyUnmount = func(target string) error {
+		lazyCalls++
+		return nil
+	}
+
+	req := &csi.NodeUnstageVolumeRequest{VolumeId: "vol_1", StagingTargetPath: target}
+
+	// the blocked unmount is abandoned after the timeout and the lazy
+	// fallback lets the unstage finish
+	_, err := d.NodeUnstageVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, lazyCalls)
+
+	// a failing lazy fallback surfaces as an internal error
+	lazyUnmount = func(target string) error {
+		return fmt.Errorf("device is busy")
+	}
+	_, err = d.NodeUnstageVolume(context.Background(), req)
+	if assert.Error(t, err) {
+		assert.Equal(t, codes.Internal, status.Code(err))
+		assert.Contains(t, err.Error(), "timed out after")
+	}
+}
 
 func TestNodeGetVolumeStats(t *testing.T) {
 	nonexistedPath := "/not/a/real/directory"
@@ -611,11 +3257,167 @@ func TestNodeGetVolumeStats(t *testing.T) {
 	d := NewFakeDriver()
 
 	for _, test := range tests {
-		_, err := d.NodeGetVolumeStats(context.Background(), &test.req)
+		resp, err := d.NodeGetVolumeStats(context.Background(), &test.req)
 		//t.Errorf("[debug] error: %v\n metrics: %v", err, metrics)
 		if !reflect.DeepEqual(err, test.expectedErr) {
 			t.Errorf("desc: %v, expected error: %v, actual error: %v", test.desc, test.expectedErr, err)
 		}
+		if err == nil && test.expectedErr == nil && runtime.GOOS == "linux" {
+			// statfs backed platforms report byte and inode usage
+			if assert.Len(t, resp.Usage, 2, test.desc) {
+				assert.Equal(t, csi.VolumeUsage_BYTES, resp.Usage[0].Unit, test.desc)
+				assert.Equal(t, csi.VolumeUsage_INODES, resp.Usage[1].Unit, test.desc)
+			}
+		}
+	}
+
+	// Clean up
+	err := os.RemoveAll(fakePath)
+	assert.NoError(t, err)
+}
+
+func TestNodeGetVolumeStatsCache(t *testing.T) {
+	fakePath := "/tmp/fake-stats-cache-volume-path"
+	_ = makeDir(fakePath)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(fakePath))
+	}()
+
+	d := NewFakeDriver()
+	d.volumeStatsCacheTTL = 200 * time.Millisecond
+
+	originalGetVolumeMetrics := getVolumeMetrics
+	defer func() { getVolumeMetrics = originalGetVolumeMetrics }()
+	probes := int32(0)
+	getVolumeMetrics = func(path string) (*volume.Metrics, error) {
+		atomic.AddInt32(&probes, 1)
+		return originalGetVolumeMetrics(path)
+	}
+
+	req := &csi.NodeGetVolumeStatsRequest{VolumeId: "vol_1", VolumePath: fakePath}
+
+	// the second call within the TTL is served from the cache
+	resp1, err := d.NodeGetVolumeStats(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&probes))
+	resp2, err := d.NodeGetVolumeStats(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&probes))
+	assert.Equal(t, resp1.Usage, resp2.Usage)
+
+	// after the TTL the statistics are recomputed
+	time.Sleep(250 * time.Millisecond)
+	_, err = d.NodeGetVolumeStats(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&probes))
+
+	// concurrent callers for the same path coalesce onto one probe
+	d = NewFakeDriver()
+	d.volumeStatsCacheTTL = 200 * time.Millisecond
+	atomic.StoreInt32(&probes, 0)
+	getVolumeMetrics = func(path string) (*volume.Metrics, error) {
+		atomic.AddInt32(&probes, 1)
+		time.Sleep(50 * time.Millisecond)
+		return originalGetVolumeMetrics(path)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := d.NodeGetVolumeStats(context.Background(), req)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&probes))
+}
+
+func TestNodeGetVolumeStatsNotMounted(t *testing.T) {
+	notMountedPath := "/tmp/fake-not-mounted-volume-path"
+	mountedPath := "/tmp/false_is_likely_mounted-volume-path"
+
+	// Setup
+	_ = makeDir(notMountedPath)
+	_ = makeDir(mountedPath)
+	d := NewFakeDriver()
+	d.mounter = &mount.SafeFormatAndMount{
+		Interface: &fakeMounter{},
+	}
+
+	// an existing path that is not a mount point must not report stats of the
+	// underlying filesystem
+	_, err := d.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumePath: notMountedPath, VolumeId: "vol_1"})
+	expectedErr := status.Errorf(codes.Internal, "volume path %s exists but is not a mount point, refusing to report stats of the underlying filesystem", notMountedPath)
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("expected error: %v, actual error: %v", expectedErr, err)
+	}
+
+	// a mounted path still reports stats
+	_, err = d.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumePath: mountedPath, VolumeId: "vol_1"})
+	assert.NoError(t, err)
+
+	// a missing path still reports NotFound
+	_, err = d.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumePath: "/not/a/real/directory", VolumeId: "vol_1"})
+	expectedErr = status.Errorf(codes.NotFound, "path /not/a/real/directory does not exist")
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("expected error: %v, actual error: %v", expectedErr, err)
+	}
+
+	// Clean up
+	assert.NoError(t, os.RemoveAll(notMountedPath))
+	assert.NoError(t, os.RemoveAll(mountedPath))
+}
+
+func TestNodeGetVolumeStatsShareTierCondition(t *testing.T) {
+	fakePath := "/tmp/fake-tier-volume-path"
+
+	tests := []struct {
+		desc            string
+		shareTier       string
+		expectedMessage string
+	}{
+		{
+			desc:            "[Success] Cool tier share produces an informational condition",
+			shareTier:       "cool",
+			expectedMessage: "share is on the cool tier, reads may observe higher first-byte latency",
+		},
+		{
+			desc:      "[Success] Hot tier share produces no condition",
+			shareTier: "hot",
+		},
+		{
+			desc: "[Success] Unknown tier produces no condition",
+		},
+	}
+
+	// Setup
+	_ = makeDir(fakePath)
+	d := NewFakeDriver()
+
+	for _, test := range tests {
+		d.recordVolumeTier("vol_1", test.shareTier)
+		resp, err := d.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumePath: fakePath, VolumeId: "vol_1"})
+		if err != nil {
+			t.Errorf("desc: %v, unexpected error: %v", test.desc, err)
+			continue
+		}
+		if test.expectedMessage == "" {
+			if resp.VolumeCondition != nil {
+				t.Errorf("desc: %v, expected no volume condition, got: %v", test.desc, resp.VolumeCondition)
+			}
+			continue
+		}
+		if resp.VolumeCondition == nil {
+			t.Errorf("desc: %v, expected a volume condition, got none", test.desc)
+			continue
+		}
+		if resp.VolumeCondition.Abnormal {
+			t.Errorf("desc: %v, condition should not be abnormal", test.desc)
+		}
+		if resp.VolumeCondition.Message != test.expectedMessage {
+			t.Errorf("desc: %v, expected message: %q, actual message: %q", test.desc, test.expectedMessage, resp.VolumeCondition.Message)
+		}
 	}
 
 	// Clean up
@@ -623,6 +3425,127 @@ func TestNodeGetVolumeStats(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestNodeGetVolumeStatsStaleMountGracePeriod(t *testing.T) {
+	fakePath := "/tmp/fake-stale-volume-path"
+	_ = makeDir(fakePath)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(fakePath))
+	}()
+
+	d := NewFakeDriver()
+	d.staleMountProbeThreshold = 2
+
+	originalGetVolumeMetrics := getVolumeMetrics
+	defer func() { getVolumeMetrics = originalGetVolumeMetrics }()
+	failingProbe := func(path string) (*volume.Metrics, error) {
+		return nil, fmt.Errorf("stale file handle")
+	}
+	getVolumeMetrics = failingProbe
+
+	req := &csi.NodeGetVolumeStatsRequest{VolumeId: "vol_1", VolumePath: fakePath}
+
+	// a single transient failure stays within the grace period
+	resp, err := d.NodeGetVolumeStats(context.Background(), req)
+	assert.NoError(t, err)
+	if assert.NotNil(t, resp.VolumeCondition) {
+		assert.False(t, resp.VolumeCondition.Abnormal)
+		assert.Contains(t, resp.VolumeCondition.Message, "transiently")
+	}
+
+	// a second consecutive failure crosses the threshold
+	resp, err = d.NodeGetVolumeStats(context.Background(), req)
+	assert.NoError(t, err)
+	if assert.NotNil(t, resp.VolumeCondition) {
+		assert.True(t, resp.VolumeCondition.Abnormal)
+		assert.Contains(t, resp.VolumeCondition.Message, "stale")
+	}
+
+	// a successful probe resets the failure history
+	getVolumeMetrics = originalGetVolumeMetrics
+	resp, err = d.NodeGetVolumeStats(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Nil(t, resp.VolumeCondition)
+
+	getVolumeMetrics = failingProbe
+	resp, err = d.NodeGetVolumeStats(context.Background(), req)
+	assert.NoError(t, err)
+	if assert.NotNil(t, resp.VolumeCondition) {
+		assert.False(t, resp.VolumeCondition.Abnormal)
+	}
+}
+
+func TestLastMountTimestamps(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+	d := NewFakeDriver()
+	fakeMounter := &fakeMounter{}
+	d.mounter = &mount.SafeFormatAndMount{
+		Interface: fakeMounter,
+	}
+	d.cloud = &azure.Cloud{
+		Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+	}
+
+	volumeID := "vol_1#f5713de20cde511e8ba4900#test_sharename"
+	assert.True(t, d.lastMountTime(volumeID).IsZero())
+
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: targetTest,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{},
+			},
+		},
+		VolumeContext: map[string]string{
+			shareNameField:  "test_sharename",
+			serverNameField: "test_servername",
+		},
+		Secrets: map[string]string{"accountname": "k8s", "accountkey": "testkey"},
+	}
+	_, err := d.NodeStageVolume(context.Background(), req)
+	assert.NoError(t, err)
+	stagedAt := d.lastMountTime(volumeID)
+	assert.False(t, stagedAt.IsZero(), "a successful stage must record a mount timestamp")
+
+	// a successful health probe refreshes the timestamp, the probe path must
+	// register as a mount point with the fake mounter
+	fakePath := "/tmp/false_is_likely_mount-time-volume-path"
+	_ = makeDir(fakePath)
+	defer func() {
+		assert.NoError(t, os.RemoveAll(fakePath))
+	}()
+	backdated := time.Now().Add(-time.Hour)
+	d.lastMountTimes[volumeID] = backdated
+	_, err = d.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: volumeID, VolumePath: fakePath})
+	assert.NoError(t, err)
+	assert.True(t, d.lastMountTime(volumeID).After(backdated), "a successful probe must refresh the mount timestamp")
+
+	// a failed probe keeps the last known good timestamp
+	refreshed := d.lastMountTime(volumeID)
+	originalGetVolumeMetrics := getVolumeMetrics
+	defer func() { getVolumeMetrics = originalGetVolumeMetrics }()
+	getVolumeMetrics = func(path string) (*volume.Metrics, error) {
+		return nil, fmt.Errorf("stale file handle")
+	}
+	_, err = d.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{VolumeId: volumeID, VolumePath: fakePath})
+	assert.NoError(t, err)
+	assert.Equal(t, refreshed, d.lastMountTime(volumeID))
+
+	// the record is visible in the debug state and dropped on unstage
+	assert.Contains(t, d.dumpDebugState().LastMountTimes, volumeID)
+	_, err = d.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: targetTest,
+	})
+	assert.NoError(t, err)
+	assert.True(t, d.lastMountTime(volumeID).IsZero())
+
+	// Clean up
+	assert.NoError(t, os.RemoveAll(targetTest))
+}
+
 func TestEnsureMountPoint(t *testing.T) {
 	errorTarget := "./error_is_likely_target"
 	alreadyExistTarget := "./false_is_likely_exist_target"
@@ -702,12 +3625,135 @@ func TestMakeDir(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestGetUsernameOverride(t *testing.T) {
+	tests := []struct {
+		desc        string
+		secrets     map[string]string
+		context     map[string]string
+		expected    string
+		expectedErr error
+	}{
+		{
+			desc:     "no override set, default derivation applies",
+			secrets:  map[string]string{"accountname": "k8s", "accountkey": "testkey"},
+			context:  map[string]string{shareNameField: "test_sharename"},
+			expected: "",
+		},
+		{
+			desc:     "username from secrets",
+			secrets:  map[string]string{"accountname": "k8s", "accountkey": "testkey", "username": "DOMAIN\\user"},
+			expected: "DOMAIN\\user",
+		},
+		{
+			desc:     "username from volume context",
+			context:  map[string]string{usernameField: "user@contoso.com"},
+			expected: "user@contoso.com",
+		},
+		{
+			desc:     "volume context takes precedence over secrets",
+			secrets:  map[string]string{"username": "DOMAIN\\user"},
+			context:  map[string]string{usernameField: "user@contoso.com"},
+			expected: "user@contoso.com",
+		},
+		{
+			desc:        "empty username is rejected",
+			context:     map[string]string{usernameField: " "},
+			expectedErr: fmt.Errorf("username field is set but empty"),
+		},
+	}
+
+	for _, test := range tests {
+		result, err := getUsernameOverride(test.secrets, test.context)
+		if !reflect.DeepEqual(err, test.expectedErr) {
+			t.Errorf("test[%s]: unexpected error: %v, expected error: %v", test.desc, err, test.expectedErr)
+		}
+		if result != test.expected {
+			t.Errorf("test[%s]: got %q, expected %q", test.desc, result, test.expected)
+		}
+	}
+}
+
 func TestNodeExpandVolume(t *testing.T) {
 	d := NewFakeDriver()
+
+	// volume ID missing
 	req := csi.NodeExpandVolumeRequest{}
 	resp, err := d.NodeExpandVolume(context.Background(), &req)
 	assert.Nil(t, resp)
-	if !reflect.DeepEqual(err, status.Error(codes.Unimplemented, "")) {
+	if !reflect.DeepEqual(err, status.Error(codes.InvalidArgument, "Volume ID missing in request")) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// volume path missing
+	req = csi.NodeExpandVolumeRequest{VolumeId: "vol_1#f5713de20cde511e8ba4900#filename"}
+	resp, err = d.NodeExpandVolume(context.Background(), &req)
+	assert.Nil(t, resp)
+	if !reflect.DeepEqual(err, status.Error(codes.InvalidArgument, "Volume path missing in request")) {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// a share mode volume needs no node side resize, the requested capacity is
+	// confirmed as is
+	stdCapacityRange := &csi.CapacityRange{RequiredBytes: int64(10 * 1024 * 1024 * 1024)}
+	req = csi.NodeExpandVolumeRequest{
+		VolumeId:      "vol_1#f5713de20cde511e8ba4900#filename",
+		VolumePath:    targetTest,
+		CapacityRange: stdCapacityRange,
+	}
+	resp, err = d.NodeExpandVolume(context.Background(), &req)
+	assert.NoError(t, err)
+	assert.NotNil(t, resp)
+	assert.Equal(t, stdCapacityRange.RequiredBytes, resp.CapacityBytes)
+
+	if runtime.GOOS != "linux" {
+		// the disk mode paths below drive the linux blkid/resize tooling
+		return
+	}
+
+	diskReq := csi.NodeExpandVolumeRequest{
+		VolumeId:      "vol_1#f5713de20cde511e8ba4900#filename#diskname.vhd",
+		VolumePath:    targetTest,
+		CapacityRange: stdCapacityRange,
+	}
+	diskPath := filepath.Join(d.proxyMountPathForTarget(targetTest), "diskname.vhd")
+	buildMounter := func(scripts []ExecArgs) *mount.SafeFormatAndMount {
+		fakeExec := &testingexec.FakeExec{ExactOrder: true}
+		for _, script := range scripts {
+			fakeCmd := &testingexec.FakeCmd{}
+			cmdAction := makeFakeCmd(fakeCmd, script.command, script.args...)
+			fakeCmd.CombinedOutputScript = append(fakeCmd.CombinedOutputScript, makeFakeOutput(script.output, script.err))
+			fakeExec.CommandScript = append(fakeExec.CommandScript, cmdAction)
+		}
+		return &mount.SafeFormatAndMount{Interface: &fakeMounter{}, Exec: fakeExec}
+	}
+
+	// an ext4 disk is grown through resize2fs on the vhd under the proxy mount
+	d.mounter = buildMounter([]ExecArgs{
+		{"blkid", []string{"-p", "-s", "TYPE", "-s", "PTTYPE", "-o", "export", diskPath}, "TYPE=ext4\n", nil},
+		{"resize2fs", []string{diskPath}, "", nil},
+	})
+	resp, err = d.NodeExpandVolume(context.Background(), &diskReq)
+	assert.NoError(t, err)
+	assert.NotNil(t, resp)
+	assert.Equal(t, stdCapacityRange.RequiredBytes, resp.CapacityBytes)
+
+	// an xfs disk is grown through the mounted filesystem
+	d.mounter = buildMounter([]ExecArgs{
+		{"blkid", []string{"-p", "-s", "TYPE", "-s", "PTTYPE", "-o", "export", diskPath}, "TYPE=xfs\n", nil},
+		{"xfs_growfs", []string{"-d", targetTest}, "", nil},
+	})
+	resp, err = d.NodeExpandVolume(context.Background(), &diskReq)
+	assert.NoError(t, err)
+	assert.NotNil(t, resp)
+
+	// a failing resize surfaces as an internal error
+	d.mounter = buildMounter([]ExecArgs{
+		{"blkid", []string{"-p", "-s", "TYPE", "-s", "PTTYPE", "-o", "export", diskPath}, "TYPE=ext4\n", nil},
+		{"resize2fs", []string{diskPath}, "resize2fs: bad magic number", fmt.Errorf("exit status 1")},
+	})
+	resp, err = d.NodeExpandVolume(context.Background(), &diskReq)
+	assert.Nil(t, resp)
+	if status.Code(err) != codes.Internal || !strings.Contains(err.Error(), "failed to resize ext4 filesystem") {
 		t.Errorf("Unexpected error: %v", err)
 	}
 }
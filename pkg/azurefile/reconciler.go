@@ -0,0 +1,110 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// defaultMountReconcileWorkers is the number of concurrent cleanup workers
+	// of the startup mount-leak reconciler when no count is configured
+	defaultMountReconcileWorkers = 4
+	// defaultMountReconcileBudget bounds how long the reconciler may delay
+	// startup on a node with many stale entries
+	defaultMountReconcileBudget = time.Minute
+)
+
+// collectLeakedMountCandidates returns the proxy mount points a previous
+// instance left under the configured base directory. The current instance has
+// not staged anything yet, so everything found there is a leak candidate.
+func (d *Driver) collectLeakedMountCandidates() []string {
+	if d.proxyMountBase == "" {
+		// the default proxy mounts sit beside their staging targets and are
+		// cleaned up by the kubelet driving NodeUnstageVolume
+		return nil
+	}
+	entries, err := os.ReadDir(d.proxyMountBase)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Warningf("mount reconciler: could not read %s: %v", d.proxyMountBase, err)
+		}
+		return nil
+	}
+	candidates := []string{}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		candidates = append(candidates, filepath.Join(d.proxyMountBase, entry.Name()))
+	}
+	return candidates
+}
+
+// reconcileLeakedMounts unmounts and removes the given candidate paths with a
+// bounded number of workers, stopping once the time budget is used up and
+// logging whatever could not be cleaned in time
+func (d *Driver) reconcileLeakedMounts(candidates []string) {
+	if len(candidates) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.mountReconcileBudget)
+	defer cancel()
+
+	var cleaned int32
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < d.mountReconcileWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for candidate := range work {
+				if err := CleanupMountPoint(d.mounter, candidate, false); err != nil && !isIgnorableUnmountError(err) {
+					klog.Warningf("mount reconciler: cleanup of %q failed: %v", candidate, err)
+					continue
+				}
+				atomic.AddInt32(&cleaned, 1)
+			}
+		}()
+	}
+
+	var remaining []string
+	for i, candidate := range candidates {
+		select {
+		case work <- candidate:
+		case <-ctx.Done():
+			remaining = candidates[i:]
+		}
+		if remaining != nil {
+			break
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	for _, candidate := range remaining {
+		klog.Warningf("mount reconciler: %q was not cleaned within the %v budget, it stays behind until the next restart", candidate, d.mountReconcileBudget)
+	}
+	klog.V(2).Infof("mount reconciler cleaned %d of %d leaked mount candidate(s)", atomic.LoadInt32(&cleaned), len(candidates))
+}
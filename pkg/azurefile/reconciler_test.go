@@ -0,0 +1,160 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/utils/mount"
+)
+
+// slowUnmounter delays every Unmount and records how many ran concurrently,
+// so the tests can observe the worker pool of the reconciler
+type slowUnmounter struct {
+	fakeMounter
+	delay time.Duration
+
+	lock        sync.Mutex
+	inFlight    int
+	maxInFlight int
+	unmounted   []string
+}
+
+func (s *slowUnmounter) Unmount(target string) error {
+	s.lock.Lock()
+	s.inFlight++
+	if s.inFlight > s.maxInFlight {
+		s.maxInFlight = s.inFlight
+	}
+	s.lock.Unlock()
+
+	time.Sleep(s.delay)
+
+	s.lock.Lock()
+	s.inFlight--
+	s.unmounted = append(s.unmounted, target)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *slowUnmounter) unmountCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.unmounted)
+}
+
+func TestCollectLeakedMountCandidates(t *testing.T) {
+	d := NewFakeDriver()
+
+	d.proxyMountBase = ""
+	assert.Empty(t, d.collectLeakedMountCandidates(), "no candidates expected without a configured base directory")
+
+	d.proxyMountBase = filepath.Join(t.TempDir(), "missing")
+	assert.Empty(t, d.collectLeakedMountCandidates(), "no candidates expected when the base directory does not exist")
+
+	d.proxyMountBase = t.TempDir()
+	for _, name := range []string{"proxymount-1a", "proxymount-2b"} {
+		assert.NoError(t, os.Mkdir(filepath.Join(d.proxyMountBase, name), 0755))
+	}
+	assert.NoError(t, os.WriteFile(filepath.Join(d.proxyMountBase, "stray-file"), []byte("x"), 0644))
+
+	candidates := d.collectLeakedMountCandidates()
+	assert.ElementsMatch(t, []string{
+		filepath.Join(d.proxyMountBase, "proxymount-1a"),
+		filepath.Join(d.proxyMountBase, "proxymount-2b"),
+	}, candidates, "only directories are leak candidates")
+}
+
+func TestReconcileLeakedMounts(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skipf("skip test on GOOS=%s", runtime.GOOS)
+	}
+	d := NewFakeDriver()
+	d.proxyMountBase = t.TempDir()
+	d.mounter = &mount.SafeFormatAndMount{Interface: &fakeMounter{}}
+
+	var candidates []string
+	for i := 0; i < 3; i++ {
+		candidate := filepath.Join(d.proxyMountBase, fmt.Sprintf("proxymount-%d", i))
+		assert.NoError(t, os.Mkdir(candidate, 0755))
+		candidates = append(candidates, candidate)
+	}
+
+	d.reconcileLeakedMounts(candidates)
+	for _, candidate := range candidates {
+		_, err := os.Stat(candidate)
+		assert.True(t, os.IsNotExist(err), "expected %q to be cleaned up", candidate)
+	}
+}
+
+func TestReconcileLeakedMountsConcurrency(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skipf("skip test on GOOS=%s", runtime.GOOS)
+	}
+	d := NewFakeDriver()
+	d.proxyMountBase = t.TempDir()
+	d.mountReconcileWorkers = 4
+	d.mountReconcileBudget = 30 * time.Second
+	unmounter := &slowUnmounter{delay: 100 * time.Millisecond}
+	d.mounter = &mount.SafeFormatAndMount{Interface: unmounter}
+
+	var candidates []string
+	for i := 0; i < 4; i++ {
+		// the false_is_likely marker makes the fake mounter treat the
+		// directory as a mount point, so Unmount is actually driven
+		candidate := filepath.Join(d.proxyMountBase, fmt.Sprintf("false_is_likely-%d", i))
+		assert.NoError(t, os.Mkdir(candidate, 0755))
+		candidates = append(candidates, candidate)
+	}
+
+	d.reconcileLeakedMounts(candidates)
+	assert.Equal(t, len(candidates), unmounter.unmountCount(), "every candidate should have been unmounted")
+	assert.Greater(t, unmounter.maxInFlight, 1, "candidates should have been unmounted concurrently")
+}
+
+func TestReconcileLeakedMountsBudget(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skipf("skip test on GOOS=%s", runtime.GOOS)
+	}
+	d := NewFakeDriver()
+	d.proxyMountBase = t.TempDir()
+	d.mountReconcileWorkers = 1
+	d.mountReconcileBudget = 150 * time.Millisecond
+	unmounter := &slowUnmounter{delay: 100 * time.Millisecond}
+	d.mounter = &mount.SafeFormatAndMount{Interface: unmounter}
+
+	var candidates []string
+	for i := 0; i < 10; i++ {
+		candidate := filepath.Join(d.proxyMountBase, fmt.Sprintf("false_is_likely-%d", i))
+		assert.NoError(t, os.Mkdir(candidate, 0755))
+		candidates = append(candidates, candidate)
+	}
+
+	start := time.Now()
+	d.reconcileLeakedMounts(candidates)
+	elapsed := time.Since(start)
+
+	assert.Less(t, unmounter.unmountCount(), len(candidates), "the budget should have stopped the reconciler early")
+	assert.True(t, elapsed < 2*time.Second, "the reconciler should return shortly after the budget is spent, took %v", elapsed)
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// testMountRequest describes the share a test mount should validate, the
+// volume context and secrets take the same shape as in NodeStageVolume
+type testMountRequest struct {
+	VolumeContext map[string]string `json:"volumeContext"`
+	Secrets       map[string]string `json:"secrets"`
+}
+
+// testMountResult reports the outcome of a test mount, the diagnostic is
+// sanitized and never contains an account key
+type testMountResult struct {
+	Success    bool   `json:"success"`
+	Diagnostic string `json:"diagnostic"`
+}
+
+// runTestMount mounts the described share at a fresh temporary directory and
+// unmounts it again right away, so operators can validate credentials and
+// connectivity before any workload references the share
+func (d *Driver) runTestMount(volumeContext, secrets map[string]string) testMountResult {
+	_, accountName, accountKey, fileShareName, _, err := d.GetAccountInfo("", secrets, volumeContext)
+	if err != nil {
+		return testMountResult{Diagnostic: sanitizeDiagnostic(fmt.Sprintf("could not resolve the account info: %v", err), accountKey)}
+	}
+	if accountName == "" || fileShareName == "" {
+		return testMountResult{Diagnostic: "the volume context must provide an account name and a share name"}
+	}
+
+	var protocol, server string
+	for k, v := range volumeContext {
+		switch strings.ToLower(k) {
+		case protocolField:
+			protocol = v
+		case serverNameField:
+			server = v
+		}
+	}
+	if protocol, err = normalizeProtocol(protocol); err != nil {
+		return testMountResult{Diagnostic: err.Error()}
+	}
+	if strings.TrimSpace(server) == "" {
+		server = fmt.Sprintf("%s.file.%s", accountName, d.cloud.Environment.StorageEndpointSuffix)
+	}
+
+	target, err := ioutil.TempDir("", "azurefile-test-mount")
+	if err != nil {
+		return testMountResult{Diagnostic: fmt.Sprintf("could not create a temporary mount point: %v", err)}
+	}
+	defer os.RemoveAll(target)
+
+	var source, mountFsType string
+	var mountOptions, sensitiveMountOptions []string
+	if protocol == nfs {
+		source = fmt.Sprintf("%s:/%s/%s", server, accountName, fileShareName)
+		mountFsType = nfs
+		mountOptions = d.defaultMountOptionsForProtocol(nfs)
+	} else {
+		osSeparator := string(os.PathSeparator)
+		source = fmt.Sprintf("%s%s%s%s%s", osSeparator, osSeparator, server, osSeparator, fileShareName)
+		mountFsType = cifs
+		mountOptions = appendDefaultMountOptions(nil, d.defaultMountOptionsForProtocol(smb))
+		sensitiveMountOptions = []string{fmt.Sprintf("username=%s,password=%s", accountName, accountKey)}
+	}
+
+	if err := SMBMount(d.mounter, source, target, mountFsType, mountOptions, sensitiveMountOptions); err != nil {
+		return testMountResult{Diagnostic: sanitizeDiagnostic(fmt.Sprintf("mount of %q failed: %v", source, err), accountKey)}
+	}
+	if err := CleanupSMBMountPoint(d.mounter, target, false); err != nil {
+		klog.Warningf("test mount: unmount of %q failed: %v", target, err)
+	}
+	return testMountResult{Success: true, Diagnostic: fmt.Sprintf("share %q mounted and unmounted successfully", source)}
+}
+
+// sanitizeDiagnostic masks the account key wherever an underlying error
+// message leaked it
+func sanitizeDiagnostic(diagnostic, accountKey string) string {
+	if accountKey == "" {
+		return diagnostic
+	}
+	return strings.ReplaceAll(diagnostic, accountKey, "****")
+}
+
+// handleTestMount serves the /debug/test-mount endpoint
+func (d *Driver) handleTestMount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req testMountRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "malformed test mount request: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(d.runTestMount(req.VolumeContext, req.Secrets)); err != nil {
+		klog.Warningf("failed to encode test mount result: %v", err)
+	}
+}
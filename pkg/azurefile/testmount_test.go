@@ -0,0 +1,107 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package azurefile
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	azure2 "github.com/Azure/go-autorest/autorest/azure"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/utils/mount"
+
+	azure "sigs.k8s.io/cloud-provider-azure/pkg/provider"
+)
+
+func newTestMountDriver() *Driver {
+	d := NewFakeDriver()
+	d.mounter = &mount.SafeFormatAndMount{
+		Interface: &fakeMounter{},
+	}
+	d.cloud = &azure.Cloud{
+		Environment: azure2.Environment{StorageEndpointSuffix: "test_suffix"},
+	}
+	return d
+}
+
+func TestRunTestMount(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+
+	volumeContext := map[string]string{
+		shareNameField:  "test_sharename",
+		serverNameField: "test_servername",
+	}
+
+	// a reachable share with valid credentials mounts and unmounts cleanly
+	d := newTestMountDriver()
+	result := d.runTestMount(volumeContext, map[string]string{
+		"accountname": "k8s",
+		"accountkey":  "testkey",
+	})
+	assert.True(t, result.Success)
+	assert.Contains(t, result.Diagnostic, "mounted and unmounted successfully")
+
+	// a bad account key surfaces the mount failure without leaking the key
+	result = d.runTestMount(volumeContext, map[string]string{
+		"accountname": "k8s",
+		"accountkey":  "invalid-key",
+	})
+	assert.False(t, result.Success)
+	assert.Contains(t, result.Diagnostic, "Permission denied")
+	assert.NotContains(t, result.Diagnostic, "invalid-key")
+
+	// an incomplete volume context is rejected before any mount is attempted
+	result = d.runTestMount(map[string]string{serverNameField: "test_servername"}, map[string]string{
+		"accountname": "k8s",
+		"accountkey":  "testkey",
+	})
+	assert.False(t, result.Success)
+	assert.Contains(t, result.Diagnostic, "must provide an account name and a share name")
+}
+
+func TestHandleTestMount(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on Windows")
+	}
+
+	d := newTestMountDriver()
+
+	w := httptest.NewRecorder()
+	d.handleTestMount(w, httptest.NewRequest("GET", "/debug/test-mount", nil))
+	assert.Equal(t, 405, w.Code)
+
+	w = httptest.NewRecorder()
+	d.handleTestMount(w, httptest.NewRequest("POST", "/debug/test-mount", strings.NewReader("{not json")))
+	assert.Equal(t, 400, w.Code)
+
+	body := `{"volumeContext":{"sharename":"test_sharename","server":"test_servername"},"secrets":{"accountname":"k8s","accountkey":"testkey"}}`
+	w = httptest.NewRecorder()
+	d.handleTestMount(w, httptest.NewRequest("POST", "/debug/test-mount", strings.NewReader(body)))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var result testMountResult
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.True(t, result.Success)
+	// the account key must never appear in the response
+	assert.NotContains(t, w.Body.String(), "testkey")
+}
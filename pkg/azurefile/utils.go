@@ -19,8 +19,12 @@ package azurefile
 import (
 	"context"
 	"fmt"
+	"net"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -33,12 +37,15 @@ import (
 type lockMap struct {
 	sync.Mutex
 	mutexMap map[string]*sync.Mutex
+	// entries currently held, only used for debugging
+	locked map[string]bool
 }
 
 // NewLockMap returns a new lock map
 func newLockMap() *lockMap {
 	return &lockMap{
 		mutexMap: make(map[string]*sync.Mutex),
+		locked:   make(map[string]bool),
 	}
 }
 
@@ -52,6 +59,10 @@ func (lm *lockMap) LockEntry(entry string) {
 
 	lm.Unlock()
 	lm.lockEntry(entry)
+
+	lm.Lock()
+	lm.locked[entry] = true
+	lm.Unlock()
 }
 
 // UnlockEntry release the lock associated with the specific entry
@@ -62,9 +73,22 @@ func (lm *lockMap) UnlockEntry(entry string) {
 	if _, exists := lm.mutexMap[entry]; !exists {
 		return
 	}
+	delete(lm.locked, entry)
 	lm.unlockEntry(entry)
 }
 
+// lockedEntries returns the entries currently held, only used for debugging
+func (lm *lockMap) lockedEntries() []string {
+	lm.Lock()
+	defer lm.Unlock()
+	entries := make([]string, 0, len(lm.locked))
+	for entry := range lm.locked {
+		entries = append(entries, entry)
+	}
+	sort.Strings(entries)
+	return entries
+}
+
 func (lm *lockMap) addEntry(entry string) {
 	lm.mutexMap[entry] = &sync.Mutex{}
 }
@@ -77,6 +101,135 @@ func (lm *lockMap) unlockEntry(entry string) {
 	lm.mutexMap[entry].Unlock()
 }
 
+// mountLimiter bounds the number of concurrent mount operations on a node.
+// Waiting callers are bounded by their context, callers beyond the queue limit
+// are rejected immediately instead of being queued.
+type mountLimiter struct {
+	slots   chan struct{}
+	waiting int32
+	// maximum number of waiting callers before new ones are rejected,
+	// 0 means waiting callers are never rejected and block until a slot frees
+	queueLimit int32
+}
+
+// newMountLimiter returns a mount limiter admitting up to limit concurrent
+// operations and queueing at most the same number, limit <= 0 means no limit
+func newMountLimiter(limit int) *mountLimiter {
+	if limit <= 0 {
+		return &mountLimiter{}
+	}
+	return &mountLimiter{
+		slots:      make(chan struct{}, limit),
+		queueLimit: int32(limit),
+	}
+}
+
+// newBlockingMountLimiter returns a mount limiter admitting up to limit
+// concurrent operations with an unbounded queue, callers over the limit block
+// until a slot frees instead of being rejected, limit <= 0 means no limit
+func newBlockingMountLimiter(limit int) *mountLimiter {
+	if limit <= 0 {
+		return &mountLimiter{}
+	}
+	return &mountLimiter{
+		slots: make(chan struct{}, limit),
+	}
+}
+
+// acquire blocks until a mount slot is free or ctx is done
+func (l *mountLimiter) acquire(ctx context.Context) error {
+	if l.slots == nil {
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if l.queueLimit > 0 && atomic.AddInt32(&l.waiting, 1) > l.queueLimit {
+		atomic.AddInt32(&l.waiting, -1)
+		return fmt.Errorf("mount operation queue limit(%d) exceeded", l.queueLimit)
+	}
+	if l.queueLimit == 0 {
+		atomic.AddInt32(&l.waiting, 1)
+	}
+	defer atomic.AddInt32(&l.waiting, -1)
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees a mount slot acquired by acquire
+func (l *mountLimiter) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// accountCreateLimiter bounds the number of concurrent storage account
+// creation calls per subscription. Azure throttles account operations
+// subscription-wide, so once all slots of a subscription are taken further
+// creations are rejected instead of being queued into the throttling window.
+type accountCreateLimiter struct {
+	sync.Mutex
+	limit    int
+	inFlight map[string]int
+}
+
+// newAccountCreateLimiter returns a limiter admitting up to limit concurrent
+// account creations per subscription, limit <= 0 means no limit
+func newAccountCreateLimiter(limit int) *accountCreateLimiter {
+	return &accountCreateLimiter{
+		limit:    limit,
+		inFlight: make(map[string]int),
+	}
+}
+
+// acquire reserves an account creation slot in the given subscription, an
+// error is returned when all slots of the subscription are taken
+func (l *accountCreateLimiter) acquire(subscriptionID string) error {
+	if l.limit <= 0 {
+		return nil
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.inFlight[subscriptionID] >= l.limit {
+		return fmt.Errorf("subscription(%s) already runs %d concurrent account creation(s)", subscriptionID, l.limit)
+	}
+	l.inFlight[subscriptionID]++
+	return nil
+}
+
+// release frees an account creation slot acquired by acquire
+func (l *accountCreateLimiter) release(subscriptionID string) {
+	if l.limit <= 0 {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.inFlight[subscriptionID] <= 1 {
+		delete(l.inFlight, subscriptionID)
+		return
+	}
+	l.inFlight[subscriptionID]--
+}
+
+// inFlight returns the number of mount slots currently in use
+func (l *mountLimiter) inFlight() int {
+	if l.slots == nil {
+		return 0
+	}
+	return len(l.slots)
+}
+
+// queued returns the number of callers waiting for a mount slot
+func (l *mountLimiter) queued() int {
+	return int(atomic.LoadInt32(&l.waiting))
+}
+
 func setAzureCredentials(kubeClient kubernetes.Interface, accountName, accountKey, secretNamespace string) (string, error) {
 	if kubeClient == nil {
 		klog.Warningf("could not create secret: kubeClient is nil")
@@ -131,6 +284,63 @@ func isSupportedFsType(fsType string) bool {
 	return false
 }
 
+// isSupportedSmbVersion reports whether the cifs kernel client can negotiate
+// the given SMB dialect
+func isSupportedSmbVersion(version string) bool {
+	for _, v := range supportedSmbVersionList {
+		if version == v {
+			return true
+		}
+	}
+	return false
+}
+
+// isSupportedNfsSec reports whether the given value is a security flavor the
+// nfs sec= mount option accepts
+func isSupportedNfsSec(sec string) bool {
+	for _, v := range supportedNfsSecList {
+		if sec == v {
+			return true
+		}
+	}
+	return false
+}
+
+// isValidServerAddress reports whether the given value is a plausible mount
+// server, either an IP address or an RFC 1123 hostname
+func isValidServerAddress(address string) bool {
+	if address == "" || len(address) > 253 {
+		return false
+	}
+	if net.ParseIP(address) != nil {
+		return true
+	}
+	for _, label := range strings.Split(address, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for i, r := range label {
+			switch {
+			case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			case r == '-' && i != 0 && i != len(label)-1:
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isValidFileMode reports whether the given string is an octal unix
+// permission mode as the cifs file_mode/dir_mode options expect, e.g. "0777"
+func isValidFileMode(mode string) bool {
+	if mode == "" || len(mode) > 5 {
+		return false
+	}
+	_, err := strconv.ParseUint(mode, 8, 32)
+	return err == nil
+}
+
 func isRetriableError(err error) bool {
 	if err != nil {
 		for _, v := range retriableErrors {
@@ -17,9 +17,11 @@ limitations under the License.
 package azurefile
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"reflect"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -291,3 +293,97 @@ func TestIsRetriableError(t *testing.T) {
 		}
 	}
 }
+
+func TestMountLimiterUnlimited(t *testing.T) {
+	limiter := newMountLimiter(0)
+	for i := 0; i < 10; i++ {
+		if err := limiter.acquire(context.Background()); err != nil {
+			t.Errorf("acquire(%d) on unlimited limiter returned with error: %v", i, err)
+		}
+	}
+	limiter.release()
+}
+
+func TestMountLimiter(t *testing.T) {
+	limiter := newMountLimiter(2)
+
+	// the limit admits N concurrent operations
+	if err := limiter.acquire(context.Background()); err != nil {
+		t.Errorf("first acquire returned with error: %v", err)
+	}
+	if err := limiter.acquire(context.Background()); err != nil {
+		t.Errorf("second acquire returned with error: %v", err)
+	}
+
+	// the N+1 operation is deferred until its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := limiter.acquire(ctx); err == nil {
+		t.Errorf("expected error from acquire with saturated limiter, got none")
+	}
+
+	// a released slot admits a deferred operation
+	limiter.release()
+	if err := limiter.acquire(context.Background()); err != nil {
+		t.Errorf("acquire after release returned with error: %v", err)
+	}
+}
+
+func TestAccountCreateLimiterUnlimited(t *testing.T) {
+	limiter := newAccountCreateLimiter(0)
+	for i := 0; i < 10; i++ {
+		if err := limiter.acquire("sub"); err != nil {
+			t.Errorf("acquire(%d) on an unlimited limiter returned with error: %v", i, err)
+		}
+	}
+}
+
+func TestAccountCreateLimiter(t *testing.T) {
+	limiter := newAccountCreateLimiter(1)
+	if err := limiter.acquire("sub1"); err != nil {
+		t.Errorf("first acquire returned with error: %v", err)
+	}
+
+	// the subscription is saturated, further creations are rejected
+	if err := limiter.acquire("sub1"); err == nil {
+		t.Errorf("expected error from acquire on a saturated subscription, got none")
+	}
+
+	// other subscriptions have their own budget
+	if err := limiter.acquire("sub2"); err != nil {
+		t.Errorf("acquire on another subscription returned with error: %v", err)
+	}
+
+	limiter.release("sub1")
+	if err := limiter.acquire("sub1"); err != nil {
+		t.Errorf("acquire after release returned with error: %v", err)
+	}
+}
+
+func TestMountLimiterQueueLimit(t *testing.T) {
+	limiter := newMountLimiter(1)
+	if err := limiter.acquire(context.Background()); err != nil {
+		t.Errorf("first acquire returned with error: %v", err)
+	}
+
+	// saturate the queue with a blocked waiter
+	waiterDone := make(chan error)
+	go func() {
+		waiterDone <- limiter.acquire(context.Background())
+	}()
+	// wait until the waiter is queued
+	for i := 0; atomic.LoadInt32(&limiter.waiting) == 0 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// beyond the queue limit the acquire is rejected immediately
+	if err := limiter.acquire(context.Background()); err == nil {
+		t.Errorf("expected error from acquire beyond the queue limit, got none")
+	}
+
+	limiter.release()
+	if err := <-waiterDone; err != nil {
+		t.Errorf("queued acquire returned with error: %v", err)
+	}
+	limiter.release()
+}
@@ -24,6 +24,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"sigs.k8s.io/azurefile-csi-driver/pkg/azurefile"
 
@@ -40,7 +41,54 @@ var (
 	nodeID         = flag.String("nodeid", "", "node id")
 	version        = flag.Bool("version", false, "Print the version and exit.")
 	metricsAddress = flag.String("metrics-address", "0.0.0.0:29614", "export the metrics")
+	strictMetrics  = flag.Bool("strict-metrics", false, "treat a failure to start the metrics endpoint as fatal instead of continuing without metrics")
 	kubeconfig     = flag.String("kubeconfig", "", "Absolute path to the kubeconfig file. Required only when running out of cluster.")
+
+	accountInventoryRefreshInterval = flag.Duration("account-inventory-refresh-interval", 5*time.Minute, "interval to refresh the cached storage account capacity inventory")
+	allowedStorageAccountSKUs       = flag.String("allowed-storage-account-skus", "", "comma separated list of storage account SKUs that may be provisioned, empty means all SKUs are allowed")
+	deniedStorageAccountSKUs        = flag.String("denied-storage-account-skus", "", "comma separated list of storage account SKUs that must not be provisioned")
+	maxConcurrentMounts             = flag.Int("max-concurrent-mounts", 0, "maximum number of concurrent mount operations on a node, 0 means no limit")
+	requireSecrets                  = flag.Bool("require-secrets", false, "treat missing node stage secrets as an error instead of fetching the account key via the cluster identity")
+	mountOptionProfilesFile         = flag.String("mount-option-profiles-file", "", "path to a yaml file defining named mount option profiles that volumes can reference via the mountProfile field")
+	debugStateAddress               = flag.String("debug-state-address", "", "address of the sanitized debug state endpoint, empty means the endpoint is disabled")
+	defaultResourceGroupSMB         = flag.String("default-resource-group-smb", "", "default resource group for SMB volumes when the storage class does not specify one")
+	defaultResourceGroupNFS         = flag.String("default-resource-group-nfs", "", "default resource group for NFS volumes when the storage class does not specify one")
+	expandWithSnapshotsPolicy       = flag.String("expand-with-snapshots-policy", "proceed", "behavior of ControllerExpandVolume when the share has snapshots: proceed, warn or block")
+	shareNameMaxLength              = flag.Int("share-name-max-length", 0, "maximum length of created file share names, longer names are truncated with a hash suffix, 0 means the Azure Files limit")
+	auditLogPath                    = flag.String("audit-log-path", "", "path of the audit log file recording provisioning operations, empty means auditing is disabled")
+	defaultDiskFsType               = flag.String("default-disk-fstype", "", "fsType used for disk-mode volumes when the volume context does not set one, never applied to plain share mounts")
+	accountRolloverAttempts         = flag.Int("account-rollover-attempts", 0, "maximum number of rollover account creation attempts per CreateVolume when an account is full, 0 disables rollover")
+	accountRolloverDelay            = flag.Duration("account-rollover-delay", 5*time.Second, "delay between rollover account creation attempts")
+	maxSharesPerAccount             = flag.Int("max-shares-per-account", 0, "maximum number of file shares packed into one automatically selected storage account, 0 disables account pooling")
+	enableAccessModeDefaults        = flag.Bool("enable-access-mode-defaults", false, "honor the requested access modes when picking provisioning defaults, e.g. disk-mode for single node volumes")
+	singleNodeDefaultQuotaGiB       = flag.Int("single-node-default-quota-gib", 0, "default quota of single-node volumes when no capacity is requested, 0 means the standard default")
+	enableCredentialRefresh         = flag.Bool("enable-credential-refresh", false, "refresh the credentials of already mounted SMB shares on re-stage when the account key rotated")
+	driverName                      = flag.String("drivername", azurefile.DriverName, "name of the driver")
+	enableQuotaVerification         = flag.Bool("enable-quota-verification", false, "warn at mount time when the share quota no longer matches the provisioned capacity")
+	deleteWithSnapshotsPolicy       = flag.String("delete-with-snapshots-policy", "", "behavior of DeleteVolume when the share has snapshots: include, fail or retain, empty means plain share deletion")
+	staleMountProbeThreshold        = flag.Int("stale-mount-probe-threshold", 1, "number of consecutive failed health probes before NodeGetVolumeStats reports a mount as abnormal")
+	credentialsDir                  = flag.String("credentials-dir", "", "directory holding transient SMB credential files, expected to be a tmpfs, empty means the built-in default")
+	forceStageOverForeignMounts     = flag.Bool("force-stage-over-foreign-mounts", false, "stage over an existing mount at the staging target even when it was not created by this driver")
+	maxVolumesPerNode               = flag.Int("max-volumes-per-node", 0, "maximum number of volumes reported to the scheduler per node, 0 means unlimited")
+	userAgentSuffix                 = flag.String("user-agent-suffix", "", "suffix appended to the User-Agent of Azure management API calls for support-case correlation")
+	accountCreateConcurrency        = flag.Int("account-create-concurrency", 0, "maximum number of concurrent storage account creations per subscription, 0 means no limit")
+	proxyMountBase                  = flag.String("proxy-mount-base", "", "base directory of the proxy mounts of disk-mode volumes, set it to a writable tmpfs path on nodes with a read-only root filesystem, empty means beside the staging target")
+	enableTestMount                 = flag.Bool("enable-test-mount", false, "expose the /debug/test-mount diagnostic endpoint on the debug state address")
+	listVolumesSharePrefix          = flag.String("list-volumes-share-prefix", "", "only list shares whose name starts with this prefix in ListVolumes, empty means all tracked shares")
+	mountReconcileWorkers           = flag.Int("mount-reconcile-workers", 0, "number of concurrent workers of the startup mount-leak reconciler, 0 means the built-in default")
+	mountReconcileBudget            = flag.Duration("mount-reconcile-budget", 0, "total time budget of the startup mount-leak reconciler, 0 means the built-in default")
+	csiProxyTimeout                 = flag.Duration("csi-proxy-timeout", 0, "timeout of each CSI proxy call on Windows, 0 means the built-in default")
+	smbDefaultMountOptions          = flag.String("smb-default-mount-options", "", "comma separated default mount options of SMB mounts, empty means the built-in set")
+	nfsDefaultMountOptions          = flag.String("nfs-default-mount-options", "", "comma separated default mount options of NFS mounts, empty means the built-in set")
+	shareNotReadyRetries            = flag.Int("share-not-ready-retries", 0, "number of NodeStageVolume mount attempts while a freshly provisioned share is not ready yet, 0 means the built-in default")
+	protocolFallback                = flag.Bool("protocol-fallback", false, "fall back to provisioning an SMB file share when the requested NFS protocol is not available in the target region or account")
+	mountPermissions                = flag.Uint64("mount-permissions", 0, "octal permissions applied to created staging target directories, 0 means the directory mode is left untouched")
+	smbMountRetries                 = flag.Int("smb-mount-retries", 0, "number of SMB global mapping attempts per mount on Windows, 0 means the built-in default")
+	maxConcurrentNodeMounts         = flag.Int("max-concurrent-node-mounts", 0, "maximum number of concurrent node mounts, callers over the limit block instead of being rejected, 0 means no limit")
+	remountOnOptionChange           = flag.Bool("remount-on-option-change", false, "remount an already staged volume when the requested mount options changed, off keeps the existing mount")
+	unmountTimeout                  = flag.Duration("unmount-timeout", 0, "timeout of a NodeUnstageVolume unmount before falling back to a lazy unmount, 0 means the built-in default")
+	volumeStatsCacheTTL             = flag.Duration("volume-stats-cache-ttl", 0, "TTL of cached NodeGetVolumeStats results, 0 disables the cache")
+	fsGroupPolicy                   = flag.String("fs-group-policy", "", "fsGroupPolicy the driver is deployed with, supported values: None, File, ReadWriteOnceWithFSType, empty behaves like File")
 )
 
 func main() {
@@ -57,26 +105,91 @@ func main() {
 		// nodeid is not needed in controller component
 		klog.Warning("nodeid is empty")
 	}
-	exportMetrics()
+	if err := startMetrics(*metricsAddress, *strictMetrics); err != nil {
+		klog.Fatalln(err)
+	}
 	handle()
 	os.Exit(0)
 }
 
 func handle() {
-	driver := azurefile.NewDriver(*nodeID)
+	driverOptions := azurefile.DriverOptions{
+		NodeID:                          *nodeID,
+		DriverName:                      *driverName,
+		AccountInventoryRefreshInterval: *accountInventoryRefreshInterval,
+		AllowedStorageAccountSKUs:       *allowedStorageAccountSKUs,
+		DeniedStorageAccountSKUs:        *deniedStorageAccountSKUs,
+		MaxConcurrentMounts:             *maxConcurrentMounts,
+		RequireSecrets:                  *requireSecrets,
+		MountOptionProfilesFile:         *mountOptionProfilesFile,
+		DebugStateAddress:               *debugStateAddress,
+		DefaultResourceGroupSMB:         *defaultResourceGroupSMB,
+		DefaultResourceGroupNFS:         *defaultResourceGroupNFS,
+		ExpandWithSnapshotsPolicy:       *expandWithSnapshotsPolicy,
+		ShareNameMaxLength:              *shareNameMaxLength,
+		AuditLogPath:                    *auditLogPath,
+		DefaultDiskFsType:               *defaultDiskFsType,
+		AccountRolloverAttempts:         *accountRolloverAttempts,
+		AccountRolloverDelay:            *accountRolloverDelay,
+		MaxSharesPerAccount:             *maxSharesPerAccount,
+		EnableAccessModeDefaults:        *enableAccessModeDefaults,
+		SingleNodeDefaultQuotaGiB:       *singleNodeDefaultQuotaGiB,
+		EnableCredentialRefresh:         *enableCredentialRefresh,
+		EnableQuotaVerification:         *enableQuotaVerification,
+		DeleteWithSnapshotsPolicy:       *deleteWithSnapshotsPolicy,
+		StaleMountProbeThreshold:        *staleMountProbeThreshold,
+		CredentialsDir:                  *credentialsDir,
+		ForceStageOverForeignMounts:     *forceStageOverForeignMounts,
+		MaxVolumesPerNode:               *maxVolumesPerNode,
+		UserAgentSuffix:                 *userAgentSuffix,
+		AccountCreateConcurrency:        *accountCreateConcurrency,
+		ProxyMountBase:                  *proxyMountBase,
+		EnableTestMount:                 *enableTestMount,
+		ListVolumesSharePrefix:          *listVolumesSharePrefix,
+		MountReconcileWorkers:           *mountReconcileWorkers,
+		MountReconcileBudget:            *mountReconcileBudget,
+		CSIProxyTimeout:                 *csiProxyTimeout,
+		DefaultMountOptionsSMB:          *smbDefaultMountOptions,
+		DefaultMountOptionsNFS:          *nfsDefaultMountOptions,
+		ShareNotReadyRetries:            *shareNotReadyRetries,
+		ProtocolFallback:                *protocolFallback,
+		MountPermissions:                *mountPermissions,
+		SmbMountRetries:                 *smbMountRetries,
+		MaxConcurrentNodeMounts:         *maxConcurrentNodeMounts,
+		RemountOnOptionChange:           *remountOnOptionChange,
+		UnmountTimeout:                  *unmountTimeout,
+		VolumeStatsCacheTTL:             *volumeStatsCacheTTL,
+		FSGroupPolicy:                   *fsGroupPolicy,
+	}
+	driver := azurefile.NewDriver(&driverOptions)
 	if driver == nil {
 		klog.Fatalln("Failed to initialize azurefile CSI Driver")
 	}
 	driver.Run(*endpoint, *kubeconfig, false)
 }
 
-func exportMetrics() {
-	l, err := net.Listen("tcp", *metricsAddress)
+// startMetrics starts the metrics endpoint, an observability port conflict
+// must not block volume operations so a startup failure is only fatal when the
+// operator asked for strict metrics
+func startMetrics(address string, strict bool) error {
+	err := exportMetrics(address)
+	if err == nil {
+		return nil
+	}
+	if strict {
+		return fmt.Errorf("failed to start the metrics endpoint on %s: %v", address, err)
+	}
+	klog.Warningf("failed to start the metrics endpoint on %s(%v), continuing without metrics", address, err)
+	return nil
+}
+
+func exportMetrics(address string) error {
+	l, err := net.Listen("tcp", address)
 	if err != nil {
-		klog.Warningf("failed to get listener for metrics endpoint: %v", err)
-		return
+		return err
 	}
 	serve(context.Background(), l, serveMetrics)
+	return nil
 }
 
 func serve(ctx context.Context, l net.Listener, serveFunc func(net.Listener) error) {
@@ -0,0 +1,44 @@
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStartMetrics(t *testing.T) {
+	// occupy a port to simulate the conflict
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	occupied := l.Addr().String()
+
+	// a port conflict only degrades observability, the driver keeps starting
+	assert.NoError(t, startMetrics(occupied, false))
+
+	// in strict mode the same conflict is surfaced so the caller can abort
+	err = startMetrics(occupied, true)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), occupied)
+	}
+
+	// a free port starts the endpoint in either mode
+	assert.NoError(t, startMetrics("127.0.0.1:0", true))
+}
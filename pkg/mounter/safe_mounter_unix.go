@@ -19,11 +19,15 @@ limitations under the License.
 package mounter
 
 import (
+	"time"
+
 	utilexec "k8s.io/utils/exec"
 	"k8s.io/utils/mount"
 )
 
-func NewSafeMounter() (*mount.SafeFormatAndMount, error) {
+// NewSafeMounter returns the mounter of the platform, the proxy timeout only
+// applies to the CSI proxy on Windows and is ignored here
+func NewSafeMounter(_ time.Duration) (*mount.SafeFormatAndMount, error) {
 	return &mount.SafeFormatAndMount{
 		Interface: mount.New(""),
 		Exec:      utilexec.New(),
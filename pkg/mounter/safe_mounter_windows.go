@@ -24,6 +24,7 @@ import (
 	"os"
 	filepath "path/filepath"
 	"strings"
+	"time"
 
 	fs "github.com/kubernetes-csi/csi-proxy/client/api/filesystem/v1beta1"
 	fsclient "github.com/kubernetes-csi/csi-proxy/client/groups/filesystem/v1beta1"
@@ -31,16 +32,59 @@ import (
 	smb "github.com/kubernetes-csi/csi-proxy/client/api/smb/v1beta1"
 	smbclient "github.com/kubernetes-csi/csi-proxy/client/groups/smb/v1beta1"
 
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
 	utilexec "k8s.io/utils/exec"
 	"k8s.io/utils/mount"
 )
 
+// defaultProxyTimeout bounds each CSI proxy call when no timeout is configured
+const defaultProxyTimeout = 2 * time.Minute
+
+// fsServer and smbServer are the subsets of the CSI proxy clients the mounter
+// uses, declared as interfaces so tests can substitute a slow or failing proxy
+type fsServer interface {
+	LinkPath(context context.Context, request *fs.LinkPathRequest, opts ...grpc.CallOption) (*fs.LinkPathResponse, error)
+	Rmdir(context context.Context, request *fs.RmdirRequest, opts ...grpc.CallOption) (*fs.RmdirResponse, error)
+	IsMountPoint(context context.Context, request *fs.IsMountPointRequest, opts ...grpc.CallOption) (*fs.IsMountPointResponse, error)
+	Mkdir(context context.Context, request *fs.MkdirRequest, opts ...grpc.CallOption) (*fs.MkdirResponse, error)
+	PathExists(context context.Context, request *fs.PathExistsRequest, opts ...grpc.CallOption) (*fs.PathExistsResponse, error)
+}
+
+type smbServer interface {
+	NewSmbGlobalMapping(context context.Context, request *smb.NewSmbGlobalMappingRequest, opts ...grpc.CallOption) (*smb.NewSmbGlobalMappingResponse, error)
+}
+
 var _ mount.Interface = &CSIProxyMounter{}
 
 type CSIProxyMounter struct {
-	FsClient  *fsclient.Client
-	SMBClient *smbclient.Client
+	FsClient  fsServer
+	SMBClient smbServer
+	// ProxyTimeout bounds each CSI proxy call, a hung proxy surfaces as a
+	// DeadlineExceeded error instead of blocking the RPC indefinitely, zero
+	// means the built-in default
+	ProxyTimeout time.Duration
+}
+
+// proxyContext returns the context every CSI proxy call runs under, bounded by
+// the configured timeout
+func (mounter *CSIProxyMounter) proxyContext() (context.Context, context.CancelFunc) {
+	timeout := mounter.ProxyTimeout
+	if timeout <= 0 {
+		timeout = defaultProxyTimeout
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// wrapProxyError converts a call that ran into the proxy timeout into a clean
+// DeadlineExceeded status naming the hung call, other errors pass through
+func (mounter *CSIProxyMounter) wrapProxyError(ctx context.Context, call string, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return status.Errorf(codes.DeadlineExceeded, "csi proxy call %s did not return within the configured timeout, the proxy looks unhealthy: %v", call, err)
+	}
+	return err
 }
 
 func normalizeWindowsPath(path string) string {
@@ -78,8 +122,13 @@ func (mounter *CSIProxyMounter) SMBMount(source, target, fsType string, mountOpt
 		Username:   mountOptions[0],
 		Password:   sensitiveMountOptions[0],
 	}
-	_, err = mounter.SMBClient.NewSmbGlobalMapping(context.Background(), smbMountRequest)
+	ctx, cancel := mounter.proxyContext()
+	defer cancel()
+	_, err = mounter.SMBClient.NewSmbGlobalMapping(ctx, smbMountRequest)
 	if err != nil {
+		if wrapped := mounter.wrapProxyError(ctx, "NewSmbGlobalMapping", err); wrapped != err {
+			return wrapped
+		}
 		return fmt.Errorf("smb mapping failed with error: %v", err)
 	}
 	return nil
@@ -101,9 +150,11 @@ func (mounter *CSIProxyMounter) Mount(source string, target string, fstype strin
 		SourcePath: normalizeWindowsPath(source),
 		TargetPath: normalizeWindowsPath(target),
 	}
-	_, err := mounter.FsClient.LinkPath(context.Background(), linkRequest)
+	ctx, cancel := mounter.proxyContext()
+	defer cancel()
+	_, err := mounter.FsClient.LinkPath(ctx, linkRequest)
 	if err != nil {
-		return err
+		return mounter.wrapProxyError(ctx, "LinkPath", err)
 	}
 	return nil
 }
@@ -119,9 +170,11 @@ func (mounter *CSIProxyMounter) Rmdir(path string) error {
 		Context: fs.PathContext_POD,
 		Force:   true,
 	}
-	_, err := mounter.FsClient.Rmdir(context.Background(), rmdirRequest)
+	ctx, cancel := mounter.proxyContext()
+	defer cancel()
+	_, err := mounter.FsClient.Rmdir(ctx, rmdirRequest)
 	if err != nil {
-		return err
+		return mounter.wrapProxyError(ctx, "Rmdir", err)
 	}
 	return nil
 }
@@ -153,12 +206,14 @@ func (mounter *CSIProxyMounter) IsLikelyNotMountPoint(path string) (bool, error)
 		return true, os.ErrNotExist
 	}
 
-	response, err := mounter.FsClient.IsMountPoint(context.Background(),
+	ctx, cancel := mounter.proxyContext()
+	defer cancel()
+	response, err := mounter.FsClient.IsMountPoint(ctx,
 		&fs.IsMountPointRequest{
 			Path: normalizeWindowsPath(path),
 		})
 	if err != nil {
-		return false, err
+		return false, mounter.wrapProxyError(ctx, "IsMountPoint", err)
 	}
 	return !response.IsMountPoint, nil
 }
@@ -192,9 +247,11 @@ func (mounter *CSIProxyMounter) MakeDir(path string) error {
 		Path:    normalizeWindowsPath(path),
 		Context: fs.PathContext_PLUGIN,
 	}
-	_, err := mounter.FsClient.Mkdir(context.Background(), mkdirReq)
+	ctx, cancel := mounter.proxyContext()
+	defer cancel()
+	_, err := mounter.FsClient.Mkdir(ctx, mkdirReq)
 	if err != nil {
-		return err
+		return mounter.wrapProxyError(ctx, "Mkdir", err)
 	}
 
 	return nil
@@ -203,12 +260,14 @@ func (mounter *CSIProxyMounter) MakeDir(path string) error {
 // ExistsPath - Checks if a path exists. Unlike util ExistsPath, this call does not perform follow link.
 func (mounter *CSIProxyMounter) ExistsPath(path string) (bool, error) {
 	klog.V(4).Infof("Exists path: %s", path)
-	isExistsResponse, err := mounter.FsClient.PathExists(context.Background(),
+	ctx, cancel := mounter.proxyContext()
+	defer cancel()
+	isExistsResponse, err := mounter.FsClient.PathExists(ctx,
 		&fs.PathExistsRequest{
 			Path: normalizeWindowsPath(path),
 		})
 	if err != nil {
-		return false, err
+		return false, mounter.wrapProxyError(ctx, "PathExists", err)
 	}
 	return isExistsResponse.Exists, err
 }
@@ -238,8 +297,9 @@ func (mounter *CSIProxyMounter) MountSensitive(source string, target string, fst
 }
 
 // NewCSIProxyMounter - creates a new CSI Proxy mounter struct which encompassed all the
-// clients to the CSI proxy - filesystem, disk and volume clients.
-func NewCSIProxyMounter() (*CSIProxyMounter, error) {
+// clients to the CSI proxy - filesystem, disk and volume clients. Each proxy
+// call is bounded by proxyTimeout, zero means the built-in default.
+func NewCSIProxyMounter(proxyTimeout time.Duration) (*CSIProxyMounter, error) {
 	fsClient, err := fsclient.NewClient()
 	if err != nil {
 		return nil, err
@@ -250,13 +310,14 @@ func NewCSIProxyMounter() (*CSIProxyMounter, error) {
 	}
 
 	return &CSIProxyMounter{
-		FsClient:  fsClient,
-		SMBClient: smbClient,
+		FsClient:     fsClient,
+		SMBClient:    smbClient,
+		ProxyTimeout: proxyTimeout,
 	}, nil
 }
 
-func NewSafeMounter() (*mount.SafeFormatAndMount, error) {
-	csiProxyMounter, err := NewCSIProxyMounter()
+func NewSafeMounter(proxyTimeout time.Duration) (*mount.SafeFormatAndMount, error) {
+	csiProxyMounter, err := NewCSIProxyMounter(proxyTimeout)
 	if err != nil {
 		return nil, err
 	}
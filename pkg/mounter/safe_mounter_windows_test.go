@@ -0,0 +1,131 @@
+// +build windows
+
+/*
+Copyright 2023 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package mounter
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	fs "github.com/kubernetes-csi/csi-proxy/client/api/filesystem/v1beta1"
+	smb "github.com/kubernetes-csi/csi-proxy/client/api/smb/v1beta1"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeProxyClient simulates a CSI proxy whose calls take delay to return,
+// honoring the context the way a real gRPC client does
+type fakeProxyClient struct {
+	delay time.Duration
+}
+
+func (f *fakeProxyClient) wait(ctx context.Context) error {
+	select {
+	case <-time.After(f.delay):
+		return nil
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+func (f *fakeProxyClient) LinkPath(ctx context.Context, request *fs.LinkPathRequest, opts ...grpc.CallOption) (*fs.LinkPathResponse, error) {
+	if err := f.wait(ctx); err != nil {
+		return nil, err
+	}
+	return &fs.LinkPathResponse{}, nil
+}
+
+func (f *fakeProxyClient) Rmdir(ctx context.Context, request *fs.RmdirRequest, opts ...grpc.CallOption) (*fs.RmdirResponse, error) {
+	if err := f.wait(ctx); err != nil {
+		return nil, err
+	}
+	return &fs.RmdirResponse{}, nil
+}
+
+func (f *fakeProxyClient) IsMountPoint(ctx context.Context, request *fs.IsMountPointRequest, opts ...grpc.CallOption) (*fs.IsMountPointResponse, error) {
+	if err := f.wait(ctx); err != nil {
+		return nil, err
+	}
+	return &fs.IsMountPointResponse{IsMountPoint: true}, nil
+}
+
+func (f *fakeProxyClient) Mkdir(ctx context.Context, request *fs.MkdirRequest, opts ...grpc.CallOption) (*fs.MkdirResponse, error) {
+	if err := f.wait(ctx); err != nil {
+		return nil, err
+	}
+	return &fs.MkdirResponse{}, nil
+}
+
+func (f *fakeProxyClient) PathExists(ctx context.Context, request *fs.PathExistsRequest, opts ...grpc.CallOption) (*fs.PathExistsResponse, error) {
+	if err := f.wait(ctx); err != nil {
+		return nil, err
+	}
+	return &fs.PathExistsResponse{Exists: true}, nil
+}
+
+func (f *fakeProxyClient) NewSmbGlobalMapping(ctx context.Context, request *smb.NewSmbGlobalMappingRequest, opts ...grpc.CallOption) (*smb.NewSmbGlobalMappingResponse, error) {
+	if err := f.wait(ctx); err != nil {
+		return nil, err
+	}
+	return &smb.NewSmbGlobalMappingResponse{}, nil
+}
+
+func TestProxyCallTimeout(t *testing.T) {
+	proxy := &fakeProxyClient{delay: 500 * time.Millisecond}
+	m := &CSIProxyMounter{
+		FsClient:     proxy,
+		SMBClient:    proxy,
+		ProxyTimeout: 50 * time.Millisecond,
+	}
+
+	// a hung proxy surfaces as DeadlineExceeded instead of blocking
+	err := m.SMBMount("\\\\server\\share", "C:\\target", "cifs", []string{"user"}, []string{"password"})
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err), "unexpected error: %v", err)
+
+	err = m.Rmdir("C:\\target")
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err), "unexpected error: %v", err)
+
+	err = m.MakeDir("C:\\target")
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err), "unexpected error: %v", err)
+
+	err = m.Mount("C:\\source", "C:\\target", "", nil)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err), "unexpected error: %v", err)
+
+	_, err = m.ExistsPath("C:\\target")
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err), "unexpected error: %v", err)
+}
+
+func TestProxyCallWithinTimeout(t *testing.T) {
+	proxy := &fakeProxyClient{delay: 10 * time.Millisecond}
+	m := &CSIProxyMounter{
+		FsClient:     proxy,
+		SMBClient:    proxy,
+		ProxyTimeout: 5 * time.Second,
+	}
+
+	assert.NoError(t, m.SMBMount("\\\\server\\share", "C:\\target", "cifs", []string{"user"}, []string{"password"}))
+	assert.NoError(t, m.MakeDir("C:\\target"))
+	assert.NoError(t, m.Rmdir("C:\\target"))
+
+	notMnt, err := m.IsLikelyNotMountPoint("C:\\target")
+	assert.NoError(t, err)
+	assert.False(t, notMnt)
+}
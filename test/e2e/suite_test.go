@@ -107,7 +107,7 @@ var _ = ginkgo.BeforeSuite(func() {
 
 		nodeid := os.Getenv("nodeid")
 		kubeconfig := os.Getenv(kubeconfigEnvVar)
-		azurefileDriver = azurefile.NewDriver(nodeid)
+		azurefileDriver = azurefile.NewDriver(&azurefile.DriverOptions{NodeID: nodeid})
 		go func() {
 			os.Setenv("AZURE_CREDENTIAL_FILE", credentials.TempAzureCredentialFilePath)
 			azurefileDriver.Run(fmt.Sprintf("unix:///tmp/csi-%s.sock", uuid.NewUUID().String()), kubeconfig, false)